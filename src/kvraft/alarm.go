@@ -0,0 +1,105 @@
+package kvraft
+
+import (
+	"sort"
+	"time"
+)
+
+// a server with a quota raises the NOSPACE alarm once the store holds more
+// than quota bytes of keys and values, rather than growing until it runs out
+// of memory or disk. like everything the replicas must agree on, the alarm
+// goes through the log: the leader's alarm checker proposes an AlarmRaise
+// entry, and from there on every replica refuses writes that can grow the
+// store with ErrNoSpace. deletes, compaction and reads still work, that's how
+// space is freed, and once the store is back under alarmClearRatio of the
+// quota an AlarmClear entry lifts the alarm.
+const (
+	AlarmRaise = "AlarmRaise"
+	AlarmClear = "AlarmClear"
+)
+
+const AlarmNoSpace = "NOSPACE"
+
+const (
+	alarmCheckInterval = 100 * time.Millisecond
+	alarmClearRatio    = 0.9
+)
+
+// 0, the default, for no quota. every server should get the same quota, the
+// leader's is the one that counts.
+func (kv *KVServer) SetQuota(bytes int64) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.quota = bytes
+}
+
+func (kv *KVServer) alarmChecker() {
+	var lastProposed time.Time
+	var last string
+	for !kv.killed() {
+		time.Sleep(alarmCheckInterval)
+		if _, isLeader := kv.rf.GetState(); !isLeader {
+			continue
+		}
+		kv.mu.RLock()
+		size, quota, raised := kv.storage.Size(), kv.quota, kv.alarms[AlarmNoSpace]
+		kv.mu.RUnlock()
+		op := Op{Key: AlarmNoSpace}
+		if !raised && quota > 0 && size > quota {
+			op.OpTask = AlarmRaise
+		} else if raised && (quota == 0 || float64(size) <= alarmClearRatio*float64(quota)) {
+			op.OpTask = AlarmClear
+		} else {
+			continue
+		}
+		// the last one may not be applied yet
+		if op.OpTask != last || time.Since(lastProposed) > ttlRepropose {
+			kv.rf.Start(op)
+			last, lastProposed = op.OpTask, time.Now()
+		}
+	}
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applyAlarm(op Op) {
+	if op.OpTask == AlarmRaise {
+		kv.alarms[op.Key] = true
+	} else {
+		delete(kv.alarms, op.Key)
+	}
+}
+
+// whether op may make the store bigger, and must wait out a NOSPACE alarm
+func grows(op Op) bool {
+	switch op.OpTask {
+	case Putt, Appendd, CompareAndSwap, Incr, CreateBucket, LockAcquire, ElectionCampaign, ElectionProclaim, Eval:
+		return true
+	case Txn:
+		if op.Txn == nil {
+			// refused by prepare
+			return false
+		}
+		for _, writes := range [][]TxnWrite{op.Txn.Writes, op.Txn.ElseWrites} {
+			for _, write := range writes {
+				if write.Op != Deletee {
+					return true
+				}
+			}
+		}
+	default:
+		// nothing to tell what an application's op does
+		h := lookup(op.OpTask)
+		return h != nil && h.custom
+	}
+	return false
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) alarmList() []string {
+	alarms := make([]string, 0, len(kv.alarms))
+	for alarm := range kv.alarms {
+		alarms = append(alarms, alarm)
+	}
+	sort.Strings(alarms)
+	return alarms
+}
@@ -0,0 +1,178 @@
+package kvraft
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// the Async forms of the clerk's ops return at once, so a producer can keep
+// many commands outstanding without a goroutine for each. a clerk has one
+// command in flight at a time, the servers only remember its latest, so
+// they go out through a fixed set of worker clerks with client ids of their
+// own. the commands on a key all go through the same worker, in the order
+// they were issued, while those on different keys may apply in any order.
+//
+// the workers start with the first Async call and take the clerk's timeout,
+// auth token and metrics sink as they are then.
+//
+// with write batching on, a worker taking a Put or Append off its queue
+// waits up to the window for more, and sends them as the writes of a single
+// Txn: one log entry for up to maxBatch writes, which a bulk load needs far
+// fewer rounds for. a command that can't go in a batch, e.g. a Get or a Put
+// with a TTL, lease, bucket or trace, ends the one being collected and goes
+// after it. a batch applies, or fails, as a whole, and the Results of its
+// Appends don't have the value.
+
+const (
+	defaultAsyncWorkers = 8
+	asyncQueueSize      = 64 // commands waiting per worker before Async calls block
+	defaultMaxBatch     = 100
+)
+
+type Result struct {
+	Value    string
+	Err      Err
+	Revision int
+}
+
+type asyncCall struct {
+	args *CommandArgs
+	done func(reply *CommandReply)
+}
+
+// how many commands may be in flight at once, before the first Async call
+func (ck *Clerk) SetAsyncWorkers(n int) {
+	ck.asyncWorkers = n
+}
+
+// coalesce the Async writes issued within window of each other, before the
+// first Async call. 0 turns batching off, the default, and maxBatch <= 0
+// means defaultMaxBatch.
+func (ck *Clerk) SetWriteBatching(window time.Duration, maxBatch int) {
+	if maxBatch <= 0 {
+		maxBatch = defaultMaxBatch
+	}
+	ck.batchWindow, ck.maxBatch = window, maxBatch
+}
+
+func (ck *Clerk) startAsync() {
+	n := ck.asyncWorkers
+	if n <= 0 {
+		n = defaultAsyncWorkers
+	}
+	ck.async = make([]chan asyncCall, n)
+	for i := range ck.async {
+		worker := MakeClerk(ck.servers)
+		worker.leaderId, worker.timeout, worker.authToken = ck.leaderId, ck.timeout, ck.authToken
+		worker.batchWindow, worker.maxBatch = ck.batchWindow, ck.maxBatch
+		worker.metrics = ck.metrics
+		ck.async[i] = make(chan asyncCall, asyncQueueSize)
+		go worker.serveAsync(ck.async[i])
+	}
+}
+
+func (ck *Clerk) serveAsync(queue chan asyncCall) {
+	var next *asyncCall // taken off the queue while batching, not a write
+	for {
+		call, ok := asyncCall{}, true
+		if next != nil {
+			call, next = *next, nil
+		} else if call, ok = <-queue; !ok {
+			return
+		}
+		if ck.batchWindow == 0 || !batchable(call.args) {
+			call.done(ck.command(call.args))
+			continue
+		}
+		batch := []asyncCall{call}
+		timer := time.NewTimer(ck.batchWindow)
+	collect:
+		for len(batch) < ck.maxBatch {
+			select {
+			case call, open := <-queue:
+				if ok = open; !ok {
+					break collect
+				}
+				if !batchable(call.args) {
+					next = &call
+					break collect
+				}
+				batch = append(batch, call)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		ck.sendBatch(batch)
+		if !ok {
+			return
+		}
+	}
+}
+
+func batchable(args *CommandArgs) bool {
+	return (args.Op == Putt || args.Op == Appendd) && args.TTL == 0 && args.Lease == 0 &&
+		args.Bucket == "" && args.Trace == ""
+}
+
+func (ck *Clerk) sendBatch(batch []asyncCall) {
+	if len(batch) == 1 {
+		batch[0].done(ck.command(batch[0].args))
+		return
+	}
+	writes := make([]TxnWrite, len(batch))
+	for i, call := range batch {
+		writes[i] = TxnWrite{Op: call.args.Op, Key: call.args.Key, Value: call.args.Value}
+	}
+	reply := ck.command(&CommandArgs{Op: Txn, Txn: &TxnRequest{Writes: writes}})
+	for _, call := range batch {
+		call.done(&CommandReply{Err: reply.Err, Index: reply.Index, Revision: reply.Revision})
+	}
+}
+
+// send args and call done with the reply, on a worker's goroutine: done
+// holds up the commands queued behind it until it returns.
+func (ck *Clerk) CommandAsync(args *CommandArgs, done func(reply *CommandReply)) {
+	if ck.async == nil {
+		ck.startAsync()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(args.Bucket))
+	h.Write([]byte{0})
+	h.Write([]byte(args.Key))
+	ck.async[h.Sum32()%uint32(len(ck.async))] <- asyncCall{args: args, done: done}
+}
+
+// the Result comes on the channel once the command is applied
+func (ck *Clerk) commandAsync(args *CommandArgs) <-chan Result {
+	result := make(chan Result, 1)
+	ck.CommandAsync(args, func(reply *CommandReply) {
+		result <- Result{Value: string(reply.Value), Err: reply.Err, Revision: reply.Revision}
+	})
+	return result
+}
+
+func (ck *Clerk) GetAsync(key string) <-chan Result {
+	return ck.commandAsync(&CommandArgs{Key: key, Op: Gett})
+}
+
+func (ck *Clerk) PutAsync(key string, value string) <-chan Result {
+	return ck.commandAsync(&CommandArgs{Key: key, Value: []byte(value), Op: Putt})
+}
+
+func (ck *Clerk) AppendAsync(key string, value string) <-chan Result {
+	return ck.commandAsync(&CommandArgs{Key: key, Value: []byte(value), Op: Appendd})
+}
+
+func (ck *Clerk) DeleteAsync(key string) <-chan Result {
+	return ck.commandAsync(&CommandArgs{Key: key, Op: Deletee})
+}
+
+// stop the workers once they're through the commands queued, for a clerk
+// done with Async calls. the clerk's other ops still work.
+func (ck *Clerk) CloseAsync() {
+	for _, queue := range ck.async {
+		close(queue)
+	}
+	ck.async = nil
+}
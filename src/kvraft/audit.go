@@ -0,0 +1,150 @@
+package kvraft
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// an audit trail of the entries a server applies, reads aside: who proposed
+// each one, when it was applied and what came of it. the change stream has
+// the values written, this has the writers.
+//
+// every replica keeps its own. a replica restarting from a snapshot applies
+// the entries after it again, so an index may show up twice; a duplicate of a
+// retried command shows up with the same client and command ids.
+
+type AuditRecord struct {
+	Index     int
+	Time      int64 // unix nanoseconds, when this replica applied it
+	ClientId  int64 // 0 for entries the leader proposes itself, e.g. Expire
+	CommandId int64
+	Op        string
+	Bucket    string `json:",omitempty"`
+	Key       string `json:",omitempty"`
+	Err       Err
+	Trace     string `json:",omitempty"` // of the request, see WithTrace
+}
+
+// called under the server's lock in the apply loop, like a ChangeSink
+type AuditSink interface {
+	Audit(record AuditRecord)
+}
+
+func (kv *KVServer) SetAuditSink(sink AuditSink) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.auditor = sink
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) audit(op Op, index int, result opResult) {
+	if kv.auditor == nil {
+		return
+	}
+	switch op.OpTask {
+	case Gett, MultiGet, Range, GetByPrefix, OpenCursor, QueryIndex, StateCheck:
+		return
+	}
+	if result.Err == "" {
+		// the leader's own entries don't report a result
+		result.Err = OK
+	}
+	kv.auditor.Audit(AuditRecord{
+		Index:     index,
+		Time:      time.Now().UnixNano(),
+		ClientId:  op.ClientId,
+		CommandId: op.CommandId,
+		Op:        op.OpTask,
+		Bucket:    op.Bucket,
+		Key:       op.Key,
+		Err:       result.Err,
+		Trace:     op.Trace,
+	})
+}
+
+// an AuditSink appending a line of JSON per record to audit.log in a
+// directory. once the file reaches maxSize bytes it's rotated: renamed
+// audit.log.1, the older ones moving up to audit.log.<keep>, past which
+// they're removed.
+type AuditLog struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+}
+
+const auditLogName = "audit.log"
+
+// dir must exist. an audit.log already there is appended to.
+func NewAuditLog(dir string, maxSize int64, keep int) *AuditLog {
+	auditLog := &AuditLog{dir: dir, maxSize: maxSize, keep: keep}
+	auditLog.open()
+	return auditLog
+}
+
+func (auditLog *AuditLog) open() {
+	file, err := os.OpenFile(filepath.Join(auditLog.dir, auditLogName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatalf("audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		log.Fatalf("audit log: %v", err)
+	}
+	auditLog.file, auditLog.size = file, info.Size()
+}
+
+func (auditLog *AuditLog) Audit(record AuditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Fatalf("audit log: %v", err)
+	}
+	line = append(line, '\n')
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	if auditLog.file == nil {
+		return // closed
+	}
+	if auditLog.size > 0 && auditLog.size+int64(len(line)) > auditLog.maxSize {
+		auditLog.rotate()
+	}
+	if _, err := auditLog.file.Write(line); err != nil {
+		log.Fatalf("audit log: %v", err)
+	}
+	auditLog.size += int64(len(line))
+}
+
+func (auditLog *AuditLog) rotate() {
+	auditLog.file.Close()
+	name := func(i int) string {
+		if i == 0 {
+			return filepath.Join(auditLog.dir, auditLogName)
+		}
+		return filepath.Join(auditLog.dir, fmt.Sprintf("%v.%v", auditLogName, i))
+	}
+	os.Remove(name(auditLog.keep))
+	for i := auditLog.keep - 1; i >= 0; i-- {
+		if err := os.Rename(name(i), name(i+1)); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("audit log: %v", err)
+		}
+	}
+	auditLog.open()
+}
+
+func (auditLog *AuditLog) Close() error {
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	if auditLog.file == nil {
+		return nil
+	}
+	err := auditLog.file.Close()
+	auditLog.file = nil
+	return err
+}
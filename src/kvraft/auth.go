@@ -0,0 +1,480 @@
+package kvraft
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"raft/labgob"
+)
+
+// users, roles and per-prefix permissions, checked before a command is
+// proposed. the configuration is changed through the log like any write, so
+// every replica has the same one. while auth is disabled, the default,
+// anyone may do anything, including setting up users and roles; enabling it
+// takes a root user, and from then on only root may change the config.
+//
+// a user authenticates with its password against the leader and gets a
+// token, an HMAC under a secret drawn each time auth is enabled. any replica
+// can check it without keeping session state. a token stays valid until its
+// user is set again or deleted, or auth is enabled anew.
+//
+// permissions cover keys whatever their bucket. only Command is checked,
+// not Watch, cursor paging or the admin RPCs.
+const (
+	AuthEnable     = "AuthEnable"
+	AuthDisable    = "AuthDisable"
+	AuthSetUser    = "AuthSetUser" // Key names the user, Value is the password
+	AuthDeleteUser = "AuthDeleteUser"
+	AuthSetRole    = "AuthSetRole" // Key names the role
+	AuthDeleteRole = "AuthDeleteRole"
+)
+
+// the user that must exist to enable auth, and the role allowing everything
+const (
+	RootUser = "root"
+	RootRole = "root"
+)
+
+// read and/or write access to the keys starting with Prefix, "" for all
+type Permission struct {
+	Prefix string
+	Read   bool
+	Write  bool
+}
+
+// auth ops only
+type AuthRequest struct {
+	Roles       []string     // AuthSetUser
+	Permissions []Permission // AuthSetRole
+	Salt        []byte       // of the password hash, drawn by the leader
+}
+
+type authUser struct {
+	Salt  []byte
+	Hash  []byte // of the salt and password
+	Roles []string
+	Since int // index it was set at, tokens from before are void
+}
+
+type authState struct {
+	Enabled bool
+	Secret  []byte // tokens are signed with
+	Users   map[string]*authUser
+	Roles   map[string][]Permission
+}
+
+func newAuthState() authState {
+	return authState{Users: make(map[string]*authUser), Roles: make(map[string][]Permission)}
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func passwordHash(salt []byte, password []byte) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(password)
+	return h.Sum(nil)
+}
+
+// fix what must be the same on every replica, and keep the password out of
+// the log
+func prepareAuth(kv *KVServer, args *CommandArgs, op *Op) Err {
+	switch op.OpTask {
+	case AuthEnable:
+		op.Value = randomBytes(32)
+	case AuthSetUser:
+		auth := AuthRequest{}
+		if op.Auth != nil {
+			auth = *op.Auth
+		}
+		auth.Salt = randomBytes(16)
+		op.Value = passwordHash(auth.Salt, op.Value)
+		op.Auth = &auth
+	}
+	return OK
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applyAuth(op Op, index int) opResult {
+	result := opResult{Err: OK, Index: index}
+	auth := &kv.auth
+	switch op.OpTask {
+	case AuthEnable:
+		if root := auth.Users[RootUser]; root == nil || !hasRole(root, RootRole) {
+			result.Err = ErrNoUser
+			return result
+		}
+		auth.Enabled, auth.Secret = true, op.Value
+	case AuthDisable:
+		auth.Enabled = false
+	case AuthSetUser:
+		var roles []string
+		if op.Auth != nil {
+			roles = op.Auth.Roles
+		}
+		for _, role := range roles {
+			if _, ok := auth.Roles[role]; !ok && role != RootRole {
+				result.Err = ErrNoRole
+				return result
+			}
+		}
+		user := &authUser{Hash: op.Value, Roles: roles, Since: index}
+		if op.Auth != nil {
+			user.Salt = op.Auth.Salt
+		}
+		if op.Key == RootUser && auth.Enabled && !hasRole(user, RootRole) {
+			// would lock everybody out
+			result.Err = ErrPermissionDenied
+			return result
+		}
+		auth.Users[op.Key] = user
+	case AuthDeleteUser:
+		if _, ok := auth.Users[op.Key]; !ok {
+			result.Err = ErrNoUser
+			return result
+		}
+		if op.Key == RootUser && auth.Enabled {
+			result.Err = ErrPermissionDenied
+			return result
+		}
+		delete(auth.Users, op.Key)
+	case AuthSetRole:
+		if op.Key == RootRole {
+			// built in
+			result.Err = ErrPermissionDenied
+			return result
+		}
+		var permissions []Permission
+		if op.Auth != nil {
+			permissions = op.Auth.Permissions
+		}
+		auth.Roles[op.Key] = permissions
+	case AuthDeleteRole:
+		if _, ok := auth.Roles[op.Key]; !ok {
+			result.Err = ErrNoRole
+			return result
+		}
+		// users keep the name, it grants nothing until the role is set again
+		delete(auth.Roles, op.Key)
+	}
+	return result
+}
+
+func hasRole(user *authUser, role string) bool {
+	for _, r := range user.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (auth *authState) sign(name string, since int) string {
+	mac := hmac.New(sha256.New, auth.Secret)
+	fmt.Fprintf(mac, "%v.%v", since, name)
+	return fmt.Sprintf("%v.%v.%x", since, hex.EncodeToString([]byte(name)), mac.Sum(nil))
+}
+
+// the user token was issued to, nil if it isn't valid
+func (auth *authState) verify(token string) *authUser {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return nil
+	}
+	since, err := strconv.Atoi(parts[0])
+	name, err2 := hex.DecodeString(parts[1])
+	if err != nil || err2 != nil {
+		return nil
+	}
+	user := auth.Users[string(name)]
+	if user == nil || user.Since != since || !hmac.Equal([]byte(auth.sign(string(name), since)), []byte(token)) {
+		return nil
+	}
+	return user
+}
+
+// whether user may read or write every key in [start, end), end "" meaning
+// up to the last key
+func (auth *authState) allowed(user *authUser, start, end string, write bool) bool {
+	for _, role := range user.Roles {
+		if role == RootRole {
+			return true
+		}
+		for _, permission := range auth.Roles[role] {
+			if write && !permission.Write || !write && !permission.Read {
+				continue
+			}
+			limit := prefixEnd(permission.Prefix)
+			if strings.HasPrefix(start, permission.Prefix) && (limit == "" || end != "" && end <= limit) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// may args run, checked before proposing it
+func (kv *KVServer) authorize(args *CommandArgs) Err {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	err := kv.authorizeL(args)
+	if err != OK {
+		// a follower's config may be behind, the leader has the last word
+		if _, isLeader := kv.rf.GetState(); !isLeader {
+			return ErrWrongLeader
+		}
+	}
+	return err
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) authorizeL(args *CommandArgs) Err {
+	auth := &kv.auth
+	if !auth.Enabled {
+		return OK
+	}
+	user := auth.verify(args.AuthToken)
+	if user == nil {
+		return ErrInvalidToken
+	}
+	ok := true
+	check := func(start, end string, write bool) {
+		ok = ok && auth.allowed(user, start, end, write)
+	}
+	read := func(key string) { check(key, key+"\x00", false) }
+	write := func(key string) { check(key, key+"\x00", true) }
+	switch args.Op {
+	case Gett:
+		read(args.Key)
+	case MultiGet:
+		for _, key := range args.Keys {
+			read(key)
+		}
+	case Range, OpenCursor:
+		start := args.Key
+		if args.Token != "" {
+			// where the scan resumes
+			start = args.Token
+		}
+		check(start, args.EndKey, false)
+	case GetByPrefix:
+		check(args.Key, prefixEnd(args.Key), false)
+	case QueryIndex:
+		// the index leads to keys anywhere
+		check("", "", false)
+	case Putt, Appendd, Deletee, SetTTL, LockAcquire, LockRelease, ElectionProclaim:
+		write(args.Key)
+	case CompareAndSwap, CompareAndDelete, Incr:
+		// these return the value too
+		read(args.Key)
+		write(args.Key)
+	case ElectionCampaign:
+		check(args.Key+"/", prefixEnd(args.Key+"/"), true)
+	case Txn:
+		if args.Txn == nil {
+			break
+		}
+		for _, condition := range args.Txn.Conditions {
+			read(condition.Key)
+		}
+		for _, reads := range [][]string{args.Txn.Reads, args.Txn.ElseReads} {
+			for _, key := range reads {
+				read(key)
+			}
+		}
+		for _, writes := range [][]TxnWrite{args.Txn.Writes, args.Txn.ElseWrites} {
+			for _, w := range writes {
+				write(w.Key)
+			}
+		}
+	case Eval:
+		if args.Script == nil {
+			break
+		}
+		for _, key := range args.Script.Keys {
+			read(key)
+			write(key)
+		}
+	case LeaseGrant, LeaseKeepAlive, LeaseRevoke:
+		// any user, a lease holds no keys by itself
+	default:
+		// compaction, buckets, auth and whatever else touches the whole store
+		ok = hasRole(user, RootRole)
+	}
+	if !ok {
+		return ErrPermissionDenied
+	}
+	return OK
+}
+
+type AuthenticateArgs struct {
+	Name     string
+	Password string
+}
+
+type AuthenticateReply struct {
+	Err   Err
+	Token string
+}
+
+// a token for the user, answered by the leader only so that it knows about
+// the latest changes to the user
+func (kv *KVServer) Authenticate(args *AuthenticateArgs, reply *AuthenticateReply) {
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	auth := &kv.auth
+	user := auth.Users[args.Name]
+	if !auth.Enabled || user == nil || !hmac.Equal(passwordHash(user.Salt, []byte(args.Password)), user.Hash) {
+		reply.Err = ErrAuthFailed
+		return
+	}
+	reply.Err, reply.Token = OK, auth.sign(args.Name, user.Since)
+}
+
+// by hand, see saveState
+func (auth *authState) encode(e *labgob.LabEncoder) {
+	// snapshots are kept small while auth is unused
+	used := auth.Enabled || len(auth.Users) > 0 || len(auth.Roles) > 0
+	e.Encode(used)
+	if !used {
+		return
+	}
+	e.Encode(auth.Enabled)
+	e.Encode(auth.Secret)
+	e.Encode(len(auth.Users))
+	for name, user := range auth.Users {
+		e.Encode(name)
+		e.Encode(user.Salt)
+		e.Encode(user.Hash)
+		e.Encode(user.Since)
+		e.Encode(len(user.Roles))
+		for _, role := range user.Roles {
+			e.Encode(role)
+		}
+	}
+	e.Encode(len(auth.Roles))
+	for name, permissions := range auth.Roles {
+		e.Encode(name)
+		e.Encode(len(permissions))
+		for _, permission := range permissions {
+			e.Encode(permission.Prefix)
+			e.Encode(permission.Read)
+			e.Encode(permission.Write)
+		}
+	}
+}
+
+func (auth *authState) decode(d *labgob.LabDecoder) error {
+	var used bool
+	var users, roles int
+	if err := d.Decode(&used); err != nil || !used {
+		return err
+	}
+	if err := d.Decode(&auth.Enabled); err != nil {
+		return err
+	}
+	if err := d.Decode(&auth.Secret); err != nil {
+		return err
+	}
+	if err := d.Decode(&users); err != nil {
+		return err
+	}
+	for i := 0; i < users; i++ {
+		var name string
+		var n int
+		user := &authUser{}
+		if err := decodeAll(d, &name, &user.Salt, &user.Hash, &user.Since, &n); err != nil {
+			return err
+		}
+		for j := 0; j < n; j++ {
+			var role string
+			if err := d.Decode(&role); err != nil {
+				return err
+			}
+			user.Roles = append(user.Roles, role)
+		}
+		auth.Users[name] = user
+	}
+	if err := d.Decode(&roles); err != nil {
+		return err
+	}
+	for i := 0; i < roles; i++ {
+		var name string
+		var n int
+		if err := decodeAll(d, &name, &n); err != nil {
+			return err
+		}
+		permissions := make([]Permission, n)
+		for j := range permissions {
+			p := &permissions[j]
+			if err := decodeAll(d, &p.Prefix, &p.Read, &p.Write); err != nil {
+				return err
+			}
+		}
+		auth.Roles[name] = permissions
+	}
+	return nil
+}
+
+func decodeAll(d *labgob.LabDecoder, targets ...interface{}) error {
+	for _, target := range targets {
+		if err := d.Decode(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authenticate with the leader, every command after carries the token
+func (ck *Clerk) Authenticate(name, password string) Err {
+	for {
+		reply := new(AuthenticateReply)
+		ok := ck.servers[ck.leaderId].Call("KVServer.Authenticate", &AuthenticateArgs{Name: name, Password: password}, reply)
+		if ok && reply.Err != ErrWrongLeader {
+			if reply.Err == OK {
+				ck.authToken = reply.Token
+			}
+			return reply.Err
+		}
+		ck.leaderId = (ck.leaderId + 1) % int64(len(ck.servers))
+	}
+}
+
+func (ck *Clerk) EnableAuth() Err {
+	return ck.command(&CommandArgs{Op: AuthEnable}).Err
+}
+
+func (ck *Clerk) DisableAuth() Err {
+	return ck.command(&CommandArgs{Op: AuthDisable}).Err
+}
+
+// add the user, or replace its password and roles
+func (ck *Clerk) SetUser(name, password string, roles ...string) Err {
+	return ck.command(&CommandArgs{Key: name, Value: []byte(password), Op: AuthSetUser, Auth: &AuthRequest{Roles: roles}}).Err
+}
+
+func (ck *Clerk) DeleteUser(name string) Err {
+	return ck.command(&CommandArgs{Key: name, Op: AuthDeleteUser}).Err
+}
+
+// add the role, or replace its permissions
+func (ck *Clerk) SetRole(name string, permissions ...Permission) Err {
+	return ck.command(&CommandArgs{Key: name, Op: AuthSetRole, Auth: &AuthRequest{Permissions: permissions}}).Err
+}
+
+func (ck *Clerk) DeleteRole(name string) Err {
+	return ck.command(&CommandArgs{Key: name, Op: AuthDeleteRole}).Err
+}
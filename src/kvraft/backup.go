@@ -0,0 +1,104 @@
+package kvraft
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"raft/labgob"
+	"raft/raft"
+	"raft/transport"
+)
+
+// every backup stream starts with this, followed by a labgob encoded
+// BackupMeta and the encoded server state
+const backupMagic = "MRKVBAK1"
+
+type BackupMeta struct {
+	AppliedIndex int    // state includes every entry up to this index
+	AppliedTerm  int    // term of the entry at AppliedIndex
+	CreatedAt    int64  // unix nanoseconds
+	KeyCount     int    // number of keys in the state
+	Size         int    // bytes of encoded state
+	Checksum     uint32 // crc32 (IEEE) of encoded state
+}
+
+var ErrBadBackup = errors.New("kvraft: malformed backup")
+
+// stream a consistent copy of this server's state to w. the state is captured
+// at the current applied index under the lock, writing happens without it, so
+// the server keeps applying entries while a slow writer drains the backup.
+func (kv *KVServer) Backup(w io.Writer) (BackupMeta, error) {
+	kv.mu.RLock()
+	state := kv.saveState()
+	meta := BackupMeta{
+		AppliedIndex: kv.lastApplied,
+		AppliedTerm:  kv.lastAppliedTerm,
+		CreatedAt:    time.Now().UnixNano(),
+		KeyCount:     kv.storage.Len(),
+	}
+	kv.mu.RUnlock()
+	meta.Size = len(state)
+	meta.Checksum = crc32.ChecksumIEEE(state)
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(backupMagic); err != nil {
+		return meta, err
+	}
+	e := labgob.NewEncoder(bw)
+	if err := e.Encode(meta); err != nil {
+		return meta, err
+	}
+	if _, err := io.Copy(bw, bytes.NewReader(state)); err != nil {
+		return meta, err
+	}
+	return meta, bw.Flush()
+}
+
+// read a stream written by Backup, checking its checksum. the returned state
+// can be handed to installSnapshot or raft as a snapshot.
+func ReadBackup(r io.Reader) (BackupMeta, []byte, error) {
+	var meta BackupMeta
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != backupMagic {
+		return meta, nil, ErrBadBackup
+	}
+	d := labgob.NewDecoder(br)
+	if err := d.Decode(&meta); err != nil {
+		return meta, nil, fmt.Errorf("%w: %v", ErrBadBackup, err)
+	}
+	state := make([]byte, meta.Size)
+	if _, err := io.ReadFull(br, state); err != nil {
+		return meta, nil, fmt.Errorf("%w: %v", ErrBadBackup, err)
+	}
+	if crc32.ChecksumIEEE(state) != meta.Checksum {
+		return meta, nil, fmt.Errorf("%w: checksum mismatch", ErrBadBackup)
+	}
+	return meta, state, nil
+}
+
+// start a server whose state machine and raft log are seeded from the backup
+// at path, instead of from an empty state. persister must be empty, to restore
+// a wiped node pass it a fresh persister. all servers of a new cluster have to
+// be restored from the same backup.
+func StartKVServerFromBackup(servers []transport.Endpoint, me int, persister *raft.Persister, maxraftstate int, path string) (*KVServer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	meta, state, err := ReadBackup(f)
+	if err != nil {
+		return nil, err
+	}
+	if err := raft.BootstrapFromSnapshot(persister, meta.AppliedIndex, meta.AppliedTerm, state); err != nil {
+		return nil, err
+	}
+	return StartKVServer(servers, me, persister, maxraftstate), nil
+}
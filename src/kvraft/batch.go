@@ -0,0 +1,28 @@
+package kvraft
+
+// batches are transactions without conditions: one log entry, and so one
+// raft round, for any number of keys, applied atomically.
+
+// put every pair
+func (ck *Clerk) BatchPut(pairs []KeyValue) {
+	writes := make([]TxnWrite, 0, len(pairs))
+	for _, kv := range pairs {
+		writes = append(writes, TxnWrite{Op: Putt, Key: kv.Key, Value: kv.Value})
+	}
+	ck.Txn(TxnRequest{Writes: writes})
+}
+
+// delete every key, missing ones are skipped
+func (ck *Clerk) BatchDelete(keys []string) {
+	writes := make([]TxnWrite, 0, len(keys))
+	for _, key := range keys {
+		writes = append(writes, TxnWrite{Op: Deletee, Key: key})
+	}
+	ck.Txn(TxnRequest{Writes: writes})
+}
+
+// the values of keys in one linearizable read, in the same order, Value nil
+// for a missing key
+func (ck *Clerk) BatchGet(keys []string) []KeyValue {
+	return ck.Txn(TxnRequest{Reads: keys}).Reads
+}
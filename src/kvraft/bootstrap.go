@@ -0,0 +1,92 @@
+package kvraft
+
+import (
+	"errors"
+
+	"raft/labgob"
+	"raft/raft"
+	"raft/transport"
+)
+
+// a new cluster is bootstrapped by writing its initial configuration, the
+// ids and addresses of its first members, into the log of each: Bootstrap
+// seeds their persisters with a ConfigInit entry, which applies as the
+// membership join.go keeps. StartKVServerFromConfig then starts a server
+// from what its persister holds, dialing the others at their addresses.
+// the configuration is read back from the log, or from the snapshot once
+// the log is compacted, at every start, so no node is handed a list of
+// peers. nodes that come later join with a token.
+//
+// every first member is bootstrapped with the same members in the same
+// order: a member's raft id is its position among them.
+const ConfigInit = "ConfigInit"
+
+var (
+	ErrNotBootstrapped = errors.New("kvraft: persister holds no configuration")
+	ErrNotMember       = errors.New("kvraft: not a member of the configuration")
+)
+
+// seed the empty persister of a first member of a new cluster
+func Bootstrap(persister *raft.Persister, members []Member) error {
+	labgob.Register(Op{})
+	voters := make([]Member, len(members))
+	for i, m := range members {
+		m.Learner = false
+		voters[i] = m
+	}
+	return raft.BootstrapLog(persister, Op{OpTask: ConfigInit, Members: voters})
+}
+
+// the voting members persister was bootstrapped with
+func Configuration(persister *raft.Persister) ([]Member, error) {
+	labgob.Register(Op{})
+	if command, ok := raft.BootstrapCommand(persister); ok {
+		if op, ok := command.(Op); ok && op.OpTask == ConfigInit {
+			return op.Members, nil
+		}
+		return nil, ErrNotBootstrapped
+	}
+	// applied and compacted into the snapshot
+	kv := &KVServer{storage: NewMemoryKV(), joinTokens: make(map[string]*joinToken)}
+	kv.installSnapshot(persister.ReadSnapshot())
+	var voters []Member
+	for _, m := range kv.members {
+		if !m.Learner {
+			voters = append(voters, m)
+		}
+	}
+	if len(voters) == 0 {
+		return nil, ErrNotBootstrapped
+	}
+	return voters, nil
+}
+
+// start the member id of a bootstrapped cluster on its persister, serving
+// the others through t and reaching them at their configured addresses
+func StartKVServerFromConfig(t transport.Transport, id string, persister *raft.Persister, maxraftstate int) (*KVServer, error) {
+	members, err := Configuration(persister)
+	if err != nil {
+		return nil, err
+	}
+	me := -1
+	ends := make([]transport.Endpoint, len(members))
+	for i, m := range members {
+		if m.Id == id {
+			me = i
+		}
+		ends[i] = t.Dial(m.Addr)
+	}
+	if me == -1 {
+		return nil, ErrNotMember
+	}
+	kv := StartKVServer(ends, me, persister, maxraftstate)
+	kv.Register(t)
+	return kv, nil
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applyConfigInit(op Op) {
+	if len(kv.members) == 0 {
+		kv.members = append([]Member(nil), op.Members...)
+	}
+}
@@ -0,0 +1,123 @@
+package kvraft
+
+import "sort"
+
+// buckets are separate key spaces, so applications sharing a cluster can use
+// the same keys and be wiped independently. a bucket is a MemoryKV of its own
+// inside the default one, which is the bucket "" and can't be deleted.
+//
+// Get, Put, Append, Delete, CompareAndSwap, CompareAndDelete, Incr, Range and
+// GetByPrefix take a bucket. the rest (TTLs, leases, watches, cursors and
+// transactions) work on the default bucket only, a Put in another bucket
+// with a TTL or a lease is refused with ErrNotInBucket.
+const (
+	CreateBucket = "CreateBucket"
+	DeleteBucket = "DeleteBucket"
+)
+
+// what snapshots keep of a bucket
+type BucketState struct {
+	KV       map[string][]byte
+	Versions map[string]int64
+}
+
+func (memoryKV *MemoryKV) Bucket(name string) (*MemoryKV, bool) {
+	if name == "" {
+		return memoryKV, true
+	}
+	bucket, ok := memoryKV.buckets[name]
+	return bucket, ok
+}
+
+func (memoryKV *MemoryKV) CreateBucket(name string) Err {
+	if _, ok := memoryKV.Bucket(name); ok {
+		return ErrBucketExists
+	}
+	bucket := newStore(memoryKV.engines(name), memoryKV.engines)
+	bucket.parent, bucket.current, bucket.oldest = memoryKV, memoryKV.current, memoryKV.oldest
+	bucket.name = name
+	memoryKV.buckets[name] = bucket
+	return OK
+}
+
+// drop the bucket and everything in it
+func (memoryKV *MemoryKV) DeleteBucket(name string) Err {
+	bucket, ok := memoryKV.buckets[name]
+	if !ok {
+		return ErrNoBucket
+	}
+	bucket.engine.Close()
+	delete(memoryKV.buckets, name)
+	memoryKV.revision = memoryKV.current
+	return OK
+}
+
+func (memoryKV *MemoryKV) bucketNames() []string {
+	names := make([]string, 0, len(memoryKV.buckets))
+	for name := range memoryKV.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (memoryKV *MemoryKV) BucketStates() map[string]BucketState {
+	states := make(map[string]BucketState, len(memoryKV.buckets))
+	for name, bucket := range memoryKV.buckets {
+		states[name] = BucketState{KV: bucket.GetKV(), Versions: bucket.Versions}
+	}
+	return states
+}
+
+// after SetKV, which leaves only the default bucket
+func (memoryKV *MemoryKV) SetBuckets(states map[string]BucketState) {
+	for name, state := range states {
+		memoryKV.CreateBucket(name)
+		memoryKV.buckets[name].SetKV(state.KV)
+		memoryKV.buckets[name].SetVersions(state.Versions)
+	}
+}
+
+// create a bucket, false if it already exists
+func (ck *Clerk) CreateBucket(name string) bool {
+	return ck.command(&CommandArgs{Op: CreateBucket, Bucket: name}).Err == OK
+}
+
+// delete a bucket with all its keys, false if there is no such bucket
+func (ck *Clerk) DeleteBucket(name string) bool {
+	return ck.command(&CommandArgs{Op: DeleteBucket, Bucket: name}).Err == OK
+}
+
+// the keys in bucket name. its ops return ErrNoBucket if the bucket doesn't
+// exist, other ops can set CommandArgs.Bucket themselves.
+func (ck *Clerk) Bucket(name string) *Bucket {
+	return &Bucket{ck: ck, name: name}
+}
+
+type Bucket struct {
+	ck   *Clerk
+	name string
+}
+
+func (b *Bucket) Get(key string) ([]byte, Err) {
+	reply := b.ck.command(&CommandArgs{Key: key, Op: Gett, Bucket: b.name})
+	return reply.Value, reply.Err
+}
+
+func (b *Bucket) Put(key string, value []byte) Err {
+	return b.ck.command(&CommandArgs{Key: key, Value: value, Op: Putt, Bucket: b.name}).Err
+}
+
+func (b *Bucket) Append(key string, value []byte) Err {
+	return b.ck.command(&CommandArgs{Key: key, Value: value, Op: Appendd, Bucket: b.name}).Err
+}
+
+func (b *Bucket) Delete(key string) Err {
+	return b.ck.command(&CommandArgs{Key: key, Op: Deletee, Bucket: b.name}).Err
+}
+
+// see Clerk.Range
+func (b *Bucket) Range(start string, end string, limit int, token string) ([]KeyValue, string, Err) {
+	reply := b.ck.command(&CommandArgs{Key: start, EndKey: end, Limit: limit, Token: token, Op: Range, Bucket: b.name})
+	return reply.Pairs, reply.Next, reply.Err
+}
@@ -0,0 +1,53 @@
+package kvraft
+
+// change data capture: a server hands every write it applies to its change
+// sink, in log order, so another system can mirror the store. unlike watches,
+// which are best effort and cover the default bucket only, the sink sees all
+// of them, including deletes by expiry, leases and whole buckets.
+//
+// a replica that installs a snapshot skips the entries it covers; the sink is
+// told, and has to reload its mirror, e.g. from a Backup, before it can
+// apply the changes that follow.
+
+// one write, as applied at Index
+type Change struct {
+	Index    int // of the log entry making it
+	Term     int
+	Revision int    // of the store after it
+	Op       string // of the entry, e.g. Put, Txn or Expire
+	Bucket   string // "" for the default one
+	Key      string // "" when a whole bucket is created or deleted
+	Value    []byte // nil for deletes
+	Deleted  bool
+}
+
+// called under the server's lock in the apply loop, so it must not block
+// for long; a sink that ships changes elsewhere should queue them
+type ChangeSink interface {
+	Changed(change Change)
+	// the state was replaced by a snapshot taken at index
+	Restored(index int)
+}
+
+func (kv *KVServer) SetChangeSink(sink ChangeSink) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.changes = sink
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) recordChange(bucket, key string, value []byte, deleted bool) {
+	if kv.changes == nil {
+		return
+	}
+	kv.changes.Changed(Change{
+		Index:    kv.lastApplied,
+		Term:     kv.lastAppliedTerm,
+		Revision: kv.storage.Revision(),
+		Op:       kv.applying.OpTask,
+		Bucket:   bucket,
+		Key:      key,
+		Value:    value,
+		Deleted:  deleted,
+	})
+}
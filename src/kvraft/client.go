@@ -1,19 +1,71 @@
 package kvraft
 
 import (
+	"context"
 	"crypto/rand"
 	"math/big"
+	"strconv"
 	"time"
 
-	"raft/labrpc"
+	"raft/metrics"
+	"raft/raft"
+	"raft/transport"
+)
+
+// how long to wait before retrying a leader that answered ErrBusy
+const busyBackoff = 20 * time.Millisecond
+
+// after every server has been tried without an answer, the clerk waits
+// before the next round, twice as long each round up to the cap. the wait is
+// jittered, so clerks that lost the same leader don't all come back at once
+// to its successor.
+const (
+	retryBackoffBase = 10 * time.Millisecond
+	retryBackoffCap  = 250 * time.Millisecond
+)
+
+const (
+	defaultAttemptTimeout = 100 * time.Millisecond
+	// servers are asked to give up this much sooner than the clerk, so their
+	// ErrTimeout arrives rather than nothing
+	replyMargin = time.Millisecond
 )
 
 type Clerk struct {
-	servers      []*labrpc.ClientEnd
+	servers      []transport.Endpoint
 	clientId     int64
 	commandId    int64
 	serverNumber int
 	leaderId     int64
+	seenIndex    int           // highest applied index any reply was read at
+	authToken    string        // see Authenticate
+	timeout      time.Duration // wait for a server's reply before trying the next
+	// where each server is in servers by its id, as learnt from replies, to
+	// follow the leader hints of ErrWrongLeader
+	positions map[int]int64
+	// the workers' queues of Async calls, see async.go
+	async        []chan asyncCall
+	asyncWorkers int
+	batchWindow  time.Duration
+	maxBatch     int
+	// see SetFollowerReads
+	followerReads bool
+	nextReplica   int
+	// see SetRetryBudget
+	maxAttempts int
+	maxElapsed  time.Duration
+	health      health // see health.go
+	// see hedge.go
+	hedgePercentile int
+	readLatencies   []time.Duration
+	nextLatency     int
+	metrics         metrics.Sink // see SetMetrics
+	// see ClerkConfig
+	metadata       func(ctx context.Context, args *CommandArgs)
+	name, password string
+	// see identity.go, "" for a clerk that isn't opened on a file
+	identityPath string
+	reserved     int64
 }
 
 func nrand() int64 {
@@ -23,49 +75,357 @@ func nrand() int64 {
 	return x
 }
 
-func MakeClerk(servers []*labrpc.ClientEnd) *Clerk {
+// how long to wait before round (from 1) of retries: a random time between
+// half and all of the doubled base, so never much less than the last wait.
+func retryBackoff(round int) time.Duration {
+	wait := retryBackoffCap
+	if round < 16 && retryBackoffBase<<(round-1) < retryBackoffCap {
+		wait = retryBackoffBase << (round - 1)
+	}
+	return wait/2 + time.Duration(nrand()%int64(wait/2+1))
+}
+
+func MakeClerk(servers []transport.Endpoint) *Clerk {
 	return &Clerk{
 		servers:      servers,
 		leaderId:     0,
 		clientId:     nrand(),
 		commandId:    0,
 		serverNumber: len(servers),
+		timeout:      defaultAttemptTimeout,
+		positions:    make(map[int]int64),
+	}
+}
+
+// how long to wait for each server's reply before trying another. a cluster
+// that is slow to commit needs more than the default to ever succeed.
+func (ck *Clerk) SetTimeout(timeout time.Duration) {
+	ck.timeout = timeout
+}
+
+// bound how long each command, and each GetStale, keeps retrying: at most
+// attempts tries and elapsed time, 0 for no bound. a command out of budget
+// returns ErrTimeout, as one whose context is done, and may still be applied
+// afterwards. servers are told to give up waiting no later than the clerk does.
+func (ck *Clerk) SetRetryBudget(attempts int, elapsed time.Duration) {
+	ck.maxAttempts, ck.maxElapsed = attempts, elapsed
+}
+
+// with follower reads on, the clerk's Gets are stale reads as GetStale's,
+// spread over the replicas in turn instead of all going to the leader. a
+// replica that doesn't answer in time, or is behind what the clerk has
+// already seen, doesn't get to wait: the read goes to the leader instead,
+// as a linearizable one.
+func (ck *Clerk) SetFollowerReads(on bool) {
+	ck.followerReads = on
+}
+
+// one stale read of args from the next replica in turn, false if it didn't
+// answer. with hedging on, the next one after is asked too if the first is
+// slow or fails, see hedge.go.
+func (ck *Clerk) followerRead(ctx context.Context, args *CommandArgs) (*CommandReply, bool) {
+	attempt := *args
+	attempt.Consistency, attempt.MinIndex, attempt.Timeout = Stale, ck.seenIndex, replyMargin
+	start := time.Now()
+	ch := make(chan *CommandReply, 2)
+	send := func() {
+		server := int(ck.healthy(int64(ck.nextReplica)))
+		ck.nextReplica = (server + 1) % len(ck.servers)
+		go func() {
+			reply := new(CommandReply)
+			ck.servers[server].Call("KVServer.Command", &attempt, reply)
+			ch <- reply
+		}()
+	}
+	send()
+	sent, failed := 1, 0
+	var hedge <-chan time.Time
+	if ck.hedgePercentile > 0 {
+		hedge = time.After(ck.hedgeDelay())
+	}
+	time_out := time.After(ck.timeout)
+	for {
+		select {
+		case reply := <-ch:
+			if reply.Err == OK || reply.Err == ErrNoKey {
+				ck.recordReadLatency(time.Since(start))
+				ck.seenIndex = raft.Max(ck.seenIndex, reply.Index)
+				return reply, true
+			}
+			if failed++; hedge != nil {
+				// no use waiting out the delay
+				hedge = nil
+				send()
+				sent++
+			} else if failed == sent {
+				return nil, false
+			}
+		case <-hedge:
+			hedge = nil
+			send()
+			sent++
+		case <-time_out:
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
 	}
 }
 
+// values are bytes, Get, Put and Append take and return strings for
+// convenience and the Bytes forms the values as they are
 func (ck *Clerk) Get(key string) string {
+	return string(ck.GetBytes(key))
+}
+
+func (ck *Clerk) GetBytes(key string) []byte {
 	return ck.Command(&CommandArgs{Key: key, Op: Gett})
 }
 
+// a Get served by any replica from its local state, without a round through
+// raft. the value may be stale, but reads never go back in time for this
+// clerk: a replica behind what the clerk has already seen refuses to answer.
+// after a round of replicas without an answer it backs off as commands do,
+// and it gives up with nil once the retry budget is spent.
+func (ck *Clerk) GetStale(key string) []byte {
+	ctx := context.Background()
+	if ck.maxElapsed > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ck.maxElapsed)
+		defer cancel()
+	}
+	args := &CommandArgs{Key: key, Op: Gett}
+	for attempts := 1; ; attempts++ {
+		if reply, ok := ck.followerRead(ctx, args); ok {
+			return reply.Value
+		}
+		if ck.maxAttempts > 0 && attempts == ck.maxAttempts || ctx.Err() != nil {
+			return nil
+		}
+		if attempts%len(ck.servers) == 0 {
+			select {
+			case <-time.After(retryBackoff(attempts / len(ck.servers))):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
 func (ck *Clerk) Put(key string, value string) {
+	ck.PutBytes(key, []byte(value))
+}
+
+func (ck *Clerk) PutBytes(key string, value []byte) {
 	ck.Command(&CommandArgs{Key: key, Value: value, Op: Putt})
 }
+
+// a Put whose key is deleted ttl after it's accepted, unless written again.
+// another Put with a TTL refreshes the deadline, one without makes it permanent.
+func (ck *Clerk) PutWithTTL(key string, value []byte, ttl time.Duration) {
+	ck.Command(&CommandArgs{Key: key, Value: value, Op: Putt, TTL: ttl})
+}
+
 func (ck *Clerk) Append(key string, value string) {
+	ck.AppendBytes(key, []byte(value))
+}
+
+func (ck *Clerk) AppendBytes(key string, value []byte) {
 	ck.Command(&CommandArgs{Key: key, Value: value, Op: Appendd})
 }
 
-func (ck *Clerk) Command(args *CommandArgs) string {
-	args.ClientId, args.CommandId = ck.clientId, ck.commandId
-	for {
+// set key to value only if it currently holds expected (empty for a missing
+// key). returns whether it did, and the value the key held at that point.
+func (ck *Clerk) CompareAndSwap(key string, expected []byte, value []byte) (bool, []byte) {
+	reply := ck.command(&CommandArgs{Key: key, Value: value, Expected: expected, Op: CompareAndSwap})
+	return reply.Swapped, reply.Value
+}
+
+// remove key only if it holds expected, e.g. to release a lock that may
+// have been taken over meanwhile. returns whether it did and the value found.
+func (ck *Clerk) CompareAndDelete(key string, expected []byte) (bool, []byte) {
+	reply := ck.command(&CommandArgs{Key: key, Expected: expected, Op: CompareAndDelete})
+	return reply.Swapped, reply.Value
+}
+
+// add delta (possibly negative) to the integer stored in key, a missing key
+// counts as 0. returns the new value, or false if key holds something else.
+func (ck *Clerk) Incr(key string, delta int64) (int64, bool) {
+	reply := ck.command(&CommandArgs{Key: key, Delta: delta, Op: Incr})
+	if reply.Err != OK {
+		return 0, false
+	}
+	n, _ := strconv.ParseInt(string(reply.Value), 10, 64)
+	return n, true
+}
+
+// one page of the pairs with start <= key < end in key order, end "" meaning
+// no upper bound. pass "" as token for the first page and the returned
+// token for the next one, until it comes back as "".
+// each page is a linearizable read, but pages are read at different points.
+func (ck *Clerk) Range(start string, end string, limit int, token string) ([]KeyValue, string) {
+	reply := ck.command(&CommandArgs{Key: start, EndKey: end, Limit: limit, Token: token, Op: Range})
+	return reply.Pairs, reply.Next
+}
+
+// up to limit pairs whose key starts with prefix, in key order, and whether
+// there are more. limit <= 0 returns them all.
+func (ck *Clerk) GetByPrefix(prefix string, limit int) ([]KeyValue, bool) {
+	reply := ck.command(&CommandArgs{Key: prefix, Limit: limit, Op: GetByPrefix})
+	return reply.Pairs, reply.Next != ""
+}
+
+// the value key had at revision, e.g. one returned with an earlier reply.
+// ErrNoKey if it didn't exist then, ErrCompacted if the servers no longer
+// remember that far back and ErrFutureRevision if revision isn't reached yet.
+func (ck *Clerk) GetAt(key string, revision int) ([]byte, Err) {
+	reply := ck.command(&CommandArgs{Key: key, Op: Gett, Revision: revision})
+	return reply.Value, reply.Err
+}
+
+// Range as of revision. unlike Range, all pages of a scan at the same
+// revision are consistent with each other.
+func (ck *Clerk) RangeAt(start string, end string, limit int, token string, revision int) ([]KeyValue, string, Err) {
+	reply := ck.command(&CommandArgs{Key: start, EndKey: end, Limit: limit, Token: token, Op: Range, Revision: revision})
+	return reply.Pairs, reply.Next, reply.Err
+}
+
+// remove key, reporting whether it existed
+func (ck *Clerk) Delete(key string) bool {
+	return ck.command(&CommandArgs{Key: key, Op: Deletee}).Err == OK
+}
+
+func (ck *Clerk) Command(args *CommandArgs) []byte {
+	return ck.command(args).Value
+}
+
+// errors that are an answer, not a reason to retry: all but the few saying
+// to ask again or elsewhere, so that those of registered ops are answers too.
+// "" is a reply that never came.
+func final(err Err) bool {
+	switch err {
+	case "", ErrWrongLeader, ErrTimeout, ErrBusy, ErrStale, ErrRateLimited:
+		return false
+	}
+	return true
+}
+
+func (ck *Clerk) command(args *CommandArgs) *CommandReply {
+	return ck.CommandContext(context.Background(), args)
+}
+
+// like Command, but gives up with ErrTimeout once ctx is done, waits between
+// retries included, or the retry budget is spent. the command may still be
+// applied afterwards. args without a Trace get that of ctx.
+//
+// the server that answered last is tried first, and another only after
+// ErrWrongLeader or no answer in time: the one a wrong server names as
+// leader if the clerk has heard from it before, the next healthy one in line
+// otherwise.
+// with follower reads on, a Get asks a follower first, see SetFollowerReads.
+func (ck *Clerk) CommandContext(ctx context.Context, args *CommandArgs) (reply *CommandReply) {
+	start := time.Now()
+	sent := 0 // attempts, for the clerk's metrics
+	defer func() { ck.observeCommand(ctx, args.Op, start, sent, reply) }()
+	args.ClientId, args.CommandId = ck.clientId, ck.nextCommandId()
+	args.AuthToken = ck.authToken
+	if args.Trace == "" {
+		args.Trace = TraceFrom(ctx)
+	}
+	if ck.metadata != nil {
+		ck.metadata(ctx, args)
+	}
+	if ck.maxElapsed > 0 {
+		// the deadline is what each attempt's Timeout is cut to
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ck.maxElapsed)
+		defer cancel()
+	}
+	if ck.followerReads && args.Op == Gett && args.Consistency == Linearizable && args.Revision == 0 {
+		sent++
+		if reply, ok := ck.followerRead(ctx, args); ok {
+			return reply
+		}
+	}
+	failures := 0 // attempts in a row with no leader answering
+	for attempts := 0; ; attempts++ {
+		if ck.maxAttempts > 0 && attempts == ck.maxAttempts {
+			ck.commandId++
+			return &CommandReply{Err: ErrTimeout, Elapsed: time.Since(start)}
+		}
+		wait := ck.timeout
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			wait = time.Until(deadline)
+		}
+		attempt := *args
+		attempt.Timeout = wait - replyMargin
+		if attempt.Timeout <= 0 {
+			attempt.Timeout = replyMargin
+		}
 		ch := make(chan *CommandReply, 1)
+		sent++
 		go func(ch chan *CommandReply, args *CommandArgs, serverId int64) {
 			reply := new(CommandReply)
 			ck.servers[serverId].Call("KVServer.Command", args, reply)
 			ch <- reply
-		}(ch, args, ck.leaderId)
+		}(ch, &attempt, ck.leaderId)
 
-		time_out := time.After(100 * time.Millisecond)
+		next := ck.healthy((ck.leaderId + 1) % int64(len(ck.servers)))
+		time_out := time.After(wait)
 		select {
+		case <-ctx.Done():
+			// the abandoned command may still apply, its id mustn't be reused
+			ck.commandId++
+			return &CommandReply{Err: ErrTimeout, Elapsed: time.Since(start)}
 		case reply := <-ch:
-			if (reply.Err == OK || reply.Err == ErrNoKey) && ck.commandId == args.CommandId {
+			if reply.Err != "" {
+				ck.positions[reply.Server] = ck.leaderId
+			}
+			if final(reply.Err) && ck.commandId == args.CommandId {
 				ck.commandId++
-				return reply.Value
+				ck.seenIndex = raft.Max(ck.seenIndex, reply.Index)
+				if ck.reauthenticate(reply) {
+					// turned down before it was proposed, send it again as a new command
+					args.CommandId, args.AuthToken = ck.nextCommandId(), ck.authToken
+					continue
+				}
+				return reply
+			}
+			if reply.Err == ErrBusy {
+				// right leader, it just needs time to catch up with its disk
+				failures = 0
+				select {
+				case <-time.After(busyBackoff):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			if reply.Err == ErrRateLimited {
+				// right leader too, this client has to slow down
+				failures = 0
+				select {
+				case <-time.After(reply.RetryAfter):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			if reply.Err == ErrWrongLeader {
+				// straight to the leader, if we know where it is
+				if position, ok := ck.positions[reply.Leader]; ok && reply.Leader >= 0 && position != ck.leaderId {
+					next = position
+				}
 			}
 			//else fail
 		case <-time_out:
 			//fail
 		}
 		//fail then retry
-		ck.leaderId = (ck.leaderId + 1) % int64(len(ck.servers))
+		ck.leaderId = next
+		if failures++; failures%len(ck.servers) == 0 {
+			// a whole round without a leader, likely an election: give it time
+			select {
+			case <-time.After(retryBackoff(failures / len(ck.servers))):
+			case <-ctx.Done():
+			}
+		}
 	}
 }
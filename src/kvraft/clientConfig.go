@@ -0,0 +1,55 @@
+package kvraft
+
+import (
+	"context"
+	"time"
+
+	"raft/metrics"
+	"raft/transport"
+)
+
+// everything a clerk of a secured cluster needs up front, instead of a
+// series of setters after MakeClerk. the zero value is a clerk as MakeClerk
+// makes it.
+type ClerkConfig struct {
+	Timeout time.Duration // for each server's reply, 0 for the default
+	Metrics metrics.Sink  // nil for none
+
+	// credentials while the cluster has auth enabled: a Token obtained
+	// elsewhere, e.g. handed out to a service, or a Name and Password to
+	// authenticate with. with a name and password the clerk authenticates
+	// again when its token is turned down, e.g. after a password change.
+	Token    string
+	Name     string
+	Password string
+
+	// called with the context and arguments of every command before it's
+	// sent, to attach the caller's metadata, e.g. a Trace taken from its
+	// own request context
+	Metadata func(ctx context.Context, args *CommandArgs)
+}
+
+// a clerk set up from config. with a Name, the clerk authenticates at once,
+// and the Err is that of Authenticate.
+func MakeClerkWithConfig(servers []transport.Endpoint, config ClerkConfig) (*Clerk, Err) {
+	ck := MakeClerk(servers)
+	if config.Timeout > 0 {
+		ck.timeout = config.Timeout
+	}
+	ck.metrics = config.Metrics
+	ck.authToken = config.Token
+	ck.metadata = config.Metadata
+	if config.Name != "" {
+		if err := ck.Authenticate(config.Name, config.Password); err != OK {
+			return ck, err
+		}
+		ck.name, ck.password = config.Name, config.Password
+	}
+	return ck, OK
+}
+
+// authenticate again with the configured credentials after reply turned
+// down the clerk's token, reporting whether the command is worth retrying
+func (ck *Clerk) reauthenticate(reply *CommandReply) bool {
+	return reply.Err == ErrInvalidToken && ck.name != "" && ck.Authenticate(ck.name, ck.password) == OK
+}
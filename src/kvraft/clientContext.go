@@ -0,0 +1,39 @@
+package kvraft
+
+import "context"
+
+// the Context forms of the clerk's basic ops give up with ErrTimeout once
+// ctx is done, see CommandContext. a trace id set on ctx with WithTrace goes
+// along with each command into the log, and so into the audit trail, to
+// tie what a replica applied back to the request that caused it.
+
+type traceKey struct{}
+
+func WithTrace(ctx context.Context, trace string) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+// the trace id set on ctx, "" for none
+func TraceFrom(ctx context.Context) string {
+	trace, _ := ctx.Value(traceKey{}).(string)
+	return trace
+}
+
+// the value of key, "" with ErrNoKey if there's none
+func (ck *Clerk) GetContext(ctx context.Context, key string) (string, Err) {
+	reply := ck.CommandContext(ctx, &CommandArgs{Key: key, Op: Gett})
+	return string(reply.Value), reply.Err
+}
+
+func (ck *Clerk) PutContext(ctx context.Context, key string, value string) Err {
+	return ck.CommandContext(ctx, &CommandArgs{Key: key, Value: []byte(value), Op: Putt}).Err
+}
+
+func (ck *Clerk) AppendContext(ctx context.Context, key string, value string) Err {
+	return ck.CommandContext(ctx, &CommandArgs{Key: key, Value: []byte(value), Op: Appendd}).Err
+}
+
+// ErrNoKey if there was nothing to delete
+func (ck *Clerk) DeleteContext(ctx context.Context, key string) Err {
+	return ck.CommandContext(ctx, &CommandArgs{Key: key, Op: Deletee}).Err
+}
@@ -0,0 +1,80 @@
+package kvraft
+
+import (
+	"context"
+	"time"
+
+	"raft/metrics"
+)
+
+// names under which a clerk reports to its metrics sink, see SetMetrics
+const (
+	MetricClientCommands = "kvraft_client_commands_total"          // labelled by op
+	MetricClientLatency  = "kvraft_client_command_latency_seconds" // labelled by op, retries and waits included
+	MetricClientRetries  = "kvraft_client_retries_total"           // labelled by op, attempts after the first
+	MetricClientErrors   = "kvraft_client_errors_total"            // labelled by the ErrorClass
+)
+
+// what kind of failure an Err is, for applications to tell trouble in the
+// cluster from mistakes of their own without matching every Err
+type ErrorClass string
+
+const (
+	ClassNone       ErrorClass = ""           // OK, or an answer such as ErrNoKey or ErrLocked
+	ClassNotLeader  ErrorClass = "NotLeader"  // no leader took the command, e.g. during an election
+	ClassTimeout    ErrorClass = "Timeout"    // no answer before the deadline or retry budget ran out
+	ClassCanceled   ErrorClass = "Canceled"   // the caller's context was canceled
+	ClassQuota      ErrorClass = "Quota"      // the store is full or the client over its rate
+	ClassWrongGroup ErrorClass = "WrongGroup" // shardkv's ErrWrongGroup, the shard moved to another group
+	ClassInvalid    ErrorClass = "Invalid"    // the command itself is at fault: too large, malformed or not allowed
+)
+
+// the class of err as returned by a command run with ctx. the clerk gives
+// up with ErrTimeout however ctx ends, a canceled ctx makes it Canceled.
+func Classify(ctx context.Context, err Err) ErrorClass {
+	switch err {
+	case OK, ErrNoKey:
+		return ClassNone
+	case ErrWrongLeader, ErrBusy, ErrStale:
+		return ClassNotLeader
+	case ErrTimeout:
+		if ctx.Err() == context.Canceled {
+			return ClassCanceled
+		}
+		return ClassTimeout
+	case ErrNoSpace, ErrRateLimited:
+		return ClassQuota
+	case "ErrWrongGroup":
+		return ClassWrongGroup
+	case ErrKeyTooLarge, ErrValueTooLarge, ErrNotInteger, ErrUnknownOp, ErrScript, ErrNoTxn, ErrNotInBucket,
+		ErrAuthFailed, ErrInvalidToken, ErrPermissionDenied:
+		return ClassInvalid
+	}
+	return ClassNone
+}
+
+// report the clerk's commands to sink, including those of Async calls
+// started afterwards
+func (ck *Clerk) SetMetrics(sink metrics.Sink) {
+	ck.metrics = sink
+}
+
+func (ck *Clerk) sink() metrics.Sink {
+	if ck.metrics == nil {
+		return metrics.Discard
+	}
+	return ck.metrics
+}
+
+// deferred by CommandContext
+func (ck *Clerk) observeCommand(ctx context.Context, op string, start time.Time, attempts int, reply *CommandReply) {
+	sink := ck.sink()
+	sink.IncCounter(labelled(MetricClientCommands, "op", op), 1)
+	sink.Observe(labelled(MetricClientLatency, "op", op), time.Since(start).Seconds())
+	if attempts > 1 {
+		sink.IncCounter(labelled(MetricClientRetries, "op", op), int64(attempts-1))
+	}
+	if class := Classify(ctx, reply.Err); class != ClassNone {
+		sink.IncCounter(labelled(MetricClientErrors, "class", string(class)), 1)
+	}
+}
@@ -0,0 +1,48 @@
+package kvraft
+
+import "raft/raft"
+
+// compaction discards the MVCC history before a revision, after which reads
+// at older revisions and watches starting before it fail with ErrCompacted.
+// it goes through the log, so every replica forgets the same history. besides
+// explicit Compact calls, the apply loop compacts on its own to keep the last
+// historyRetention revisions.
+const Compact = "Compact"
+
+// automatic compaction runs every this many log entries and keeps at least
+// this many revisions of history
+const defaultHistoryRetention = 10000
+
+// caller must hold kv.mu. the answer depends on kv.compacted rather than
+// the history's oldest revision, which a replica that loads a snapshot moves
+// on its own.
+func (kv *KVServer) applyCompact(op Op, index int) Err {
+	if op.Revision > index {
+		return ErrFutureRevision
+	}
+	if op.Revision < kv.compacted {
+		return ErrCompacted
+	}
+	kv.compact(op.Revision)
+	return OK
+}
+
+// called by the apply loop after every entry, caller must hold kv.mu.
+// depends only on the log, so replicas compact at the same points.
+func (kv *KVServer) autoCompact(index int) {
+	if kv.historyRetention > 0 && index%kv.historyRetention == 0 && index > kv.historyRetention {
+		kv.compact(index - kv.historyRetention)
+	}
+}
+
+func (kv *KVServer) compact(revision int) {
+	kv.compacted = raft.Max(kv.compacted, revision)
+	kv.storage.Compact(revision)
+	kv.compactWatches(revision)
+}
+
+// discard the history before revision, returning ErrCompacted if it's
+// already gone and ErrFutureRevision if it isn't reached yet
+func (ck *Clerk) Compact(revision int) Err {
+	return ck.command(&CommandArgs{Op: Compact, Revision: revision}).Err
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"raft/labrpc"
+	"raft/transport"
 
 	// import "log"
 	crand "crypto/rand"
@@ -34,8 +35,8 @@ func makeSeed() int64 {
 }
 
 // Randomize server handles
-func random_handles(kvh []*labrpc.ClientEnd) []*labrpc.ClientEnd {
-	sa := make([]*labrpc.ClientEnd, len(kvh))
+func random_handles(kvh []transport.Endpoint) []transport.Endpoint {
+	sa := make([]transport.Endpoint, len(kvh))
 	copy(sa, kvh)
 	for i := range sa {
 		j := rand.Intn(i + 1)
@@ -79,6 +80,9 @@ func (cfg *config) cleanup() {
 	}
 	cfg.net.Cleanup()
 	cfg.checkTimeout()
+	if cfg.t.Failed() {
+		cfg.t.Logf("replay the network with LABRPC_SEED=%v", cfg.net.GetSeed())
+	}
 }
 
 // Maximum log size across all servers
@@ -196,7 +200,7 @@ func (cfg *config) makeClient(to []int) *Clerk {
 	defer cfg.mu.Unlock()
 
 	// a fresh set of ClientEnds.
-	ends := make([]*labrpc.ClientEnd, cfg.n)
+	ends := make([]transport.Endpoint, cfg.n)
 	endnames := make([]string, cfg.n)
 	for j := 0; j < cfg.n; j++ {
 		endnames[j] = randstring(20)
@@ -288,6 +292,19 @@ func (cfg *config) ShutdownServer(i int) {
 
 // If restart servers, first call ShutdownServer
 func (cfg *config) StartServer(i int) {
+	cfg.startServer(i, false, func(ends []transport.Endpoint, persister *raft.Persister) (*KVServer, error) {
+		return StartKVServer(ends, i, persister, cfg.maxraftstate), nil
+	})
+}
+
+// start server i wiped, restored from the backup at path
+func (cfg *config) StartServerFromBackup(i int, path string) error {
+	return cfg.startServer(i, true, func(ends []transport.Endpoint, persister *raft.Persister) (*KVServer, error) {
+		return StartKVServerFromBackup(ends, i, persister, cfg.maxraftstate, path)
+	})
+}
+
+func (cfg *config) startServer(i int, wipe bool, start func([]transport.Endpoint, *raft.Persister) (*KVServer, error)) error {
 	cfg.mu.Lock()
 
 	// a fresh set of outgoing ClientEnd names.
@@ -297,7 +314,7 @@ func (cfg *config) StartServer(i int) {
 	}
 
 	// a fresh set of ClientEnds.
-	ends := make([]*labrpc.ClientEnd, cfg.n)
+	ends := make([]transport.Endpoint, cfg.n)
 	for j := 0; j < cfg.n; j++ {
 		ends[j] = cfg.net.MakeEnd(cfg.endnames[i][j])
 		cfg.net.Connect(cfg.endnames[i][j], j)
@@ -308,14 +325,18 @@ func (cfg *config) StartServer(i int) {
 	// give the fresh persister a copy of the old persister's
 	// state, so that the spec is that we pass StartKVServer()
 	// the last persisted state.
-	if cfg.saved[i] != nil {
+	if cfg.saved[i] != nil && !wipe {
 		cfg.saved[i] = cfg.saved[i].Copy()
 	} else {
 		cfg.saved[i] = raft.MakePersister()
 	}
 	cfg.mu.Unlock()
 
-	cfg.kvservers[i] = StartKVServer(ends, i, cfg.saved[i], cfg.maxraftstate)
+	kv, err := start(ends, cfg.saved[i])
+	if err != nil {
+		return err
+	}
+	cfg.kvservers[i] = kv
 
 	kvsvc := labrpc.MakeService(cfg.kvservers[i])
 	rfsvc := labrpc.MakeService(cfg.kvservers[i].rf)
@@ -323,6 +344,7 @@ func (cfg *config) StartServer(i int) {
 	srv.AddService(kvsvc)
 	srv.AddService(rfsvc)
 	cfg.net.AddServer(i, srv)
+	return nil
 }
 
 func (cfg *config) Leader() (bool, int) {
@@ -0,0 +1,138 @@
+package kvraft
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// a cursor iterates over [start, end) as it was at the log index where it was
+// opened. OpenCursor goes through the log, and the server that proposed it
+// copies the range while applying it. the pages are then served by that
+// server alone from the copy, without touching the apply loop, so a long
+// scan neither holds up writes nor sees them.
+const OpenCursor = "OpenCursor"
+
+// cursors nobody asked for a page in this long are dropped
+const cursorIdleTimeout = time.Minute
+
+var ErrCursorLost = errors.New("kvraft: cursor no longer exists on its server")
+
+type cursor struct {
+	revision int
+	pairs    []KeyValue
+	lastUsed time.Time
+}
+
+type cursorTable struct {
+	mu      sync.Mutex
+	cursors map[int64]*cursor
+}
+
+type CursorArgs struct {
+	Id     int64
+	Offset int // position of the first pair wanted, which makes retries harmless
+	Limit  int
+}
+
+type CursorReply struct {
+	Err   Err
+	Pairs []KeyValue
+	Done  bool // no pairs after these
+}
+
+// caller must hold kv.mu. only the server with a waiting Command keeps a copy.
+func (kv *KVServer) openCursor(op Op, index int) int64 {
+	if !kv.awaited(op, index) {
+		return 0
+	}
+	pairs, _ := kv.storage.Range(op.Key, op.EndKey, 0)
+	id := nrand()
+
+	kv.cursors.mu.Lock()
+	defer kv.cursors.mu.Unlock()
+	for id, c := range kv.cursors.cursors {
+		if time.Since(c.lastUsed) > cursorIdleTimeout {
+			delete(kv.cursors.cursors, id)
+		}
+	}
+	kv.cursors.cursors[id] = &cursor{revision: index, pairs: pairs, lastUsed: time.Now()}
+	return id
+}
+
+func (kv *KVServer) CursorNext(args *CursorArgs, reply *CursorReply) {
+	kv.cursors.mu.Lock()
+	defer kv.cursors.mu.Unlock()
+	c, ok := kv.cursors.cursors[args.Id]
+	if !ok {
+		reply.Err = ErrNoCursor
+		return
+	}
+	c.lastUsed = time.Now()
+	from := args.Offset
+	if from > len(c.pairs) {
+		from = len(c.pairs)
+	}
+	to := len(c.pairs)
+	if args.Limit > 0 && from+args.Limit < to {
+		to = from + args.Limit
+	}
+	reply.Err = OK
+	reply.Pairs = c.pairs[from:to]
+	reply.Done = to == len(c.pairs)
+}
+
+func (kv *KVServer) CursorClose(args *CursorArgs, reply *CursorReply) {
+	kv.cursors.mu.Lock()
+	defer kv.cursors.mu.Unlock()
+	delete(kv.cursors.cursors, args.Id)
+	reply.Err = OK
+}
+
+type Cursor struct {
+	ck       *Clerk
+	server   int64
+	id       int64
+	offset   int
+	done     bool
+	Revision int // log index the cursor reads the key space at
+}
+
+// a cursor over the pairs with start <= key < end, end "" meaning no upper bound
+func (ck *Clerk) OpenCursor(start string, end string) *Cursor {
+	reply := ck.command(&CommandArgs{Key: start, EndKey: end, Op: OpenCursor})
+	return &Cursor{ck: ck, server: ck.leaderId, id: reply.Cursor, Revision: reply.Index}
+}
+
+// the next limit pairs (all remaining if limit <= 0), io.EOF once there are
+// none left, and ErrCursorLost if the server restarted, is unreachable or
+// dropped the cursor for being idle; the caller may then open a new one.
+func (cur *Cursor) Next(limit int) ([]KeyValue, error) {
+	if cur.done {
+		return nil, io.EOF
+	}
+	args := &CursorArgs{Id: cur.id, Offset: cur.offset, Limit: limit}
+	for try := 0; try < 10; try++ {
+		reply := new(CursorReply)
+		if !cur.ck.servers[cur.server].Call("KVServer.CursorNext", args, reply) {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if reply.Err != OK {
+			break
+		}
+		cur.offset += len(reply.Pairs)
+		cur.done = reply.Done
+		if len(reply.Pairs) == 0 && reply.Done {
+			return nil, io.EOF
+		}
+		return reply.Pairs, nil
+	}
+	return nil, ErrCursorLost
+}
+
+// release the server's copy, best effort
+func (cur *Cursor) Close() {
+	cur.ck.servers[cur.server].Call("KVServer.CursorClose", &CursorArgs{Id: cur.id}, new(CursorReply))
+}
@@ -0,0 +1,159 @@
+package kvraft
+
+import (
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// a StateMachine with the values in a file and only the keys and the position
+// of their values in memory. values are appended and never overwritten; once
+// most of the file is dead it's rewritten with just the live values.
+//
+// this keeps the values off the heap between snapshots, but the data still
+// can't outgrow RAM: Snapshot reads every value back, and the snapshot is a
+// full serialisation of them that raft keeps in memory and ships whole to
+// followers. snapshots as checkpoints of the file would need raft to keep
+// and send snapshots it doesn't hold as bytes, which it can't.
+type diskEngine struct {
+	path   string
+	file   *os.File
+	values map[string]diskValue
+	size   int64     // end of the file
+	live   int64     // bytes of the values still in use
+	keys   int64     // bytes of the keys, which are in memory
+	cache  *RowCache // hot values, may be nil
+}
+
+type diskValue struct {
+	offset int64
+	length int
+}
+
+// the file is rewritten once it's at least this big and mostly dead
+const diskEngineMinRewrite = 1 << 20
+
+// engines keeping each bucket in a file under dir, which must exist.
+// the files are scratch space, replaced when the server starts.
+func DiskEngines(dir string) EngineFactory {
+	return DiskEnginesWithCache(dir, nil)
+}
+
+// like DiskEngines, with the hot values of every bucket kept in cache
+func DiskEnginesWithCache(dir string, cache *RowCache) EngineFactory {
+	return func(bucket string) StateMachine {
+		return openDiskEngine(filepath.Join(dir, "bucket-"+hex.EncodeToString([]byte(bucket))+".kv"), cache)
+	}
+}
+
+func openDiskEngine(path string, cache *RowCache) *diskEngine {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Fatalf("disk engine: %v", err)
+	}
+	return &diskEngine{path: path, file: file, values: make(map[string]diskValue), cache: cache}
+}
+
+func (engine *diskEngine) Apply(key string, value []byte, deleted bool) {
+	if old, ok := engine.values[key]; ok {
+		engine.live -= int64(old.length)
+		engine.keys -= int64(len(key))
+		delete(engine.values, key)
+	}
+	if deleted {
+		engine.cache.remove(engine, key)
+		return
+	}
+	engine.values[key] = engine.write(value)
+	engine.keys += int64(len(key))
+	engine.cache.add(engine, key, value)
+	if engine.size >= diskEngineMinRewrite && engine.live < engine.size/2 {
+		engine.rewrite()
+	}
+}
+
+func (engine *diskEngine) write(value []byte) diskValue {
+	if _, err := engine.file.WriteAt(value, engine.size); err != nil {
+		log.Fatalf("disk engine: %v", err)
+	}
+	at := diskValue{offset: engine.size, length: len(value)}
+	engine.size += int64(len(value))
+	engine.live += int64(len(value))
+	return at
+}
+
+func (engine *diskEngine) Read(key string) ([]byte, bool) {
+	at, ok := engine.values[key]
+	if !ok {
+		return nil, false
+	}
+	if value, ok := engine.cache.get(engine, key); ok {
+		return value, true
+	}
+	value := engine.readFile(at)
+	engine.cache.add(engine, key, value)
+	return value, true
+}
+
+func (engine *diskEngine) readFile(at diskValue) []byte {
+	value := make([]byte, at.length)
+	if _, err := engine.file.ReadAt(value, at.offset); err != nil {
+		log.Fatalf("disk engine: %v", err)
+	}
+	return value
+}
+
+// read straight from the file so a snapshot doesn't flush the cache
+func (engine *diskEngine) Snapshot() map[string][]byte {
+	kv := make(map[string][]byte, len(engine.values))
+	for key, at := range engine.values {
+		kv[key] = engine.readFile(at)
+	}
+	return kv
+}
+
+func (engine *diskEngine) Restore(kv map[string][]byte) {
+	engine.reset()
+	for key, value := range kv {
+		engine.values[key] = engine.write(value)
+		engine.keys += int64(len(key))
+	}
+}
+
+func (engine *diskEngine) reset() {
+	if err := engine.file.Truncate(0); err != nil {
+		log.Fatalf("disk engine: %v", err)
+	}
+	engine.cache.drop(engine)
+	engine.values = make(map[string]diskValue)
+	engine.size, engine.live, engine.keys = 0, 0, 0
+}
+
+// copy the live values to a new file, which then replaces the old one
+func (engine *diskEngine) rewrite() {
+	fresh := openDiskEngine(engine.path+".new", engine.cache)
+	for key, at := range engine.values {
+		fresh.values[key] = fresh.write(engine.readFile(at))
+	}
+	engine.file.Close()
+	if err := os.Rename(fresh.path, engine.path); err != nil {
+		log.Fatalf("disk engine: %v", err)
+	}
+	fresh.path, fresh.keys = engine.path, engine.keys
+	*engine = *fresh
+}
+
+func (engine *diskEngine) Len() int {
+	return len(engine.values)
+}
+
+func (engine *diskEngine) Size() int64 {
+	return engine.keys + engine.live
+}
+
+func (engine *diskEngine) Close() {
+	engine.cache.drop(engine)
+	engine.file.Close()
+	os.Remove(engine.path)
+}
@@ -0,0 +1,126 @@
+package kvraft
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// leader election among clients, after etcd's recipe. every candidate for an
+// election named prefix gets a key prefix/<index>, index being where its
+// Campaign entry was applied, attached to its lease; keys sort by index, so
+// the first key under the prefix is the leader and the others queue up
+// behind it in the order they campaigned. resigning or letting the lease
+// expire deletes the key and hands leadership to the next one.
+const (
+	ElectionCampaign = "ElectionCampaign"
+	ElectionProclaim = "ElectionProclaim"
+)
+
+// how often a campaigning candidate checks whether it leads yet
+const electionPollInterval = 50 * time.Millisecond
+
+func candidateKey(prefix string, index int) string {
+	return fmt.Sprintf("%s/%020d", prefix, index)
+}
+
+// the leader's key, "" if nobody campaigns. caller must hold kv.mu.
+func (kv *KVServer) electionLeader(prefix string) string {
+	pairs, _ := kv.storage.Range(prefix+"/", prefixEnd(prefix+"/"), 1)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return pairs[0].Key
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applyElection(op Op, index int) opResult {
+	result := opResult{Err: OK, Index: index}
+	switch op.OpTask {
+	case ElectionCampaign:
+		if kv.leases[op.Lease] == nil {
+			result.Err = ErrNoLease
+			return result
+		}
+		// a lease campaigns once, a retry finds the key it got the first time
+		for key, lease := range kv.storage.Leases {
+			if lease == op.Lease && strings.HasPrefix(key, op.Key+"/") {
+				result.Value = []byte(key)
+				return result
+			}
+		}
+		key := candidateKey(op.Key, index)
+		kv.storage.Put(key, op.Value)
+		kv.storage.SetLease(key, op.Lease)
+		result.Value = []byte(key)
+	case ElectionProclaim:
+		slash := strings.LastIndex(op.Key, "/")
+		if slash == -1 || kv.electionLeader(op.Key[:slash]) != op.Key {
+			result.Err = ErrNotElected
+			return result
+		}
+		// keeps the key's lease
+		kv.storage.Put(op.Key, op.Value)
+	}
+	return result
+}
+
+// a candidate in the election named Prefix, holding its place through Lease
+type Election struct {
+	ck     *Clerk
+	Prefix string
+	Lease  int64
+	Key    string // this candidate's key, "" until it campaigns
+}
+
+func (ck *Clerk) Election(prefix string, lease int64) *Election {
+	return &Election{ck: ck, Prefix: prefix, Lease: lease}
+}
+
+// stand with value and wait until elected, false if the lease expired first.
+// the lease must be kept alive meanwhile.
+func (e *Election) Campaign(value []byte) bool {
+	reply := e.ck.command(&CommandArgs{Key: e.Prefix, Value: value, Lease: e.Lease, Op: ElectionCampaign})
+	if reply.Err != OK {
+		return false
+	}
+	e.Key = string(reply.Value)
+	for {
+		if e.ck.command(&CommandArgs{Key: e.Key, Op: Gett}).Err == ErrNoKey {
+			// the lease expired
+			e.Key = ""
+			return false
+		}
+		if leader, _ := e.Leader(); leader.Key == e.Key {
+			return true
+		}
+		time.Sleep(electionPollInterval)
+	}
+}
+
+// replace the leader's value, false if this candidate doesn't lead
+func (e *Election) Proclaim(value []byte) bool {
+	if e.Key == "" {
+		return false
+	}
+	return e.ck.command(&CommandArgs{Key: e.Key, Value: value, Op: ElectionProclaim}).Err == OK
+}
+
+// step down, or leave the queue if not elected yet
+func (e *Election) Resign() bool {
+	if e.Key == "" {
+		return false
+	}
+	ok := e.ck.Delete(e.Key)
+	e.Key = ""
+	return ok
+}
+
+// the current leader's key and value, false if nobody campaigns
+func (e *Election) Leader() (KeyValue, bool) {
+	pairs, _ := e.ck.GetByPrefix(e.Prefix+"/", 1)
+	if len(pairs) == 0 {
+		return KeyValue{}, false
+	}
+	return pairs[0], true
+}
@@ -0,0 +1,74 @@
+package kvraft
+
+// MemoryKV keeps the current value of each key in a StateMachine, which may
+// keep them on disk, and everything else (the sorted keys, versions, TTLs,
+// leases, indexes and the recent history) in memory.
+//
+// the engine needn't be durable: on a restart the server rebuilds it from
+// the raft snapshot and log, starting with Restore.
+type StateMachine interface {
+	// set key to value, or remove it if deleted. the engine may keep value
+	// as it is, the caller doesn't modify it afterwards.
+	Apply(key string, value []byte, deleted bool)
+	Read(key string) ([]byte, bool)
+	// every key with its value, for a snapshot
+	Snapshot() map[string][]byte
+	// replace the contents with kv
+	Restore(kv map[string][]byte)
+	Len() int
+	// bytes of keys and values held
+	Size() int64
+	// release what the engine holds, after which it isn't used again
+	Close()
+}
+
+// makes the engine of each bucket, "" being the default one
+type EngineFactory func(bucket string) StateMachine
+
+type memoryEngine struct {
+	values map[string][]byte
+	size   int64
+}
+
+func NewMemoryEngine(bucket string) StateMachine {
+	return &memoryEngine{values: make(map[string][]byte)}
+}
+
+func (engine *memoryEngine) Apply(key string, value []byte, deleted bool) {
+	if old, ok := engine.values[key]; ok {
+		engine.size -= int64(len(key) + len(old))
+	}
+	if deleted {
+		delete(engine.values, key)
+		return
+	}
+	engine.values[key] = value
+	engine.size += int64(len(key) + len(value))
+}
+
+func (engine *memoryEngine) Read(key string) ([]byte, bool) {
+	value, ok := engine.values[key]
+	return value, ok
+}
+
+func (engine *memoryEngine) Snapshot() map[string][]byte {
+	return engine.values
+}
+
+func (engine *memoryEngine) Restore(kv map[string][]byte) {
+	engine.values = kv
+	engine.size = 0
+	for key, value := range kv {
+		engine.size += int64(len(key) + len(value))
+	}
+}
+
+func (engine *memoryEngine) Len() int {
+	return len(engine.values)
+}
+
+func (engine *memoryEngine) Size() int64 {
+	return engine.size
+}
+
+func (engine *memoryEngine) Close() {}
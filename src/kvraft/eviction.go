@@ -0,0 +1,148 @@
+package kvraft
+
+import (
+	"container/list"
+	"time"
+)
+
+// in cache mode the store is kept under a memory budget by evicting the
+// least recently used keys, rather than refusing writes as a quota does.
+// which keys were used recently is each replica's own bookkeeping, but the
+// evictions go through the log like the Expire of a key past its TTL: once
+// the store holds more than the budget, the leader's evictor proposes an
+// Evict entry with the coldest keys, and applying it deletes each one that
+// hasn't been written since. keys with a TTL still expire as usual.
+//
+// only keys in the default bucket are evicted and only reads and writes of
+// them through the log count as uses, stale reads don't.
+const Evict = "Evict"
+
+const (
+	evictBatch       = 100 // keys per Evict entry at most
+	evictTargetRatio = 0.9 // of the budget, evict down to
+)
+
+// a key as the leader chose it for eviction
+type EvictKey struct {
+	Key     string
+	Version int64 // evicted only if still at this version
+}
+
+// keys of the default bucket, most recently used first. local to a replica.
+type lruKeys struct {
+	order *list.List // of string
+	keys  map[string]*list.Element
+}
+
+func (lru *lruKeys) touch(key string) {
+	if lru.keys == nil {
+		lru.order, lru.keys = list.New(), make(map[string]*list.Element)
+	}
+	if element, ok := lru.keys[key]; ok {
+		lru.order.MoveToFront(element)
+		return
+	}
+	lru.keys[key] = lru.order.PushFront(key)
+}
+
+func (lru *lruKeys) remove(key string) {
+	if element, ok := lru.keys[key]; ok {
+		lru.order.Remove(element)
+		delete(lru.keys, key)
+	}
+}
+
+// 0, the default, turns cache mode off. every server should get the same
+// budget, the leader's is the one that counts.
+func (kv *KVServer) SetCacheBudget(bytes int64) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.cacheBudget = bytes
+	if bytes == 0 {
+		kv.lru = lruKeys{}
+	}
+}
+
+// op used its key, caller must hold kv.mu
+func (kv *KVServer) touch(op Op) {
+	if kv.cacheBudget > 0 && op.Bucket == "" && op.Key != "" {
+		if kv.storage.Found(op.Key) {
+			kv.lru.touch(op.Key)
+		} else {
+			kv.lru.remove(op.Key)
+		}
+	}
+}
+
+func (kv *KVServer) evictor() {
+	proposedAt := 0 // index of the last Evict proposed
+	var lastProposed time.Time
+	for !kv.killed() {
+		time.Sleep(alarmCheckInterval)
+		if _, isLeader := kv.rf.GetState(); !isLeader {
+			continue
+		}
+		kv.mu.Lock()
+		if kv.cacheBudget == 0 || kv.storage.Size() <= kv.cacheBudget ||
+			(kv.lastApplied < proposedAt && time.Since(lastProposed) < ttlRepropose) {
+			// the last one may not be applied yet
+			kv.mu.Unlock()
+			continue
+		}
+		victims := kv.coldestL()
+		kv.mu.Unlock()
+		if len(victims) == 0 {
+			continue
+		}
+		index, _, isLeader := kv.rf.Start(Op{OpTask: Evict, Evictions: victims})
+		if isLeader {
+			proposedAt, lastProposed = index, time.Now()
+		}
+	}
+}
+
+// the least recently used keys whose eviction brings the store down to
+// evictTargetRatio of the budget, up to evictBatch of them. caller must
+// hold kv.mu.
+func (kv *KVServer) coldestL() []EvictKey {
+	if len(kv.lru.keys) < kv.storage.Len() {
+		// restored from a snapshot, or cache mode was just turned on: keys
+		// not used since count as the coldest
+		untracked := make([]string, 0)
+		for _, key := range kv.storage.keys {
+			if _, ok := kv.lru.keys[key]; !ok {
+				untracked = append(untracked, key)
+			}
+		}
+		for _, key := range untracked {
+			kv.lru.touch(key)
+			kv.lru.order.MoveToBack(kv.lru.keys[key])
+		}
+	}
+	excess := kv.storage.Size() - int64(evictTargetRatio*float64(kv.cacheBudget))
+	victims := make([]EvictKey, 0)
+	for element := kv.lru.order.Back(); element != nil && excess > 0 && len(victims) < evictBatch; {
+		key, prev := element.Value.(string), element.Prev()
+		if value, err := kv.storage.Get(key); err != OK {
+			kv.lru.remove(key)
+		} else {
+			victims = append(victims, EvictKey{Key: key, Version: kv.storage.Version(key)})
+			excess -= int64(len(key) + len(value))
+		}
+		element = prev
+	}
+	return victims
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applyEvict(op Op) {
+	evicted := 0
+	for _, victim := range op.Evictions {
+		if kv.storage.Found(victim.Key) && kv.storage.Version(victim.Key) == victim.Version {
+			kv.storage.Delete(victim.Key)
+			kv.lru.remove(victim.Key)
+			evicted++
+		}
+	}
+	kv.sink().IncCounter(MetricEvictions, int64(evicted))
+}
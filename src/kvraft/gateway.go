@@ -0,0 +1,192 @@
+package kvraft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// an HTTP front for the store, so curl and clients in other languages can
+// use it without speaking labrpc and gob. it's a client like any other,
+// sending everything through the clerk it's given:
+//
+//	GET    /kv/<key>                       the value, 404 if there's none
+//	PUT    /kv/<key>                       the body as the value
+//	DELETE /kv/<key>                       404 if there was nothing to delete
+//	GET    /range?start=&end=&limit=&token= {"Pairs": [...], "Next": ""}
+//	GET    /watch/<key>?prefix=1&from=<rev> server-sent events, one per change
+//
+// values are the bodies as they are, in JSON they're base64 like any []byte.
+// errors come back as a status and the Err as the body.
+//
+// each watch event is sent with its revision as the id, so an EventSource
+// reconnecting with Last-Event-ID resumes after it.
+type Gateway struct {
+	mu sync.Mutex // a clerk sends one command at a time
+	ck *Clerk
+}
+
+func NewGateway(ck *Clerk) *Gateway {
+	return &Gateway{ck: ck}
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/kv/"):
+		g.serveKey(w, r, strings.TrimPrefix(r.URL.Path, "/kv/"))
+	case r.URL.Path == "/range" && r.Method == http.MethodGet:
+		g.serveRange(w, r)
+	case strings.HasPrefix(r.URL.Path, "/watch/") && r.Method == http.MethodGet:
+		g.serveWatch(w, r, strings.TrimPrefix(r.URL.Path, "/watch/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (g *Gateway) command(r *http.Request, args *CommandArgs) *CommandReply {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.ck.CommandContext(r.Context(), args)
+}
+
+func httpStatus(err Err) int {
+	switch err {
+	case OK:
+		return http.StatusOK
+	case ErrNoKey:
+		return http.StatusNotFound
+	case ErrTimeout:
+		return http.StatusGatewayTimeout
+	case ErrInvalidToken:
+		return http.StatusUnauthorized
+	case ErrPermissionDenied:
+		return http.StatusForbidden
+	case ErrKeyTooLarge, ErrValueTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrRateLimited:
+		return http.StatusTooManyRequests
+	case ErrNoSpace:
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+func httpError(w http.ResponseWriter, err Err) {
+	http.Error(w, err.Error(), httpStatus(err))
+}
+
+func (g *Gateway) serveKey(w http.ResponseWriter, r *http.Request, key string) {
+	args := &CommandArgs{Key: key}
+	switch r.Method {
+	case http.MethodGet:
+		args.Op = Gett
+	case http.MethodPut:
+		value, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		args.Op, args.Value = Putt, value
+	case http.MethodDelete:
+		args.Op = Deletee
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reply := g.command(r, args)
+	if reply.Err != OK {
+		httpError(w, reply.Err)
+		return
+	}
+	w.Header().Set("X-Revision", strconv.Itoa(reply.Revision))
+	if args.Op == Gett {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(reply.Value)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type rangeResponse struct {
+	Pairs []KeyValue
+	Next  string // the token of the next page, "" after the last
+}
+
+func (g *Gateway) serveRange(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := 0
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+	}
+	reply := g.command(r, &CommandArgs{
+		Op:     Range,
+		Key:    query.Get("start"),
+		EndKey: query.Get("end"),
+		Limit:  limit,
+		Token:  query.Get("token"),
+	})
+	if reply.Err != OK {
+		httpError(w, reply.Err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rangeResponse{Pairs: reply.Pairs, Next: reply.Next})
+}
+
+func (g *Gateway) serveWatch(w http.ResponseWriter, r *http.Request, key string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	from := 0
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		last, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "bad Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		from = last + 1
+	} else if s := r.URL.Query().Get("from"); s != "" {
+		var err error
+		if from, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "bad from", http.StatusBadRequest)
+			return
+		}
+	}
+	prefix := r.URL.Query().Get("prefix") != ""
+
+	g.mu.Lock()
+	watcher := g.ck.Watch(key, prefix, from)
+	g.mu.Unlock()
+	defer watcher.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				fmt.Fprintf(w, "event: error\ndata: %v\n\n", watcher.Err().Error())
+				flusher.Flush()
+				return
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", event.Revision, event.Type, data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package kvraft
+
+import (
+	"sync"
+	"time"
+
+	"raft/raft"
+)
+
+// with health checks on, the clerk pings every server each interval and
+// marks those that don't answer within its timeout unhealthy, until one
+// answers again. retries pass over unhealthy servers and follower reads
+// don't go to them, so a dead server doesn't cost every command a timeout.
+// a server named leader by another is asked regardless, and once all are
+// unhealthy the clerk tries them in turn as it would without checks.
+// the pings also track each server's latency, see Liveness and Nearest.
+
+type PingArgs struct{}
+
+type PingReply struct {
+	Server int
+}
+
+// answered locally, it only says the server is up and reachable
+func (kv *KVServer) Ping(args *PingArgs, reply *PingReply) {
+	reply.Server = kv.me
+}
+
+type health struct {
+	mu        sync.Mutex
+	unhealthy []bool
+	liveness  *raft.LivenessTracker
+	stop      chan struct{}
+}
+
+// start pinging the servers every interval, in the background until
+// StopHealthChecks
+func (ck *Clerk) StartHealthChecks(interval time.Duration) {
+	if ck.health.stop != nil {
+		return
+	}
+	ck.health.unhealthy = make([]bool, len(ck.servers))
+	// a server is alive until it misses a ping
+	ck.health.liveness = raft.MakeLivenessTracker(len(ck.servers), interval+ck.timeout)
+	ck.health.stop = make(chan struct{})
+	go ck.checkHealth(interval, ck.timeout, ck.health.stop)
+}
+
+func (ck *Clerk) StopHealthChecks() {
+	if ck.health.stop == nil {
+		return
+	}
+	close(ck.health.stop)
+	ck.health.mu.Lock()
+	defer ck.health.mu.Unlock()
+	ck.health.stop, ck.health.unhealthy, ck.health.liveness = nil, nil, nil
+}
+
+// the servers that missed their last ping, by position in servers
+func (ck *Clerk) Unhealthy() []int {
+	ck.health.mu.Lock()
+	defer ck.health.mu.Unlock()
+	var servers []int
+	for i, down := range ck.health.unhealthy {
+		if down {
+			servers = append(servers, i)
+		}
+	}
+	return servers
+}
+
+// what the pings have shown of the servers, by position in servers. nil
+// without health checks.
+func (ck *Clerk) Liveness() []raft.Liveness {
+	ck.health.mu.Lock()
+	liveness := ck.health.liveness
+	ck.health.mu.Unlock()
+	if liveness == nil {
+		return nil
+	}
+	return liveness.All()
+}
+
+// the alive server quickest to answer pings, to send reads to that any
+// replica can serve. -1 without health checks or if none is alive.
+func (ck *Clerk) Nearest() int {
+	nearest := -1
+	liveness := ck.Liveness()
+	for i, l := range liveness {
+		if l.Alive && (nearest == -1 || l.Latency < liveness[nearest].Latency) {
+			nearest = i
+		}
+	}
+	return nearest
+}
+
+func (ck *Clerk) checkHealth(interval time.Duration, timeout time.Duration, stop chan struct{}) {
+	liveness := ck.health.liveness
+	for {
+		var wg sync.WaitGroup
+		for i := range ck.servers {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				start := time.Now()
+				up := ck.ping(i, timeout)
+				liveness.Record(i, time.Since(start), up)
+				ck.health.mu.Lock()
+				defer ck.health.mu.Unlock()
+				if ck.health.unhealthy != nil {
+					ck.health.unhealthy[i] = !up
+				}
+			}(i)
+		}
+		wg.Wait()
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (ck *Clerk) ping(server int, timeout time.Duration) bool {
+	ch := make(chan bool, 1)
+	go func() {
+		ch <- ck.servers[server].Call("KVServer.Ping", &PingArgs{}, &PingReply{})
+	}()
+	select {
+	case ok := <-ch:
+		return ok
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// the first server from server on that isn't unhealthy, server itself if
+// none is up
+func (ck *Clerk) healthy(server int64) int64 {
+	ck.health.mu.Lock()
+	defer ck.health.mu.Unlock()
+	if ck.health.unhealthy == nil {
+		return server
+	}
+	n := int64(len(ck.servers))
+	for i := int64(0); i < n; i++ {
+		if next := (server + i) % n; !ck.health.unhealthy[next] {
+			return next
+		}
+	}
+	return server
+}
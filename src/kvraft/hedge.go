@@ -0,0 +1,42 @@
+package kvraft
+
+import (
+	"sort"
+	"time"
+)
+
+// with hedging on, a stale read, GetStale's or a follower read, that the
+// replica asked hasn't answered within the given percentile of the clerk's
+// recent stale reads also goes to the next healthy replica, and the first
+// answer is taken. a replica stalled, e.g. collecting garbage, then costs a
+// read little more than a usual one rather than a whole timeout.
+
+const (
+	hedgeSamples      = 64 // latencies of recent reads the delay is taken from
+	hedgeMinSamples   = 10 // until there are as many, defaultHedgeDelay is used
+	defaultHedgeDelay = 20 * time.Millisecond
+)
+
+// percentile in (0, 100), 0 turns hedging off, the default
+func (ck *Clerk) SetReadHedging(percentile int) {
+	ck.hedgePercentile = percentile
+}
+
+func (ck *Clerk) recordReadLatency(latency time.Duration) {
+	if len(ck.readLatencies) < hedgeSamples {
+		ck.readLatencies = append(ck.readLatencies, latency)
+	} else {
+		ck.readLatencies[ck.nextLatency] = latency
+	}
+	ck.nextLatency = (ck.nextLatency + 1) % hedgeSamples
+}
+
+// how long a stale read waits for its replica before asking another too
+func (ck *Clerk) hedgeDelay() time.Duration {
+	if len(ck.readLatencies) < hedgeMinSamples {
+		return defaultHedgeDelay
+	}
+	latencies := append([]time.Duration(nil), ck.readLatencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[len(latencies)*ck.hedgePercentile/100]
+}
@@ -0,0 +1,95 @@
+package kvraft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"raft/labgob"
+	"raft/transport"
+)
+
+// servers apply a client's command ids at most once, in increasing order,
+// so a client process restarting under its old id mustn't reuse ids it may
+// already have sent, and one minting a new id loses the exactly-once
+// guarantee for its command in flight. a clerk opened on an identity file
+// keeps its client id there, along with the end of a block of command ids it
+// has reserved: ids are only handed out below it, and the file is rewritten
+// once the block runs out. a restarted clerk starts from the end of the
+// last block, skipping at most a block's worth of ids, which servers allow.
+//
+// only the clerk's own commands count, Async calls go through worker clerks
+// with fresh ids of their own.
+
+const identityBlock = 1000
+
+type clerkIdentity struct {
+	ClientId int64
+	Reserved int64 // command ids from here on are unused
+}
+
+// a clerk continuing the command sequence of clientId from commandId, e.g.
+// as saved from Identity by a process that persists it itself
+func MakeClerkWithIdentity(servers []transport.Endpoint, clientId int64, commandId int64) *Clerk {
+	ck := MakeClerk(servers)
+	ck.clientId, ck.commandId = clientId, commandId
+	return ck
+}
+
+// the clerk's client id and the id of its next command. any command ids
+// after are unused, so a clerk made with both later doesn't repeat one.
+func (ck *Clerk) Identity() (int64, int64) {
+	return ck.clientId, ck.commandId
+}
+
+// a clerk with the identity kept in the file at path, created with a new
+// one if the file doesn't exist
+func OpenClerk(servers []transport.Endpoint, path string) (*Clerk, error) {
+	ck := MakeClerk(servers)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		var identity clerkIdentity
+		if err := labgob.NewDecoder(bytes.NewReader(data)).Decode(&identity); err != nil {
+			return nil, err
+		}
+		ck.clientId, ck.commandId = identity.ClientId, identity.Reserved
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	ck.identityPath, ck.reserved = path, ck.commandId
+	return ck, nil
+}
+
+// the id for the clerk's next command, reserved first if need be
+func (ck *Clerk) nextCommandId() int64 {
+	if ck.identityPath != "" && ck.commandId >= ck.reserved {
+		ck.reserveCommandIds()
+	}
+	return ck.commandId
+}
+
+// reserve the next block of command ids before the clerk uses one of them.
+// a clerk that can't record its ids can't go on safely.
+func (ck *Clerk) reserveCommandIds() {
+	identity := clerkIdentity{ClientId: ck.clientId, Reserved: ck.commandId + identityBlock}
+	w := new(bytes.Buffer)
+	labgob.NewEncoder(w).Encode(identity)
+	f, err := os.Create(ck.identityPath + ".tmp")
+	if err != nil {
+		log.Fatalf("clerk identity: %v", err)
+	}
+	if _, err := f.Write(w.Bytes()); err != nil {
+		log.Fatalf("clerk identity: write %v: %v", ck.identityPath, err)
+	}
+	if err := f.Sync(); err != nil {
+		log.Fatalf("clerk identity: fsync %v: %v", ck.identityPath, err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("clerk identity: %v", err)
+	}
+	if err := os.Rename(ck.identityPath+".tmp", ck.identityPath); err != nil {
+		log.Fatalf("clerk identity: %v", err)
+	}
+	ck.reserved = identity.Reserved
+}
@@ -0,0 +1,102 @@
+package kvraft
+
+import "sort"
+
+// a secondary index maps a term extracted from each value, e.g. a field of a
+// record, to the keys whose values have that term, so QueryIndex finds them
+// without a scan. an IndexFunc can't go through the log, so indexes are
+// registered on every server with RegisterIndex, the same ones everywhere.
+// the storage updates them with every write, in the same step as the write.
+// they are derived from the values, so not part of snapshots, and cover the
+// default bucket.
+const QueryIndex = "QueryIndex"
+
+// the term value is indexed under, false to leave the key out of the index
+type IndexFunc func(key string, value []byte) (term string, ok bool)
+
+type secondaryIndex struct {
+	extract IndexFunc
+	terms   map[string]string              // key -> its term
+	keys    map[string]map[string]struct{} // term -> keys with it
+}
+
+func (index *secondaryIndex) remove(key string) {
+	term, ok := index.terms[key]
+	if !ok {
+		return
+	}
+	delete(index.terms, key)
+	delete(index.keys[term], key)
+	if len(index.keys[term]) == 0 {
+		delete(index.keys, term)
+	}
+}
+
+func (index *secondaryIndex) set(key string, value []byte) {
+	index.remove(key)
+	term, ok := index.extract(key, value)
+	if !ok {
+		return
+	}
+	index.terms[key] = term
+	if index.keys[term] == nil {
+		index.keys[term] = make(map[string]struct{})
+	}
+	index.keys[term][key] = struct{}{}
+}
+
+// index every current key with extract, replacing an index of the same name
+func (memoryKV *MemoryKV) AddIndex(name string, extract IndexFunc) {
+	index := &secondaryIndex{extract: extract}
+	memoryKV.indexes[name] = index
+	memoryKV.rebuildIndex(index)
+}
+
+func (memoryKV *MemoryKV) rebuildIndex(index *secondaryIndex) {
+	index.terms = make(map[string]string)
+	index.keys = make(map[string]map[string]struct{})
+	for _, key := range memoryKV.keys {
+		value, _ := memoryKV.engine.Read(key)
+		index.set(key, value)
+	}
+}
+
+// up to limit pairs with key >= start whose value has term in index name,
+// in key order and paged as by Range. ErrNoIndex if there's no such index.
+func (memoryKV *MemoryKV) QueryIndex(name string, term string, start string, limit int) (pairs []KeyValue, next string, err Err) {
+	index, ok := memoryKV.indexes[name]
+	if !ok {
+		return nil, "", ErrNoIndex
+	}
+	keys := make([]string, 0, len(index.keys[term]))
+	for key := range index.keys[term] {
+		if key >= start {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		next, keys = keys[limit], keys[:limit]
+	}
+	pairs = make([]KeyValue, 0, len(keys))
+	for _, key := range keys {
+		value, _ := memoryKV.engine.Read(key)
+		pairs = append(pairs, KeyValue{key, value})
+	}
+	return pairs, next, OK
+}
+
+// maintain index name with extract from now on, indexing the current keys.
+// every server must register the same indexes, before the clients query them.
+func (kv *KVServer) RegisterIndex(name string, extract IndexFunc) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.storage.AddIndex(name, extract)
+}
+
+// one page of the pairs whose value has term in index, see IndexFunc, paged
+// as by Range. ErrNoIndex if the servers don't have the index.
+func (ck *Clerk) QueryIndex(index string, term string, limit int, token string) ([]KeyValue, string, Err) {
+	reply := ck.command(&CommandArgs{Op: QueryIndex, Index: index, Value: []byte(term), Limit: limit, Token: token})
+	return reply.Pairs, reply.Next, reply.Err
+}
@@ -0,0 +1,238 @@
+package kvraft
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"raft/labgob"
+	"raft/raft"
+)
+
+// a node joins the cluster by presenting a join token to any member,
+// instead of an operator editing every node's peer list. an operator (root,
+// once auth is enabled) issues tokens with IssueJoinToken; only a token's
+// hash goes through the log, so neither the log nor the snapshots handed to
+// joining nodes hold one that works. the new node calls Join with the token,
+// its id and its address: the leader proposes the join, which uses up the
+// token on every replica and records the node as a learner in the
+// membership, and the reply carries the membership and a snapshot taken
+// right after the join, to start the node from with raft.BootstrapFromSnapshot.
+// a Join retried with the same token and id succeeds again.
+//
+// the membership starts out as the configuration the cluster was
+// bootstrapped with, see bootstrap.go. raft's peers are fixed when it's
+// made, so a learner gets no entries until raft can add peers.
+const (
+	JoinTokenIssue = "JoinTokenIssue" // Key is the token's hash
+	JoinCluster    = "JoinCluster"    // proposed by the leader for Join
+)
+
+// how long a token issued without a TTL can be used
+const defaultJoinTokenTTL = time.Hour
+
+type Member struct {
+	Id      string
+	Addr    string
+	Learner bool // gets entries but doesn't vote
+}
+
+type joinToken struct {
+	Expiry int64  // unix nanoseconds, fixed by the leader that issued it
+	Member string // the id of the node that joined with it, "" if unused
+}
+
+// the hash a token is known by in the log and the replicas' state
+func joinTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func prepareJoinToken(kv *KVServer, args *CommandArgs, op *Op) Err {
+	op.TTL = args.TTL
+	if op.TTL <= 0 {
+		op.TTL = defaultJoinTokenTTL
+	}
+	op.ExpireAt = time.Now().Add(op.TTL).UnixNano()
+	return OK
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applyJoinTokenIssue(op Op, index int) opResult {
+	// tokens expired by the time this one is issued are of no more use
+	now := op.ExpireAt - int64(op.TTL)
+	for hash, token := range kv.joinTokens {
+		if token.Expiry <= now {
+			delete(kv.joinTokens, hash)
+		}
+	}
+	kv.joinTokens[op.Key] = &joinToken{Expiry: op.ExpireAt}
+	return okAt(index)
+}
+
+// op.ExpireAt is when the leader proposed the join. caller must hold kv.mu.
+func (kv *KVServer) applyJoinCluster(op Op, index int) opResult {
+	result := okAt(index)
+	token := kv.joinTokens[op.Key]
+	if token == nil || token.Expiry <= op.ExpireAt || token.Member != "" && token.Member != op.Members[0].Id {
+		result.Err = ErrInvalidToken
+		return result
+	}
+	if token.Member != "" {
+		// a retry
+		return result
+	}
+	for _, m := range kv.members {
+		if m.Id == op.Members[0].Id {
+			result.Err = ErrMemberExists
+			return result
+		}
+	}
+	token.Member = op.Members[0].Id
+	kv.members = append(kv.members, op.Members[0])
+	return result
+}
+
+// a token admitting one node for ttl, 0 for defaultJoinTokenTTL
+func (ck *Clerk) IssueJoinToken(ttl time.Duration) (string, Err) {
+	token := hex.EncodeToString(randomBytes(16))
+	reply := ck.command(&CommandArgs{Key: joinTokenHash(token), Op: JoinTokenIssue, TTL: ttl})
+	if reply.Err != OK {
+		return "", reply.Err
+	}
+	return token, OK
+}
+
+type JoinArgs struct {
+	Token string
+	Id    string
+	Addr  string
+}
+
+type JoinReply struct {
+	Err     Err
+	Leader  int      // with ErrWrongLeader, -1 if unknown
+	Members []Member // the membership once the node has joined
+	// the state once the node has joined, in raft.BootstrapFromSnapshot's terms
+	Snapshot      []byte
+	SnapshotIndex int
+	SnapshotTerm  int
+}
+
+// admit the node args names as a learner, answered by the leader only
+func (kv *KVServer) Join(args *JoinArgs, reply *JoinReply) {
+	if !kv.enter() {
+		reply.Err, reply.Leader = ErrWrongLeader, -1
+		return
+	}
+	defer kv.leave()
+	op := Op{
+		OpTask:   JoinCluster,
+		Key:      joinTokenHash(args.Token),
+		ClientId: nrand(), // tells the waiter this entry from others at its index
+		ExpireAt: time.Now().UnixNano(),
+		Members:  []Member{{Id: args.Id, Addr: args.Addr, Learner: true}},
+	}
+	start := time.Now()
+	index, _, err := kv.rf.Propose(op)
+	if err == raft.ErrBusy {
+		reply.Err = ErrBusy
+		return
+	} else if err != nil {
+		reply.Err, reply.Leader = ErrWrongLeader, kv.rf.Leader()
+		return
+	}
+	kv.mu.Lock()
+	if index <= kv.lastApplied {
+		// applied before we got to wait for it, a retry tells how it went
+		kv.mu.Unlock()
+		reply.Err = ErrTimeout
+		return
+	}
+	w := kv.startWaiter(op, index)
+	kv.mu.Unlock()
+	defer func() { go kv.deleteWaiterL(index, w) }()
+	select {
+	case <-time.After(kv.requestTimeout - time.Since(start)):
+		reply.Err = ErrTimeout
+		return
+	case result := <-w.c:
+		if reply.Err = result.Err; reply.Err != OK {
+			return
+		}
+	}
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	reply.Members = append([]Member(nil), kv.members...)
+	reply.Snapshot = kv.saveState()
+	reply.SnapshotIndex, reply.SnapshotTerm = kv.lastApplied, kv.lastAppliedTerm
+}
+
+// join the cluster as the node with id at addr, asking the servers in turn
+// until the leader answers. ErrTimeout and ErrBusy are retried too, the
+// join being safe to repeat with the same token.
+func (ck *Clerk) Join(token, id, addr string) JoinReply {
+	for {
+		reply := JoinReply{}
+		ok := ck.servers[ck.leaderId].Call("KVServer.Join", &JoinArgs{Token: token, Id: id, Addr: addr}, &reply)
+		if ok && reply.Err != ErrWrongLeader && reply.Err != ErrTimeout && reply.Err != ErrBusy {
+			return reply
+		}
+		ck.leaderId = (ck.leaderId + 1) % int64(len(ck.servers))
+	}
+}
+
+// the members the cluster was bootstrapped with, then those that joined
+func (kv *KVServer) Members() []Member {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return append([]Member(nil), kv.members...)
+}
+
+func (kv *KVServer) encodeMembership(e *labgob.LabEncoder) {
+	e.Encode(len(kv.members))
+	for _, m := range kv.members {
+		e.Encode(m.Id)
+		e.Encode(m.Addr)
+		e.Encode(m.Learner)
+	}
+	hashes := make([]string, 0, len(kv.joinTokens))
+	for hash := range kv.joinTokens {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	e.Encode(len(hashes))
+	for _, hash := range hashes {
+		token := kv.joinTokens[hash]
+		e.Encode(hash)
+		e.Encode(token.Expiry)
+		e.Encode(token.Member)
+	}
+}
+
+func decodeMembership(d *labgob.LabDecoder, members *[]Member, tokens map[string]*joinToken) error {
+	var nmembers, ntokens int
+	if err := d.Decode(&nmembers); err != nil {
+		return err
+	}
+	for i := 0; i < nmembers; i++ {
+		var m Member
+		if err := decodeAll(d, &m.Id, &m.Addr, &m.Learner); err != nil {
+			return err
+		}
+		*members = append(*members, m)
+	}
+	if err := d.Decode(&ntokens); err != nil {
+		return err
+	}
+	for i := 0; i < ntokens; i++ {
+		var hash string
+		token := new(joinToken)
+		if err := decodeAll(d, &hash, &token.Expiry, &token.Member); err != nil {
+			return err
+		}
+		tokens[hash] = token
+	}
+	return nil
+}
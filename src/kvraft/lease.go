@@ -0,0 +1,86 @@
+package kvraft
+
+import "time"
+
+// a lease is a TTL that keys can share. it is granted by the leader, kept
+// alive by its holder, and when it is revoked or expires a single log entry
+// deletes every key attached to it, e.g. a service's ephemeral registration
+// or a lock held by a client that went away.
+// lease ids are the log index of the grant, so every replica agrees on them.
+const (
+	LeaseGrant     = "LeaseGrant"
+	LeaseRevoke    = "LeaseRevoke"
+	LeaseKeepAlive = "LeaseKeepAlive"
+	LeaseExpire    = "LeaseExpire" // proposed by the leader's sweeper
+)
+
+type Lease struct {
+	TTL      time.Duration
+	Deadline int64 // unix nanoseconds, fixed by the leader that granted or renewed it
+}
+
+// a keep-alive's op.ExpireAt is when the leader proposed it. caller must
+// hold kv.mu.
+func (kv *KVServer) applyLease(op Op, index int) opResult {
+	result := opResult{Err: OK, Index: index}
+	switch op.OpTask {
+	case LeaseGrant:
+		kv.leases[int64(index)] = &Lease{TTL: op.TTL, Deadline: op.ExpireAt}
+		result.Lease = int64(index)
+	case LeaseKeepAlive:
+		if lease, ok := kv.leases[op.Lease]; ok {
+			lease.Deadline = op.ExpireAt + int64(lease.TTL)
+		} else {
+			result.Err = ErrNoLease
+		}
+	case LeaseRevoke:
+		if _, ok := kv.leases[op.Lease]; ok {
+			kv.dropLease(op.Lease)
+		} else {
+			result.Err = ErrNoLease
+		}
+	}
+	return result
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applyLeaseExpire(op Op) {
+	if lease, ok := kv.leases[op.Lease]; ok && lease.Deadline == op.ExpireAt {
+		kv.dropLease(op.Lease)
+	}
+}
+
+// delete the lease and its keys, caller must hold kv.mu
+func (kv *KVServer) dropLease(id int64) {
+	delete(kv.leases, id)
+	keys := make([]string, 0)
+	for key, lease := range kv.storage.Leases {
+		if lease == id {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		kv.storage.Delete(key)
+	}
+}
+
+// a lease that goes away ttl after the last keep-alive, returns its id
+func (ck *Clerk) GrantLease(ttl time.Duration) int64 {
+	args := &CommandArgs{Op: LeaseGrant, TTL: ttl}
+	return ck.command(args).Lease
+}
+
+// push the lease's deadline a full TTL out, false if it already expired
+func (ck *Clerk) KeepAlive(lease int64) bool {
+	return ck.command(&CommandArgs{Op: LeaseKeepAlive, Lease: lease}).Err == OK
+}
+
+// delete the lease and all keys attached to it, false if it already expired
+func (ck *Clerk) RevokeLease(lease int64) bool {
+	return ck.command(&CommandArgs{Op: LeaseRevoke, Lease: lease}).Err == OK
+}
+
+// a Put attaching key to lease, false (and nothing written) if the lease is gone
+func (ck *Clerk) PutWithLease(key string, value []byte, lease int64) bool {
+	return ck.command(&CommandArgs{Key: key, Value: value, Op: Putt, Lease: lease}).Err == OK
+}
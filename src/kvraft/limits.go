@@ -0,0 +1,53 @@
+package kvraft
+
+// keys and values are checked against the server's limits as requests come
+// in, before they become raft entries: a huge entry has to be written and
+// sent to every follower before anything after it commits, stalling every
+// other client meanwhile. the limits are on what a request carries, Append
+// can still build a bigger value over several requests.
+const (
+	defaultMaxKeySize   = 4 << 10
+	defaultMaxValueSize = 1 << 20
+)
+
+// 0 for no limit
+func (kv *KVServer) SetSizeLimits(maxKey, maxValue int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.maxKeySize, kv.maxValueSize = maxKey, maxValue
+}
+
+// ErrKeyTooLarge or ErrValueTooLarge if something in args is over its limit
+func (kv *KVServer) checkSizes(args *CommandArgs) Err {
+	kv.mu.RLock()
+	maxKey, maxValue := kv.maxKeySize, kv.maxValueSize
+	kv.mu.RUnlock()
+	keys := append([]string{args.Key, args.EndKey, args.Token, args.Bucket, args.Index}, args.Keys...)
+	values := [][]byte{args.Value, args.Expected}
+	if args.Txn != nil {
+		for _, condition := range args.Txn.Conditions {
+			keys, values = append(keys, condition.Key), append(values, condition.Value)
+		}
+		keys = append(append(keys, args.Txn.Reads...), args.Txn.ElseReads...)
+		for _, writes := range [][]TxnWrite{args.Txn.Writes, args.Txn.ElseWrites} {
+			for _, write := range writes {
+				keys, values = append(keys, write.Key), append(values, write.Value)
+			}
+		}
+	}
+	if args.Script != nil {
+		keys = append(keys, args.Script.Keys...)
+		values = append(append(values, []byte(args.Script.Source)), args.Script.Args...)
+	}
+	for _, key := range keys {
+		if maxKey > 0 && len(key) > maxKey {
+			return ErrKeyTooLarge
+		}
+	}
+	for _, value := range values {
+		if maxValue > 0 && len(value) > maxValue {
+			return ErrValueTooLarge
+		}
+	}
+	return OK
+}
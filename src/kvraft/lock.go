@@ -0,0 +1,78 @@
+package kvraft
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// a lock is a key held through a lease: acquiring it creates the key attached
+// to the holder's lease, releasing it or letting the lease expire deletes it.
+// each acquisition returns a fencing token, the log index it was applied at,
+// which only goes up. a holder that stalls past its lease may still think it
+// holds the lock, so whatever the lock protects should take the token along
+// and refuse tokens lower than the highest it has seen.
+const (
+	LockAcquire = "LockAcquire"
+	LockRelease = "LockRelease"
+)
+
+// how often a blocked Lock tries again
+const lockRetryInterval = 50 * time.Millisecond
+
+// caller must hold kv.mu
+func (kv *KVServer) applyLock(op Op, index int) opResult {
+	result := opResult{Err: OK, Index: index}
+	switch op.OpTask {
+	case LockAcquire:
+		if kv.leases[op.Lease] == nil {
+			result.Err = ErrNoLease
+		} else if token, err := kv.storage.Get(op.Key); err == OK {
+			// held already, maybe by this very lease
+			result.Value = token
+			if kv.storage.Leases[op.Key] != op.Lease {
+				result.Err = ErrLocked
+			}
+		} else {
+			result.Value = []byte(strconv.Itoa(index))
+			kv.storage.Put(op.Key, result.Value)
+			kv.storage.SetLease(op.Key, op.Lease)
+		}
+	case LockRelease:
+		if token, err := kv.storage.Get(op.Key); err != OK || !bytes.Equal(token, op.Value) {
+			result.Err = ErrNotLocked
+		} else {
+			kv.storage.Delete(op.Key)
+		}
+	}
+	return result
+}
+
+// acquire name for lease if it's free, returning the fencing token.
+// ErrLocked if someone else holds it, ErrNoLease if the lease is gone.
+func (ck *Clerk) TryLock(name string, lease int64) (int64, Err) {
+	reply := ck.command(&CommandArgs{Key: name, Lease: lease, Op: LockAcquire})
+	if reply.Err != OK {
+		return 0, reply.Err
+	}
+	token, _ := strconv.ParseInt(string(reply.Value), 10, 64)
+	return token, OK
+}
+
+// wait for name to be free and acquire it, false if the lease expired first.
+// the lease must be kept alive meanwhile.
+func (ck *Clerk) Lock(name string, lease int64) (int64, bool) {
+	for {
+		token, err := ck.TryLock(name, lease)
+		if err != ErrLocked {
+			return token, err == OK
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// release name if the holder's token is still the current one
+func (ck *Clerk) Unlock(name string, token int64) bool {
+	args := &CommandArgs{Key: name, Value: []byte(strconv.FormatInt(token, 10)), Op: LockRelease}
+	return ck.command(args).Err == OK
+}
@@ -0,0 +1,162 @@
+package kvraft
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a listener speaking the memcached text protocol's get, set, delete and
+// incr, so memcached clients can use the store as a cache that never
+// returns a stale value. like the RedisFrontend, it's a client sending
+// everything through the clerk it's given.
+//
+// flags aren't kept, gets return them as 0. exptime is as memcached has it:
+// seconds from now, or up to 30 days of them, a unix time beyond that.
+type MemcachedFrontend struct {
+	mu sync.Mutex // a clerk sends one command at a time
+	ck *Clerk
+}
+
+const memcachedMaxRelative = 30 * 24 * 60 * 60 // exptime seconds beyond this are a unix time
+
+// incr only if the key exists, memcached doesn't create it
+const memcachedIncr = `(if (exists (arg 0)) (put (arg 0) (+ (get (arg 0)) (arg 1))) nil)`
+
+func NewMemcachedFrontend(ck *Clerk) *MemcachedFrontend {
+	return &MemcachedFrontend{ck: ck}
+}
+
+// serve connections from l until it's closed
+func (f *MemcachedFrontend) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go f.serveConn(conn)
+	}
+}
+
+func (f *MemcachedFrontend) command(args *CommandArgs) *CommandReply {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ck.command(args)
+}
+
+func (f *MemcachedFrontend) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		line, err := readRedisLine(r)
+		if err != nil {
+			return
+		}
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if words[0] == "quit" {
+			w.Flush()
+			return
+		} else if err := f.execute(r, w, words); err != nil {
+			return
+		}
+		// answers to pipelined commands go out together
+		if r.Buffered() == 0 && w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// the error is the connection's, the client's are answered
+func (f *MemcachedFrontend) execute(r *bufio.Reader, w *bufio.Writer, words []string) error {
+	// a trailing noreply asks for no answer to a storage command
+	noreply := len(words) > 2 && words[len(words)-1] == "noreply" && words[0] != "get"
+	if noreply {
+		words = words[:len(words)-1]
+		w = bufio.NewWriter(ioutil.Discard)
+	}
+	switch {
+	case words[0] == "get" && len(words) > 1:
+		for _, key := range words[1:] {
+			reply := f.command(&CommandArgs{Op: Gett, Key: key})
+			if reply.Err == OK {
+				fmt.Fprintf(w, "VALUE %s 0 %d\r\n", key, len(reply.Value))
+				w.Write(reply.Value)
+				w.WriteString("\r\n")
+			} else if reply.Err != ErrNoKey {
+				fmt.Fprintf(w, "SERVER_ERROR %s\r\n", reply.Err.Error())
+				return nil
+			}
+		}
+		w.WriteString("END\r\n")
+	case words[0] == "set" && len(words) == 5:
+		exptime, err1 := strconv.ParseInt(words[3], 10, 64)
+		size, err2 := strconv.Atoi(words[4])
+		if err1 != nil || err2 != nil || size < 0 || size > redisMaxBulk {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+			return nil
+		}
+		args := &CommandArgs{Op: Putt, Key: words[1], Value: data[:size]}
+		if exptime > memcachedMaxRelative {
+			exptime -= time.Now().Unix()
+			if exptime <= 0 {
+				exptime = -1
+			}
+		}
+		if exptime < 0 {
+			// expired as soon as it's set
+			args = &CommandArgs{Op: Deletee, Key: words[1]}
+		}
+		args.TTL = time.Duration(exptime) * time.Second
+		if reply := f.command(args); reply.Err != OK && reply.Err != ErrNoKey {
+			fmt.Fprintf(w, "SERVER_ERROR %s\r\n", reply.Err.Error())
+			return nil
+		}
+		w.WriteString("STORED\r\n")
+	case words[0] == "delete" && len(words) == 2:
+		switch reply := f.command(&CommandArgs{Op: Deletee, Key: words[1]}); reply.Err {
+		case OK:
+			w.WriteString("DELETED\r\n")
+		case ErrNoKey:
+			w.WriteString("NOT_FOUND\r\n")
+		default:
+			fmt.Fprintf(w, "SERVER_ERROR %s\r\n", reply.Err.Error())
+		}
+	case words[0] == "incr" && len(words) == 3:
+		if _, err := strconv.ParseUint(words[2], 10, 63); err != nil {
+			w.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+			return nil
+		}
+		script := &ScriptRequest{Source: memcachedIncr, Keys: []string{words[1]}, Args: [][]byte{[]byte(words[1]), []byte(words[2])}}
+		reply := f.command(&CommandArgs{Op: Eval, Script: script})
+		switch {
+		case reply.Err == ErrScript:
+			w.WriteString("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+		case reply.Err != OK:
+			fmt.Fprintf(w, "SERVER_ERROR %s\r\n", reply.Err.Error())
+		case reply.Value == nil:
+			w.WriteString("NOT_FOUND\r\n")
+		default:
+			w.Write(reply.Value)
+			w.WriteString("\r\n")
+		}
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return nil
+}
@@ -1,36 +1,305 @@
 package kvraft
 
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+)
+
 type MemoryKV struct {
-	KV map[string]string
+	engine   StateMachine     // the current values, see engine.go
+	engines  EngineFactory    // for buckets
+	Versions map[string]int64 // writes to each key since it was created, has every key
+	Expiry   map[string]int64 // unix nanosecond deadline of keys with a TTL
+	Leases   map[string]int64 // lease each key is attached to, if any
+	keys     []string         // sorted keys, for range scans
+
+	History  map[string][]KeyRevision // see mvcc.go
+	revision int
+	current  int
+	oldest   int
+
+	buckets map[string]*MemoryKV       // see bucket.go
+	parent  *MemoryKV                  // of a bucket, the default one
+	indexes map[string]*secondaryIndex // see index.go
+
+	onChange func(key string, value []byte, deleted bool) // called for every write, default bucket only
+	// of the default bucket, called for every write in any bucket
+	onWrite func(bucket, key string, value []byte, deleted bool)
+	name    string // of a bucket
 }
 
 func NewMemoryKV() *MemoryKV {
+	return NewMemoryKVWith(NewMemoryEngine)
+}
+
+// a MemoryKV keeping the values of each bucket in the engine from engines
+func NewMemoryKVWith(engines EngineFactory) *MemoryKV {
+	return newStore(engines(""), engines)
+}
+
+func newStore(engine StateMachine, engines EngineFactory) *MemoryKV {
 	return &MemoryKV{
-		KV: make(map[string]string),
+		engine:   engine,
+		engines:  engines,
+		Versions: make(map[string]int64),
+		Expiry:   make(map[string]int64),
+		Leases:   make(map[string]int64),
+		History:  make(map[string][]KeyRevision),
+		buckets:  make(map[string]*MemoryKV),
+		indexes:  make(map[string]*secondaryIndex),
+	}
+}
+func (memoryKV *MemoryKV) GetKV() map[string][]byte {
+	return memoryKV.engine.Snapshot()
+}
+func (memoryKV *MemoryKV) Len() int {
+	return memoryKV.engine.Len()
+}
+
+// bytes of keys and values, buckets included
+func (memoryKV *MemoryKV) Size() int64 {
+	size := memoryKV.engine.Size()
+	for _, bucket := range memoryKV.buckets {
+		size += bucket.Size()
+	}
+	return size
+}
+func (memoryKV *MemoryKV) SetKV(newKV map[string][]byte) {
+	memoryKV.engine.Restore(newKV)
+	memoryKV.keys = make([]string, 0, len(newKV))
+	for key := range newKV {
+		memoryKV.keys = append(memoryKV.keys, key)
+	}
+	sort.Strings(memoryKV.keys)
+	memoryKV.Versions = make(map[string]int64, len(newKV))
+	for key := range newKV {
+		memoryKV.Versions[key] = 1
+	}
+	memoryKV.Expiry = make(map[string]int64)
+	memoryKV.Leases = make(map[string]int64)
+	memoryKV.History = make(map[string][]KeyRevision)
+	for _, bucket := range memoryKV.buckets {
+		bucket.engine.Close()
+	}
+	memoryKV.buckets = make(map[string]*MemoryKV)
+	for _, index := range memoryKV.indexes {
+		memoryKV.rebuildIndex(index)
+	}
+}
+
+func (memoryKV *MemoryKV) SetLeases(leases map[string]int64) {
+	for key, lease := range leases {
+		memoryKV.SetLease(key, lease)
+	}
+}
+
+// 0 detaches the key from its lease
+func (memoryKV *MemoryKV) SetLease(key string, lease int64) {
+	if !memoryKV.Found(key) || lease == 0 {
+		delete(memoryKV.Leases, key)
+		return
+	}
+	memoryKV.Leases[key] = lease
+}
+
+func (memoryKV *MemoryKV) SetExpiries(expiry map[string]int64) {
+	for key, at := range expiry {
+		memoryKV.SetExpiry(key, at)
+	}
+}
+
+// 0 removes the key's TTL
+func (memoryKV *MemoryKV) SetExpiry(key string, at int64) {
+	if !memoryKV.Found(key) || at == 0 {
+		delete(memoryKV.Expiry, key)
+		return
+	}
+	memoryKV.Expiry[key] = at
+}
+
+// versions are set after SetKV, which starts every key at version 1
+func (memoryKV *MemoryKV) SetVersions(versions map[string]int64) {
+	for key, version := range versions {
+		if memoryKV.Found(key) {
+			memoryKV.Versions[key] = version
+		}
+	}
+}
+
+// 0 for a missing key
+func (memoryKV *MemoryKV) Version(key string) int64 {
+	return memoryKV.Versions[key]
+}
+
+// all writes go through set and remove, which keep keys in sync with the engine.
+// stored values are shared with the history and replies, never modify them.
+func (memoryKV *MemoryKV) set(key string, value []byte) {
+	memoryKV.keepBase(key)
+	if !memoryKV.Found(key) {
+		i := sort.SearchStrings(memoryKV.keys, key)
+		memoryKV.keys = append(memoryKV.keys, "")
+		copy(memoryKV.keys[i+1:], memoryKV.keys[i:])
+		memoryKV.keys[i] = key
+	}
+	memoryKV.engine.Apply(key, value, false)
+	memoryKV.Versions[key]++
+	for _, index := range memoryKV.indexes {
+		index.set(key, value)
 	}
+	memoryKV.record(key, value, false)
+	memoryKV.changed(key, value, false)
 }
-func (memoryKV *MemoryKV) GetKV() map[string]string {
-	return memoryKV.KV
+
+func (memoryKV *MemoryKV) remove(key string) {
+	i := sort.SearchStrings(memoryKV.keys, key)
+	if i == len(memoryKV.keys) || memoryKV.keys[i] != key {
+		return
+	}
+	memoryKV.keepBase(key)
+	memoryKV.keys = append(memoryKV.keys[:i], memoryKV.keys[i+1:]...)
+	memoryKV.engine.Apply(key, nil, true)
+	delete(memoryKV.Versions, key)
+	delete(memoryKV.Expiry, key)
+	delete(memoryKV.Leases, key)
+	for _, index := range memoryKV.indexes {
+		index.remove(key)
+	}
+	memoryKV.record(key, nil, true)
+	memoryKV.changed(key, nil, true)
 }
-func (memoryKV *MemoryKV) SetKV(newKV map[string]string) {
-	memoryKV.KV = newKV
+
+func (memoryKV *MemoryKV) changed(key string, value []byte, deleted bool) {
+	if memoryKV.onChange != nil {
+		memoryKV.onChange(key, value, deleted)
+	}
+	root := memoryKV
+	if memoryKV.parent != nil {
+		root = memoryKV.parent
+	}
+	if root.onWrite != nil {
+		root.onWrite(memoryKV.name, key, value, deleted)
+	}
 }
 func (memoryKV *MemoryKV) Found(key string) bool {
-	_, ok := memoryKV.KV[key]
+	_, ok := memoryKV.Versions[key]
 	return ok
 }
-func (memoryKV *MemoryKV) Get(key string) (string, Err) {
-	value, ok := memoryKV.KV[key]
+func (memoryKV *MemoryKV) Get(key string) ([]byte, Err) {
+	value, ok := memoryKV.engine.Read(key)
 	if ok {
 		return value, OK
 	}
-	return "", ErrNoKey
+	return nil, ErrNoKey
 }
-func (memoryKV *MemoryKV) Put(key, value string) Err {
-	memoryKV.KV[key] = value
+func (memoryKV *MemoryKV) Put(key string, value []byte) Err {
+	memoryKV.set(key, value)
 	return OK
 }
-func (memoryKV *MemoryKV) Append(key, value string) Err {
-	memoryKV.KV[key] += value
+func (memoryKV *MemoryKV) Append(key string, value []byte) Err {
+	current, _ := memoryKV.engine.Read(key)
+	appended := make([]byte, 0, len(current)+len(value))
+	memoryKV.set(key, append(append(appended, current...), value...))
 	return OK
 }
+func (memoryKV *MemoryKV) Delete(key string) Err {
+	if !memoryKV.Found(key) {
+		return ErrNoKey
+	}
+	memoryKV.remove(key)
+	return OK
+}
+
+// set key to value if it currently holds expected, a missing key holds an
+// empty value. returns the value found and whether it was replaced.
+func (memoryKV *MemoryKV) CompareAndSwap(key string, expected, value []byte) ([]byte, bool) {
+	current, _ := memoryKV.engine.Read(key)
+	if !bytes.Equal(current, expected) {
+		return current, false
+	}
+	memoryKV.set(key, value)
+	return current, true
+}
+
+// remove key if it exists and holds expected.
+// returns the value found and whether the key was removed.
+func (memoryKV *MemoryKV) CompareAndDelete(key string, expected []byte) ([]byte, bool) {
+	current, ok := memoryKV.engine.Read(key)
+	if !ok || !bytes.Equal(current, expected) {
+		return current, false
+	}
+	memoryKV.remove(key)
+	return current, true
+}
+
+// add delta to the decimal integer in key, a missing key counts as 0.
+// returns the new value, or ErrNotInteger leaving the key untouched.
+func (memoryKV *MemoryKV) Incr(key string, delta int64) ([]byte, Err) {
+	n := int64(0)
+	if current, ok := memoryKV.engine.Read(key); ok {
+		var err error
+		if n, err = strconv.ParseInt(string(current), 10, 64); err != nil {
+			return current, ErrNotInteger
+		}
+	}
+	value := []byte(strconv.FormatInt(n+delta, 10))
+	memoryKV.set(key, value)
+	return value, OK
+}
+
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// up to limit pairs with start <= key < end in key order, an empty end means
+// no upper bound and limit <= 0 no limit. next is the key to start the
+// following page at, "" once the range is exhausted.
+func (memoryKV *MemoryKV) Range(start, end string, limit int) (pairs []KeyValue, next string) {
+	pairs = make([]KeyValue, 0)
+	for i := sort.SearchStrings(memoryKV.keys, start); i < len(memoryKV.keys); i++ {
+		key := memoryKV.keys[i]
+		if end != "" && key >= end {
+			break
+		}
+		if limit > 0 && len(pairs) == limit {
+			return pairs, key
+		}
+		value, _ := memoryKV.engine.Read(key)
+		pairs = append(pairs, KeyValue{key, value})
+	}
+	return pairs, ""
+}
+
+// smallest key greater than every key starting with prefix, "" if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// hash of the whole key space, independent of map iteration order
+func (memoryKV *MemoryKV) Hash() uint64 {
+	h := fnv.New64a()
+	memoryKV.hashKeys(h)
+	for _, name := range memoryKV.bucketNames() {
+		fmt.Fprintf(h, "[%q]", name)
+		memoryKV.buckets[name].hashKeys(h)
+	}
+	return h.Sum64()
+}
+
+func (memoryKV *MemoryKV) hashKeys(w io.Writer) {
+	for _, key := range memoryKV.keys {
+		value, _ := memoryKV.engine.Read(key)
+		fmt.Fprintf(w, "%q=%q;", key, value)
+	}
+}
@@ -0,0 +1,56 @@
+package kvraft
+
+import (
+	"time"
+
+	"raft/metrics"
+)
+
+// names under which a server reports to its metrics sink. per op ones carry
+// the op as a label, e.g. kvraft_commands_total{op=Put}.
+const (
+	MetricCommands        = "kvraft_commands_total"
+	MetricCommandLatency  = "kvraft_command_latency_seconds"
+	MetricCommandErrors   = "kvraft_command_errors_total" // labelled by the error rather than the op
+	MetricCommandTimeouts = "kvraft_command_timeouts_total"
+	MetricApplyLag        = "kvraft_apply_lag_entries"    // committed entries not yet applied, seen at each apply
+	MetricApplyBatch      = "kvraft_apply_batch_messages" // raft messages applied under one lock acquisition
+	MetricSnapshots       = "kvraft_snapshots_total"
+	MetricSnapshotEntries = "kvraft_snapshot_interval_entries" // entries applied since the previous snapshot
+	MetricEvictions       = "kvraft_evicted_keys_total"        // in cache mode, see eviction.go
+)
+
+func labelled(name, label, value string) string {
+	return name + "{" + label + "=" + value + "}"
+}
+
+func (kv *KVServer) SetMetrics(sink metrics.Sink) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.metrics = sink
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) sink() metrics.Sink {
+	if kv.metrics == nil {
+		return metrics.Discard
+	}
+	return kv.metrics
+}
+
+// deferred by Command
+func (kv *KVServer) observeCommand(op string, start time.Time, reply *CommandReply) {
+	kv.mu.RLock()
+	sink := kv.sink()
+	kv.mu.RUnlock()
+	sink.IncCounter(labelled(MetricCommands, "op", op), 1)
+	sink.Observe(labelled(MetricCommandLatency, "op", op), time.Since(start).Seconds())
+	switch reply.Err {
+	case OK, ErrNoKey:
+	case ErrTimeout:
+		sink.IncCounter(MetricCommandTimeouts, 1)
+		fallthrough
+	default:
+		sink.IncCounter(labelled(MetricCommandErrors, "err", reply.Err.Error()), 1)
+	}
+}
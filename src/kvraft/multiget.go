@@ -0,0 +1,40 @@
+package kvraft
+
+// read several keys at once. unlike a Get per key, which may each see a
+// different write in between, they're all read as of the same index: the
+// MultiGet's own entry in the log, or with a Revision the state back then.
+const MultiGet = "MultiGet"
+
+// the keys of keys that exist, in order, with their values
+func multiGet(storage *MemoryKV, keys []string, revision int) []KeyValue {
+	pairs := make([]KeyValue, 0, len(keys))
+	for _, key := range keys {
+		var value []byte
+		var err Err
+		if revision == 0 {
+			value, err = storage.Get(key)
+		} else {
+			value, err = storage.GetAt(key, revision)
+		}
+		if err == OK {
+			pairs = append(pairs, KeyValue{Key: key, Value: value})
+		}
+	}
+	return pairs
+}
+
+// the values of the keys that exist and the revision they were read at
+func (ck *Clerk) MultiGet(keys ...string) (map[string][]byte, int) {
+	values, revision, _ := ck.MultiGetAt(0, keys...)
+	return values, revision
+}
+
+// MultiGet as of revision, 0 for the latest. errors as for GetAt.
+func (ck *Clerk) MultiGetAt(revision int, keys ...string) (map[string][]byte, int, Err) {
+	reply := ck.command(&CommandArgs{Op: MultiGet, Keys: keys, Revision: revision})
+	values := make(map[string][]byte, len(reply.Pairs))
+	for _, pair := range reply.Pairs {
+		values[pair.Key] = pair.Value
+	}
+	return values, reply.Revision, reply.Err
+}
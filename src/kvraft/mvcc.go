@@ -0,0 +1,159 @@
+package kvraft
+
+import "sort"
+
+// MemoryKV keeps every write to each key, not just the latest value, so that
+// past states of the key space can be read back. a write is stamped with the
+// store's revision, which is the log index of the entry making it: it only
+// grows, and replicas agree on it. the engine, Versions and the sorted keys
+// are the view at the latest revision, kept for fast reads.
+//
+// the history starts at the oldest revision and only holds the keys written
+// since, the others still have the value they had then. the first write to a
+// key also keeps what it held at the oldest revision.
+//
+// the history is not part of snapshots, which would otherwise grow with every
+// write: a replica that loads one starts its history over from that point.
+// reads at a revision before that fail with ErrCompacted, other replicas may
+// still reach back further.
+
+type KeyRevision struct {
+	Revision int
+	Value    []byte
+	Version  int64 // of the key after this write, 0 for a delete
+	Deleted  bool
+}
+
+// writes from now on happen at revision, called before applying each entry
+func (memoryKV *MemoryKV) Begin(revision int) {
+	memoryKV.current = revision
+	for _, bucket := range memoryKV.buckets {
+		bucket.current = revision
+	}
+}
+
+// revision of the latest write
+func (memoryKV *MemoryKV) Revision() int {
+	return memoryKV.revision
+}
+
+func (memoryKV *MemoryKV) record(key string, value []byte, deleted bool) {
+	change := KeyRevision{Revision: memoryKV.current, Value: value, Version: memoryKV.Versions[key], Deleted: deleted}
+	history := memoryKV.History[key]
+	if n := len(history); n > 0 && history[n-1].Revision == change.Revision {
+		// written again by the same entry, e.g. in a transaction
+		history[n-1] = change
+	} else {
+		memoryKV.History[key] = append(history, change)
+	}
+	memoryKV.revision = memoryKV.current
+	if memoryKV.parent != nil {
+		memoryKV.parent.revision = memoryKV.current
+	}
+}
+
+// before key is first written since the oldest revision, remember what it
+// held then. the caller is about to change it.
+func (memoryKV *MemoryKV) keepBase(key string) {
+	if len(memoryKV.History[key]) > 0 {
+		return
+	}
+	if value, ok := memoryKV.engine.Read(key); ok {
+		memoryKV.History[key] = []KeyRevision{{Revision: memoryKV.oldest, Value: value, Version: memoryKV.Versions[key]}}
+	}
+}
+
+// start the history over after loading a snapshot taken at revision
+func (memoryKV *MemoryKV) ResetHistory(revision int) {
+	memoryKV.revision, memoryKV.current = revision, revision
+	memoryKV.oldest = revision
+	memoryKV.History = make(map[string][]KeyRevision)
+	for _, bucket := range memoryKV.buckets {
+		bucket.ResetHistory(revision)
+	}
+}
+
+// earliest revision the history can be read at
+func (memoryKV *MemoryKV) Oldest() int {
+	return memoryKV.oldest
+}
+
+// the write to key in effect at revision, if the key existed then
+func (memoryKV *MemoryKV) at(key string, revision int) (KeyRevision, bool) {
+	history, ok := memoryKV.History[key]
+	if !ok {
+		// not written since the oldest revision
+		value, ok := memoryKV.engine.Read(key)
+		return KeyRevision{Revision: memoryKV.oldest, Value: value, Version: memoryKV.Versions[key]}, ok
+	}
+	i := sort.Search(len(history), func(i int) bool { return history[i].Revision > revision })
+	if i == 0 || history[i-1].Deleted {
+		return KeyRevision{}, false
+	}
+	return history[i-1], true
+}
+
+// value of key as of revision, which the caller checked is within the history
+func (memoryKV *MemoryKV) GetAt(key string, revision int) ([]byte, Err) {
+	if change, ok := memoryKV.at(key, revision); ok {
+		return change.Value, OK
+	}
+	return nil, ErrNoKey
+}
+
+// Range as of revision. keys only deleted since aren't in the sorted keys,
+// so this also goes through every key with a history.
+func (memoryKV *MemoryKV) RangeAt(start, end string, limit int, revision int) (pairs []KeyValue, next string) {
+	keys := make([]string, 0)
+	for key := range memoryKV.History {
+		if key >= start && (end == "" || key < end) && !memoryKV.Found(key) {
+			keys = append(keys, key)
+		}
+	}
+	for i := sort.SearchStrings(memoryKV.keys, start); i < len(memoryKV.keys); i++ {
+		if end != "" && memoryKV.keys[i] >= end {
+			break
+		}
+		keys = append(keys, memoryKV.keys[i])
+	}
+	sort.Strings(keys)
+	pairs = make([]KeyValue, 0)
+	for _, key := range keys {
+		change, ok := memoryKV.at(key, revision)
+		if !ok {
+			continue
+		}
+		if limit > 0 && len(pairs) == limit {
+			return pairs, key
+		}
+		pairs = append(pairs, KeyValue{key, change.Value})
+	}
+	return pairs, ""
+}
+
+// drop the writes no read at revision or later can see, which makes revision
+// the oldest one the history can be read at
+func (memoryKV *MemoryKV) Compact(revision int) {
+	for _, bucket := range memoryKV.buckets {
+		bucket.Compact(revision)
+	}
+	if revision <= memoryKV.oldest {
+		return
+	}
+	for key, history := range memoryKV.History {
+		i := sort.Search(len(history), func(i int) bool { return history[i].Revision > revision })
+		if i == len(history) {
+			// not written since, the current value is the one at revision
+			delete(memoryKV.History, key)
+			continue
+		}
+		if i > 0 && !history[i-1].Deleted {
+			// still the value at revision
+			i--
+		}
+		if i > 0 {
+			memoryKV.History[key] = append([]KeyRevision(nil), history[i:]...)
+		}
+	}
+	memoryKV.oldest = revision
+}
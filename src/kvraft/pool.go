@@ -0,0 +1,86 @@
+package kvraft
+
+import (
+	"context"
+
+	"raft/transport"
+)
+
+// a Clerk has one command in flight at a time and isn't safe to share, and
+// a clerk per goroutine leaves servers with a duplicate table entry for
+// every one of them. a Pool is safe for concurrent use: each command borrows
+// one of a fixed set of clerks over the same ends, so a process has no more
+// client ids than the pool has clerks, and commands wait for a free one when
+// all are busy.
+
+const defaultPoolSize = 8
+
+type Pool struct {
+	clerks chan *Clerk
+	size   int
+}
+
+// size <= 0 means defaultPoolSize
+func MakePool(servers []transport.Endpoint, size int) *Pool {
+	if size <= 0 {
+		size = defaultPoolSize
+	}
+	p := &Pool{clerks: make(chan *Clerk, size), size: size}
+	for i := 0; i < size; i++ {
+		p.clerks <- MakeClerk(servers)
+	}
+	return p
+}
+
+// call fn on every clerk of the pool once none is in use, e.g. to set the
+// timeout or metrics sink of them all
+func (p *Pool) Configure(fn func(ck *Clerk)) {
+	clerks := make([]*Clerk, p.size)
+	for i := range clerks {
+		clerks[i] = <-p.clerks
+	}
+	for _, ck := range clerks {
+		fn(ck)
+		p.clerks <- ck
+	}
+}
+
+// call fn with a clerk of its own until it returns, waiting for one to be
+// free if need be
+func (p *Pool) With(fn func(ck *Clerk)) {
+	ck := <-p.clerks
+	defer func() { p.clerks <- ck }()
+	fn(ck)
+}
+
+// like Clerk.CommandContext, ctx also bounds the wait for a free clerk
+func (p *Pool) CommandContext(ctx context.Context, args *CommandArgs) *CommandReply {
+	var ck *Clerk
+	select {
+	case ck = <-p.clerks:
+	case <-ctx.Done():
+		return &CommandReply{Err: ErrTimeout}
+	}
+	defer func() { p.clerks <- ck }()
+	return ck.CommandContext(ctx, args)
+}
+
+func (p *Pool) command(args *CommandArgs) *CommandReply {
+	return p.CommandContext(context.Background(), args)
+}
+
+func (p *Pool) Get(key string) string {
+	return string(p.command(&CommandArgs{Key: key, Op: Gett}).Value)
+}
+
+func (p *Pool) Put(key string, value string) {
+	p.command(&CommandArgs{Key: key, Value: []byte(value), Op: Putt})
+}
+
+func (p *Pool) Append(key string, value string) {
+	p.command(&CommandArgs{Key: key, Value: []byte(value), Op: Appendd})
+}
+
+func (p *Pool) Delete(key string) bool {
+	return p.command(&CommandArgs{Key: key, Op: Deletee}).Err == OK
+}
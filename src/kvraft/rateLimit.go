@@ -0,0 +1,69 @@
+package kvraft
+
+import "time"
+
+// a token bucket per client, so that one client sending as fast as it can
+// doesn't crowd everyone else out of the log. each client gets rate commands
+// a second and may save up to burst of them. it's local to the server, and
+// only the leader's matters since only commands that are about to be
+// proposed take a token; retries of applied commands, stale reads and
+// rejected requests don't. with a real transport this could key on the
+// source address as well.
+type rateLimiter struct {
+	rate      float64 // tokens a second, 0 for no limit
+	burst     float64
+	buckets   map[int64]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when tokens was last brought up to date
+}
+
+// full buckets are forgotten at most this often
+const rateSweepInterval = time.Second
+
+// 0 for no limit, the default
+func (kv *KVServer) SetRateLimit(rate float64, burst int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.limiter.rate, kv.limiter.burst = rate, float64(burst)
+	kv.limiter.buckets = make(map[int64]*tokenBucket)
+}
+
+// take one of client's tokens, or say how long until there is one.
+// caller must hold kv.mu.
+func (limiter *rateLimiter) take(client int64, now time.Time) (bool, time.Duration) {
+	if limiter.rate == 0 {
+		return true, 0
+	}
+	if now.Sub(limiter.lastSweep) > rateSweepInterval {
+		limiter.sweep(now)
+	}
+	bucket, ok := limiter.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: limiter.burst, last: now}
+		limiter.buckets[client] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * limiter.rate
+	if bucket.tokens > limiter.burst {
+		bucket.tokens = limiter.burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// drop the buckets that have filled up again, a new one starts full anyway
+func (limiter *rateLimiter) sweep(now time.Time) {
+	for client, bucket := range limiter.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.rate >= limiter.burst {
+			delete(limiter.buckets, client)
+		}
+	}
+	limiter.lastSweep = now
+}
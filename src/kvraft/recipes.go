@@ -0,0 +1,151 @@
+package kvraft
+
+import (
+	"sync"
+	"time"
+)
+
+// ready-made coordination recipes on top of leases, locks and plain keys,
+// so applications don't each write their own keep-alive loops and fencing.
+// a Session keeps a lease alive in the background, and Mutexes and
+// sequential keys hold on to it; a Barrier is a key that blocks waiters
+// while it exists.
+
+// how often a barrier's waiters check whether it's gone
+const barrierPollInterval = 50 * time.Millisecond
+
+// a lease kept alive until Close, or until a keep-alive finds it expired,
+// e.g. after the client was cut off for longer than its TTL. the keep-alives
+// go out through a clerk of the session's own, so the clerk that made it is
+// free for other commands meanwhile.
+type Session struct {
+	Lease int64
+	ck    *Clerk
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// a session whose lease expires ttl after the client stops renewing it.
+// the lease is renewed every third of ttl.
+func (ck *Clerk) NewSession(ttl time.Duration) *Session {
+	keeper := MakeClerk(ck.servers)
+	keeper.leaderId, keeper.timeout, keeper.authToken = ck.leaderId, ck.timeout, ck.authToken
+	s := &Session{Lease: keeper.GrantLease(ttl), ck: keeper, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.keepAlive(ttl / 3)
+	return s
+}
+
+func (s *Session) keepAlive(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !s.ck.KeepAlive(s.Lease) {
+				return
+			}
+		case <-s.stop:
+			s.ck.RevokeLease(s.Lease)
+			return
+		}
+	}
+}
+
+// closed once the lease is gone, and with it whatever was held through it
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// revoke the lease, releasing every lock and deleting every key held
+// through it
+func (s *Session) Close() {
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// a lock held through a session, see lock.go. Token is the fencing token of
+// the current hold, to pass along to whatever the lock protects.
+type Mutex struct {
+	ck      *Clerk
+	session *Session
+	Name    string
+	Token   int64
+}
+
+func (ck *Clerk) NewMutex(session *Session, name string) *Mutex {
+	return &Mutex{ck: ck, session: session, Name: name}
+}
+
+// wait for the lock and take it, false if the session ended first
+func (m *Mutex) Lock() bool {
+	token, ok := m.ck.Lock(m.Name, m.session.Lease)
+	if ok {
+		m.Token = token
+	}
+	return ok
+}
+
+// take the lock if it's free, ErrLocked if someone else holds it
+func (m *Mutex) TryLock() Err {
+	token, err := m.ck.TryLock(m.Name, m.session.Lease)
+	if err == OK {
+		m.Token = token
+	}
+	return err
+}
+
+// release the lock, false if this hold was lost meanwhile
+func (m *Mutex) Unlock() bool {
+	ok := m.ck.Unlock(m.Name, m.Token)
+	m.Token = 0
+	return ok
+}
+
+// waiters block while the barrier's key exists
+type Barrier struct {
+	ck  *Clerk
+	Key string
+}
+
+func (ck *Clerk) NewBarrier(key string) *Barrier {
+	return &Barrier{ck: ck, Key: key}
+}
+
+// raise the barrier, held through session if it isn't nil, so that it
+// falls if the holder goes away
+func (b *Barrier) Hold(session *Session) bool {
+	if session == nil {
+		b.ck.Put(b.Key, "")
+		return true
+	}
+	return b.ck.PutWithLease(b.Key, nil, session.Lease)
+}
+
+func (b *Barrier) Release() {
+	b.ck.Delete(b.Key)
+}
+
+// block until the barrier is down
+func (b *Barrier) Wait() {
+	for b.ck.command(&CommandArgs{Key: b.Key, Op: Gett}).Err != ErrNoKey {
+		time.Sleep(barrierPollInterval)
+	}
+}
+
+// put value under a new key prefix/<n>, n from a counter kept beside the
+// prefix, so keys sort in the order they were created; held through
+// session if it isn't nil. returns the key, "" if the session is gone.
+func (ck *Clerk) PutSequential(prefix string, value []byte, session *Session) string {
+	n, _ := ck.Incr(prefix+".seq", 1)
+	key := candidateKey(prefix, int(n))
+	lease := int64(0)
+	if session != nil {
+		lease = session.Lease
+	}
+	if !ck.PutWithLease(key, value, lease) {
+		return ""
+	}
+	return key
+}
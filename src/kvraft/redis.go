@@ -0,0 +1,319 @@
+package kvraft
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a listener speaking enough of the Redis protocol (RESP) for Redis client
+// libraries to use the store: GET, SET (with EX or PX), APPEND, DEL, INCR,
+// EXPIRE, SCAN (with MATCH and COUNT) and PING. like the Gateway, it's a
+// client sending everything through the clerk it's given, so every command
+// is linearizable, unlike a Redis replica's.
+//
+// SCAN's cursor is opaque to clients anyway: here it's the key the scan
+// resumes at, hex encoded so that it's never "0".
+type RedisFrontend struct {
+	mu sync.Mutex // a clerk sends one command at a time
+	ck *Clerk
+}
+
+const (
+	redisMaxArgs  = 1024
+	redisMaxBulk  = 64 << 20
+	redisScanSize = 10 // SCAN's default COUNT
+)
+
+var errRedisProtocol = errors.New("protocol error")
+
+func NewRedisFrontend(ck *Clerk) *RedisFrontend {
+	return &RedisFrontend{ck: ck}
+}
+
+// serve connections from l until it's closed
+func (f *RedisFrontend) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go f.serveConn(conn)
+	}
+}
+
+func (f *RedisFrontend) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		args, err := readRedisCommand(r)
+		if err == errRedisProtocol {
+			writeRedisError(w, "ERR Protocol error")
+			w.Flush()
+			return
+		} else if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := strings.ToUpper(string(args[0])) == "QUIT"
+		if quit {
+			w.WriteString("+OK\r\n")
+		} else {
+			f.execute(w, args)
+		}
+		// answers to pipelined commands go out together
+		if r.Buffered() == 0 || quit {
+			if w.Flush() != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// a command as an array of bulk strings, or inline as words on a line
+func readRedisCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		var args [][]byte
+		for _, word := range strings.Fields(line) {
+			args = append(args, []byte(word))
+		}
+		return args, nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > redisMaxArgs {
+		return nil, errRedisProtocol
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readRedisLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRedisProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > redisMaxBulk {
+			return nil, errRedisProtocol
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, errRedisProtocol
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+func readRedisLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+func writeRedisError(w *bufio.Writer, message string) {
+	w.WriteString("-" + message + "\r\n")
+}
+
+func writeRedisInt(w *bufio.Writer, n int64) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+// nil is the null bulk string, Redis' missing key
+func writeRedisBulk(w *bufio.Writer, value []byte) {
+	if value == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	fmt.Fprintf(w, "$%d\r\n", len(value))
+	w.Write(value)
+	w.WriteString("\r\n")
+}
+
+func redisErr(err Err) string {
+	if err == ErrNotInteger {
+		return "ERR value is not an integer or out of range"
+	}
+	return "ERR " + err.Error()
+}
+
+func (f *RedisFrontend) command(args *CommandArgs) *CommandReply {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ck.command(args)
+}
+
+func (f *RedisFrontend) execute(w *bufio.Writer, args [][]byte) {
+	name := strings.ToUpper(string(args[0]))
+	arity := map[string]int{"PING": -1, "GET": 2, "SET": -3, "APPEND": 3, "DEL": -2, "INCR": 2, "EXPIRE": 3, "SCAN": -2}
+	n, ok := arity[name]
+	if !ok {
+		writeRedisError(w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	// negative for at least -n
+	if (n > 0 && len(args) != n) || (n < 0 && len(args) < -n) {
+		writeRedisError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			writeRedisBulk(w, args[1])
+		} else {
+			w.WriteString("+PONG\r\n")
+		}
+	case "GET":
+		reply := f.command(&CommandArgs{Op: Gett, Key: string(args[1])})
+		switch reply.Err {
+		case OK:
+			writeRedisBulk(w, reply.Value)
+		case ErrNoKey:
+			writeRedisBulk(w, nil)
+		default:
+			writeRedisError(w, redisErr(reply.Err))
+		}
+	case "SET":
+		command := &CommandArgs{Op: Putt, Key: string(args[1]), Value: args[2]}
+		for i := 3; i < len(args); i += 2 {
+			option := strings.ToUpper(string(args[i]))
+			if i+1 == len(args) || (option != "EX" && option != "PX") {
+				writeRedisError(w, "ERR syntax error")
+				return
+			}
+			ttl, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || ttl <= 0 {
+				writeRedisError(w, "ERR invalid expire time in 'set' command")
+				return
+			}
+			if option == "EX" {
+				command.TTL = time.Duration(ttl) * time.Second
+			} else {
+				command.TTL = time.Duration(ttl) * time.Millisecond
+			}
+		}
+		if reply := f.command(command); reply.Err != OK {
+			writeRedisError(w, redisErr(reply.Err))
+			return
+		}
+		w.WriteString("+OK\r\n")
+	case "APPEND":
+		reply := f.command(&CommandArgs{Op: Appendd, Key: string(args[1]), Value: args[2]})
+		if reply.Err != OK {
+			writeRedisError(w, redisErr(reply.Err))
+			return
+		}
+		writeRedisInt(w, int64(len(reply.Value)))
+	case "DEL":
+		deleted := int64(0)
+		for _, key := range args[1:] {
+			switch reply := f.command(&CommandArgs{Op: Deletee, Key: string(key)}); reply.Err {
+			case OK:
+				deleted++
+			case ErrNoKey:
+			default:
+				writeRedisError(w, redisErr(reply.Err))
+				return
+			}
+		}
+		writeRedisInt(w, deleted)
+	case "INCR":
+		reply := f.command(&CommandArgs{Op: Incr, Key: string(args[1]), Delta: 1})
+		if reply.Err != OK {
+			writeRedisError(w, redisErr(reply.Err))
+			return
+		}
+		n, _ := strconv.ParseInt(string(reply.Value), 10, 64)
+		writeRedisInt(w, n)
+	case "EXPIRE":
+		seconds, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			writeRedisError(w, redisErr(ErrNotInteger))
+			return
+		}
+		command := &CommandArgs{Op: SetTTL, Key: string(args[1]), TTL: time.Duration(seconds) * time.Second}
+		if seconds <= 0 {
+			// already expired
+			command = &CommandArgs{Op: Deletee, Key: string(args[1])}
+		}
+		switch reply := f.command(command); reply.Err {
+		case OK:
+			writeRedisInt(w, 1)
+		case ErrNoKey:
+			writeRedisInt(w, 0)
+		default:
+			writeRedisError(w, redisErr(reply.Err))
+		}
+	case "SCAN":
+		f.scan(w, args)
+	}
+}
+
+func (f *RedisFrontend) scan(w *bufio.Writer, args [][]byte) {
+	token := ""
+	if cursor := string(args[1]); cursor != "0" {
+		start, err := hex.DecodeString(cursor)
+		if err != nil || len(start) == 0 {
+			writeRedisError(w, "ERR invalid cursor")
+			return
+		}
+		token = string(start)
+	}
+	match, count := "", redisScanSize
+	for i := 2; i < len(args); i += 2 {
+		option := strings.ToUpper(string(args[i]))
+		if i+1 == len(args) || (option != "MATCH" && option != "COUNT") {
+			writeRedisError(w, "ERR syntax error")
+			return
+		}
+		if option == "MATCH" {
+			match = string(args[i+1])
+		} else if n, err := strconv.Atoi(string(args[i+1])); err != nil || n <= 0 {
+			writeRedisError(w, "ERR syntax error")
+			return
+		} else {
+			count = n
+		}
+	}
+	reply := f.command(&CommandArgs{Op: Range, Limit: count, Token: token})
+	if reply.Err != OK {
+		writeRedisError(w, redisErr(reply.Err))
+		return
+	}
+	// like Redis, MATCH filters the page, so it may come back short or empty
+	keys := make([]string, 0, len(reply.Pairs))
+	for _, pair := range reply.Pairs {
+		if matched, _ := path.Match(match, pair.Key); match == "" || matched {
+			keys = append(keys, pair.Key)
+		}
+	}
+	next := "0"
+	if reply.Next != "" {
+		next = hex.EncodeToString([]byte(reply.Next))
+	}
+	w.WriteString("*2\r\n")
+	writeRedisBulk(w, []byte(next))
+	fmt.Fprintf(w, "*%d\r\n", len(keys))
+	for _, key := range keys {
+		writeRedisBulk(w, []byte(key))
+	}
+}
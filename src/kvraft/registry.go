@@ -0,0 +1,318 @@
+package kvraft
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// every op is dispatched through a handler registered under its name: what
+// the server a command arrives at fills in before proposing it, and how
+// each replica applies it. the built in ops are registered below, and
+// applications can add their own with Register, e.g. a queue or a set kept
+// in the store, without touching the apply loop.
+type handler struct {
+	// on the server the command arrives at, before proposing it, with kv.mu
+	// held. may be nil.
+	prepare func(kv *KVServer, args *CommandArgs, op *Op) Err
+	// on every replica in log order, with kv.mu held. storage is op.Bucket's
+	// for ops in buckets, the default one's otherwise.
+	apply func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult
+
+	inBucket bool
+	// read only and possibly large, so not remembered for duplicates: a
+	// retry simply reads again
+	scan bool
+	// proposed by the leader itself, not by clients, and applied without
+	// any of the client bookkeeping
+	internal bool
+	custom   bool // added through Register
+}
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = make(map[string]*handler)
+)
+
+func register(name string, h *handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	if _, ok := handlers[name]; ok {
+		log.Fatalf("op %v registered twice", name)
+	}
+	handlers[name] = h
+}
+
+// nil for an op nobody registered
+func lookup(name string) *handler {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	return handlers[name]
+}
+
+// applies a custom op to store, the bucket the command names. it runs on
+// every replica, in log order and with the server's lock held, so it must
+// be deterministic and must not change anything but store. what it returns
+// is the reply's Value and Err.
+type ApplyFunc func(store *MemoryKV, op Op, index int) ([]byte, Err)
+
+// fills in a custom op from the command's args on the server it arrives at,
+// before it's proposed, e.g. with a deadline every replica has to agree on.
+// Key, Value, Bucket and the client's ids are copied already. anything but
+// OK refuses the command with that Err.
+type EncodeFunc func(args *CommandArgs, op *Op) Err
+
+// add the op name, through which clients run apply with Clerk.Do. register
+// before starting any server, so that each knows the op by the time its
+// entries are applied. encode may be nil.
+func Register(name string, apply ApplyFunc, encode EncodeFunc) {
+	h := &handler{inBucket: true, custom: true}
+	h.apply = func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := opResult{Index: index}
+		result.Value, result.Err = apply(storage, op, index)
+		return result
+	}
+	if encode != nil {
+		h.prepare = func(kv *KVServer, args *CommandArgs, op *Op) Err {
+			return encode(args, op)
+		}
+	}
+	register(name, h)
+}
+
+// run the registered op on key in the default bucket
+func (ck *Clerk) Do(op string, key string, value []byte) ([]byte, Err) {
+	reply := ck.command(&CommandArgs{Key: key, Value: value, Op: op})
+	return reply.Value, reply.Err
+}
+
+func okAt(index int) opResult {
+	return opResult{Err: OK, Index: index}
+}
+
+func init() {
+	register(Gett, &handler{inBucket: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		result.Value, result.Err = storage.Get(op.Key)
+		return result
+	}})
+	register(Putt, &handler{
+		inBucket: true,
+		prepare: func(kv *KVServer, args *CommandArgs, op *Op) Err {
+			if args.Bucket != "" && (args.TTL > 0 || args.Lease != 0) {
+				// only the default bucket's keys expire, see bucket.go
+				return ErrNotInBucket
+			}
+			if args.TTL > 0 {
+				// the deadline is fixed here, replicas must not use their own clocks
+				op.ExpireAt = time.Now().Add(args.TTL).UnixNano()
+			}
+			return OK
+		},
+		apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+			result := okAt(index)
+			if op.Lease != 0 && kv.leases[op.Lease] == nil {
+				result.Err = ErrNoLease
+				return result
+			}
+			storage.Put(op.Key, op.Value)
+			if storage == kv.storage {
+				kv.storage.SetExpiry(op.Key, op.ExpireAt)
+				kv.storage.SetLease(op.Key, op.Lease)
+			}
+			result.Value = op.Value
+			return result
+		},
+	})
+	register(SetTTL, &handler{
+		prepare: func(kv *KVServer, args *CommandArgs, op *Op) Err {
+			if args.TTL > 0 {
+				op.ExpireAt = time.Now().Add(args.TTL).UnixNano()
+			}
+			return OK
+		},
+		apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+			return kv.applySetTTL(op, index)
+		},
+	})
+	register(Appendd, &handler{inBucket: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		storage.Append(op.Key, op.Value)
+		result.Value, _ = storage.Get(op.Key)
+		return result
+	}})
+	register(Deletee, &handler{inBucket: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		result.Err = storage.Delete(op.Key)
+		return result
+	}})
+	register(CompareAndSwap, &handler{inBucket: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		result.Value, result.Swapped = storage.CompareAndSwap(op.Key, op.Expected, op.Value)
+		return result
+	}})
+	register(CompareAndDelete, &handler{inBucket: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		result.Value, result.Swapped = storage.CompareAndDelete(op.Key, op.Expected)
+		return result
+	}})
+	register(Incr, &handler{inBucket: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		result.Value, result.Err = storage.Incr(op.Key, op.Delta)
+		return result
+	}})
+
+	resume := func(kv *KVServer, args *CommandArgs, op *Op) Err {
+		if args.Token != "" {
+			op.Key = args.Token
+		}
+		return OK
+	}
+	register(Range, &handler{inBucket: true, scan: true, prepare: resume, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		result.Pairs, result.Next = storage.Range(op.Key, op.EndKey, op.Limit)
+		return result
+	}})
+	register(GetByPrefix, &handler{inBucket: true, scan: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		result.Pairs, result.Next = storage.Range(op.Key, prefixEnd(op.Key), op.Limit)
+		return result
+	}})
+	register(MultiGet, &handler{inBucket: true, scan: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		result.Pairs = multiGet(storage, op.Keys, 0)
+		return result
+	}})
+	register(OpenCursor, &handler{scan: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		result.Cursor = kv.openCursor(op, index)
+		return result
+	}})
+	register(QueryIndex, &handler{scan: true, prepare: resume, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		result.Pairs, result.Next, result.Err = kv.storage.QueryIndex(op.Index, string(op.Value), op.Key, op.Limit)
+		return result
+	}})
+
+	register(Txn, &handler{
+		prepare: func(kv *KVServer, args *CommandArgs, op *Op) Err {
+			if op.Txn == nil {
+				return ErrNoTxn
+			}
+			return OK
+		},
+		apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+			result := okAt(index)
+			result.Txn = kv.applyTxn(op.Txn)
+			return result
+		},
+	})
+	register(Eval, &handler{
+		inBucket: true,
+		prepare: func(kv *KVServer, args *CommandArgs, op *Op) Err {
+			// replicas may be set up with different limits
+			op.MaxValue = kv.maxValueSize
+			return OK
+		},
+		apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+			return kv.applyScript(storage, op.Script, op.MaxValue, index)
+		},
+	})
+
+	lease := func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		return kv.applyLease(op, index)
+	}
+	register(LeaseGrant, &handler{
+		prepare: func(kv *KVServer, args *CommandArgs, op *Op) Err {
+			op.TTL, op.ExpireAt = args.TTL, time.Now().Add(args.TTL).UnixNano()
+			return OK
+		},
+		apply: lease,
+	})
+	register(LeaseKeepAlive, &handler{
+		prepare: func(kv *KVServer, args *CommandArgs, op *Op) Err {
+			// the lease's TTL is added on apply: a new leader may not have
+			// applied the grant yet
+			op.ExpireAt = time.Now().UnixNano()
+			return OK
+		},
+		apply: lease,
+	})
+	register(LeaseRevoke, &handler{apply: lease})
+	lock := func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		return kv.applyLock(op, index)
+	}
+	register(LockAcquire, &handler{apply: lock})
+	register(LockRelease, &handler{apply: lock})
+	election := func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		return kv.applyElection(op, index)
+	}
+	register(ElectionCampaign, &handler{apply: election})
+	register(ElectionProclaim, &handler{apply: election})
+
+	register(Compact, &handler{apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		result.Err = kv.applyCompact(op, index)
+		return result
+	}})
+	register(CreateBucket, &handler{apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		if result.Err = kv.storage.CreateBucket(op.Bucket); result.Err == OK {
+			kv.recordChange(op.Bucket, "", nil, false)
+		}
+		return result
+	}})
+	register(DeleteBucket, &handler{apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		result := okAt(index)
+		if result.Err = kv.storage.DeleteBucket(op.Bucket); result.Err == OK {
+			kv.recordChange(op.Bucket, "", nil, true)
+		}
+		return result
+	}})
+
+	auth := func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		return kv.applyAuth(op, index)
+	}
+	for _, name := range []string{AuthEnable, AuthDisable, AuthSetUser, AuthDeleteUser, AuthSetRole, AuthDeleteRole} {
+		register(name, &handler{prepare: prepareAuth, apply: auth})
+	}
+
+	register(JoinTokenIssue, &handler{prepare: prepareJoinToken, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		return kv.applyJoinTokenIssue(op, index)
+	}})
+
+	// the leader's own
+	register(StateCheck, &handler{internal: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		kv.applyStateCheck(op, index)
+		return opResult{}
+	}})
+	register(Expire, &handler{internal: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		kv.applyExpire(op)
+		return opResult{}
+	}})
+	register(LeaseExpire, &handler{internal: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		kv.applyLeaseExpire(op)
+		return opResult{}
+	}})
+	register(SessionExpire, &handler{internal: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		kv.applySessionExpire(op)
+		return opResult{}
+	}})
+	register(Evict, &handler{internal: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		kv.applyEvict(op)
+		return opResult{}
+	}})
+	alarm := func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		kv.applyAlarm(op)
+		return opResult{}
+	}
+	register(AlarmRaise, &handler{internal: true, apply: alarm})
+	register(AlarmClear, &handler{internal: true, apply: alarm})
+	register(JoinCluster, &handler{internal: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		return kv.applyJoinCluster(op, index)
+	}})
+	register(ConfigInit, &handler{internal: true, apply: func(kv *KVServer, storage *MemoryKV, op Op, index int) opResult {
+		kv.applyConfigInit(op)
+		return opResult{}
+	}})
+}
@@ -0,0 +1,121 @@
+package kvraft
+
+import (
+	"container/list"
+	"sync"
+)
+
+// an LRU of values read from or written to disk engines, bounded by the bytes
+// of keys and values it holds. one cache can be shared by every engine of a
+// server so the hot keys stay in memory whichever bucket they're in.
+//
+// stale reads call Read under the server's read lock, so the cache has a lock
+// of its own. a nil *RowCache caches nothing.
+type RowCache struct {
+	mu       sync.Mutex
+	capacity int
+	size     int
+	order    *list.List // of *cachedRow, most recently used first
+	rows     map[*diskEngine]map[string]*list.Element
+	hits     int64
+	misses   int64
+}
+
+type cachedRow struct {
+	engine *diskEngine
+	key    string
+	value  []byte
+}
+
+func NewRowCache(capacity int) *RowCache {
+	return &RowCache{
+		capacity: capacity,
+		order:    list.New(),
+		rows:     make(map[*diskEngine]map[string]*list.Element),
+	}
+}
+
+func (cache *RowCache) get(engine *diskEngine, key string) ([]byte, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.rows[engine][key]
+	if !ok {
+		cache.misses++
+		return nil, false
+	}
+	cache.hits++
+	cache.order.MoveToFront(element)
+	return element.Value.(*cachedRow).value, true
+}
+
+// values are shared with the store, which never modifies them
+func (cache *RowCache) add(engine *diskEngine, key string, value []byte) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.removeLocked(engine, key)
+	if len(key)+len(value) > cache.capacity {
+		return
+	}
+	if cache.rows[engine] == nil {
+		cache.rows[engine] = make(map[string]*list.Element)
+	}
+	cache.rows[engine][key] = cache.order.PushFront(&cachedRow{engine, key, value})
+	cache.size += len(key) + len(value)
+	for cache.size > cache.capacity {
+		row := cache.order.Back().Value.(*cachedRow)
+		cache.removeLocked(row.engine, row.key)
+	}
+}
+
+func (cache *RowCache) remove(engine *diskEngine, key string) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.removeLocked(engine, key)
+}
+
+func (cache *RowCache) removeLocked(engine *diskEngine, key string) {
+	element, ok := cache.rows[engine][key]
+	if !ok {
+		return
+	}
+	row := cache.order.Remove(element).(*cachedRow)
+	cache.size -= len(row.key) + len(row.value)
+	delete(cache.rows[engine], key)
+	if len(cache.rows[engine]) == 0 {
+		delete(cache.rows, engine)
+	}
+}
+
+// forget every value of engine, when it's reset or closed
+func (cache *RowCache) drop(engine *diskEngine) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for key := range cache.rows[engine] {
+		cache.removeLocked(engine, key)
+	}
+}
+
+type RowCacheStats struct {
+	Bytes  int // of keys and values cached
+	Rows   int
+	Hits   int64
+	Misses int64
+}
+
+func (cache *RowCache) Stats() RowCacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return RowCacheStats{cache.size, cache.order.Len(), cache.hits, cache.misses}
+}
@@ -1,20 +1,81 @@
 package kvraft
 
+import (
+	"strings"
+	"time"
+
+	"raft/raft"
+)
+
 const (
-	OK             = "OK"
-	ErrNoKey       = "ErrNoKey"
-	ErrWrongLeader = "ErrWrongLeader"
-	ErrTimeout     = " ErrTimeout"
+	OK             Err = "OK"
+	ErrNoKey       Err = "ErrNoKey"
+	ErrWrongLeader Err = "ErrWrongLeader"
+	ErrTimeout     Err = " ErrTimeout"
+	ErrBusy        Err = "ErrBusy"  // leader is alive but can't take writes right now
+	ErrStale       Err = "ErrStale" // replica is behind what the client has already seen
+	ErrNotInteger  Err = "ErrNotInteger"
+	ErrNoCursor    Err = "ErrNoCursor"
+	ErrNoWatch     Err = "ErrNoWatch"
+	ErrCompacted   Err = "ErrCompacted"
+	ErrNoLease     Err = "ErrNoLease"
+	// read at a revision later than the point the read was applied at
+	ErrFutureRevision Err = "ErrFutureRevision"
+	ErrNoBucket       Err = "ErrNoBucket"
+	ErrBucketExists   Err = "ErrBucketExists"
+	ErrNoIndex        Err = "ErrNoIndex"
+	ErrNoSpace        Err = "ErrNoSpace" // the store is over its quota, see alarm.go
+	ErrKeyTooLarge    Err = "ErrKeyTooLarge"
+	ErrValueTooLarge  Err = "ErrValueTooLarge"
+	ErrRateLimited    Err = "ErrRateLimited" // the client sends faster than the leader allows, see RetryAfter
+	ErrLocked         Err = "ErrLocked"      // held through another lease
+	ErrNotLocked      Err = "ErrNotLocked"   // not held with the given token
+	ErrNotElected     Err = "ErrNotElected"  // Proclaim by a candidate that doesn't lead
+
+	ErrAuthFailed       Err = "ErrAuthFailed" // wrong name or password, or auth is disabled
+	ErrInvalidToken     Err = "ErrInvalidToken"
+	ErrPermissionDenied Err = "ErrPermissionDenied"
+	ErrNoUser           Err = "ErrNoUser"
+	ErrNoRole           Err = "ErrNoRole"
+	ErrScript           Err = "ErrScript" // the script didn't parse, failed or aborted, see Value
+	ErrUnknownOp        Err = "ErrUnknownOp"
+	ErrMemberExists     Err = "ErrMemberExists" // a node of that id has joined already
+	ErrNoTxn            Err = "ErrNoTxn"        // a Txn command without its TxnRequest
+	ErrNotInBucket      Err = "ErrNotInBucket"  // a TTL or lease for a key outside the default bucket
 )
 
 const (
 	Putt    = "Put"
 	Appendd = "Append"
 	Gett    = "Get"
+	Deletee = "Delete"
+
+	CompareAndSwap   = "CompareAndSwap"
+	CompareAndDelete = "CompareAndDelete"
+	Incr             = "Incr"
+	Range            = "Range"
+	GetByPrefix      = "GetByPrefix"
 )
 
 type Err string
 
+// Err values travel as their strings, so servers and clients of different
+// versions understand each other, and on the client side they are errors:
+// test for one with errors.Is, or take it out of a wrapping error with
+// errors.As. ErrTimeout's string keeps the leading space it always had on
+// the wire, its Error leaves it out.
+func (e Err) Error() string {
+	return strings.TrimSpace(string(e))
+}
+
+// nil for OK, e otherwise, for callers that deal in errors
+func (e Err) AsError() error {
+	if e == OK {
+		return nil
+	}
+	return e
+}
+
 // Put or Append
 type PutAppendArgs struct {
 	Key    string
@@ -39,15 +100,108 @@ type GetReply struct {
 	Value string
 }
 
+// read consistency of a Get
+type Consistency int
+
+const (
+	Linearizable Consistency = iota // goes through the leader and the log
+	Stale                           // local applied state of whichever replica is asked
+)
+
 type CommandArgs struct {
-	Key       string
-	Value     string
-	Op        string // "Put" or "Append"
-	ClientId  int64
-	CommandId int64
+	Key         string
+	Value       []byte
+	Op          string // "Put" or "Append"
+	ClientId    int64
+	CommandId   int64
+	Consistency Consistency   // Get only
+	MinIndex    int           // Stale only, refuse to answer from state older than this
+	Expected    []byte        // CompareAndSwap and CompareAndDelete only
+	Delta       int64         // Incr only
+	Txn         *TxnRequest   // Txn only
+	TTL         time.Duration // Put and SetTTL: 0 for a key that doesn't expire, LeaseGrant: the lease's
+	Lease       int64         // Put: lease to attach the key to, 0 for none. lease ops: the lease
+	Revision    int           // Get, Range and GetByPrefix: read as of this revision, 0 for the latest. Compact: the first revision to keep
+	Bucket      string        // key ops and scans: the bucket, "" for the default one. bucket ops: the bucket's name
+	Index       string        // QueryIndex only, with the term in Value. Key, Limit and Token as for Range
+	Timeout     time.Duration // how long the server may wait for the command to apply, 0 for its default
+	AuthToken   string        // from Authenticate, while auth is enabled
+	Auth        *AuthRequest  // auth ops only
+	Script      *ScriptRequest
+	Keys        []string // MultiGet only
+	Trace       string   // the caller's trace id, see WithTrace
+
+	// Range only: keys in [Key, EndKey) from Token on, at most Limit of them.
+	// GetByPrefix uses Key as the prefix and Limit, OpenCursor Key and EndKey.
+	EndKey string
+	Limit  int
+	Token  string
 }
 
 type CommandReply struct {
 	Err   Err
-	Value string
+	Value []byte
+	Index int // applied index the reply was read at
+	// CompareAndSwap and CompareAndDelete only, whether the value was replaced
+	// or removed. Value is the one found.
+	Swapped bool
+	// Range, GetByPrefix and QueryIndex, Next is the Token for the following page, "" after the last
+	Pairs []KeyValue
+	Next  string
+	// OpenCursor only, the id to page with through the same server
+	Cursor int64
+	Txn    *TxnResult // Txn only
+	Lease  int64      // LeaseGrant only
+	// store revision the reply reflects: that of the latest write up to Index
+	Revision int
+	// ErrTimeout only, how long was waited
+	Elapsed time.Duration
+	// ErrRateLimited only, when the client may send again
+	RetryAfter time.Duration
+	// the replying server's id and, with ErrWrongLeader, the id of the one it
+	// believes leads, -1 if it doesn't know. see Clerk.CommandContext.
+	Server int
+	Leader int
+}
+
+type StatusArgs struct{}
+
+type StatusReply struct {
+	IsLeader     bool
+	AppliedIndex int
+	Keys         int   // in the default bucket
+	Buckets      int   // besides the default one
+	Size         int64 // bytes of keys and values
+	Quota        int64 // 0 for none
+	Alarms       []string
+	Revision     int // latest write
+	Oldest       int // oldest revision still readable
+	Clients      int // in the duplicate table
+	Leases       int
+	Raft         raft.Status
+
+	// the latest snapshot this server took or installed
+	SnapshotIndex int
+	SnapshotSize  int
+	RaftStateSize int
+}
+
+type AdminSnapshotArgs struct{}
+
+type AdminSnapshotReply struct {
+	Index int  // the snapshot covers the log up to here
+	Size  int  // bytes
+	Taken bool // false if there was nothing new since the last one
+}
+
+type VerifyArgs struct {
+	From      int
+	To        int
+	RangeSize int
+}
+
+type VerifyReply struct {
+	Digest       raft.LogDigest
+	AppliedIndex int
+	StateHash    uint64
 }
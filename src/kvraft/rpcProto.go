@@ -0,0 +1,418 @@
+package kvraft
+
+import (
+	"time"
+
+	"raft/protowire"
+)
+
+// CommandArgs and CommandReply in the protobuf format of kvraft.proto, used
+// in place of labgob by transport.TCPTransport
+
+func (kv *KeyValue) Marshal() ([]byte, error) {
+	var b protowire.Buffer
+	b.String(1, kv.Key)
+	b.Bytes(2, kv.Value)
+	return b.Data(), nil
+}
+
+func (kv *KeyValue) Unmarshal(data []byte) error {
+	*kv = KeyValue{}
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			kv.Key = r.String()
+		case 2:
+			kv.Value = r.Bytes()
+		}
+	}
+	return r.Err()
+}
+
+func (args *CommandArgs) Marshal() ([]byte, error) {
+	var b protowire.Buffer
+	b.String(1, args.Key)
+	b.Bytes(2, args.Value)
+	b.String(3, args.Op)
+	b.Int64(4, args.ClientId)
+	b.Int64(5, args.CommandId)
+	b.Int(6, int(args.Consistency))
+	b.Int(7, args.MinIndex)
+	b.Bytes(8, args.Expected)
+	b.Int64(9, args.Delta)
+	b.Int64(11, int64(args.TTL))
+	b.Int64(12, args.Lease)
+	b.Int(13, args.Revision)
+	b.String(14, args.Bucket)
+	b.String(15, args.Index)
+	b.Int64(16, int64(args.Timeout))
+	b.String(17, args.AuthToken)
+	for _, key := range args.Keys {
+		b.Element(20, []byte(key))
+	}
+	b.String(21, args.Trace)
+	b.String(22, args.EndKey)
+	b.Int(23, args.Limit)
+	b.String(24, args.Token)
+	// written even if empty, nil and empty requests differ
+	if args.Txn != nil {
+		b.Element(25, args.Txn.marshal())
+	}
+	if args.Auth != nil {
+		b.Element(26, args.Auth.marshal())
+	}
+	if args.Script != nil {
+		b.Element(27, args.Script.marshal())
+	}
+	return b.Data(), nil
+}
+
+func (args *CommandArgs) Unmarshal(data []byte) error {
+	*args = CommandArgs{}
+	r := protowire.NewReader(data)
+	for r.Next() {
+		var err error
+		switch r.Field() {
+		case 1:
+			args.Key = r.String()
+		case 2:
+			args.Value = r.Bytes()
+		case 3:
+			args.Op = r.String()
+		case 4:
+			args.ClientId = r.Int64()
+		case 5:
+			args.CommandId = r.Int64()
+		case 6:
+			args.Consistency = Consistency(r.Int())
+		case 7:
+			args.MinIndex = r.Int()
+		case 8:
+			args.Expected = r.Bytes()
+		case 9:
+			args.Delta = r.Int64()
+		case 11:
+			args.TTL = time.Duration(r.Int64())
+		case 12:
+			args.Lease = r.Int64()
+		case 13:
+			args.Revision = r.Int()
+		case 14:
+			args.Bucket = r.String()
+		case 15:
+			args.Index = r.String()
+		case 16:
+			args.Timeout = time.Duration(r.Int64())
+		case 17:
+			args.AuthToken = r.String()
+		case 20:
+			args.Keys = append(args.Keys, r.String())
+		case 21:
+			args.Trace = r.String()
+		case 22:
+			args.EndKey = r.String()
+		case 23:
+			args.Limit = r.Int()
+		case 24:
+			args.Token = r.String()
+		case 25:
+			args.Txn = new(TxnRequest)
+			err = args.Txn.unmarshal(r.Bytes())
+		case 26:
+			args.Auth = new(AuthRequest)
+			err = args.Auth.unmarshal(r.Bytes())
+		case 27:
+			args.Script = new(ScriptRequest)
+			err = args.Script.unmarshal(r.Bytes())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return r.Err()
+}
+
+func (reply *CommandReply) Marshal() ([]byte, error) {
+	var b protowire.Buffer
+	b.String(1, string(reply.Err))
+	b.Bytes(2, reply.Value)
+	b.Int(3, reply.Index)
+	b.Bool(4, reply.Swapped)
+	for i := range reply.Pairs {
+		pb, _ := reply.Pairs[i].Marshal()
+		b.Element(5, pb)
+	}
+	b.String(6, reply.Next)
+	b.Int64(7, reply.Cursor)
+	b.Int64(9, reply.Lease)
+	b.Int(10, reply.Revision)
+	b.Int64(11, int64(reply.Elapsed))
+	b.Int64(12, int64(reply.RetryAfter))
+	b.Int(13, reply.Server)
+	b.Int(14, reply.Leader)
+	if reply.Txn != nil {
+		b.Element(15, reply.Txn.marshal())
+	}
+	return b.Data(), nil
+}
+
+func (reply *CommandReply) Unmarshal(data []byte) error {
+	*reply = CommandReply{}
+	r := protowire.NewReader(data)
+	for r.Next() {
+		var err error
+		switch r.Field() {
+		case 1:
+			reply.Err = Err(r.String())
+		case 2:
+			reply.Value = r.Bytes()
+		case 3:
+			reply.Index = r.Int()
+		case 4:
+			reply.Swapped = r.Bool()
+		case 5:
+			var pair KeyValue
+			err = pair.Unmarshal(r.Bytes())
+			reply.Pairs = append(reply.Pairs, pair)
+		case 6:
+			reply.Next = r.String()
+		case 7:
+			reply.Cursor = r.Int64()
+		case 9:
+			reply.Lease = r.Int64()
+		case 10:
+			reply.Revision = r.Int()
+		case 11:
+			reply.Elapsed = time.Duration(r.Int64())
+		case 12:
+			reply.RetryAfter = time.Duration(r.Int64())
+		case 13:
+			reply.Server = r.Int()
+		case 14:
+			reply.Leader = r.Int()
+		case 15:
+			reply.Txn = new(TxnResult)
+			err = reply.Txn.unmarshal(r.Bytes())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return r.Err()
+}
+
+// the messages CommandArgs and CommandReply carry, never sent on their own,
+// so not transport.Messages
+
+func (c *TxnCondition) marshal() []byte {
+	var b protowire.Buffer
+	b.String(1, c.Key)
+	b.Bytes(2, c.Value)
+	b.Int(3, c.Target)
+	b.Int(4, c.Cmp)
+	b.Int64(5, c.Version)
+	return b.Data()
+}
+
+func (c *TxnCondition) unmarshal(data []byte) error {
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			c.Key = r.String()
+		case 2:
+			c.Value = r.Bytes()
+		case 3:
+			c.Target = r.Int()
+		case 4:
+			c.Cmp = r.Int()
+		case 5:
+			c.Version = r.Int64()
+		}
+	}
+	return r.Err()
+}
+
+func (w *TxnWrite) marshal() []byte {
+	var b protowire.Buffer
+	b.String(1, w.Op)
+	b.String(2, w.Key)
+	b.Bytes(3, w.Value)
+	return b.Data()
+}
+
+func (w *TxnWrite) unmarshal(data []byte) error {
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			w.Op = r.String()
+		case 2:
+			w.Key = r.String()
+		case 3:
+			w.Value = r.Bytes()
+		}
+	}
+	return r.Err()
+}
+
+func (txn *TxnRequest) marshal() []byte {
+	var b protowire.Buffer
+	for i := range txn.Conditions {
+		b.Element(1, txn.Conditions[i].marshal())
+	}
+	for _, key := range txn.Reads {
+		b.Element(2, []byte(key))
+	}
+	for i := range txn.Writes {
+		b.Element(3, txn.Writes[i].marshal())
+	}
+	for _, key := range txn.ElseReads {
+		b.Element(4, []byte(key))
+	}
+	for i := range txn.ElseWrites {
+		b.Element(5, txn.ElseWrites[i].marshal())
+	}
+	return b.Data()
+}
+
+func (txn *TxnRequest) unmarshal(data []byte) error {
+	r := protowire.NewReader(data)
+	for r.Next() {
+		var err error
+		switch r.Field() {
+		case 1:
+			var c TxnCondition
+			err = c.unmarshal(r.Bytes())
+			txn.Conditions = append(txn.Conditions, c)
+		case 2:
+			txn.Reads = append(txn.Reads, r.String())
+		case 3:
+			var w TxnWrite
+			err = w.unmarshal(r.Bytes())
+			txn.Writes = append(txn.Writes, w)
+		case 4:
+			txn.ElseReads = append(txn.ElseReads, r.String())
+		case 5:
+			var w TxnWrite
+			err = w.unmarshal(r.Bytes())
+			txn.ElseWrites = append(txn.ElseWrites, w)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return r.Err()
+}
+
+func (result *TxnResult) marshal() []byte {
+	var b protowire.Buffer
+	b.Bool(1, result.Succeeded)
+	b.Int(2, result.Failed)
+	for i := range result.Reads {
+		pb, _ := result.Reads[i].Marshal()
+		b.Element(3, pb)
+	}
+	return b.Data()
+}
+
+func (result *TxnResult) unmarshal(data []byte) error {
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			result.Succeeded = r.Bool()
+		case 2:
+			result.Failed = r.Int()
+		case 3:
+			var read KeyValue
+			if err := read.Unmarshal(r.Bytes()); err != nil {
+				return err
+			}
+			result.Reads = append(result.Reads, read)
+		}
+	}
+	return r.Err()
+}
+
+func (p *Permission) marshal() []byte {
+	var b protowire.Buffer
+	b.String(1, p.Prefix)
+	b.Bool(2, p.Read)
+	b.Bool(3, p.Write)
+	return b.Data()
+}
+
+func (p *Permission) unmarshal(data []byte) error {
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			p.Prefix = r.String()
+		case 2:
+			p.Read = r.Bool()
+		case 3:
+			p.Write = r.Bool()
+		}
+	}
+	return r.Err()
+}
+
+func (auth *AuthRequest) marshal() []byte {
+	var b protowire.Buffer
+	for _, role := range auth.Roles {
+		b.Element(1, []byte(role))
+	}
+	for i := range auth.Permissions {
+		b.Element(2, auth.Permissions[i].marshal())
+	}
+	b.Bytes(3, auth.Salt)
+	return b.Data()
+}
+
+func (auth *AuthRequest) unmarshal(data []byte) error {
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			auth.Roles = append(auth.Roles, r.String())
+		case 2:
+			var p Permission
+			if err := p.unmarshal(r.Bytes()); err != nil {
+				return err
+			}
+			auth.Permissions = append(auth.Permissions, p)
+		case 3:
+			auth.Salt = r.Bytes()
+		}
+	}
+	return r.Err()
+}
+
+func (script *ScriptRequest) marshal() []byte {
+	var b protowire.Buffer
+	b.String(1, script.Source)
+	for _, key := range script.Keys {
+		b.Element(2, []byte(key))
+	}
+	for _, arg := range script.Args {
+		b.Element(3, arg)
+	}
+	return b.Data()
+}
+
+func (script *ScriptRequest) unmarshal(data []byte) error {
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			script.Source = r.String()
+		case 2:
+			script.Keys = append(script.Keys, r.String())
+		case 3:
+			script.Args = append(script.Args, r.Bytes())
+		}
+	}
+	return r.Err()
+}
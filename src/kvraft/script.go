@@ -0,0 +1,381 @@
+package kvraft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// server side scripts: a read-modify-write as a single op, run in the apply
+// loop so it reads and writes the store atomically without a round trip per
+// step. a script is an s-expression in a small language with no loops or
+// calls, so every run ends, and with byte strings as the only values, so
+// every replica computes the same. it may only touch the keys it declares,
+// which is also what ACLs are checked against, and its writes take effect
+// only if it runs to the end.
+//
+//	(if (< (len (get "log")) 100)
+//		(append "log" (arg 0))
+//		(abort "log full"))
+//
+// nil is a missing key and false, anything else is true; numbers are
+// decimal strings, nil counting as 0. the forms:
+//
+//	"text" 42 nil                       literals, strings quoted as in Go
+//	(arg i)                             the i-th of the script's Args
+//	(get k) (exists k)                  seeing the script's own writes
+//	(put k v) (append k v) (delete k)   these return the new value
+//	(len v) (concat v...)
+//	(+ a b) (- a b) (< a b) (<= a b) (> a b) (>= a b)
+//	(= a b)                             compares bytes
+//	(not v) (and v...) (or v...) (if c then else) (do e...)
+//	(abort message)                     stops without writing anything
+//
+// the script's result is the value of its expression.
+const Eval = "Eval"
+
+// a run is bounded in steps, in how deeply its forms nest, and in the size
+// of every value it makes, what it writes included: the server's
+// maxValueSize as the command was proposed, as with values that come in a
+// request. concat can double a value with every step.
+const (
+	maxScriptSteps = 10000 // forms evaluated per run
+	maxScriptDepth = 100   // forms within forms
+)
+
+type ScriptRequest struct {
+	Source string
+	Keys   []string // the only ones it may touch
+	Args   [][]byte
+}
+
+type scriptNode struct {
+	list   []*scriptNode
+	isList bool
+	symbol string // of an atom that isn't a literal
+	value  []byte // of a literal
+}
+
+func parseScript(source string) (*scriptNode, error) {
+	tokens, err := scriptTokens(source)
+	if err != nil {
+		return nil, err
+	}
+	node, rest, err := parseNode(tokens, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%q after the expression", rest[0])
+	}
+	return node, nil
+}
+
+func scriptTokens(source string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(source); {
+		switch c := source[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, source[i:i+1])
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(source) && source[j] != '"' {
+				if source[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(source) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, source[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(source) && !strings.ContainsRune(" \t\n\r()\"", rune(source[j])) {
+				j++
+			}
+			tokens = append(tokens, source[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func parseNode(tokens []string, depth int) (*scriptNode, []string, error) {
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("unexpected end")
+	}
+	token, tokens := tokens[0], tokens[1:]
+	switch {
+	case token == "(":
+		if depth == maxScriptDepth {
+			return nil, nil, fmt.Errorf("forms nested deeper than %v", maxScriptDepth)
+		}
+		node := &scriptNode{isList: true}
+		for len(tokens) > 0 && tokens[0] != ")" {
+			var child *scriptNode
+			var err error
+			if child, tokens, err = parseNode(tokens, depth+1); err != nil {
+				return nil, nil, err
+			}
+			node.list = append(node.list, child)
+		}
+		if len(tokens) == 0 {
+			return nil, nil, errors.New("missing )")
+		}
+		return node, tokens[1:], nil
+	case token == ")":
+		return nil, nil, errors.New("unexpected )")
+	case token[0] == '"':
+		s, err := strconv.Unquote(token)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad string %v", token)
+		}
+		return &scriptNode{value: []byte(s)}, tokens, nil
+	case token == "nil":
+		return &scriptNode{}, tokens, nil
+	}
+	if _, err := strconv.ParseInt(token, 10, 64); err == nil {
+		return &scriptNode{value: []byte(token)}, tokens, nil
+	}
+	return &scriptNode{symbol: token}, tokens, nil
+}
+
+// a run of a script against storage, its writes held back until it ends
+type scriptRun struct {
+	storage *MemoryKV
+	request *ScriptRequest
+	writes  map[string][]byte // nil for a delete
+	order   []string          // of the keys written, so replicas apply them alike
+	steps   int
+	// 0 for no limit
+	maxValue int
+}
+
+var scriptTrue = []byte("1")
+
+func truth(b bool) []byte {
+	if b {
+		return scriptTrue
+	}
+	return nil
+}
+
+func scriptInt(value []byte) (int64, error) {
+	if len(value) == 0 {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an integer", value)
+	}
+	return n, nil
+}
+
+// the number of operands each form takes, -1 for any
+var scriptArity = map[string]int{
+	"arg": 1, "get": 1, "exists": 1, "put": 2, "append": 2, "delete": 1,
+	"len": 1, "concat": -1, "+": 2, "-": 2, "<": 2, "<=": 2, ">": 2, ">=": 2, "=": 2,
+	"not": 1, "and": -1, "or": -1, "if": 3, "do": -1, "abort": 1,
+}
+
+func (run *scriptRun) key(value []byte) (string, error) {
+	for _, key := range run.request.Keys {
+		if key == string(value) {
+			return key, nil
+		}
+	}
+	return "", fmt.Errorf("key %q not declared", value)
+}
+
+func (run *scriptRun) read(key string) ([]byte, bool) {
+	if value, ok := run.writes[key]; ok {
+		return value, value != nil
+	}
+	value, err := run.storage.Get(key)
+	return value, err == OK
+}
+
+func (run *scriptRun) write(key string, value []byte) {
+	if _, ok := run.writes[key]; !ok {
+		run.order = append(run.order, key)
+	}
+	run.writes[key] = value
+}
+
+// the value of node, which puts and appends also write
+func (run *scriptRun) eval(node *scriptNode) ([]byte, error) {
+	value, err := run.evalNode(node)
+	if err == nil && run.maxValue > 0 && len(value) > run.maxValue {
+		return nil, fmt.Errorf("a value of %v bytes, over the limit of %v", len(value), run.maxValue)
+	}
+	return value, err
+}
+
+func (run *scriptRun) evalNode(node *scriptNode) ([]byte, error) {
+	if run.steps++; run.steps > maxScriptSteps {
+		return nil, errors.New("too many steps")
+	}
+	if !node.isList {
+		if node.symbol != "" {
+			return nil, fmt.Errorf("%v outside a form", node.symbol)
+		}
+		return node.value, nil
+	}
+	if len(node.list) == 0 || node.list[0].isList || node.list[0].symbol == "" {
+		return nil, errors.New("a form must start with its name")
+	}
+	name, operands := node.list[0].symbol, node.list[1:]
+	arity, ok := scriptArity[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown form %v", name)
+	}
+	if arity >= 0 && len(operands) != arity {
+		return nil, fmt.Errorf("%v takes %v operands", name, arity)
+	}
+	// these don't evaluate every operand
+	switch name {
+	case "if":
+		c, err := run.eval(operands[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(c) > 0 {
+			return run.eval(operands[1])
+		}
+		return run.eval(operands[2])
+	case "and", "or":
+		result := truth(name == "and")
+		for _, operand := range operands {
+			var err error
+			if result, err = run.eval(operand); err != nil {
+				return nil, err
+			}
+			if (len(result) > 0) != (name == "and") {
+				break
+			}
+		}
+		return result, nil
+	}
+	values := make([][]byte, len(operands))
+	for i, operand := range operands {
+		var err error
+		if values[i], err = run.eval(operand); err != nil {
+			return nil, err
+		}
+	}
+	switch name {
+	case "arg":
+		i, err := scriptInt(values[0])
+		if err != nil || i < 0 || i >= int64(len(run.request.Args)) {
+			return nil, fmt.Errorf("no argument %q", values[0])
+		}
+		return run.request.Args[i], nil
+	case "get", "exists", "put", "append", "delete":
+		key, err := run.key(values[0])
+		if err != nil {
+			return nil, err
+		}
+		value, found := run.read(key)
+		switch name {
+		case "get":
+			return value, nil
+		case "exists":
+			return truth(found), nil
+		case "put":
+			value = values[1]
+		case "append":
+			value = append(append([]byte{}, value...), values[1]...)
+		case "delete":
+			value = nil
+		}
+		if name != "delete" && value == nil {
+			// the value of a key that exists isn't nil
+			value = []byte{}
+		}
+		run.write(key, value)
+		return value, nil
+	case "len":
+		return []byte(strconv.Itoa(len(values[0]))), nil
+	case "concat":
+		return bytes.Join(values, nil), nil
+	case "+", "-", "<", "<=", ">", ">=":
+		a, err := scriptInt(values[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := scriptInt(values[1])
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "+":
+			return []byte(strconv.FormatInt(a+b, 10)), nil
+		case "-":
+			return []byte(strconv.FormatInt(a-b, 10)), nil
+		case "<":
+			return truth(a < b), nil
+		case "<=":
+			return truth(a <= b), nil
+		case ">":
+			return truth(a > b), nil
+		default:
+			return truth(a >= b), nil
+		}
+	case "=":
+		return truth(bytes.Equal(values[0], values[1])), nil
+	case "not":
+		return truth(len(values[0]) == 0), nil
+	case "do":
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return values[len(values)-1], nil
+	default: // abort
+		return nil, fmt.Errorf("aborted: %s", values[0])
+	}
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applyScript(storage *MemoryKV, request *ScriptRequest, maxValue int, index int) opResult {
+	result := opResult{Err: OK, Index: index}
+	if request == nil {
+		request = &ScriptRequest{}
+	}
+	node, err := parseScript(request.Source)
+	run := &scriptRun{storage: storage, request: request, writes: make(map[string][]byte), maxValue: maxValue}
+	if err == nil {
+		result.Value, err = run.eval(node)
+	}
+	if err != nil {
+		result.Err, result.Value = ErrScript, []byte(err.Error())
+		return result
+	}
+	for _, key := range run.order {
+		if value := run.writes[key]; value == nil {
+			storage.Delete(key)
+		} else {
+			storage.Put(key, value)
+		}
+	}
+	return result
+}
+
+// run source on the keys it names, see Eval. ErrScript if it doesn't parse,
+// fails or aborts, with the reason as the value.
+func (ck *Clerk) Eval(source string, keys []string, args ...[]byte) ([]byte, Err) {
+	reply := ck.command(&CommandArgs{Op: Eval, Script: &ScriptRequest{Source: source, Keys: keys, Args: args}})
+	return reply.Value, reply.Err
+}
+
+// a Bucket's Eval runs on its keys
+func (b *Bucket) Eval(source string, keys []string, args ...[]byte) ([]byte, Err) {
+	reply := b.ck.command(&CommandArgs{Op: Eval, Bucket: b.name, Script: &ScriptRequest{Source: source, Keys: keys, Args: args}})
+	return reply.Value, reply.Err
+}
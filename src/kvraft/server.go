@@ -2,23 +2,50 @@ package kvraft
 
 import (
 	"bytes"
+	"context"
 	"log"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"raft/labgob"
-	"raft/labrpc"
+	"raft/metrics"
 	"raft/raft"
+	"raft/transport"
 )
 
 type Op struct {
 	OpTask    string
 	Key       string
-	Value     string
+	Value     []byte
 	ClientId  int64
 	CommandId int64
-	Seq       int64
+	Expected  []byte // CompareAndSwap and CompareAndDelete only
+	Delta     int64  // Incr only
+	Txn       *TxnRequest
+	ExpireAt  int64         // Put, Expire and lease ops only
+	TTL       time.Duration // LeaseGrant only
+	Lease     int64
+	EndKey    string // Range and OpenCursor only
+	Limit     int    // Range and GetByPrefix only
+	Revision  int    // Get, Range, GetByPrefix and Compact only
+	Bucket    string
+	Index     string // QueryIndex only
+	Auth      *AuthRequest
+	Script    *ScriptRequest
+	MaxValue  int      // Eval only, the proposing server's maxValueSize
+	Keys      []string // MultiGet only
+	Trace     string
+
+	SessionDeadline int64 // of the client's session, see session.go
+
+	Evictions []EvictKey // Evict only
+
+	Members []Member // JoinCluster (the one joining) and ConfigInit only
+
+	// StateCheck only
+	CheckIndex int
+	CheckHash  uint64
 }
 
 type KVServer struct {
@@ -26,119 +53,569 @@ type KVServer struct {
 	me           int
 	rf           *raft.Raft
 	applyCh      chan raft.ApplyMsg
-	dead         int32 // set by Kill()
-	maxraftstate int   // snapshot if log grows this big
+	dead         int32         // set by Kill()
+	stop         chan struct{} // closed by Kill()
+	applyDone    chan struct{} // closed as listenApplyCh returns
+	maxraftstate int           // snapshot if log grows this big
 
 	// Your definitions here.
-	storage     *MemoryKV
-	latestTime  map[int64]int64
-	waitChannel map[int64]chan bool
-	persister   *raft.Persister
-	//lastApplied int
+	storage         *MemoryKV
+	latestTime      map[int64]int64
+	lastResult      map[int64]opResult // result of each client's latestTime command
+	sessions        map[int64]int64    // deadline of each client's session, see session.go
+	sessionTTL      time.Duration
+	waiters         map[int]*waiter // by the log index of the awaited command
+	applied         *sync.Cond      // on kv.mu's read side, signalled as lastApplied moves
+	persister       *raft.Persister
+	lastApplied     int
+	lastAppliedTerm int
+
+	snapshotPolicy    SnapshotPolicy // nil means never snapshot
+	lastSnapshotIndex int
+	lastSnapshotTime  time.Time
+
+	stateCheckInterval time.Duration
+	lastCheckIndex     int    // index of the last StateCheck applied
+	lastCheckHash      uint64 // state hash at lastCheckIndex
+	onDivergence       DivergenceHandler
+	divergences        int
+
+	cursors cursorTable // local to this server, not replicated
+	watches watchHub
+
+	leases map[int64]*Lease
+
+	historyRetention int // revisions of MVCC history kept, 0 for no automatic compaction
+	compacted        int // the latest revision compacted to, the same on every replica
+
+	requestTimeout time.Duration // wait for a command to apply, unless its client says otherwise
+
+	quota  int64           // bytes the store may hold, 0 for no limit. see alarm.go
+	alarms map[string]bool // raised ones
+
+	maxKeySize   int // see limits.go
+	maxValueSize int
+
+	limiter rateLimiter // see rateLimit.go
+
+	metrics metrics.Sink // nil reports nowhere
+
+	changes  ChangeSink // nil for none, see changes.go
+	applying Op         // the entry being applied
+	auditor  AuditSink  // nil for none, see audit.go
+
+	auth authState // see auth.go
+
+	members    []Member              // see join.go
+	joinTokens map[string]*joinToken // by hash
+
+	cacheBudget int64   // bytes, 0 for no cache mode. see eviction.go
+	lru         lruKeys // of the default bucket's keys, in cache mode
+
+	draining int32 // set by Shutdown, see shutdown.go
+	inflight int32 // Commands let in, atomically
+}
+
+// a little less than the clerk waits by default, so the ErrTimeout arrives
+const defaultRequestTimeout = defaultAttemptTimeout - replyMargin
+
+func StartKVServer(servers []transport.Endpoint, me int, persister *raft.Persister, maxraftstate int) *KVServer {
+	return StartKVServerWithEngine(servers, me, persister, maxraftstate, NewMemoryEngine)
 }
 
-func StartKVServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister, maxraftstate int) *KVServer {
+// serve clerks and the other peers through t, for a cluster that doesn't run
+// on labrpc. servers passed to StartKVServer are then t.Dial'd endpoints.
+func (kv *KVServer) Register(t transport.Transport) {
+	t.Register(kv)
+	t.Register(kv.rf)
+}
+
+// as Register, for a server of group on a node that hosts several. its
+// servers are then t.DialGroup'd endpoints.
+func (kv *KVServer) RegisterGroup(t transport.GroupTransport, group int) {
+	t.RegisterGroup(group, kv)
+	t.RegisterGroup(group, kv.rf)
+}
+
+// a server keeping its values in the engines from engines, e.g. DiskEngines
+func StartKVServerWithEngine(servers []transport.Endpoint, me int, persister *raft.Persister, maxraftstate int, engines EngineFactory) *KVServer {
 	labgob.Register(Op{})
 	kv := new(KVServer)
-	kv.applyCh = make(chan raft.ApplyMsg, 1)
+	kv.applyCh = make(chan raft.ApplyMsg, applyBatchSize)
+	kv.stop, kv.applyDone = make(chan struct{}), make(chan struct{})
 	kv.rf = raft.Make(servers, me, persister, kv.applyCh)
 	kv.me = me
 	kv.maxraftstate = maxraftstate
-	kv.storage = NewMemoryKV()
+	kv.storage = NewMemoryKVWith(engines)
 	kv.latestTime = make(map[int64]int64)
-	kv.waitChannel = make(map[int64]chan bool)
+	kv.lastResult = make(map[int64]opResult)
+	kv.sessions = make(map[int64]int64)
+	kv.alarms = make(map[string]bool)
+	kv.leases = make(map[int64]*Lease)
+	kv.waiters = make(map[int]*waiter)
+	kv.applied = sync.NewCond(kv.mu.RLocker())
+	kv.cursors.cursors = make(map[int64]*cursor)
+	if maxraftstate != -1 {
+		kv.snapshotPolicy = NewSizePolicy(maxraftstate)
+	}
+	kv.lastSnapshotTime = time.Now()
+	kv.stateCheckInterval = defaultStateCheckInterval
+	kv.historyRetention = defaultHistoryRetention
+	kv.sessionTTL = defaultSessionTTL
+	kv.requestTimeout = defaultRequestTimeout
+	kv.maxKeySize, kv.maxValueSize = defaultMaxKeySize, defaultMaxValueSize
+	kv.limiter.buckets = make(map[int64]*tokenBucket)
+	kv.auth = newAuthState()
+	kv.joinTokens = make(map[string]*joinToken)
 	kv.installSnapshot(persister.ReadSnapshot())
 	kv.persister = persister
+	kv.watches.init(kv.lastApplied)
+	kv.storage.onChange = kv.recordEvent
+	kv.storage.onWrite = kv.recordChange
 	go kv.listenApplyCh()
+	go kv.stateChecker()
+	go kv.ttlSweeper()
+	go kv.alarmChecker()
+	go kv.evictor()
 	return kv
 }
 
 func (kv *KVServer) Command(args *CommandArgs, reply *CommandReply) {
+	start := time.Now()
+	defer kv.observeCommand(args.Op, start, reply)
+	defer func() {
+		reply.Server = kv.me
+		if reply.Err == ErrWrongLeader {
+			reply.Leader = kv.rf.Leader()
+		}
+	}()
+	if !kv.enter() {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	defer kv.leave()
+	if err := kv.checkSizes(args); err != OK {
+		reply.Err = err
+		return
+	}
+	if err := kv.authorize(args); err != OK {
+		reply.Err = err
+		return
+	}
+	h := lookup(args.Op)
+	if h == nil || h.internal {
+		reply.Err = ErrUnknownOp
+		return
+	}
 	op := Op{}
 	op.OpTask = args.Op
 	op.Key = args.Key
 	op.Value = args.Value
 	op.ClientId = args.ClientId
 	op.CommandId = args.CommandId
-	op.Seq = nrand()
+	op.Expected = args.Expected
+	op.Delta = args.Delta
+	op.Txn = args.Txn
+	op.Lease = args.Lease
+	op.EndKey = args.EndKey
+	op.Limit = args.Limit
+	op.Revision = args.Revision
+	op.Bucket = args.Bucket
+	op.Index = args.Index
+	op.Auth = args.Auth
+	op.Script = args.Script
+	op.Keys = args.Keys
+	op.Trace = args.Trace
+
+	if args.Op == Gett && args.Consistency == Stale {
+		kv.staleRead(args, reply)
+		return
+	}
 
 	kv.mu.Lock()
 	if kv.dupCommand(args.CommandId, args.ClientId) {
-		reply.Value, reply.Err = kv.storage.Get(args.Key)
+		result := kv.currentResult(op)
+		result.Index, result.Revision = kv.lastApplied, kv.storage.Revision()
+		result.fill(reply)
 		kv.mu.Unlock()
 		return
 	}
-	c := kv.startWaitChannel(op.Seq)
+	if kv.alarms[AlarmNoSpace] && grows(op) {
+		// would be refused when applied anyway
+		reply.Err = ErrNoSpace
+		kv.mu.Unlock()
+		return
+	}
+	if _, isLeader := kv.rf.GetState(); isLeader {
+		if ok, wait := kv.limiter.take(args.ClientId, start); !ok {
+			reply.Err, reply.RetryAfter = ErrRateLimited, wait
+			kv.mu.Unlock()
+			return
+		}
+	}
+	if h.prepare != nil {
+		if err := h.prepare(kv, args, &op); err != OK {
+			reply.Err = err
+			kv.mu.Unlock()
+			return
+		}
+	}
+	op.SessionDeadline = kv.sessionDeadline()
+	timeout := kv.requestTimeout
+	if args.Timeout > 0 {
+		timeout = args.Timeout
+	}
 	kv.mu.Unlock()
 
-	_, _, isLeader := kv.rf.Start(op)
+	index, _, err := kv.rf.Propose(op)
 
-	if !isLeader {
-		go kv.deleteWaitChannelL(op.Seq)
+	if err == raft.ErrBusy {
+		reply.Err = ErrBusy
+		return
+	} else if err != nil {
 		reply.Err = ErrWrongLeader
-	} else {
-		timer := time.After(99 * time.Millisecond)
+		return
+	}
+	kv.mu.Lock()
+	if index <= kv.lastApplied {
+		// applied before we got to wait for it
+		if kv.dupCommand(args.CommandId, args.ClientId) {
+			result := kv.currentResult(op)
+			result.Index, result.Revision = kv.lastApplied, kv.storage.Revision()
+			result.fill(reply)
+		} else {
+			reply.Err, reply.Elapsed = ErrTimeout, time.Since(start)
+		}
+		kv.mu.Unlock()
+		return
+	}
+	w := kv.startWaiter(op, index)
+	kv.mu.Unlock()
+
+	timer := time.NewTimer(timeout - time.Since(start))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		reply.Err, reply.Elapsed = ErrTimeout, time.Since(start)
+		// the apply loop removes the waiters it wakes
+		kv.deleteWaiterL(index, w)
+	case result := <-w.c:
+		// this has been apply to database
+		result.fill(reply)
+	}
+}
+
+// answer a Get from whatever this replica has applied, leader or not.
+// the value may be arbitrarily old, but never older than args.MinIndex: a
+// client passing the highest index it has seen reads its own writes. a
+// replica that is behind waits up to the request's timeout to catch up.
+func (kv *KVServer) staleRead(args *CommandArgs, reply *CommandReply) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	if kv.lastApplied < args.MinIndex {
+		wait := kv.requestTimeout
+		if args.Timeout > 0 {
+			wait = args.Timeout
+		}
+		expired := false
+		timer := time.AfterFunc(wait, func() {
+			kv.mu.Lock()
+			expired = true
+			kv.applied.Broadcast()
+			kv.mu.Unlock()
+		})
+		defer timer.Stop()
+		for kv.lastApplied < args.MinIndex && !expired && !kv.killed() {
+			kv.applied.Wait()
+		}
+	}
+	if kv.lastApplied < args.MinIndex {
+		reply.Err = ErrStale
+		return
+	}
+	storage, ok := kv.storage.Bucket(args.Bucket)
+	if !ok {
+		reply.Err = ErrNoBucket
+		return
+	}
+	reply.Value, reply.Err = storage.Get(args.Key)
+	reply.Index, reply.Revision = kv.lastApplied, kv.storage.Revision()
+}
+
+// block until this replica has applied every entry through index, so that
+// e.g. a coordinator moving shards can fence on it having seen everything up
+// to a point. ctx.Err() if ctx is done first, raft.ErrKilled if the server
+// is killed.
+func (kv *KVServer) WaitApplied(ctx context.Context, index int) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
 		select {
-		case <-timer:
-			go kv.deleteWaitChannelL(op.Seq)
-			reply.Err = ErrTimeout
-		case <-c:
-			// this has been apply to database
+		case <-ctx.Done():
 			kv.mu.Lock()
-			reply.Err = OK
-			if args.Op == Gett {
-				reply.Value, reply.Err = kv.storage.Get(args.Key)
-			}
-			kv.deleteWaitChannel(op.Seq)
+			kv.applied.Broadcast()
 			kv.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	for kv.lastApplied < index {
+		if kv.killed() {
+			return raft.ErrKilled
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		kv.applied.Wait()
 	}
+	return nil
+}
+
+// hashes of this replica's committed log in [From, To] and of its applied state,
+// served locally without going through raft. see VerifyReplicas.
+func (kv *KVServer) Verify(args *VerifyArgs, reply *VerifyReply) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	reply.Digest = kv.rf.LogDigest(args.From, args.To, args.RangeSize)
+	reply.AppliedIndex = kv.lastApplied
+	reply.StateHash = kv.storage.Hash()
 }
 
+// whatever raft has handed over by the time the lock is taken is applied
+// under it in one go, up to applyBatchSize messages, and the Commands
+// waiting for them are woken once it's released.
 func (kv *KVServer) listenApplyCh() {
-	for applyMessage := range kv.applyCh {
+	defer close(kv.applyDone)
+	for {
+		var applyMessage raft.ApplyMsg
+		select {
+		case applyMessage = <-kv.applyCh:
+		case <-kv.stop:
+			return
+		}
 		if kv.killed() {
 			return
 		}
 		kv.mu.Lock()
-		if applyMessage.CommandValid {
-			curOp := applyMessage.Command.(Op)
-			if !kv.dupCommand(curOp.CommandId, curOp.ClientId) {
-				if curOp.OpTask == Appendd {
-					kv.storage.Append(curOp.Key, curOp.Value)
-				} else if curOp.OpTask == Putt {
-					kv.storage.Put(curOp.Key, curOp.Value)
-				}
-				kv.latestTime[curOp.ClientId] = curOp.CommandId
-			}
-			if currentTerm, isLeader := kv.rf.GetState(); isLeader && applyMessage.CommandTerm == currentTerm {
-				c, ok := kv.waitChannel[curOp.Seq]
-				if ok {
-					c <- true
+		woken := kv.applyMessage(applyMessage, nil)
+		n := 1
+	drain:
+		for ; n < applyBatchSize && !kv.killed(); n++ {
+			select {
+			case next, ok := <-kv.applyCh:
+				if !ok {
+					break drain
 				}
+				woken = kv.applyMessage(next, woken)
+			default:
+				break drain
 			}
-			if kv.needSnapShot() {
-				kv.takeSnapShot(applyMessage.CommandIndex)
-			}
-		} else if applyMessage.SnapshotValid {
-			kv.installSnapshot(applyMessage.Snapshot)
 		}
+		if kv.metrics != nil {
+			kv.metrics.Observe(MetricApplyBatch, float64(n))
+		}
+		kv.applied.Broadcast()
 		kv.mu.Unlock()
+		for _, wake := range woken {
+			wake.w.c <- wake.result
+		}
+	}
+}
+
+// messages applied under one acquisition of kv.mu at most, also the room
+// raft has in applyCh to queue them up
+const applyBatchSize = 64
+
+type wakeup struct {
+	w      *waiter
+	result opResult
+}
+
+// apply one message from raft, adding the waiters to wake to woken. caller
+// must hold kv.mu.
+func (kv *KVServer) applyMessage(applyMessage raft.ApplyMsg, woken []wakeup) []wakeup {
+	if applyMessage.CommandValid && applyMessage.CommandIndex <= kv.lastApplied {
+		// already covered by a snapshot installed in the meantime
+		return woken
+	}
+	if applyMessage.CommandValid {
+		kv.lastApplied, kv.lastAppliedTerm = applyMessage.CommandIndex, applyMessage.CommandTerm
+		if kv.metrics != nil {
+			kv.metrics.Observe(MetricApplyLag, float64(kv.rf.Status().CommitIndex-kv.lastApplied))
+		}
+		kv.storage.Begin(applyMessage.CommandIndex)
+		curOp := applyMessage.Command.(Op)
+		kv.applying = curOp
+		var result opResult
+		if h := lookup(curOp.OpTask); h != nil && h.internal {
+			result = h.apply(kv, kv.storage, curOp, applyMessage.CommandIndex)
+		} else {
+			result = kv.applyOp(curOp, applyMessage.CommandIndex)
+			result.Revision = kv.storage.Revision()
+		}
+		kv.audit(curOp, applyMessage.CommandIndex, result)
+		kv.autoCompact(applyMessage.CommandIndex)
+		if w := kv.wakeWaiter(curOp, applyMessage.CommandIndex, result); w != nil {
+			woken = append(woken, *w)
+		}
+		if kv.needSnapShot(applyMessage.CommandIndex) {
+			kv.takeSnapShot(applyMessage.CommandIndex)
+		}
+	} else if applyMessage.SnapshotValid {
+		kv.installSnapshot(applyMessage.Snapshot)
+	}
+	return woken
+}
+
+// what applying an op produced, handed to the waiting Command call
+type opResult struct {
+	Err     Err
+	Value   []byte // Get: the value read, Put/Append/Incr: the value after the op, CAS: the value before it
+	Swapped bool   // CompareAndSwap/CompareAndDelete: whether it took effect
+	Pairs   []KeyValue
+	Next    string
+	Cursor  int64
+	Txn     *TxnResult
+	Lease   int64
+	Index   int
+	// store revision once the op is applied, i.e. of the latest write up to it
+	Revision int
+}
+
+func (result opResult) fill(reply *CommandReply) {
+	reply.Err, reply.Value, reply.Swapped = result.Err, result.Value, result.Swapped
+	reply.Pairs, reply.Next, reply.Cursor, reply.Index = result.Pairs, result.Next, result.Cursor, result.Index
+	reply.Txn, reply.Lease, reply.Revision = result.Txn, result.Lease, result.Revision
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applyOp(op Op, index int) opResult {
+	if kv.dupCommand(op.CommandId, op.ClientId) {
+		// a retry, so the client is still around
+		kv.renewSession(op)
+		return kv.currentResult(op)
+	}
+	result := opResult{Err: OK, Index: index}
+	if kv.alarms[AlarmNoSpace] && grows(op) {
+		result.Err = ErrNoSpace
+		kv.remember(op, result)
+		return result
 	}
+	h := lookup(op.OpTask)
+	if h == nil {
+		// from before the op was registered, say. a no-op on every replica.
+		kv.remember(op, result)
+		return result
+	}
+	storage := kv.storage
+	if h.inBucket {
+		// not remembered, a retry may find the bucket created meanwhile
+		var ok bool
+		if storage, ok = kv.storage.Bucket(op.Bucket); !ok {
+			result.Err = ErrNoBucket
+			return result
+		}
+	}
+	if op.Revision != 0 && (op.OpTask == Gett || op.OpTask == Range || op.OpTask == GetByPrefix || op.OpTask == MultiGet) {
+		return kv.readAt(storage, op, index)
+	}
+	result = h.apply(kv, storage, op, index)
+	if h.inBucket {
+		kv.touch(op)
+	}
+	if h.scan {
+		return result
+	}
+	kv.remember(op, result)
+	return result
+}
+
+// a Get or scan as of op.Revision. the past doesn't change, so like scans
+// these aren't remembered for duplicates. caller must hold kv.mu.
+func (kv *KVServer) readAt(storage *MemoryKV, op Op, index int) opResult {
+	result := opResult{Err: OK, Index: index}
+	if op.Revision > index {
+		result.Err = ErrFutureRevision
+		return result
+	}
+	if op.Revision < kv.storage.Oldest() {
+		result.Err = ErrCompacted
+		return result
+	}
+	switch op.OpTask {
+	case Gett:
+		result.Value, result.Err = storage.GetAt(op.Key, op.Revision)
+	case Range:
+		result.Pairs, result.Next = storage.RangeAt(op.Key, op.EndKey, op.Limit, op.Revision)
+	case GetByPrefix:
+		result.Pairs, result.Next = storage.RangeAt(op.Key, prefixEnd(op.Key), op.Limit, op.Revision)
+	case MultiGet:
+		result.Pairs = multiGet(storage, op.Keys, op.Revision)
+	}
+	return result
 }
 
-func (kv *KVServer) startWaitChannel(seq int64) chan bool {
-	c := make(chan bool, 1)
-	kv.waitChannel[seq] = c
-	return c
+// reply for a command that was already applied, caller must hold kv.mu.
+// the latest command of a client gets its original result back, older ones
+// (whose client has moved on and won't look) the current value.
+func (kv *KVServer) currentResult(op Op) opResult {
+	if result, ok := kv.lastResult[op.ClientId]; ok && kv.latestTime[op.ClientId] == op.CommandId {
+		return result
+	}
+	storage, ok := kv.storage.Bucket(op.Bucket)
+	if !ok {
+		return opResult{Err: ErrNoBucket}
+	}
+	value, err := storage.Get(op.Key)
+	if op.OpTask != Gett {
+		err = OK
+	}
+	return opResult{Err: err, Value: value}
 }
 
-func (kv *KVServer) deleteWaitChannel(seq int64) {
-	delete(kv.waitChannel, seq)
+// a Command waiting for the entry it proposed at some index. another leader
+// may have put a different entry there, so the applied entry must be the
+// same client's same command.
+type waiter struct {
+	clientId  int64
+	commandId int64
+	c         chan opResult
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) startWaiter(op Op, index int) *waiter {
+	w := &waiter{clientId: op.ClientId, commandId: op.CommandId, c: make(chan opResult, 1)}
+	kv.waiters[index] = w
+	return w
+}
+
+// whether a Command waits for op at index, caller must hold kv.mu
+func (kv *KVServer) awaited(op Op, index int) bool {
+	w, ok := kv.waiters[index]
+	return ok && w.clientId == op.ClientId && w.commandId == op.CommandId
+}
+
+// the waiter of the entry at index with the result to hand it, nil if
+// nobody waits. caller must hold kv.mu.
+func (kv *KVServer) wakeWaiter(op Op, index int, result opResult) *wakeup {
+	w, ok := kv.waiters[index]
+	if !ok {
+		return nil
+	}
+	delete(kv.waiters, index)
+	if w.clientId != op.ClientId || w.commandId != op.CommandId {
+		// lost the slot to another leader's entry
+		result = opResult{Err: ErrWrongLeader}
+	}
+	return &wakeup{w, result}
 }
-func (kv *KVServer) deleteWaitChannelL(seq int64) {
+
+func (kv *KVServer) deleteWaiterL(index int, w *waiter) {
 	kv.mu.Lock()
-	delete(kv.waitChannel, seq)
+	if kv.waiters[index] == w {
+		delete(kv.waiters, index)
+	}
 	kv.mu.Unlock()
 }
 
@@ -147,45 +624,253 @@ func (kv *KVServer) dupCommand(commandId int64, clientId int64) bool {
 	return exist && commandId <= latestId
 }
 
-func (kv *KVServer) needSnapShot() bool {
-	return kv.maxraftstate != -1 && float32(kv.persister.RaftStateSize()/kv.maxraftstate) > 0.8
+// how long Command waits for commands of clients that don't send a timeout
+func (kv *KVServer) SetRequestTimeout(timeout time.Duration) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.requestTimeout = timeout
+}
+
+// replace the default size based policy, nil disables snapshots
+func (kv *KVServer) SetSnapshotPolicy(policy SnapshotPolicy) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.snapshotPolicy = policy
+}
+
+func (kv *KVServer) snapshotStats(index int) SnapshotStats {
+	return SnapshotStats{
+		RaftStateSize: kv.persister.RaftStateSize(),
+		AppliedSince:  index - kv.lastSnapshotIndex,
+		SinceLast:     time.Since(kv.lastSnapshotTime),
+	}
+}
+
+func (kv *KVServer) needSnapShot(index int) bool {
+	return kv.snapshotPolicy != nil && kv.snapshotPolicy.ShouldSnapshot(kv.snapshotStats(index))
 }
 
 func (kv *KVServer) takeSnapShot(index int) {
+	kv.sink().IncCounter(MetricSnapshots, 1)
+	kv.sink().Observe(MetricSnapshotEntries, float64(index-kv.lastSnapshotIndex))
 	snapShot := kv.saveState()
 	kv.rf.Snapshot(index, snapShot)
+	kv.lastSnapshotIndex = index
+	kv.lastSnapshotTime = time.Now()
+	if kv.snapshotPolicy != nil {
+		kv.snapshotPolicy.Snapshotted(kv.snapshotStats(index))
+	}
 }
 
+// snapshot layout by version:
+// 0: storage, latestTime
+// 1: storage, latestTime, lastApplied, lastAppliedTerm
+// 2: storage, latestTime, lastApplied, lastAppliedTerm, key versions
+// 3: storage, latestTime, lastApplied, lastAppliedTerm, key versions, key expiry
+// 4: as 3, then the lease of each key and the leases
+// 5: as 4, then the store revision
+// 6: as 5, with values as []byte rather than string
+// 7: as 6, then the buckets
+// 8: as 7, then the client sessions
+// 9: as 8, then the result of each client's latest command
+// 10: as 9, then the raised alarms
+// 11: as 10, then the auth config
+// 12: as 11, then the membership and join tokens
+// 13: as 11, then a bitmask of the optional sections that follow: the
+// membership and join tokens, the compacted revision
+const snapshotVersion = 13
+
+// the optional sections at the end of a snapshot, each there only if its bit
+// is set, so that snapshots stay small while they're unused
+const (
+	sectionMembership = 1 << iota
+	sectionCompacted
+)
+
 func (kv *KVServer) installSnapshot(data []byte) {
 	if data == nil || len(data) < 1 { // bootstrap without any state?
 		return
 	}
+	version, data := raft.SplitFormatVersion(data)
+	if version > snapshotVersion {
+		log.Fatalf("snapshot has format version %v, this build reads up to %v", version, snapshotVersion)
+	}
 	r := bytes.NewBuffer(data)
 	d := labgob.NewDecoder(r)
-	var storage map[string]string
+	var storage map[string][]byte
 	var latestTime map[int64]int64
+	var lastApplied int
+	var lastAppliedTerm int
+	var versions map[string]int64
+	var expiry map[string]int64
+	var keyLeases map[string]int64
+	leases := make(map[int64]*Lease)
+	revision := 0
+	buckets := make(map[string]BucketState)
+	// clients in older snapshots keep their entries until their next command
+	sessions := make(map[int64]int64)
+	lastResult := make(map[int64]opResult)
+	alarms := make(map[string]bool)
+	auth := newAuthState()
+	var members []Member
+	joinTokens := make(map[string]*joinToken)
+	compacted := 0
+	var sections int
+	var membershipUsed bool // version 12
+	// values were strings before version 6
+	var legacyStorage map[string]string
+	var storageTarget interface{} = &storage
+	if version < 6 {
+		storageTarget = &legacyStorage
+	}
 	// var record map[int64]map[int64]bool
-	if d.Decode(&storage) != nil ||
-		d.Decode(&latestTime) != nil {
+	if d.Decode(storageTarget) != nil ||
+		d.Decode(&latestTime) != nil ||
+		version >= 1 && (d.Decode(&lastApplied) != nil ||
+			d.Decode(&lastAppliedTerm) != nil) ||
+		version >= 2 && d.Decode(&versions) != nil ||
+		version >= 3 && d.Decode(&expiry) != nil ||
+		version >= 4 && (d.Decode(&keyLeases) != nil ||
+			d.Decode(&leases) != nil) ||
+		version >= 5 && d.Decode(&revision) != nil ||
+		version >= 7 && decodeBuckets(d, buckets) != nil ||
+		version >= 8 && d.Decode(&sessions) != nil ||
+		version >= 9 && d.Decode(&lastResult) != nil ||
+		version >= 10 && decodeAlarms(d, alarms) != nil ||
+		version >= 11 && auth.decode(d) != nil ||
+		version == 12 && d.Decode(&membershipUsed) != nil ||
+		version >= 13 && d.Decode(&sections) != nil ||
+		(membershipUsed || sections&sectionMembership != 0) && decodeMembership(d, &members, joinTokens) != nil ||
+		sections&sectionCompacted != 0 && d.Decode(&compacted) != nil {
 		log.Fatal("error")
 	} else {
+		if version < 6 {
+			storage = make(map[string][]byte, len(legacyStorage))
+			for key, value := range legacyStorage {
+				storage[key] = []byte(value)
+			}
+		}
 		kv.storage.SetKV(storage)
+		kv.storage.SetVersions(versions)
+		kv.storage.SetExpiries(expiry)
+		kv.storage.SetLeases(keyLeases)
+		kv.storage.SetBuckets(buckets)
+		if version < 5 {
+			revision = lastApplied
+		}
+		kv.storage.ResetHistory(revision)
+		kv.leases = leases
 		kv.latestTime = latestTime
+		kv.sessions = sessions
+		kv.lastResult = lastResult
+		kv.alarms = alarms
+		kv.auth = auth
+		kv.members, kv.joinTokens = members, joinTokens
+		kv.compacted = compacted
+		kv.lastApplied, kv.lastAppliedTerm = lastApplied, lastAppliedTerm
+		kv.lastSnapshotIndex = lastApplied
+		kv.lru = lruKeys{}
+		if kv.watches.cond != nil {
+			kv.resetWatches()
+		}
+		if kv.changes != nil {
+			kv.changes.Restored(lastApplied)
+		}
 	}
 }
 
+func decodeBuckets(d *labgob.LabDecoder, buckets map[string]BucketState) error {
+	var n int
+	if err := d.Decode(&n); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		var name string
+		var state BucketState
+		if err := d.Decode(&name); err != nil {
+			return err
+		}
+		if err := d.Decode(&state.KV); err != nil {
+			return err
+		}
+		if err := d.Decode(&state.Versions); err != nil {
+			return err
+		}
+		buckets[name] = state
+	}
+	return nil
+}
+
+func decodeAlarms(d *labgob.LabDecoder, alarms map[string]bool) error {
+	var n int
+	if err := d.Decode(&n); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		var alarm string
+		if err := d.Decode(&alarm); err != nil {
+			return err
+		}
+		alarms[alarm] = true
+	}
+	return nil
+}
+
 func (kv *KVServer) saveState() []byte {
 	w := new(bytes.Buffer)
 	e := labgob.NewEncoder(w)
 	e.Encode(kv.storage.GetKV())
 	e.Encode(kv.latestTime)
-	return w.Bytes()
+	e.Encode(kv.lastApplied)
+	e.Encode(kv.lastAppliedTerm)
+	e.Encode(kv.storage.Versions)
+	e.Encode(kv.storage.Expiry)
+	e.Encode(kv.storage.Leases)
+	e.Encode(kv.leases)
+	e.Encode(kv.storage.Revision())
+	// by hand, a map of structs would cost its type description every time
+	buckets := kv.storage.BucketStates()
+	e.Encode(len(buckets))
+	for _, name := range kv.storage.bucketNames() {
+		state := buckets[name]
+		e.Encode(name)
+		e.Encode(state.KV)
+		e.Encode(state.Versions)
+	}
+	e.Encode(kv.sessions)
+	e.Encode(kv.lastResult)
+	// by hand too, a []string would cost its type description
+	e.Encode(len(kv.alarms))
+	for _, alarm := range kv.alarmList() {
+		e.Encode(alarm)
+	}
+	kv.auth.encode(e)
+	sections := 0
+	if len(kv.members) > 0 || len(kv.joinTokens) > 0 {
+		sections |= sectionMembership
+	}
+	if kv.compacted > 0 {
+		sections |= sectionCompacted
+	}
+	e.Encode(sections)
+	if sections&sectionMembership != 0 {
+		kv.encodeMembership(e)
+	}
+	if sections&sectionCompacted != 0 {
+		e.Encode(kv.compacted)
+	}
+	return raft.AddFormatVersion(snapshotVersion, w.Bytes())
 }
 
+// stop right away, abandoning the commands in flight. see Shutdown.
 func (kv *KVServer) Kill() {
-	atomic.StoreInt32(&kv.dead, 1)
+	if atomic.CompareAndSwapInt32(&kv.dead, 0, 1) {
+		close(kv.stop)
+	}
 	kv.rf.Kill()
-	// Your code here, if desired.
+	kv.mu.Lock()
+	kv.applied.Broadcast() // for WaitApplied
+	kv.mu.Unlock()
 }
 
 func (kv *KVServer) killed() bool {
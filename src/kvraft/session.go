@@ -0,0 +1,58 @@
+package kvraft
+
+import "time"
+
+// a client's session is its entry in the duplicate table, latestTime and
+// lastResult. every command a client gets applied renews the session, and one
+// idle for sessionTTL is dropped, so the table doesn't keep every clerk that
+// ever connected. as with TTLs the deadline is fixed by the leader proposing
+// the command, and the leader's sweeper drops expired sessions through a
+// SessionExpire entry, so every replica keeps the same table.
+//
+// a clerk coming back after its session expired is taken for a new one: a
+// retry of a command from before then could apply twice, so the TTL should be
+// far longer than any clerk keeps retrying a command.
+const SessionExpire = "SessionExpire"
+
+const defaultSessionTTL = 10 * time.Minute
+
+// zero keeps sessions forever
+func (kv *KVServer) SetSessionTTL(ttl time.Duration) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.sessionTTL = ttl
+}
+
+// deadline for the session of a command proposed now, caller must hold kv.mu
+func (kv *KVServer) sessionDeadline() int64 {
+	if kv.sessionTTL == 0 {
+		return 0
+	}
+	return time.Now().Add(kv.sessionTTL).UnixNano()
+}
+
+// remember the result of the client's latest command, caller must hold kv.mu
+func (kv *KVServer) remember(op Op, result opResult) {
+	kv.latestTime[op.ClientId] = op.CommandId
+	kv.lastResult[op.ClientId] = result
+	kv.renewSession(op)
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) renewSession(op Op) {
+	if op.SessionDeadline == 0 {
+		delete(kv.sessions, op.ClientId)
+	} else if op.SessionDeadline > kv.sessions[op.ClientId] {
+		// never earlier, the leader proposing it may have a slower clock
+		kv.sessions[op.ClientId] = op.SessionDeadline
+	}
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applySessionExpire(op Op) {
+	if at, ok := kv.sessions[op.ClientId]; ok && at == op.ExpireAt {
+		delete(kv.sessions, op.ClientId)
+		delete(kv.latestTime, op.ClientId)
+		delete(kv.lastResult, op.ClientId)
+	}
+}
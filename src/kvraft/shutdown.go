@@ -0,0 +1,74 @@
+package kvraft
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// stop this server without dropping what it's in the middle of, unlike
+// Kill: new commands are turned away with ErrWrongLeader, so clients move on
+// to another server, and the ones already accepted get to finish. once they
+// have, or ctx is done and those left are told ErrWrongLeader, the applied
+// state is snapshotted, so a restart doesn't replay the log, and raft and
+// the apply loop are stopped. returns ctx.Err() if it had to give up on
+// commands, nil otherwise.
+func (kv *KVServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&kv.draining, 1)
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	var err error
+wait:
+	for {
+		if atomic.LoadInt32(&kv.inflight) == 0 {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+			kv.failWaiters()
+			break wait
+		}
+	}
+
+	kv.mu.Lock()
+	if kv.lastApplied > kv.lastSnapshotIndex {
+		kv.takeSnapShot(kv.lastApplied)
+	}
+	kv.mu.Unlock()
+
+	kv.Kill()
+	select {
+	case <-kv.applyDone:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return err
+}
+
+func (kv *KVServer) failWaiters() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for index, w := range kv.waiters {
+		delete(kv.waiters, index)
+		w.c <- opResult{Err: ErrWrongLeader}
+	}
+}
+
+// let a command in unless the server is shutting down, in which case it
+// must not; every one let in must leave. it counts itself in before
+// looking at draining, so Shutdown either sees it or turns it away.
+func (kv *KVServer) enter() bool {
+	atomic.AddInt32(&kv.inflight, 1)
+	if atomic.LoadInt32(&kv.draining) == 1 || kv.killed() {
+		kv.leave()
+		return false
+	}
+	return true
+}
+
+func (kv *KVServer) leave() {
+	atomic.AddInt32(&kv.inflight, -1)
+}
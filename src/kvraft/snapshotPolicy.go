@@ -0,0 +1,132 @@
+package kvraft
+
+import (
+	"time"
+
+	"raft/transport"
+)
+
+// what a SnapshotPolicy looks at when deciding whether to snapshot
+type SnapshotStats struct {
+	RaftStateSize int           // bytes of persisted raft state
+	AppliedSince  int           // entries applied since the last snapshot
+	SinceLast     time.Duration // time since the last snapshot
+}
+
+// decides when the server should hand a snapshot to raft so it can trim its log.
+// Snapshotted is called right after a snapshot was taken, so that policies can
+// reset whatever they keep between two snapshots.
+type SnapshotPolicy interface {
+	ShouldSnapshot(stats SnapshotStats) bool
+	Snapshotted(stats SnapshotStats)
+}
+
+// snapshot once raft state reaches High*MaxBytes. after firing, the policy
+// stays quiet until the state drops below Low*MaxBytes again, so that we don't
+// snapshot on every entry while hovering around the threshold, and at least
+// MinInterval passes between two snapshots so that a sustained write load
+// doesn't keep the server busy snapshotting. MaxBytes itself is a hard limit
+// and always fires.
+type SizePolicy struct {
+	MaxBytes    int
+	High        float32
+	Low         float32
+	MinInterval time.Duration
+	disarmed    bool
+}
+
+func NewSizePolicy(maxBytes int) *SizePolicy {
+	return &SizePolicy{
+		MaxBytes:    maxBytes,
+		High:        0.8,
+		Low:         0.5,
+		MinInterval: 100 * time.Millisecond,
+	}
+}
+
+func (p *SizePolicy) ShouldSnapshot(stats SnapshotStats) bool {
+	if p.MaxBytes <= 0 {
+		return false
+	}
+	ratio := float32(stats.RaftStateSize) / float32(p.MaxBytes)
+	if ratio < p.Low {
+		p.disarmed = false
+	}
+	return ratio >= 1 || (!p.disarmed && ratio >= p.High && stats.SinceLast >= p.MinInterval)
+}
+
+func (p *SizePolicy) Snapshotted(stats SnapshotStats) {
+	p.disarmed = true
+}
+
+// snapshot after MaxEntries entries have been applied since the last one
+type EntryPolicy struct {
+	MaxEntries int
+}
+
+func (p *EntryPolicy) ShouldSnapshot(stats SnapshotStats) bool {
+	return p.MaxEntries > 0 && stats.AppliedSince >= p.MaxEntries
+}
+
+func (p *EntryPolicy) Snapshotted(stats SnapshotStats) {}
+
+// snapshot when Interval has passed since the last one and something was applied since
+type IntervalPolicy struct {
+	Interval time.Duration
+}
+
+func (p *IntervalPolicy) ShouldSnapshot(stats SnapshotStats) bool {
+	return p.Interval > 0 && stats.AppliedSince > 0 && stats.SinceLast >= p.Interval
+}
+
+func (p *IntervalPolicy) Snapshotted(stats SnapshotStats) {}
+
+// snapshot as soon as any of the policies wants to
+type anyPolicy []SnapshotPolicy
+
+func AnyPolicy(policies ...SnapshotPolicy) SnapshotPolicy {
+	return anyPolicy(policies)
+}
+
+func (ps anyPolicy) ShouldSnapshot(stats SnapshotStats) bool {
+	ret := false
+	// ask every policy, so that stateful ones all see the same stats
+	for _, p := range ps {
+		if p.ShouldSnapshot(stats) {
+			ret = true
+		}
+	}
+	return ret
+}
+
+func (ps anyPolicy) Snapshotted(stats SnapshotStats) {
+	for _, p := range ps {
+		p.Snapshotted(stats)
+	}
+}
+
+// snapshot this server's state and trim its log right away, whatever the
+// policy says, e.g. before a planned restart or after a bulk load. each
+// server trims its own log, see SnapshotAll.
+func (kv *KVServer) AdminSnapshot(args *AdminSnapshotArgs, reply *AdminSnapshotReply) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.lastApplied > kv.lastSnapshotIndex {
+		kv.takeSnapShot(kv.lastApplied)
+		reply.Taken = true
+	}
+	reply.Index = kv.lastSnapshotIndex
+	reply.Size = kv.persister.SnapshotSize()
+}
+
+// AdminSnapshot on every server, nil for those that didn't answer
+func SnapshotAll(servers []transport.Endpoint) []*AdminSnapshotReply {
+	replies := make([]*AdminSnapshotReply, len(servers))
+	for i, server := range servers {
+		reply := new(AdminSnapshotReply)
+		if server.Call("KVServer.AdminSnapshot", &AdminSnapshotArgs{}, reply) {
+			replies[i] = reply
+		}
+	}
+	return replies
+}
@@ -0,0 +1,63 @@
+package kvraft
+
+import (
+	"log"
+	"time"
+)
+
+// the leader periodically proposes a StateCheck entry. every replica applying
+// it records the hash of its state at that index, and the entry carries the
+// leader's hash recorded at the previous check, so each replica can compare it
+// with its own record of the same index. replicas at the same index must hold
+// the same state, so any mismatch means silent divergence.
+const StateCheck = "StateCheck"
+
+const defaultStateCheckInterval = 5 * time.Second
+
+// called with the index of the check, this replica's hash and the leader's
+type DivergenceHandler func(index int, local uint64, leader uint64)
+
+// zero disables the periodic check
+func (kv *KVServer) SetStateCheckInterval(interval time.Duration) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.stateCheckInterval = interval
+}
+
+func (kv *KVServer) SetDivergenceHandler(handler DivergenceHandler) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.onDivergence = handler
+}
+
+func (kv *KVServer) stateChecker() {
+	lastCheck := time.Now()
+	for !kv.killed() {
+		// poll rather than sleep a whole interval, so interval changes apply quickly
+		time.Sleep(50 * time.Millisecond)
+		kv.mu.RLock()
+		interval := kv.stateCheckInterval
+		op := Op{OpTask: StateCheck, CheckIndex: kv.lastCheckIndex, CheckHash: kv.lastCheckHash}
+		kv.mu.RUnlock()
+		if interval <= 0 || time.Since(lastCheck) < interval {
+			continue
+		}
+		lastCheck = time.Now()
+		// does nothing on followers
+		kv.rf.Start(op)
+	}
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applyStateCheck(op Op, index int) {
+	if op.CheckIndex != 0 && op.CheckIndex == kv.lastCheckIndex && op.CheckHash != kv.lastCheckHash {
+		kv.divergences++
+		if kv.onDivergence != nil {
+			kv.onDivergence(op.CheckIndex, kv.lastCheckHash, op.CheckHash)
+		} else {
+			log.Printf("kvserver %v: state diverged from leader at index %v (local %x, leader %x)",
+				kv.me, op.CheckIndex, kv.lastCheckHash, op.CheckHash)
+		}
+	}
+	kv.lastCheckIndex, kv.lastCheckHash = index, kv.storage.Hash()
+}
@@ -0,0 +1,47 @@
+package kvraft
+
+import "raft/transport"
+
+// this server's view, served locally without going through raft, so tests
+// and operators can check on a cluster without digging through logs
+func (kv *KVServer) Status(args *StatusArgs, reply *StatusReply) {
+	reply.Raft = kv.rf.Status()
+	reply.IsLeader = reply.Raft.State == "Leader"
+	reply.SnapshotSize = kv.persister.SnapshotSize()
+	reply.RaftStateSize = kv.persister.RaftStateSize()
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	reply.AppliedIndex = kv.lastApplied
+	reply.Keys = kv.storage.Len()
+	reply.Buckets = len(kv.storage.buckets)
+	reply.Size = kv.storage.Size()
+	reply.Quota = kv.quota
+	reply.Alarms = kv.alarmList()
+	reply.Revision, reply.Oldest = kv.storage.Revision(), kv.storage.Oldest()
+	reply.Clients = len(kv.latestTime)
+	reply.Leases = len(kv.leases)
+	reply.SnapshotIndex = kv.lastSnapshotIndex
+}
+
+// the status of the first server that answers, trying the leader first
+func (ck *Clerk) Status() *StatusReply {
+	for {
+		reply := new(StatusReply)
+		if ck.servers[ck.leaderId].Call("KVServer.Status", &StatusArgs{}, reply) {
+			return reply
+		}
+		ck.leaderId = (ck.leaderId + 1) % int64(len(ck.servers))
+	}
+}
+
+// the status of every server, nil for those that didn't answer
+func ClusterStatus(servers []transport.Endpoint) []*StatusReply {
+	replies := make([]*StatusReply, len(servers))
+	for i, server := range servers {
+		reply := new(StatusReply)
+		if server.Call("KVServer.Status", &StatusArgs{}, reply) {
+			replies[i] = reply
+		}
+	}
+	return replies
+}
@@ -1,11 +1,28 @@
 package kvraft
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"raft/labgob"
+	"raft/metrics"
 	"raft/models"
 	"raft/porcupine"
+	"raft/raft"
+	"raft/transport"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -716,3 +733,4570 @@ func TestSnapshotUnreliableRecoverConcurrentPartitionLinearizable3B(t *testing.T
 	// Test: unreliable net, restarts, partitions, snapshots, random keys, many clients (3B) ...
 	GenericTest(t, "3B", 15, 7, true, true, true, 1000, true)
 }
+
+func TestSizePolicyHysteresis(t *testing.T) {
+	p := NewSizePolicy(1000)
+	p.MinInterval = 0
+	if p.ShouldSnapshot(SnapshotStats{RaftStateSize: 700}) {
+		t.Fatalf("snapshot below the high threshold")
+	}
+	if !p.ShouldSnapshot(SnapshotStats{RaftStateSize: 800}) {
+		t.Fatalf("no snapshot at the high threshold")
+	}
+	p.Snapshotted(SnapshotStats{RaftStateSize: 800})
+	if p.ShouldSnapshot(SnapshotStats{RaftStateSize: 850}) {
+		t.Fatalf("snapshot again before dropping below the low threshold")
+	}
+	if !p.ShouldSnapshot(SnapshotStats{RaftStateSize: 1000}) {
+		t.Fatalf("no snapshot at the hard limit")
+	}
+	p.ShouldSnapshot(SnapshotStats{RaftStateSize: 100})
+	if !p.ShouldSnapshot(SnapshotStats{RaftStateSize: 800}) {
+		t.Fatalf("no snapshot after dropping below the low threshold")
+	}
+}
+
+func TestSizePolicyMinInterval(t *testing.T) {
+	p := NewSizePolicy(1000)
+	soon := p.MinInterval / 2
+	if p.ShouldSnapshot(SnapshotStats{RaftStateSize: 800, SinceLast: soon}) {
+		t.Fatalf("snapshot at the high threshold within MinInterval of the last one")
+	}
+	if !p.ShouldSnapshot(SnapshotStats{RaftStateSize: 1000, SinceLast: soon}) {
+		t.Fatalf("no snapshot at the hard limit within MinInterval of the last one")
+	}
+	// held back, not disarmed
+	if !p.ShouldSnapshot(SnapshotStats{RaftStateSize: 800, SinceLast: p.MinInterval}) {
+		t.Fatalf("no snapshot at the high threshold once MinInterval passed")
+	}
+}
+
+func TestSnapshotEntryPolicy3B(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].SetSnapshotPolicy(&EntryPolicy{MaxEntries: 10})
+	}
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: snapshot by entry count (3B)")
+
+	for i := 0; i < 30; i++ {
+		Put(cfg, ck, strconv.Itoa(i), strconv.Itoa(i), nil, -1)
+	}
+	time.Sleep(electionTimeout)
+	if cfg.SnapshotSize() == 0 {
+		t.Fatalf("entry policy never took a snapshot")
+	}
+	check(cfg, t, ck, "29", "29")
+
+	cfg.end()
+}
+
+func TestVerifyReplicas3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: replicas verify identical (3A)")
+
+	for i := 0; i < 20; i++ {
+		Put(cfg, ck, strconv.Itoa(i), strconv.Itoa(i), nil, -1)
+	}
+	// let followers learn the final commit index
+	time.Sleep(electionTimeout)
+
+	report := VerifyReplicas(ck.servers, 4)
+	if report.DivergentIndex != -1 || report.StateDiverged || len(report.Unreachable) != 0 {
+		t.Fatalf("healthy replicas reported as diverged: %+v", report)
+	}
+
+	cfg.end()
+}
+
+func TestBackup3B(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, 1000)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: streaming backup (3B)")
+
+	for i := 0; i < 50; i++ {
+		Put(cfg, ck, strconv.Itoa(i), strconv.Itoa(i), nil, -1)
+	}
+
+	var buf bytes.Buffer
+	_, leader := cfg.Leader()
+	meta, err := cfg.kvservers[leader].Backup(&buf)
+	if err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	if meta.AppliedIndex == 0 || meta.KeyCount == 0 {
+		t.Fatalf("backup metadata is empty: %+v", meta)
+	}
+
+	raw := buf.Bytes()
+	_, state, err := ReadBackup(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("reading backup failed: %v", err)
+	}
+	restored := &KVServer{storage: NewMemoryKV()}
+	restored.installSnapshot(state)
+	if restored.lastApplied != meta.AppliedIndex || len(restored.storage.GetKV()) != meta.KeyCount {
+		t.Fatalf("restored state doesn't match backup metadata %+v", meta)
+	}
+
+	raw[len(raw)-1] ^= 0xff
+	if _, _, err := ReadBackup(bytes.NewReader(raw)); !errors.Is(err, ErrBadBackup) {
+		t.Fatalf("corrupted backup not detected: %v", err)
+	}
+
+	cfg.end()
+}
+
+func TestRestoreFromBackup3B(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, 1000)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: bootstrap a cluster from a backup (3B)")
+
+	for i := 0; i < 30; i++ {
+		Put(cfg, ck, strconv.Itoa(i), strconv.Itoa(i), nil, -1)
+	}
+
+	f, err := ioutil.TempFile("", "kvbackup")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Remove(f.Name())
+	// followers may not have applied the last put yet
+	_, leader := cfg.Leader()
+	if _, err := cfg.kvservers[leader].Backup(f); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	f.Close()
+
+	// wipe every server and bring it back from the backup
+	for i := 0; i < nservers; i++ {
+		cfg.ShutdownServer(i)
+	}
+	for i := 0; i < nservers; i++ {
+		if err := cfg.StartServerFromBackup(i, f.Name()); err != nil {
+			t.Fatalf("restore from backup failed: %v", err)
+		}
+	}
+	cfg.ConnectAll()
+
+	check(cfg, t, ck, "0", "0")
+	check(cfg, t, ck, "29", "29")
+	Put(cfg, ck, "after", "restore", nil, -1)
+	check(cfg, t, ck, "after", "restore")
+
+	if _, err := StartKVServerFromBackup(nil, 0, cfg.saved[0], -1, f.Name()); err != raft.ErrPersisterNotEmpty {
+		t.Fatalf("restore overwrote existing state: %v", err)
+	}
+
+	cfg.end()
+}
+
+func TestLegacySnapshotFormat(t *testing.T) {
+	// snapshots written before format versioning: storage and latestTime only
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(map[string]string{"a": "1"})
+	e.Encode(map[int64]int64{7: 3})
+
+	kv := &KVServer{storage: NewMemoryKV()}
+	kv.installSnapshot(w.Bytes())
+	if v, _ := kv.storage.Get("a"); string(v) != "1" || kv.latestTime[7] != 3 {
+		t.Fatalf("legacy snapshot not migrated: %v %v", kv.storage.GetKV(), kv.latestTime)
+	}
+
+	version, _ := raft.SplitFormatVersion(kv.saveState())
+	if version != snapshotVersion {
+		t.Fatalf("snapshot saved with version %v, expected %v", version, snapshotVersion)
+	}
+
+	// version 5, the last with string values
+	w = new(bytes.Buffer)
+	e = labgob.NewEncoder(w)
+	e.Encode(map[string]string{"a": "1", "b": "2"})
+	e.Encode(map[int64]int64{7: 3, 8: 1})
+	e.Encode(10)
+	e.Encode(1)
+	e.Encode(map[string]int64{"a": 4, "b": 1})
+	e.Encode(map[string]int64{})
+	e.Encode(map[string]int64{})
+	e.Encode(map[int64]*Lease{})
+	e.Encode(9)
+	kv = &KVServer{storage: NewMemoryKV()}
+	kv.installSnapshot(raft.AddFormatVersion(5, w.Bytes()))
+	if v, _ := kv.storage.Get("b"); string(v) != "2" || kv.storage.Version("a") != 4 || kv.storage.Revision() != 9 {
+		t.Fatalf("version 5 snapshot not migrated: %v", kv.storage.GetKV())
+	}
+
+	// from version 9 on, the result of each client's latest command is kept
+	kv.lastResult[7] = opResult{Err: OK, Value: []byte("1")}
+	restored := &KVServer{storage: NewMemoryKV()}
+	restored.installSnapshot(kv.saveState())
+	if r := restored.lastResult[7]; string(r.Value) != "1" {
+		t.Fatalf("cached result not restored: %+v", r)
+	}
+
+	// version 12, the membership after a flag rather than in a section
+	members := []Member{{Id: "n1", Addr: "a1"}, {Id: "n2", Addr: "a2", Learner: true}}
+	w = new(bytes.Buffer)
+	e = labgob.NewEncoder(w)
+	e.Encode(map[string][]byte{"a": []byte("1")})
+	e.Encode(map[int64]int64{})
+	e.Encode(10)
+	e.Encode(1)
+	e.Encode(map[string]int64{"a": 1})
+	e.Encode(map[string]int64{})
+	e.Encode(map[string]int64{})
+	e.Encode(map[int64]*Lease{})
+	e.Encode(10)
+	e.Encode(0) // buckets
+	e.Encode(map[int64]int64{})
+	e.Encode(map[int64]opResult{})
+	e.Encode(0) // alarms
+	auth := newAuthState()
+	auth.encode(e)
+	e.Encode(true)
+	(&KVServer{members: members}).encodeMembership(e)
+	kv = &KVServer{storage: NewMemoryKV()}
+	kv.installSnapshot(raft.AddFormatVersion(12, w.Bytes()))
+	if !reflect.DeepEqual(kv.members, members) || kv.compacted != 0 {
+		t.Fatalf("version 12 snapshot not migrated: %+v %v", kv.members, kv.compacted)
+	}
+
+	// and back, with the compacted revision
+	kv.compacted = 7
+	restored = &KVServer{storage: NewMemoryKV()}
+	restored.installSnapshot(kv.saveState())
+	if !reflect.DeepEqual(restored.members, members) || restored.compacted != 7 {
+		t.Fatalf("snapshot sections not restored: %+v %v", restored.members, restored.compacted)
+	}
+}
+
+func TestStateCheck3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	var mu sync.Mutex
+	diverged := map[int]bool{}
+	for i := 0; i < nservers; i++ {
+		i := i
+		cfg.kvservers[i].SetStateCheckInterval(100 * time.Millisecond)
+		cfg.kvservers[i].SetDivergenceHandler(func(index int, local uint64, leader uint64) {
+			mu.Lock()
+			defer mu.Unlock()
+			diverged[i] = true
+		})
+	}
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: replicated state checks (3A)")
+
+	for i := 0; i < 10; i++ {
+		Put(cfg, ck, strconv.Itoa(i), strconv.Itoa(i), nil, -1)
+	}
+	time.Sleep(500 * time.Millisecond)
+	mu.Lock()
+	if len(diverged) != 0 {
+		t.Fatalf("healthy replicas reported divergence: %v", diverged)
+	}
+	mu.Unlock()
+
+	// silently corrupt one follower
+	_, leader := cfg.Leader()
+	victim := (leader + 1) % nservers
+	cfg.kvservers[victim].mu.Lock()
+	cfg.kvservers[victim].storage.Put("0", []byte("corrupted"))
+	cfg.kvservers[victim].mu.Unlock()
+
+	time.Sleep(500 * time.Millisecond)
+	mu.Lock()
+	if !diverged[victim] {
+		t.Fatalf("divergence of server %v not detected: %v", victim, diverged)
+	}
+	mu.Unlock()
+
+	cfg.end()
+}
+
+func TestStaleRead3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: stale reads from any replica (3A)")
+
+	Put(cfg, ck, "k", "1", nil, -1)
+	time.Sleep(200 * time.Millisecond)
+
+	// cut one follower off, it keeps serving its old state
+	_, leader := cfg.Leader()
+	isolated := (leader + 1) % nservers
+	others := []int{}
+	for i := 0; i < nservers; i++ {
+		if i != isolated {
+			others = append(others, i)
+		}
+	}
+	cfg.partition(others, []int{isolated})
+	Put(cfg, ck, "k", "2", nil, -1)
+
+	stale := cfg.makeClient([]int{isolated})
+	if v := stale.GetStale("k"); string(v) != "1" {
+		t.Fatalf("stale read from isolated server got %v, expected 1", v)
+	}
+	if v := ck.Get("k"); v != "2" {
+		t.Fatalf("linearizable read got %v, expected 2", v)
+	}
+
+	// it must not serve a clerk that has already seen a newer index
+	reply := new(CommandReply)
+	cfg.kvservers[isolated].Command(&CommandArgs{Key: "k", Op: Gett, Consistency: Stale, MinIndex: ck.seenIndex}, reply)
+	if reply.Err != ErrStale {
+		t.Fatalf("isolated server answered a read newer than it has applied: %v", reply.Err)
+	}
+
+	// unless it may wait long enough to catch up
+	done := make(chan *CommandReply)
+	args := CommandArgs{Key: "k", Op: Gett, Consistency: Stale, MinIndex: ck.seenIndex, Timeout: 5 * time.Second}
+	go func() {
+		reply := new(CommandReply)
+		cfg.kvservers[isolated].Command(&args, reply)
+		done <- reply
+	}()
+	time.Sleep(200 * time.Millisecond)
+	cfg.ConnectAll()
+	if reply := <-done; reply.Err != OK || string(reply.Value) != "2" || reply.Index < args.MinIndex {
+		t.Fatalf("read waiting for index %v got %v %q at %v", args.MinIndex, reply.Err, reply.Value, reply.Index)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if v := ck.GetStale("k"); string(v) != "2" {
+		t.Fatalf("stale read after healing got %v, expected 2", v)
+	}
+
+	cfg.end()
+}
+
+func TestApplyResults3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: replies carry the applied op's result (3A)")
+
+	clientId := nrand()
+	command := func(args CommandArgs) *CommandReply {
+		args.ClientId = clientId
+		for {
+			_, leader := cfg.Leader()
+			reply := new(CommandReply)
+			cfg.kvservers[leader].Command(&args, reply)
+			if reply.Err == OK || reply.Err == ErrNoKey {
+				return reply
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	if reply := command(CommandArgs{Op: Gett, Key: "a", CommandId: 0}); reply.Err != ErrNoKey {
+		t.Fatalf("Get of a missing key returned %v, expected %v", reply.Err, ErrNoKey)
+	}
+	reply := command(CommandArgs{Op: Appendd, Key: "a", Value: []byte("x"), CommandId: 1})
+	if reply.Err != OK || string(reply.Value) != "x" {
+		t.Fatalf("Append returned %v %q, expected OK \"x\"", reply.Err, reply.Value)
+	}
+	reply = command(CommandArgs{Op: Appendd, Key: "a", Value: []byte("y"), CommandId: 2})
+	if string(reply.Value) != "xy" {
+		t.Fatalf("Append returned %q, expected \"xy\"", reply.Value)
+	}
+	first := reply.Index
+	reply = command(CommandArgs{Op: Gett, Key: "a", CommandId: 3})
+	if reply.Err != OK || string(reply.Value) != "xy" || reply.Index <= first {
+		t.Fatalf("Get returned %v %q at %v, expected OK \"xy\" after %v", reply.Err, reply.Value, reply.Index, first)
+	}
+
+	// a retry gets the original result back, not the key's current value
+	command(CommandArgs{Op: Incr, Key: "n", Delta: 1, CommandId: 4})
+	ck := cfg.makeClient(cfg.All())
+	ck.Put("n", "10")
+	reply = command(CommandArgs{Op: Incr, Key: "n", Delta: 1, CommandId: 4})
+	if string(reply.Value) != "1" {
+		t.Fatalf("retried Incr returned %q, expected \"1\"", reply.Value)
+	}
+	if v := ck.Get("n"); v != "10" {
+		t.Fatalf("retried Incr was applied again, n is %q", v)
+	}
+
+	cfg.end()
+}
+
+func TestDelete3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: delete (3A)")
+
+	Put(cfg, ck, "a", "1", nil, -1)
+	if !ck.Delete("a") {
+		t.Fatalf("Delete of an existing key reported it missing")
+	}
+	if v := ck.Get("a"); v != "" {
+		t.Fatalf("Get after Delete got %q", v)
+	}
+	if ck.Delete("a") {
+		t.Fatalf("second Delete reported the key as existing")
+	}
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].mu.RLock()
+		found := cfg.kvservers[i].storage.Found("a")
+		cfg.kvservers[i].mu.RUnlock()
+		if found {
+			t.Fatalf("server %v still holds the deleted key", i)
+		}
+	}
+
+	cfg.end()
+}
+
+func TestCompareAndSwap3A(t *testing.T) {
+	const nservers = 5
+	const nclients = 5
+	const nswaps = 10
+	cfg := make_config(t, nservers, true, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: compare-and-swap, unreliable net (3A)")
+
+	if ok, v := ck.CompareAndSwap("n", []byte("x"), []byte("1")); ok || string(v) != "" {
+		t.Fatalf("CompareAndSwap on a missing key swapped=%v found %q", ok, v)
+	}
+	if ok, _ := ck.CompareAndSwap("n", nil, []byte("0")); !ok {
+		t.Fatalf("CompareAndSwap expecting a missing key didn't swap")
+	}
+
+	// clients race to increment the counter, each swap must count exactly once
+	// even when the network drops replies and the clerk retries
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			myck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(myck)
+			for done := 0; done < nswaps; {
+				v := myck.Get("n")
+				n, _ := strconv.Atoi(v)
+				if ok, _ := myck.CompareAndSwap("n", []byte(v), []byte(strconv.Itoa(n+1))); ok {
+					done++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v := ck.Get("n"); v != strconv.Itoa(nclients*nswaps) {
+		t.Fatalf("counter is %v after %v successful swaps", v, nclients*nswaps)
+	}
+
+	cfg.end()
+}
+
+func TestCompareAndDelete3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: compare-and-delete (3A)")
+
+	if ok, _ := ck.CompareAndDelete("lock", nil); ok {
+		t.Fatalf("CompareAndDelete removed a missing key")
+	}
+	Put(cfg, ck, "lock", "owner-1", nil, -1)
+	// owner 1 lost its lease and owner 2 took the lock over
+	Put(cfg, ck, "lock", "owner-2", nil, -1)
+	if ok, v := ck.CompareAndDelete("lock", []byte("owner-1")); ok || string(v) != "owner-2" {
+		t.Fatalf("stale owner's CompareAndDelete: removed=%v found %q", ok, v)
+	}
+	if ok, _ := ck.CompareAndDelete("lock", []byte("owner-2")); !ok {
+		t.Fatalf("current owner's CompareAndDelete didn't remove the lock")
+	}
+	if v := ck.Get("lock"); v != "" {
+		t.Fatalf("lock still held by %q", v)
+	}
+
+	cfg.end()
+}
+
+func TestIncr3A(t *testing.T) {
+	const nservers = 5
+	const nclients = 5
+	const nincrs = 20
+	cfg := make_config(t, nservers, true, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: atomic increment, unreliable net (3A)")
+
+	// retried increments must be applied exactly once
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			myck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(myck)
+			for i := 0; i < nincrs; i++ {
+				myck.Incr("n", 2)
+				myck.Incr("n", -1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v := ck.Get("n"); v != strconv.Itoa(nclients*nincrs) {
+		t.Fatalf("counter is %v, expected %v", v, nclients*nincrs)
+	}
+	if n, ok := ck.Incr("n", 5); !ok || n != nclients*nincrs+5 {
+		t.Fatalf("Incr returned %v %v", n, ok)
+	}
+
+	Put(cfg, ck, "s", "abc", nil, -1)
+	if _, ok := ck.Incr("s", 1); ok {
+		t.Fatalf("Incr of a non-integer value succeeded")
+	}
+	if v := ck.Get("s"); v != "abc" {
+		t.Fatalf("failed Incr changed the value to %q", v)
+	}
+
+	cfg.end()
+}
+
+func TestRange3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: range scans (3A)")
+
+	for i := 9; i >= 0; i-- {
+		Put(cfg, ck, "k"+strconv.Itoa(i), strconv.Itoa(i), nil, -1)
+	}
+	Put(cfg, ck, "other", "x", nil, -1)
+	ck.Delete("k5")
+
+	// page through [k, l) three keys at a time
+	got := []string{}
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatalf("range scan doesn't terminate")
+		}
+		var pairs []KeyValue
+		pairs, token = ck.Range("k", "l", 3, token)
+		if len(pairs) > 3 {
+			t.Fatalf("page of %v pairs exceeds the limit", len(pairs))
+		}
+		for _, kv := range pairs {
+			if string(kv.Value) != kv.Key[1:] {
+				t.Fatalf("range returned %v=%v", kv.Key, kv.Value)
+			}
+			got = append(got, kv.Key)
+		}
+		if token == "" {
+			break
+		}
+	}
+	expected := []string{"k0", "k1", "k2", "k3", "k4", "k6", "k7", "k8", "k9"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Fatalf("range returned %v, expected %v", got, expected)
+	}
+
+	if pairs, next := ck.Range("k8", "", 0, ""); len(pairs) != 3 || pairs[2].Key != "other" || next != "" {
+		t.Fatalf("unbounded range returned %v %q", pairs, next)
+	}
+
+	cfg.end()
+}
+
+func TestGetByPrefix3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: prefix scans (3A)")
+
+	keys := []string{"/config/db/host", "/config/service/a", "/config/service/b",
+		"/config/service/c", "/config/serviceX", "/config/servicf"}
+	for _, key := range keys {
+		Put(cfg, ck, key, "v", nil, -1)
+	}
+
+	pairs, more := ck.GetByPrefix("/config/service/", 0)
+	if len(pairs) != 3 || more || pairs[0].Key != "/config/service/a" || pairs[2].Key != "/config/service/c" {
+		t.Fatalf("GetByPrefix returned %v more=%v", pairs, more)
+	}
+	if pairs, more := ck.GetByPrefix("/config/service/", 2); len(pairs) != 2 || !more {
+		t.Fatalf("limited GetByPrefix returned %v more=%v", pairs, more)
+	}
+	if pairs, _ := ck.GetByPrefix("/config/service", 0); len(pairs) != 4 {
+		t.Fatalf("GetByPrefix without trailing slash returned %v", pairs)
+	}
+	if pairs, _ := ck.GetByPrefix("/nothing/", 0); len(pairs) != 0 {
+		t.Fatalf("GetByPrefix of an unused prefix returned %v", pairs)
+	}
+	if prefixEnd("a\xff\xff") != "b" || prefixEnd("\xff") != "" {
+		t.Fatalf("prefixEnd: %q %q", prefixEnd("a\xff\xff"), prefixEnd("\xff"))
+	}
+
+	cfg.end()
+}
+
+func TestCursor3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: cursors see a consistent view (3A)")
+
+	for i := 0; i < 20; i++ {
+		Put(cfg, ck, fmt.Sprintf("k%02d", i), "old", nil, -1)
+	}
+
+	cur := ck.OpenCursor("k", "")
+	defer cur.Close()
+
+	// writes after opening must not show up in the scan
+	for i := 0; i < 20; i += 2 {
+		Put(cfg, ck, fmt.Sprintf("k%02d", i), "new", nil, -1)
+	}
+	Put(cfg, ck, "k99", "new", nil, -1)
+	ck.Delete("k01")
+
+	n := 0
+	for {
+		pairs, err := cur.Next(6)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("cursor failed: %v", err)
+		}
+		for _, kv := range pairs {
+			if kv.Key != fmt.Sprintf("k%02d", n) || string(kv.Value) != "old" {
+				t.Fatalf("cursor returned %v=%v at position %v", kv.Key, kv.Value, n)
+			}
+			n++
+		}
+	}
+	if n != 20 {
+		t.Fatalf("cursor returned %v pairs, expected 20", n)
+	}
+
+	cur.Close()
+	if _, err := cur.Next(1); err != io.EOF {
+		t.Fatalf("exhausted cursor returned %v", err)
+	}
+	closed := &Cursor{ck: ck, server: cur.server, id: cur.id}
+	if _, err := closed.Next(1); err != ErrCursorLost {
+		t.Fatalf("closed cursor returned %v", err)
+	}
+
+	cfg.end()
+}
+
+func TestTxn3A(t *testing.T) {
+	const nservers = 5
+	const nclients = 5
+	const ntransfers = 10
+	cfg := make_config(t, nservers, true, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: multi-key transactions, unreliable net (3A)")
+
+	Put(cfg, ck, "a", "100", nil, -1)
+	Put(cfg, ck, "b", "0", nil, -1)
+
+	// concurrent transfers from a to b, which must never lose or create money
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			myck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(myck)
+			for done := 0; done < ntransfers; {
+				read := myck.Txn(TxnRequest{Reads: []string{"a", "b"}})
+				a, _ := strconv.Atoi(string(read.Reads[0].Value))
+				b, _ := strconv.Atoi(string(read.Reads[1].Value))
+				result := myck.Txn(TxnRequest{
+					Conditions: []TxnCondition{{Key: "a", Value: read.Reads[0].Value}, {Key: "b", Value: read.Reads[1].Value}},
+					Writes:     []TxnWrite{{Putt, "a", []byte(strconv.Itoa(a - 1))}, {Putt, "b", []byte(strconv.Itoa(b + 1))}},
+				})
+				if result.Succeeded {
+					done++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := ck.Txn(TxnRequest{Reads: []string{"a", "b"}})
+	if !result.Succeeded || string(result.Reads[0].Value) != strconv.Itoa(100-nclients*ntransfers) ||
+		string(result.Reads[1].Value) != strconv.Itoa(nclients*ntransfers) {
+		t.Fatalf("balances after transfers: %v", result.Reads)
+	}
+
+	// a failed condition writes nothing
+	result = ck.Txn(TxnRequest{
+		Conditions: []TxnCondition{{Key: "a", Value: []byte("50")}, {Key: "b", Value: []byte("wrong")}},
+		Writes:     []TxnWrite{{Putt, "a", []byte("x")}, {Deletee, "b", nil}},
+	})
+	if result.Succeeded || result.Failed != 1 {
+		t.Fatalf("transaction with a false condition returned %+v", result)
+	}
+	if v := ck.Get("a"); v != "50" {
+		t.Fatalf("failed transaction wrote a=%v", v)
+	}
+	if result := ck.Txn(TxnRequest{Writes: []TxnWrite{{"Bogus", "a", nil}}}); result.Succeeded || result.Failed != -1 {
+		t.Fatalf("transaction with an unknown write returned %+v", result)
+	}
+
+	cfg.end()
+}
+
+func TestTxnIfThenElse3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck1 := cfg.makeClient(cfg.All())
+	ck2 := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: If/Then/Else transactions (3A)")
+
+	// leader election, only the first candidate wins
+	elect := func(ck *Clerk, me string) TxnResult {
+		return ck.If(CompareVersion("leader", CmpEqual, 0)).
+			Then(OpPut("leader", []byte(me)), OpPut("epoch", []byte("1"))).
+			Else(OpGet("leader")).
+			Commit()
+	}
+	if result := elect(ck1, "s1"); !result.Succeeded {
+		t.Fatalf("first candidate lost the election: %+v", result)
+	}
+	result := elect(ck2, "s2")
+	if result.Succeeded || len(result.Reads) != 1 || string(result.Reads[0].Value) != "s1" {
+		t.Fatalf("second candidate's election returned %+v", result)
+	}
+
+	// fencing: a write only goes through while the leader key is unchanged
+	version := int64(1)
+	fenced := func(ck *Clerk) bool {
+		return ck.If(CompareVersion("leader", CmpEqual, version), CompareValue("leader", CmpEqual, []byte("s1"))).
+			Then(OpAppend("log", []byte("x"))).
+			Commit().Succeeded
+	}
+	if !fenced(ck1) {
+		t.Fatalf("write fenced by the current leadership failed")
+	}
+	Put(cfg, ck2, "leader", "s2", nil, -1)
+	if fenced(ck1) {
+		t.Fatalf("write by a deposed leader went through")
+	}
+	if v := ck1.Get("log"); v != "x" {
+		t.Fatalf("log is %q", v)
+	}
+
+	if result := ck1.If(CompareVersion("leader", CmpGreater, 1), CompareValue("epoch", CmpLess, []byte("2"))).Commit(); !result.Succeeded {
+		t.Fatalf("ordered comparisons failed: %+v", result)
+	}
+
+	// versions survive a snapshot
+	_, leader := cfg.Leader()
+	cfg.kvservers[leader].mu.RLock()
+	state := cfg.kvservers[leader].saveState()
+	cfg.kvservers[leader].mu.RUnlock()
+	restored := &KVServer{storage: NewMemoryKV()}
+	restored.installSnapshot(state)
+	if v := restored.storage.Version("leader"); v != 2 {
+		t.Fatalf("restored version of leader is %v, expected 2", v)
+	}
+
+	cfg.end()
+}
+
+func TestWatch3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: watches (3A)")
+
+	next := func(w *Watcher) WatchEvent {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				t.Fatalf("watch ended: %v", w.Err())
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no watch event")
+		}
+		return WatchEvent{}
+	}
+	expect := func(w *Watcher, typ string, key string, value string) WatchEvent {
+		event := next(w)
+		if event.Type != typ || event.Key != key || string(event.Value) != value {
+			t.Fatalf("got event %+v, expected %v %v=%v", event, typ, key, value)
+		}
+		return event
+	}
+
+	w := ck.Watch("/svc/", true, 0)
+	defer w.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	Put(cfg, ck, "/other", "x", nil, -1)
+	Put(cfg, ck, "/svc/a", "1", nil, -1)
+	Append(cfg, ck, "/svc/a", "2", nil, -1)
+	ck.Txn(TxnRequest{Writes: []TxnWrite{{Putt, "/svc/b", []byte("3")}, {Deletee, "/svc/a", nil}}})
+
+	first := expect(w, EventPut, "/svc/a", "1")
+	expect(w, EventPut, "/svc/a", "12")
+	b := expect(w, EventPut, "/svc/b", "3")
+	del := expect(w, EventDelete, "/svc/a", "")
+	if first.Revision <= 0 || b.Revision != del.Revision {
+		t.Fatalf("revisions %v %v %v", first.Revision, b.Revision, del.Revision)
+	}
+
+	// replay from history
+	replay := ck.Watch("/svc/a", false, first.Revision)
+	defer replay.Close()
+	expect(replay, EventPut, "/svc/a", "1")
+	expect(replay, EventPut, "/svc/a", "12")
+	expect(replay, EventDelete, "/svc/a", "")
+
+	// losing the replica serving the watch doesn't lose events
+	_, leader := cfg.Leader()
+	cfg.ShutdownServer(leader)
+	Put(cfg, ck, "/svc/c", "4", nil, -1)
+	expect(w, EventPut, "/svc/c", "4")
+	cfg.StartServer(leader)
+	cfg.ConnectAll()
+
+	cfg.end()
+}
+
+func TestTTL3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: keys with a TTL expire on every replica (3A)")
+
+	ck.PutWithTTL("short", []byte("1"), 300*time.Millisecond)
+	ck.PutWithTTL("refreshed", []byte("1"), 300*time.Millisecond)
+	ck.PutWithTTL("permanent", []byte("1"), 300*time.Millisecond)
+	ck.Put("permanent", "2")
+	Put(cfg, ck, "plain", "1", nil, -1)
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(150 * time.Millisecond)
+		ck.PutWithTTL("refreshed", []byte(strconv.Itoa(i)), 300*time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	if v := ck.Get("short"); v != "" {
+		t.Fatalf("short-lived key still holds %q", v)
+	}
+	if v := ck.Get("refreshed"); v != "3" {
+		t.Fatalf("refreshed key holds %q", v)
+	}
+	if v := ck.Get("permanent"); v != "2" {
+		t.Fatalf("key made permanent holds %q", v)
+	}
+	if v := ck.Get("plain"); v != "1" {
+		t.Fatalf("key without a TTL holds %q", v)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if v := ck.Get("refreshed"); v != "" {
+		t.Fatalf("refreshed key didn't expire, holds %q", v)
+	}
+
+	// every replica deleted them at the same index
+	time.Sleep(200 * time.Millisecond)
+	if report := VerifyReplicas(ck.servers, 8); report.DivergentIndex != -1 || report.StateDiverged {
+		t.Fatalf("replicas disagree: %+v", report)
+	}
+
+	cfg.end()
+}
+
+func TestLease3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: leases (3A)")
+
+	kept := ck.GrantLease(400 * time.Millisecond)
+	lapsed := ck.GrantLease(400 * time.Millisecond)
+	revoked := ck.GrantLease(time.Minute)
+	if kept == 0 || kept == lapsed || lapsed == revoked {
+		t.Fatalf("lease ids %v %v %v", kept, lapsed, revoked)
+	}
+	for i := 0; i < 3; i++ {
+		if !ck.PutWithLease("kept/"+strconv.Itoa(i), []byte("x"), kept) ||
+			!ck.PutWithLease("lapsed/"+strconv.Itoa(i), []byte("x"), lapsed) ||
+			!ck.PutWithLease("revoked/"+strconv.Itoa(i), []byte("x"), revoked) {
+			t.Fatalf("PutWithLease on a live lease failed")
+		}
+	}
+	// detached again by a plain Put
+	ck.Put("lapsed/0", "y")
+
+	if !ck.RevokeLease(revoked) {
+		t.Fatalf("RevokeLease failed")
+	}
+	if pairs, _ := ck.GetByPrefix("revoked/", 0); len(pairs) != 0 {
+		t.Fatalf("keys of a revoked lease remain: %v", pairs)
+	}
+	if ck.PutWithLease("revoked/x", []byte("x"), revoked) || ck.Get("revoked/x") != "" {
+		t.Fatalf("PutWithLease on a revoked lease went through")
+	}
+
+	for i := 0; i < 6; i++ {
+		time.Sleep(150 * time.Millisecond)
+		if !ck.KeepAlive(kept) {
+			t.Fatalf("KeepAlive of a live lease failed")
+		}
+	}
+	if pairs, _ := ck.GetByPrefix("lapsed/", 0); len(pairs) != 1 || string(pairs[0].Value) != "y" {
+		t.Fatalf("keys of an expired lease: %v", pairs)
+	}
+	if ck.KeepAlive(lapsed) {
+		t.Fatalf("KeepAlive of an expired lease succeeded")
+	}
+	if pairs, _ := ck.GetByPrefix("kept/", 0); len(pairs) != 3 {
+		t.Fatalf("keys of a kept-alive lease: %v", pairs)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if report := VerifyReplicas(ck.servers, 8); report.DivergentIndex != -1 || report.StateDiverged {
+		t.Fatalf("replicas disagree: %+v", report)
+	}
+
+	cfg.end()
+}
+
+func TestMVCCHistory3B(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, 1000)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: MVCC history and revisions (3B)")
+
+	revisions := []int{}
+	for i := 0; i < 3; i++ {
+		reply := ck.command(&CommandArgs{Key: "k", Value: []byte(strconv.Itoa(i)), Op: Putt})
+		revisions = append(revisions, reply.Revision)
+	}
+	reply := ck.command(&CommandArgs{Key: "k", Op: Deletee})
+	revisions = append(revisions, reply.Revision)
+	for i := 1; i < len(revisions); i++ {
+		if revisions[i] <= revisions[i-1] {
+			t.Fatalf("write revisions don't increase: %v", revisions)
+		}
+	}
+	if reply := ck.command(&CommandArgs{Key: "k", Op: Gett}); reply.Revision != revisions[3] {
+		t.Fatalf("read reflects revision %v, latest write was %v", reply.Revision, revisions[3])
+	}
+
+	_, leader := cfg.Leader()
+	kv := cfg.kvservers[leader]
+	kv.mu.RLock()
+	history := append([]KeyRevision(nil), kv.storage.History["k"]...)
+	kv.mu.RUnlock()
+	if len(history) != 4 || !history[3].Deleted || string(history[2].Value) != "2" || history[2].Version != 3 {
+		t.Fatalf("history of k: %+v", history)
+	}
+	for i, change := range history {
+		if change.Revision != revisions[i] {
+			t.Fatalf("change %v at revision %v, the write returned %v", i, change.Revision, revisions[i])
+		}
+	}
+
+	// a snapshot keeps the revision, the history starts over from it
+	ck.Put("k", "again")
+	kv.mu.RLock()
+	state := kv.saveState()
+	revision := kv.storage.Revision()
+	kv.mu.RUnlock()
+	restored := &KVServer{storage: NewMemoryKV()}
+	restored.installSnapshot(state)
+	if restored.storage.Revision() != revision {
+		t.Fatalf("restored store at revision %v, saved at %v", restored.storage.Revision(), revision)
+	}
+	if history := restored.storage.History["k"]; len(history) != 0 {
+		t.Fatalf("history of k after a snapshot: %+v", history)
+	}
+	if value, err := restored.storage.GetAt("k", revision); err != OK || string(value) != "again" {
+		t.Fatalf("k at the snapshot's revision: %q %v", value, err)
+	}
+
+	cfg.end()
+}
+
+func TestReadAtRevision3B(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: reads at a past revision (3B)")
+
+	revisions := []int{}
+	for i := 0; i < 3; i++ {
+		reply := ck.command(&CommandArgs{Key: "k", Value: []byte(strconv.Itoa(i)), Op: Putt})
+		revisions = append(revisions, reply.Revision)
+	}
+	deleted := ck.command(&CommandArgs{Key: "k", Op: Deletee}).Revision
+	for i, revision := range revisions {
+		if value, err := ck.GetAt("k", revision); err != OK || string(value) != strconv.Itoa(i) {
+			t.Fatalf("Get of k at revision %v: %q %v, expected %q", revision, value, err, strconv.Itoa(i))
+		}
+	}
+	if _, err := ck.GetAt("k", deleted); err != ErrNoKey {
+		t.Fatalf("Get of k after its delete: %v", err)
+	}
+	if _, err := ck.GetAt("k", revisions[0]-1); err != ErrNoKey {
+		t.Fatalf("Get of k before it was written: %v", err)
+	}
+	if _, err := ck.GetAt("k", deleted+1000); err != ErrFutureRevision {
+		t.Fatalf("Get at a future revision: %v", err)
+	}
+
+	// pages of a scan at one revision don't see writes made in between
+	for i := 0; i < 5; i++ {
+		ck.Put("r"+strconv.Itoa(i), "old")
+	}
+	at := ck.command(&CommandArgs{Key: "r0", Op: Gett}).Revision
+	pairs, token, err := ck.RangeAt("r", "s", 2, "", at)
+	for token != "" && err == OK {
+		ck.Delete("r4")
+		ck.Put("r2", "new")
+		var page []KeyValue
+		page, token, err = ck.RangeAt("r", "s", 2, token, at)
+		pairs = append(pairs, page...)
+	}
+	if err != OK || len(pairs) != 5 {
+		t.Fatalf("scan at revision %v: %v %v", at, pairs, err)
+	}
+	for i, kv := range pairs {
+		if kv.Key != "r"+strconv.Itoa(i) || string(kv.Value) != "old" {
+			t.Fatalf("scan at revision %v saw %v", at, pairs)
+		}
+	}
+	check(cfg, t, ck, "r2", "new")
+
+	// a replica restarting from a snapshot no longer has the history before it
+	_, leader := cfg.Leader()
+	kv := cfg.kvservers[leader]
+	kv.mu.Lock()
+	kv.storage.ResetHistory(kv.storage.Revision())
+	kv.mu.Unlock()
+	if _, err := ck.GetAt("k", revisions[0]); err != ErrCompacted {
+		t.Fatalf("Get before the history: %v", err)
+	}
+
+	cfg.end()
+}
+
+func TestCompact3B(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: MVCC history compaction (3B)")
+
+	first := ck.command(&CommandArgs{Key: "k", Value: []byte("1"), Op: Putt}).Revision
+	second := ck.command(&CommandArgs{Key: "k", Value: []byte("2"), Op: Putt}).Revision
+	ck.Put("gone", "x")
+	ck.Delete("gone")
+	latest := ck.command(&CommandArgs{Key: "k", Op: Gett}).Revision
+
+	if err := ck.Compact(latest + 1000); err != ErrFutureRevision {
+		t.Fatalf("Compact past the log: %v", err)
+	}
+	if err := ck.Compact(second); err != OK {
+		t.Fatalf("Compact: %v", err)
+	}
+	if _, err := ck.GetAt("k", first); err != ErrCompacted {
+		t.Fatalf("Get before the compaction: %v", err)
+	}
+	if value, err := ck.GetAt("k", second); err != OK || string(value) != "2" {
+		t.Fatalf("Get at the compaction: %q %v", value, err)
+	}
+	if err := ck.Compact(first); err != ErrCompacted {
+		t.Fatalf("Compact before an earlier compaction: %v", err)
+	}
+
+	// every replica dropped the same versions
+	if err := ck.Compact(latest); err != OK {
+		t.Fatalf("Compact: %v", err)
+	}
+	put := ck.command(&CommandArgs{Key: "k", Value: []byte("3"), Op: Putt}).Revision
+	for i := 0; i < nservers; i++ {
+		kv := cfg.kvservers[i]
+		for {
+			kv.mu.RLock()
+			applied, n := kv.lastApplied, len(kv.storage.History["k"])
+			_, gone := kv.storage.History["gone"]
+			kv.mu.RUnlock()
+			if applied >= put {
+				if n != 2 || gone {
+					t.Fatalf("server %v kept %v versions of k, deleted key kept: %v", i, n, gone)
+				}
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	w := ck.Watch("k", false, first)
+	if _, ok := <-w.Events; ok || w.Err() != ErrCompacted {
+		t.Fatalf("watch from before the compaction: %v", w.Err())
+	}
+
+	// automatic compaction keeps a window of recent revisions
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].mu.Lock()
+		cfg.kvservers[i].historyRetention = 10
+		cfg.kvservers[i].mu.Unlock()
+	}
+	for i := 0; i < 30; i++ {
+		ck.Put("k", strconv.Itoa(i))
+	}
+	_, leader := cfg.Leader()
+	kv := cfg.kvservers[leader]
+	kv.mu.RLock()
+	oldest, applied, n := kv.storage.Oldest(), kv.lastApplied, len(kv.storage.History["k"])
+	kv.mu.RUnlock()
+	if applied-oldest < 10 || applied-oldest >= 20 || n > 20 {
+		t.Fatalf("at %v history goes back to %v with %v versions of k", applied, oldest, n)
+	}
+
+	cfg.end()
+}
+
+func TestBinaryValues3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, 1000)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: binary values (3A)")
+
+	// not valid UTF-8, with NULs
+	blob := []byte{0x00, 0xff, 0xfe, 0x00, 0x80, 'a'}
+	ck.PutBytes("blob", blob)
+	ck.AppendBytes("blob", []byte{0x00})
+	expected := append(append([]byte(nil), blob...), 0x00)
+	if value := ck.GetBytes("blob"); !bytes.Equal(value, expected) {
+		t.Fatalf("GetBytes: %v, expected %v", value, expected)
+	}
+	if ok, _ := ck.CompareAndSwap("blob", expected, []byte{0x01}); !ok {
+		t.Fatalf("CompareAndSwap on a binary value failed")
+	}
+
+	// survives snapshots
+	for i := 0; i < 100; i++ {
+		ck.Put("filler", strconv.Itoa(i))
+	}
+	_, leader := cfg.Leader()
+	kv := cfg.kvservers[leader]
+	kv.mu.RLock()
+	state := kv.saveState()
+	kv.mu.RUnlock()
+	restored := &KVServer{storage: NewMemoryKV()}
+	restored.installSnapshot(state)
+	if value, _ := restored.storage.Get("blob"); !bytes.Equal(value, []byte{0x01}) {
+		t.Fatalf("binary value after a snapshot: %v", value)
+	}
+
+	cfg.end()
+}
+
+func TestBuckets3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: buckets (3A)")
+
+	app := ck.Bucket("app")
+	if _, err := app.Get("k"); err != ErrNoBucket {
+		t.Fatalf("Get in a missing bucket: %v", err)
+	}
+	if err := app.Put("k", []byte("x")); err != ErrNoBucket {
+		t.Fatalf("Put in a missing bucket: %v", err)
+	}
+	if !ck.CreateBucket("app") || ck.CreateBucket("app") {
+		t.Fatalf("CreateBucket should succeed once")
+	}
+	if err := ck.command(&CommandArgs{Op: Putt, Bucket: "app", Key: "t", TTL: time.Second}).Err; err != ErrNotInBucket {
+		t.Fatalf("Put with a TTL in a bucket: %v", err)
+	}
+	if err := ck.command(&CommandArgs{Op: Putt, Bucket: "app", Key: "t", Lease: 1}).Err; err != ErrNotInBucket {
+		t.Fatalf("Put with a lease in a bucket: %v", err)
+	}
+
+	// the same key in two buckets
+	ck.Put("k", "default")
+	app.Put("k", []byte("app"))
+	app.Append("k", []byte("!"))
+	for i := 0; i < 3; i++ {
+		app.Put("k"+strconv.Itoa(i), []byte(strconv.Itoa(i)))
+	}
+	check(cfg, t, ck, "k", "default")
+	if value, err := app.Get("k"); err != OK || string(value) != "app!" {
+		t.Fatalf("Get in bucket: %q %v", value, err)
+	}
+	if ok, _ := ck.GetByPrefix("k", 0); len(ok) != 1 {
+		t.Fatalf("default bucket sees other buckets' keys: %v", ok)
+	}
+	if pairs, _, err := app.Range("k", "", 0, ""); err != OK || len(pairs) != 4 {
+		t.Fatalf("Range in bucket: %v %v", pairs, err)
+	}
+
+	// buckets survive snapshots
+	_, leader := cfg.Leader()
+	kv := cfg.kvservers[leader]
+	kv.mu.RLock()
+	state, hash := kv.saveState(), kv.storage.Hash()
+	kv.mu.RUnlock()
+	restored := &KVServer{storage: NewMemoryKV()}
+	restored.installSnapshot(state)
+	if restored.storage.Hash() != hash {
+		t.Fatalf("buckets changed across a snapshot")
+	}
+
+	// deleting a bucket wipes it and nothing else
+	if !ck.DeleteBucket("app") || ck.DeleteBucket("app") {
+		t.Fatalf("DeleteBucket should succeed once")
+	}
+	if _, err := app.Get("k"); err != ErrNoBucket {
+		t.Fatalf("Get in a deleted bucket: %v", err)
+	}
+	check(cfg, t, ck, "k", "default")
+	ck.CreateBucket("app")
+	if _, err := app.Get("k"); err != ErrNoKey {
+		t.Fatalf("recreated bucket isn't empty: %v", err)
+	}
+
+	cfg.end()
+}
+
+func TestSecondaryIndex3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	// values are "name,city", indexed by city
+	city := func(key string, value []byte) (string, bool) {
+		fields := strings.Split(string(value), ",")
+		if len(fields) != 2 {
+			return "", false
+		}
+		return fields[1], true
+	}
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].RegisterIndex("city", city)
+	}
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: secondary indexes (3A)")
+
+	query := func(term string, limit int) []string {
+		keys := []string{}
+		token := ""
+		for {
+			pairs, next, err := ck.QueryIndex("city", term, limit, token)
+			if err != OK {
+				t.Fatalf("QueryIndex: %v", err)
+			}
+			for _, kv := range pairs {
+				keys = append(keys, kv.Key)
+			}
+			if token = next; token == "" {
+				return keys
+			}
+		}
+	}
+	expect := func(term string, keys ...string) {
+		if got := query(term, 2); strings.Join(got, " ") != strings.Join(keys, " ") {
+			t.Fatalf("keys in %v: %v, expected %v", term, got, keys)
+		}
+	}
+
+	ck.Put("u1", "ann,paris")
+	ck.Put("u2", "bob,oslo")
+	ck.Put("u3", "cat,paris")
+	ck.Put("u4", "dan,paris")
+	ck.Put("other", "not a record")
+	expect("paris", "u1", "u3", "u4")
+	expect("oslo", "u2")
+
+	// every kind of write keeps the index up to date
+	ck.Put("u3", "cat,oslo")
+	ck.Delete("u4")
+	ck.Append("u1", "x")
+	ck.Txn(TxnRequest{Writes: []TxnWrite{{Putt, "u5", []byte("eve,paris")}}})
+	expect("paris", "u5")
+	expect("parisx", "u1")
+	expect("oslo", "u2", "u3")
+	expect("rome")
+
+	if _, _, err := ck.QueryIndex("age", "1", 0, ""); err != ErrNoIndex {
+		t.Fatalf("query of a missing index: %v", err)
+	}
+
+	// rebuilt from a snapshot
+	_, leader := cfg.Leader()
+	kv := cfg.kvservers[leader]
+	kv.mu.RLock()
+	state := kv.saveState()
+	kv.mu.RUnlock()
+	restored := &KVServer{storage: NewMemoryKV()}
+	restored.RegisterIndex("city", city)
+	restored.installSnapshot(state)
+	if pairs, _, _ := restored.storage.QueryIndex("city", "oslo", "", 0); len(pairs) != 2 {
+		t.Fatalf("index after a snapshot: %v", pairs)
+	}
+
+	cfg.end()
+}
+
+func TestBatch3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: batch puts, deletes and gets (3A)")
+
+	pairs := []KeyValue{}
+	keys := []string{}
+	for i := 0; i < 50; i++ {
+		key := "b" + strconv.Itoa(i)
+		pairs = append(pairs, KeyValue{key, []byte(strconv.Itoa(i))})
+		keys = append(keys, key)
+	}
+	ck.BatchPut(pairs)
+
+	// one log entry for the lot
+	_, leader := cfg.Leader()
+	kv := cfg.kvservers[leader]
+	kv.mu.RLock()
+	revisions := map[int]bool{}
+	for _, key := range keys {
+		if history := kv.storage.History[key]; len(history) == 1 {
+			revisions[history[0].Revision] = true
+		}
+	}
+	kv.mu.RUnlock()
+	if len(revisions) != 1 {
+		t.Fatalf("batch written at revisions %v", revisions)
+	}
+
+	got := ck.BatchGet(append(keys, "missing"))
+	if len(got) != len(keys)+1 || got[len(keys)].Value != nil {
+		t.Fatalf("BatchGet returned %v", got)
+	}
+	for i, kv := range got[:len(keys)] {
+		if kv.Key != keys[i] || string(kv.Value) != strconv.Itoa(i) {
+			t.Fatalf("BatchGet of %v: %v", keys[i], kv)
+		}
+	}
+
+	ck.BatchDelete(append(keys[10:], "missing"))
+	if pairs, _ := ck.GetByPrefix("b", 0); len(pairs) != 10 {
+		t.Fatalf("%v keys left after BatchDelete", len(pairs))
+	}
+
+	cfg.end()
+}
+
+func TestDiskEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvraft-engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk := NewMemoryKVWith(DiskEngines(dir))
+	memory := NewMemoryKV()
+	disk.CreateBucket("b")
+	memory.CreateBucket("b")
+
+	// the same writes to both, enough rewrites of a few big values to
+	// make the disk engine compact its file
+	value := make([]byte, 10000)
+	for i := 0; i < 500; i++ {
+		key := "k" + strconv.Itoa(rand.Intn(10))
+		value[0] = byte(i)
+		op := rand.Intn(4)
+		for _, store := range []*MemoryKV{disk, memory} {
+			store.Begin(i + 1)
+			switch op {
+			case 0:
+				store.Delete(key)
+			case 1:
+				store.Append(key, []byte("+"))
+			default:
+				store.Put(key, append([]byte(nil), value...))
+			}
+			bucket, _ := store.Bucket("b")
+			bucket.Put(key, []byte(strconv.Itoa(i)))
+		}
+	}
+	if disk.Hash() != memory.Hash() {
+		t.Fatalf("disk and memory engines disagree")
+	}
+	for key := 0; key < 10; key++ {
+		v1, _ := disk.GetAt("k"+strconv.Itoa(key), 250)
+		v2, _ := memory.GetAt("k"+strconv.Itoa(key), 250)
+		if !bytes.Equal(v1, v2) {
+			t.Fatalf("disk and memory engines disagree on the past")
+		}
+	}
+	if size := disk.engine.(*diskEngine).size; size > 4*diskEngineMinRewrite {
+		t.Fatalf("disk engine file grew to %v bytes", size)
+	}
+
+	// restored from a snapshot of the other
+	other := dir + "/restored"
+	os.Mkdir(other, 0755)
+	restored := &KVServer{storage: NewMemoryKVWith(DiskEngines(other))}
+	server := &KVServer{storage: memory}
+	restored.installSnapshot(server.saveState())
+	if restored.storage.Hash() != memory.Hash() {
+		t.Fatalf("disk engine restored from a snapshot differs")
+	}
+
+	disk.DeleteBucket("b")
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 { // the default bucket's and restored
+		t.Fatalf("%v files left in the engine directory", len(files))
+	}
+}
+
+func TestRowCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvraft-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// room for about 10 of the 1000 byte values
+	cache := NewRowCache(10 * 1010)
+	disk := NewMemoryKVWith(DiskEnginesWithCache(dir, cache))
+	memory := NewMemoryKV()
+	disk.CreateBucket("b")
+	memory.CreateBucket("b")
+
+	value := make([]byte, 1000)
+	for i := 0; i < 3000; i++ {
+		key := "k" + strconv.Itoa(rand.Intn(100))
+		value[0] = byte(i)
+		op := rand.Intn(5)
+		for _, store := range []*MemoryKV{disk, memory} {
+			store.Begin(i + 1)
+			bucket, _ := store.Bucket("b")
+			switch op {
+			case 0:
+				store.Delete(key)
+			case 1:
+				store.Append(key, []byte("+"))
+			case 2:
+				bucket.Put(key, []byte(strconv.Itoa(i)))
+			default:
+				store.Put(key, append([]byte(nil), value...))
+			}
+		}
+		if stats := cache.Stats(); stats.Bytes > 10*1010 {
+			t.Fatalf("cache holds %v bytes", stats.Bytes)
+		}
+	}
+	if disk.Hash() != memory.Hash() {
+		t.Fatalf("cached disk and memory engines disagree")
+	}
+
+	// hot keys are served from memory
+	for i := 0; i < 5; i++ {
+		disk.Put("k"+strconv.Itoa(i), value)
+	}
+	before := cache.Stats()
+	for i := 0; i < 100; i++ {
+		disk.Get("k" + strconv.Itoa(i%5))
+	}
+	if stats := cache.Stats(); stats.Hits-before.Hits < 90 {
+		t.Fatalf("only %v of 100 reads of hot keys hit the cache", stats.Hits-before.Hits)
+	}
+
+	disk.DeleteBucket("b")
+	disk.SetKV(map[string][]byte{"a": []byte("1")})
+	if stats := cache.Stats(); stats.Rows > 1 {
+		t.Fatalf("%v rows cached after a reset", stats.Rows)
+	}
+}
+
+func TestSessionExpiry3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].SetSessionTTL(500 * time.Millisecond)
+	}
+	idle := cfg.makeClient(cfg.All())
+	active := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: idle client sessions expire on every replica (3A)")
+
+	idle.Put("idle", "1")
+	for i := 0; i < 15; i++ {
+		active.Put("active", strconv.Itoa(i))
+		time.Sleep(100 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	for i := 0; i < nservers; i++ {
+		kv := cfg.kvservers[i]
+		kv.mu.RLock()
+		_, idleKept := kv.latestTime[idle.clientId]
+		_, activeKept := kv.latestTime[active.clientId]
+		_, idleSession := kv.sessions[idle.clientId]
+		kv.mu.RUnlock()
+		if idleKept || idleSession {
+			t.Fatalf("server %v kept the idle client's session", i)
+		}
+		if !activeKept {
+			t.Fatalf("server %v dropped the active client's session", i)
+		}
+	}
+
+	// the idle client starts a new session
+	idle.Append("idle", "2")
+	if v := idle.Get("idle"); v != "12" {
+		t.Fatalf("idle client reads %q after its session expired", v)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if report := VerifyReplicas(idle.servers, 8); report.DivergentIndex != -1 || report.StateDiverged {
+		t.Fatalf("replicas disagree: %+v", report)
+	}
+
+	cfg.end()
+}
+
+func TestRequestTimeout3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+	ck.SetTimeout(time.Second)
+	ck.Put("a", "1")
+
+	cfg.begin("Test: request timeouts (3A)")
+
+	// a leader cut off from the others can't commit anything
+	leader := -1
+	for leader == -1 {
+		if ok, l := cfg.Leader(); ok {
+			leader = l
+		}
+	}
+	others := make([]int, 0)
+	for i := 0; i < nservers; i++ {
+		if i != leader {
+			others = append(others, i)
+		}
+	}
+	cfg.partition([]int{leader}, others)
+	kv := cfg.kvservers[leader]
+	// the majority moves on, so the cut off leader can't win back and commit
+	// what it was given meanwhile
+	ck.Put("b", "1")
+
+	args := CommandArgs{Op: Putt, Key: "a", Value: []byte("2"), ClientId: nrand(), Timeout: 300 * time.Millisecond}
+	reply := new(CommandReply)
+	kv.Command(&args, reply)
+	if reply.Err != ErrTimeout || reply.Elapsed < 300*time.Millisecond {
+		t.Fatalf("Command with a 300ms timeout returned %v after %v", reply.Err, reply.Elapsed)
+	}
+	kv.SetRequestTimeout(200 * time.Millisecond)
+	args = CommandArgs{Op: Putt, Key: "a", Value: []byte("2"), ClientId: nrand()}
+	reply = new(CommandReply)
+	kv.Command(&args, reply)
+	if reply.Err != ErrTimeout || reply.Elapsed < 200*time.Millisecond || reply.Elapsed > 300*time.Millisecond {
+		t.Fatalf("Command with the server's 200ms timeout returned %v after %v", reply.Err, reply.Elapsed)
+	}
+
+	// the clerk gives up once its context is done
+	stuck := cfg.makeClient([]int{leader})
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	reply = stuck.CommandContext(ctx, &CommandArgs{Op: Appendd, Key: "a", Value: []byte("x")})
+	if reply.Err != ErrTimeout || reply.Elapsed < 400*time.Millisecond || reply.Elapsed > time.Second {
+		t.Fatalf("CommandContext with a 400ms deadline returned %v after %v", reply.Err, reply.Elapsed)
+	}
+
+	// and its next command isn't mistaken for the abandoned one
+	cfg.ConnectAll()
+	cfg.ConnectClient(stuck, cfg.All())
+	stuck.Append("a", "y")
+	if v := ck.Get("a"); v != "1y" && v != "1xy" {
+		t.Fatalf("a is %q after an abandoned and a completed Append", v)
+	}
+
+	cfg.end()
+}
+
+func TestQuota3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].SetQuota(5000)
+	}
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: writes are refused over the quota (3A)")
+
+	value := []byte(strings.Repeat("x", 100))
+	n := 0
+	for ; n < 200; n++ {
+		reply := ck.command(&CommandArgs{Op: Putt, Key: "k" + strconv.Itoa(n), Value: value})
+		if reply.Err == ErrNoSpace {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n == 200 {
+		t.Fatalf("200 Puts of 100 bytes didn't hit a 5000 byte quota")
+	}
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < nservers; i++ {
+		status := new(StatusReply)
+		cfg.kvservers[i].Status(&StatusArgs{}, status)
+		if len(status.Alarms) != 1 || status.Alarms[0] != AlarmNoSpace || status.Size <= 5000 {
+			t.Fatalf("server %v status %+v", i, status)
+		}
+	}
+	if err := ck.command(&CommandArgs{Op: Appendd, Key: "k0", Value: value}).Err; err != ErrNoSpace {
+		t.Fatalf("Append over the quota returned %v", err)
+	}
+	if err := ck.command(&CommandArgs{Op: Txn}).Err; err != ErrNoTxn {
+		t.Fatalf("Txn without a TxnRequest over the quota returned %v", err)
+	}
+	if v := ck.Get("k0"); v != string(value) {
+		t.Fatalf("Get over the quota returned %q", v)
+	}
+
+	// deleting frees space and lifts the alarm
+	for i := 0; i < n/2; i++ {
+		if !ck.Delete("k" + strconv.Itoa(i)) {
+			t.Fatalf("Delete over the quota failed")
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	if status := ck.Status(); len(status.Alarms) != 0 {
+		t.Fatalf("alarms %v after freeing space", status.Alarms)
+	}
+	if err := ck.command(&CommandArgs{Op: Putt, Key: "k0", Value: value}).Err; err != OK {
+		t.Fatalf("Put after freeing space returned %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if report := VerifyReplicas(ck.servers, 8); report.DivergentIndex != -1 || report.StateDiverged {
+		t.Fatalf("replicas disagree: %+v", report)
+	}
+
+	cfg.end()
+}
+
+func TestSizeLimits3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: key and value size limits (3A)")
+
+	long := strings.Repeat("k", defaultMaxKeySize+1)
+	if err := ck.command(&CommandArgs{Op: Putt, Key: long, Value: []byte("1")}).Err; err != ErrKeyTooLarge {
+		t.Fatalf("Put with a %v byte key returned %v", len(long), err)
+	}
+	big := make([]byte, defaultMaxValueSize+1)
+	if err := ck.command(&CommandArgs{Op: Putt, Key: "a", Value: big}).Err; err != ErrValueTooLarge {
+		t.Fatalf("Put with a %v byte value returned %v", len(big), err)
+	}
+
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].SetSizeLimits(10, 100)
+	}
+	if err := ck.command(&CommandArgs{Op: Gett, Key: "01234567890"}).Err; err != ErrKeyTooLarge {
+		t.Fatalf("Get with an 11 byte key returned %v", err)
+	}
+	txn := &TxnRequest{Writes: []TxnWrite{{Op: Putt, Key: "a", Value: make([]byte, 101)}}}
+	if err := ck.command(&CommandArgs{Op: Txn, Txn: txn}).Err; err != ErrValueTooLarge {
+		t.Fatalf("Txn writing a 101 byte value returned %v", err)
+	}
+	if ok, _ := ck.CompareAndSwap("a", make([]byte, 101), []byte("1")); ok {
+		t.Fatalf("CompareAndSwap expecting a 101 byte value succeeded")
+	}
+	ck.Put("0123456789", strings.Repeat("v", 100))
+	ck.Append("0123456789", strings.Repeat("v", 100))
+	if v := ck.Get("0123456789"); len(v) != 200 {
+		t.Fatalf("value within the limits holds %v bytes", len(v))
+	}
+	if v := ck.Get("a"); v != "" {
+		t.Fatalf("refused writes left a = %q", v)
+	}
+
+	cfg.end()
+}
+
+func TestRateLimit3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+	ck.Put("a", "")
+
+	cfg.begin("Test: per-client rate limits (3A)")
+
+	_, leader := cfg.Leader()
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].SetRateLimit(1, 2)
+	}
+	clientId := nrand()
+	var reply *CommandReply
+	for i := 0; i < 3; i++ {
+		reply = new(CommandReply)
+		args := CommandArgs{Op: Appendd, Key: "a", Value: []byte("x"), ClientId: clientId, CommandId: int64(i)}
+		cfg.kvservers[leader].Command(&args, reply)
+	}
+	if reply.Err != ErrRateLimited || reply.RetryAfter <= 0 || reply.RetryAfter > time.Second {
+		t.Fatalf("third command with a burst of 2 returned %v, retry after %v", reply.Err, reply.RetryAfter)
+	}
+
+	// a greedy client is slowed down, the others aren't
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].SetRateLimit(20, 5)
+	}
+	done := make(chan time.Duration)
+	go func() {
+		greedy := cfg.makeClient(cfg.All())
+		defer cfg.deleteClient(greedy)
+		start := time.Now()
+		for i := 0; i < 45; i++ {
+			greedy.Append("a", "g")
+		}
+		done <- time.Since(start)
+	}()
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		ck.Append("a", "p")
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Fatalf("polite client waited %v next to a greedy one", elapsed)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if elapsed := <-done; elapsed < 1500*time.Millisecond {
+		t.Fatalf("45 Appends at 20 a second took only %v", elapsed)
+	}
+	if v := ck.Get("a"); strings.Count(v, "g") != 45 || strings.Count(v, "p") != 5 {
+		t.Fatalf("a = %q", v)
+	}
+
+	cfg.end()
+}
+
+func TestMetrics3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, 1000)
+	defer cfg.cleanup()
+
+	registry := metrics.NewRegistry()
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].SetMetrics(registry)
+	}
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: servers report command metrics (3A)")
+
+	for i := 0; i < 50; i++ {
+		ck.Put("k"+strconv.Itoa(i), strings.Repeat("x", 50))
+		ck.Get("k" + strconv.Itoa(i))
+	}
+	ck.Get("missing")
+
+	puts := registry.Counter(labelled(MetricCommands, "op", Putt))
+	gets := registry.Counter(labelled(MetricCommands, "op", Gett))
+	if puts < 50 || gets < 51 {
+		t.Fatalf("%v Puts and %v Gets counted", puts, gets)
+	}
+	if h := registry.Histogram(labelled(MetricCommandLatency, "op", Putt)); h.Count != puts || h.Max <= 0 {
+		t.Fatalf("Put latencies %+v for %v Puts", h, puts)
+	}
+	// at least the leader applies every entry, followers may skip some with a snapshot
+	if h := registry.Histogram(MetricApplyLag); h.Count < 100 {
+		t.Fatalf("apply lag observed %v times", h.Count)
+	}
+	if n := registry.Counter(MetricSnapshots); n == 0 || registry.Histogram(MetricSnapshotEntries).Count != n {
+		t.Fatalf("%v snapshots counted", n)
+	}
+
+	cfg.end()
+}
+
+func TestStatus3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, 1000)
+	defer cfg.cleanup()
+
+	ck1 := cfg.makeClient(cfg.All())
+	ck2 := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: status of each server (3A)")
+
+	for i := 0; i < 25; i++ {
+		ck1.Put("a"+strconv.Itoa(i), "1")
+		ck2.Put("b"+strconv.Itoa(i), "1")
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	leaders := 0
+	for i, status := range ClusterStatus(ck1.servers) {
+		if status == nil {
+			t.Fatalf("server %v didn't answer", i)
+		}
+		if status.IsLeader {
+			leaders++
+		}
+		if status.Keys != 50 || status.Clients != 2 || status.AppliedIndex != status.Raft.LastApplied {
+			t.Fatalf("server %v status %+v", i, status)
+		}
+		if status.SnapshotIndex == 0 || status.SnapshotSize == 0 || status.SnapshotIndex > status.AppliedIndex {
+			t.Fatalf("server %v snapshot status %+v", i, status)
+		}
+	}
+	if leaders != 1 {
+		t.Fatalf("%v servers say they lead", leaders)
+	}
+
+	cfg.DisconnectClient(ck1, []int{0})
+	unreachable := 0
+	for _, status := range ClusterStatus(ck1.servers) {
+		if status == nil {
+			unreachable++
+		}
+	}
+	if unreachable != 1 {
+		t.Fatalf("%v servers didn't answer, expected 1", unreachable)
+	}
+
+	cfg.end()
+}
+
+func TestAdminSnapshot3B(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: snapshots on request (3B)")
+
+	for i := 0; i < 100; i++ {
+		ck.Put("k"+strconv.Itoa(i), strings.Repeat("x", 20))
+	}
+	time.Sleep(200 * time.Millisecond)
+	before := cfg.LogSize()
+	if cfg.SnapshotSize() != 0 {
+		t.Fatalf("snapshot taken without maxraftstate")
+	}
+
+	for i, reply := range SnapshotAll(ck.servers) {
+		if reply == nil || !reply.Taken || reply.Index < 100 || reply.Size == 0 {
+			t.Fatalf("server %v AdminSnapshot reply %+v", i, reply)
+		}
+	}
+	if after := cfg.LogSize(); after >= before/2 {
+		t.Fatalf("log went from %v to %v bytes", before, after)
+	}
+	for i, reply := range SnapshotAll(ck.servers) {
+		if reply == nil || reply.Taken {
+			t.Fatalf("server %v took another snapshot with nothing new %+v", i, reply)
+		}
+	}
+
+	// the servers come back from the snapshot
+	for i := 0; i < nservers; i++ {
+		cfg.ShutdownServer(i)
+	}
+	for i := 0; i < nservers; i++ {
+		cfg.StartServer(i)
+	}
+	cfg.ConnectAll()
+	if v := ck.Get("k99"); v != strings.Repeat("x", 20) {
+		t.Fatalf("k99 = %q after a restart", v)
+	}
+
+	cfg.end()
+}
+
+func TestLock3A(t *testing.T) {
+	const nservers = 3
+	const nclients = 5
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: locks with fencing tokens (3A)")
+
+	a, b := ck.GrantLease(time.Minute), ck.GrantLease(time.Minute)
+	first, err := ck.TryLock("l", a)
+	if err != OK || first == 0 {
+		t.Fatalf("TryLock of a free lock returned %v %v", first, err)
+	}
+	if token, err := ck.TryLock("l", a); err != OK || token != first {
+		t.Fatalf("TryLock by the holder returned %v %v, expected %v", token, err, first)
+	}
+	if _, err := ck.TryLock("l", b); err != ErrLocked {
+		t.Fatalf("TryLock of a held lock returned %v", err)
+	}
+	if ck.Unlock("l", first+1) {
+		t.Fatalf("Unlock with the wrong token succeeded")
+	}
+	if !ck.Unlock("l", first) {
+		t.Fatalf("Unlock by the holder failed")
+	}
+	second, ok := ck.Lock("l", b)
+	if !ok || second <= first {
+		t.Fatalf("Lock after Unlock returned %v %v, expected a token above %v", second, ok, first)
+	}
+	ck.RevokeLease(b)
+
+	// a holder that stops keeping its lease alive loses the lock
+	stalled := ck.GrantLease(300 * time.Millisecond)
+	third, _ := ck.Lock("l", stalled)
+	start := time.Now()
+	fourth, ok := ck.Lock("l", a)
+	if !ok || fourth <= third || time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("Lock behind a stalled holder returned %v %v after %v", fourth, ok, time.Since(start))
+	}
+	if ck.Unlock("l", third) {
+		t.Fatalf("stalled holder released a lock it lost")
+	}
+	ck.Unlock("l", fourth)
+
+	// mutual exclusion around a read-modify-write
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			myck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(myck)
+			lease := myck.GrantLease(time.Minute)
+			for i := 0; i < 5; i++ {
+				token, ok := myck.Lock("counter-lock", lease)
+				if !ok {
+					t.Errorf("Lock failed")
+					return
+				}
+				n, _ := strconv.Atoi(myck.Get("counter"))
+				myck.Put("counter", strconv.Itoa(n+1))
+				myck.Unlock("counter-lock", token)
+			}
+		}()
+	}
+	wg.Wait()
+	if v := ck.Get("counter"); v != strconv.Itoa(nclients*5) {
+		t.Fatalf("counter is %v, expected %v", v, nclients*5)
+	}
+
+	cfg.end()
+}
+
+func TestElection3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: elections among clients (3A)")
+
+	first := ck.Election("svc", ck.GrantLease(time.Minute))
+	if !first.Campaign([]byte("a")) {
+		t.Fatalf("sole candidate wasn't elected")
+	}
+	if leader, ok := first.Leader(); !ok || leader.Key != first.Key || string(leader.Value) != "a" {
+		t.Fatalf("leader is %v %v", leader, ok)
+	}
+
+	elected := make(chan bool)
+	second := cfg.makeClient(cfg.All()).Election("svc", ck.GrantLease(time.Minute))
+	go func() {
+		elected <- second.Campaign([]byte("b"))
+	}()
+	// a candidate whose lease lapses drops out of the queue
+	stalled := cfg.makeClient(cfg.All()).Election("svc", ck.GrantLease(500*time.Millisecond))
+	gaveUp := make(chan bool)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		gaveUp <- !stalled.Campaign([]byte("c"))
+	}()
+
+	if !first.Proclaim([]byte("a2")) {
+		t.Fatalf("leader's Proclaim failed")
+	}
+	if leader, _ := first.Leader(); string(leader.Value) != "a2" {
+		t.Fatalf("leader's value is %q after Proclaim", leader.Value)
+	}
+	select {
+	case <-elected:
+		t.Fatalf("second candidate elected while the first leads")
+	case <-time.After(300 * time.Millisecond):
+	}
+	if !<-gaveUp {
+		t.Fatalf("candidate with an expired lease was elected")
+	}
+
+	if !first.Resign() {
+		t.Fatalf("Resign failed")
+	}
+	if !<-elected {
+		t.Fatalf("second candidate wasn't elected after the first resigned")
+	}
+	if first.Proclaim([]byte("a3")) {
+		t.Fatalf("resigned leader's Proclaim succeeded")
+	}
+	if leader, _ := second.Leader(); leader.Key != second.Key || string(leader.Value) != "b" {
+		t.Fatalf("leader is %v after the first resigned", leader)
+	}
+
+	ck.RevokeLease(second.Lease)
+	if _, ok := second.Leader(); ok {
+		t.Fatalf("leader left after every lease is gone")
+	}
+
+	cfg.end()
+}
+
+// mirrors a server's store from its changes
+type mirrorSink struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+	last    int
+	ops     map[string]bool
+	err     string
+}
+
+func (m *mirrorSink) Changed(change Change) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if change.Index < m.last || change.Revision > change.Index {
+		m.err = fmt.Sprintf("change %+v after index %v", change, m.last)
+	}
+	m.last = change.Index
+	m.ops[change.Op] = true
+	if change.Key == "" {
+		delete(m.buckets, change.Bucket)
+		if !change.Deleted {
+			m.buckets[change.Bucket] = make(map[string][]byte)
+		}
+	} else if change.Deleted {
+		delete(m.buckets[change.Bucket], change.Key)
+	} else {
+		m.buckets[change.Bucket][change.Key] = change.Value
+	}
+}
+
+func (m *mirrorSink) Restored(index int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = fmt.Sprintf("restored at %v", index)
+}
+
+func copyKV(kv map[string][]byte) map[string][]byte {
+	c := make(map[string][]byte, len(kv))
+	for k, v := range kv {
+		c[k] = v
+	}
+	return c
+}
+
+func TestChangeStream3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: change data capture (3A)")
+
+	kv := cfg.kvservers[0]
+	mirror := &mirrorSink{buckets: map[string]map[string][]byte{"": {}}, ops: make(map[string]bool)}
+	kv.SetChangeSink(mirror)
+
+	for i := 0; i < 20; i++ {
+		ck.Put(strconv.Itoa(i), "x")
+		ck.Append(strconv.Itoa(i%5), "y")
+	}
+	for i := 0; i < 20; i += 3 {
+		ck.Delete(strconv.Itoa(i))
+	}
+	ck.PutWithTTL("ttl", []byte("z"), 100*time.Millisecond)
+	ck.CreateBucket("b")
+	ck.Bucket("b").Put("k", []byte("v"))
+	ck.CreateBucket("gone")
+	ck.Bucket("gone").Put("k", []byte("v"))
+	ck.DeleteBucket("gone")
+
+	start := time.Now()
+	for {
+		kv.mu.RLock()
+		_, expiring := kv.storage.Expiry["ttl"]
+		// the replica may lag behind the leader
+		expiring = expiring || kv.lastApplied < ck.seenIndex
+		// copies, the engine's map changes once kv.mu is released
+		state := map[string]map[string][]byte{"": copyKV(kv.storage.GetKV())}
+		for _, name := range kv.storage.bucketNames() {
+			state[name] = copyKV(kv.storage.buckets[name].GetKV())
+		}
+		kv.mu.RUnlock()
+		mirror.mu.Lock()
+		same := reflect.DeepEqual(state, mirror.buckets)
+		mirror.mu.Unlock()
+		if same && !expiring {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("mirror %v doesn't match the store %v", mirror.buckets, state)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	mirror.mu.Lock()
+	defer mirror.mu.Unlock()
+	if mirror.err != "" {
+		t.Fatalf("%v", mirror.err)
+	}
+	for _, op := range []string{Putt, Appendd, Deletee, Expire, CreateBucket, DeleteBucket} {
+		if !mirror.ops[op] {
+			t.Fatalf("no change from a %v", op)
+		}
+	}
+
+	cfg.end()
+}
+
+func TestAuditLog3A(t *testing.T) {
+	const nservers = 3
+	const maxSize = 2000
+	const keep = 2
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: audit log with rotation (3A)")
+
+	dir, err := ioutil.TempDir("", "kvraft-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	auditLog := NewAuditLog(dir, maxSize, keep)
+	kv := cfg.kvservers[0]
+	kv.SetAuditSink(auditLog)
+
+	for i := 0; i < 50; i++ {
+		ck.Put("k"+strconv.Itoa(i), "x")
+		ck.Get("k" + strconv.Itoa(i))
+	}
+	if _, ok := ck.Incr("k0", 1); ok {
+		t.Fatalf("Incr of a non-integer succeeded")
+	}
+
+	// the last command is the failed Incr
+	var records []AuditRecord
+	start := time.Now()
+	for {
+		kv.SetAuditSink(nil)
+		records = nil
+		for i := keep; i >= 0; i-- {
+			name := filepath.Join(dir, auditLogName)
+			if i > 0 {
+				name += "." + strconv.Itoa(i)
+			}
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatalf("rotated file missing: %v", err)
+			}
+			if len(data) > maxSize {
+				t.Fatalf("%v has %v bytes, more than %v", name, len(data), maxSize)
+			}
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				var record AuditRecord
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatalf("bad record %q: %v", line, err)
+				}
+				records = append(records, record)
+			}
+		}
+		kv.SetAuditSink(auditLog)
+		if last := records[len(records)-1]; last.Op == Incr {
+			if last.ClientId != ck.clientId || last.Key != "k0" || last.Err != ErrNotInteger {
+				t.Fatalf("audit record %+v for the failed Incr", last)
+			}
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("last record is %+v, not the Incr", records[len(records)-1])
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := os.Stat(filepath.Join(dir, auditLogName+"."+strconv.Itoa(keep+1))); !os.IsNotExist(err) {
+		t.Fatalf("kept more than %v rotated files", keep)
+	}
+	for i, record := range records {
+		if record.Op == Gett {
+			t.Fatalf("read audited: %+v", record)
+		}
+		if i > 0 && record.Index <= records[i-1].Index {
+			t.Fatalf("audit record %+v after %+v", record, records[i-1])
+		}
+		if record.Op == Putt && (record.ClientId != ck.clientId || record.Err != OK) {
+			t.Fatalf("audit record %+v for a Put", record)
+		}
+	}
+	auditLog.Close()
+
+	cfg.end()
+}
+
+func TestAuth3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, 1000)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+	alice := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: authentication and per-prefix ACLs (3A)")
+
+	put := func(ck *Clerk, key string) Err {
+		return ck.command(&CommandArgs{Key: key, Value: []byte("v"), Op: Putt}).Err
+	}
+	get := func(ck *Clerk, key string) Err {
+		return ck.command(&CommandArgs{Key: key, Op: Gett}).Err
+	}
+
+	// anyone may set things up until auth is enabled
+	if err := ck.SetRole("reader", Permission{Prefix: "pub/", Read: true}); err != OK {
+		t.Fatalf("SetRole returned %v", err)
+	}
+	ck.SetRole("writer", Permission{Prefix: "app/", Read: true, Write: true})
+	if err := ck.SetUser("alice", "apw", "reader", "writer"); err != OK {
+		t.Fatalf("SetUser returned %v", err)
+	}
+	if err := ck.SetUser("bob", "bpw", "nosuch"); err != ErrNoRole {
+		t.Fatalf("SetUser with an unknown role returned %v", err)
+	}
+	if err := ck.EnableAuth(); err != ErrNoUser {
+		t.Fatalf("EnableAuth without root returned %v", err)
+	}
+	if err := alice.Authenticate("alice", "apw"); err != ErrAuthFailed {
+		t.Fatalf("Authenticate while disabled returned %v", err)
+	}
+	ck.SetUser(RootUser, "rootpw", RootRole)
+	if err := ck.EnableAuth(); err != OK {
+		t.Fatalf("EnableAuth returned %v", err)
+	}
+
+	if err := put(ck, "app/1"); err != ErrInvalidToken {
+		t.Fatalf("Put without a token returned %v", err)
+	}
+	if err := alice.Authenticate("alice", "wrong"); err != ErrAuthFailed {
+		t.Fatalf("Authenticate with a wrong password returned %v", err)
+	}
+	if err := alice.Authenticate("alice", "apw"); err != OK {
+		t.Fatalf("Authenticate returned %v", err)
+	}
+	if err := put(alice, "app/1"); err != OK {
+		t.Fatalf("Put in a writable prefix returned %v", err)
+	}
+	if err := get(alice, "pub/1"); err != ErrNoKey {
+		t.Fatalf("Get in a readable prefix returned %v", err)
+	}
+	if pairs, _ := alice.GetByPrefix("app/", 10); len(pairs) != 1 {
+		t.Fatalf("GetByPrefix in a readable prefix returned %v", pairs)
+	}
+	denied := []*CommandArgs{
+		{Key: "pub/1", Value: []byte("v"), Op: Putt},
+		{Key: "secret", Op: Gett},
+		{Key: "app/", Op: Range},
+		{Key: "pub/1", Op: Incr, Delta: 1},
+		{Op: Txn, Txn: &TxnRequest{Reads: []string{"app/1"}, Writes: []TxnWrite{{Op: Putt, Key: "pub/1"}}}},
+		{Op: CreateBucket, Bucket: "b"},
+		{Key: "alice", Value: []byte("x"), Op: AuthSetUser},
+	}
+	for _, args := range denied {
+		if err := alice.command(args).Err; err != ErrPermissionDenied {
+			t.Fatalf("%v of %q returned %v", args.Op, args.Key, err)
+		}
+	}
+
+	if err := ck.Authenticate(RootUser, "rootpw"); err != OK {
+		t.Fatalf("Authenticate as root returned %v", err)
+	}
+	if err := put(ck, "pub/1"); err != OK {
+		t.Fatalf("root's Put returned %v", err)
+	}
+	if err := ck.DeleteUser(RootUser); err != ErrPermissionDenied {
+		t.Fatalf("deleting root while enabled returned %v", err)
+	}
+
+	// the config and the tokens survive a restart from snapshots
+	for i := 0; i < 30; i++ {
+		put(ck, "pub/"+strconv.Itoa(i))
+	}
+	for i := 0; i < nservers; i++ {
+		cfg.ShutdownServer(i)
+	}
+	for i := 0; i < nservers; i++ {
+		cfg.StartServer(i)
+	}
+	cfg.ConnectAll()
+	if err := get(alice, "pub/1"); err != OK {
+		t.Fatalf("Get after a restart returned %v", err)
+	}
+	if err := put(alice, "pub/1"); err != ErrPermissionDenied {
+		t.Fatalf("Put after a restart returned %v", err)
+	}
+
+	// setting the user again voids its tokens
+	ck.SetUser("alice", "apw2", "reader")
+	if err := get(alice, "pub/1"); err != ErrInvalidToken {
+		t.Fatalf("Get with a void token returned %v", err)
+	}
+	alice.Authenticate("alice", "apw2")
+	if err := put(alice, "app/1"); err != ErrPermissionDenied {
+		t.Fatalf("Put with a revoked role returned %v", err)
+	}
+
+	if err := ck.DisableAuth(); err != OK {
+		t.Fatalf("DisableAuth returned %v", err)
+	}
+	if err := put(cfg.makeClient(cfg.All()), "secret"); err != OK {
+		t.Fatalf("Put after disabling auth returned %v", err)
+	}
+
+	cfg.end()
+}
+
+func TestJoin3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, 1000)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+	joiner := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: nodes join with one-time tokens (3A)")
+
+	ck.Put("k", "v")
+	if reply := joiner.Join("bogus", "n3", "10.0.0.3:7000"); reply.Err != ErrInvalidToken {
+		t.Fatalf("Join with a bogus token returned %v", reply.Err)
+	}
+	token, err := ck.IssueJoinToken(0)
+	if err != OK {
+		t.Fatalf("IssueJoinToken returned %v", err)
+	}
+	reply := joiner.Join(token, "n3", "10.0.0.3:7000")
+	if reply.Err != OK {
+		t.Fatalf("Join returned %v", reply.Err)
+	}
+	want := []Member{{Id: "n3", Addr: "10.0.0.3:7000", Learner: true}}
+	if !reflect.DeepEqual(reply.Members, want) {
+		t.Fatalf("members %v, expected %v", reply.Members, want)
+	}
+	// the snapshot has what was written before the join
+	persister := raft.MakePersister()
+	if err := raft.BootstrapFromSnapshot(persister, reply.SnapshotIndex, reply.SnapshotTerm, reply.Snapshot); err != nil {
+		t.Fatalf("bootstrapping from the join's snapshot: %v", err)
+	}
+	kv := &KVServer{storage: NewMemoryKV(), joinTokens: make(map[string]*joinToken)}
+	kv.installSnapshot(persister.ReadSnapshot())
+	if value, _ := kv.storage.Get("k"); string(value) != "v" || !reflect.DeepEqual(kv.members, want) {
+		t.Fatalf("snapshot holds k=%q and members %v", value, kv.members)
+	}
+
+	// the token is used up, but a retry of the same join succeeds
+	if reply := joiner.Join(token, "n3", "10.0.0.3:7000"); reply.Err != OK {
+		t.Fatalf("retried Join returned %v", reply.Err)
+	}
+	if reply := joiner.Join(token, "n4", "10.0.0.4:7000"); reply.Err != ErrInvalidToken {
+		t.Fatalf("Join with a used token returned %v", reply.Err)
+	}
+	token, _ = ck.IssueJoinToken(0)
+	if reply := joiner.Join(token, "n3", "10.0.0.5:7000"); reply.Err != ErrMemberExists {
+		t.Fatalf("Join of a member again returned %v", reply.Err)
+	}
+	expired, _ := ck.IssueJoinToken(time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if reply := joiner.Join(expired, "n4", "10.0.0.4:7000"); reply.Err != ErrInvalidToken {
+		t.Fatalf("Join with an expired token returned %v", reply.Err)
+	}
+
+	// every replica has the membership, across restarts
+	for i := 0; i < nservers; i++ {
+		cfg.ShutdownServer(i)
+	}
+	for i := 0; i < nservers; i++ {
+		cfg.StartServer(i)
+	}
+	cfg.ConnectAll()
+	if reply := joiner.Join(token, "n4", "10.0.0.4:7000"); reply.Err != OK || len(reply.Members) != 2 {
+		t.Fatalf("Join after a restart returned %v with members %v", reply.Err, reply.Members)
+	}
+	cfg.mu.Lock()
+	servers := append([]*KVServer(nil), cfg.kvservers...)
+	cfg.mu.Unlock()
+	for i, kv := range servers {
+		for start := time.Now(); len(kv.Members()) != 2; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 2*time.Second {
+				t.Fatalf("server %v has members %v", i, kv.Members())
+			}
+		}
+	}
+
+	cfg.end()
+}
+
+func TestScript3A(t *testing.T) {
+	const nservers = 3
+	const nclients = 5
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: server side scripts (3A)")
+
+	appendUnder := `(if (< (len (get "log")) 5) (append "log" (arg 0)) (abort "log full"))`
+	for i := 0; i < 8; i++ {
+		value, err := ck.Eval(appendUnder, []string{"log"}, []byte("x"))
+		if i < 5 && (err != OK || string(value) != strings.Repeat("x", i+1)) {
+			t.Fatalf("append %v returned %q %v", i, value, err)
+		}
+		if i >= 5 && (err != ErrScript || string(value) != "aborted: log full") {
+			t.Fatalf("append to a full log returned %q %v", value, err)
+		}
+	}
+
+	// read-modify-write without lost updates
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(ck)
+			for i := 0; i < 10; i++ {
+				ck.Eval(`(put "n" (+ (get "n") 1))`, []string{"n"})
+			}
+		}()
+	}
+	wg.Wait()
+	if n := ck.Get("n"); n != strconv.Itoa(nclients*10) {
+		t.Fatalf("counter is %v, expected %v", n, nclients*10)
+	}
+
+	// a failing script writes nothing
+	failing := map[string]string{
+		`(do (put "a" "1") (get "b"))`:                          "not declared",
+		`(do (put "a" "1") (+ "x" 1))`:                          "not an integer",
+		`(do (put "a" "1") (arg 3))`:                            "no argument",
+		`(do (put "a" "1")`:                                     "missing )",
+		`(do (put "a" "1") (frob))`:                             "unknown form",
+		"(do " + strings.Repeat("1 ", maxScriptSteps) + ")":     "too many steps",
+		`(do (put "a" "1") (if (exists "a") (abort "no") nil))`: "aborted: no",
+		strings.Repeat("(not ", maxScriptDepth+1) + "1" + strings.Repeat(")", maxScriptDepth+1): "nested deeper",
+	}
+	for source, reason := range failing {
+		value, err := ck.Eval(source, []string{"a"})
+		if err != ErrScript || !strings.Contains(string(value), reason) {
+			t.Fatalf("script returned %q %v, expected %q", value, err, reason)
+		}
+	}
+	// a kilobyte doubled 11 times is over the 1MB values may have
+	big := `(arg 0)`
+	for i := 0; i < 11; i++ {
+		big = "(concat " + big + " " + big + ")"
+	}
+	if value, err := ck.Eval(`(put "a" `+big+`)`, []string{"a"}, make([]byte, 1<<10)); err != ErrScript || !strings.Contains(string(value), "over the limit") {
+		t.Fatalf("script making a 2MB value returned %.100q %v", value, err)
+	}
+	if value := ck.Get("a"); value != "" {
+		t.Fatalf("failed script wrote %q", value)
+	}
+
+	ck.Put("a", "1")
+	value, err := ck.Eval(`(and (exists "a") (do (delete "a") (not (exists "a"))) (concat (arg 0) (arg 1)))`, []string{"a"}, []byte("o"), []byte("k"))
+	if err != OK || string(value) != "ok" {
+		t.Fatalf("script returned %q %v", value, err)
+	}
+	if err := ck.command(&CommandArgs{Key: "a", Op: Gett}).Err; err != ErrNoKey {
+		t.Fatalf("deleted key still there")
+	}
+
+	ck.CreateBucket("b")
+	if _, err := ck.Bucket("b").Eval(`(put "k" "v")`, []string{"k"}); err != OK {
+		t.Fatalf("script in a bucket returned %v", err)
+	}
+	if value, _ := ck.Bucket("b").Get("k"); string(value) != "v" {
+		t.Fatalf("script wrote %q in the bucket", value)
+	}
+	if ck.Get("k") != "" {
+		t.Fatalf("script in a bucket wrote to the default one")
+	}
+
+	cfg.end()
+}
+
+const (
+	queuePush = "QueuePush"
+	queuePop  = "QueuePop"
+
+	errQueueEmpty Err = "ErrQueueEmpty"
+	errNoValue    Err = "ErrNoValue"
+)
+
+var registerQueue sync.Once
+
+// a FIFO queue kept under key/, as an application would add it
+func registerQueueOps() {
+	registerQueue.Do(func() {
+		Register(queuePush, func(store *MemoryKV, op Op, index int) ([]byte, Err) {
+			store.Put(fmt.Sprintf("%s/%020d", op.Key, index), op.Value)
+			return nil, OK
+		}, func(args *CommandArgs, op *Op) Err {
+			if len(args.Value) == 0 {
+				return errNoValue
+			}
+			return OK
+		})
+		Register(queuePop, func(store *MemoryKV, op Op, index int) ([]byte, Err) {
+			pairs, _ := store.Range(op.Key+"/", prefixEnd(op.Key+"/"), 1)
+			if len(pairs) == 0 {
+				return nil, errQueueEmpty
+			}
+			store.Delete(pairs[0].Key)
+			return pairs[0].Value, OK
+		}, nil)
+	})
+}
+
+func TestRegistry3A(t *testing.T) {
+	const nservers = 3
+	const nclients = 5
+	const npushes = 10
+	registerQueueOps()
+	cfg := make_config(t, nservers, false, 1000)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: commands registered by the application (3A)")
+
+	if _, err := ck.Do("NoSuchOp", "k", nil); err != ErrUnknownOp {
+		t.Fatalf("unregistered op returned %v", err)
+	}
+	if _, err := ck.Do(Expire, "k", nil); err != ErrUnknownOp {
+		t.Fatalf("client proposing a leader's op got %v", err)
+	}
+	if _, err := ck.Do(queuePush, "q", nil); err != errNoValue {
+		t.Fatalf("push refused by its encoder returned %v", err)
+	}
+	if _, err := ck.Do(queuePop, "q", nil); err != errQueueEmpty {
+		t.Fatalf("pop of an empty queue returned %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			ck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(ck)
+			for i := 0; i < npushes; i++ {
+				if _, err := ck.Do(queuePush, "q", []byte(fmt.Sprintf("%v %v", c, i))); err != OK {
+					t.Errorf("push returned %v", err)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	// a crash loses nothing, the queue is in the store and so in snapshots
+	for i := 0; i < nservers; i++ {
+		cfg.ShutdownServer(i)
+	}
+	for i := 0; i < nservers; i++ {
+		cfg.StartServer(i)
+	}
+	cfg.ConnectAll()
+
+	next := make([]int, nclients)
+	for n := 0; n < nclients*npushes; n++ {
+		value, err := ck.Do(queuePop, "q", nil)
+		if err != OK {
+			t.Fatalf("pop %v returned %v", n, err)
+		}
+		var c, i int
+		fmt.Sscanf(string(value), "%d %d", &c, &i)
+		if i != next[c] {
+			t.Fatalf("popped %q, expected %v %v first", value, c, next[c])
+		}
+		next[c]++
+	}
+	if _, err := ck.Do(queuePop, "q", nil); err != errQueueEmpty {
+		t.Fatalf("pop of a drained queue returned %v", err)
+	}
+
+	cfg.end()
+}
+
+func TestApplyBatch3A(t *testing.T) {
+	const nservers = 3
+	const nclients = 10
+	const maxPuts = 50
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	registry := metrics.NewRegistry()
+	cfg.kvservers[0].SetMetrics(registry)
+
+	cfg.begin("Test: entries applied in batches (3A)")
+
+	// the clients stop once a batch has been seen rather than after a fixed
+	// number of Puts, which would pile up handlers under -race
+	var batched int32
+	puts := make([]int, nclients)
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			ck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(ck)
+			for ; puts[c] < maxPuts && atomic.LoadInt32(&batched) == 0; puts[c]++ {
+				ck.Put(strconv.Itoa(c), strconv.Itoa(puts[c]))
+				if registry.Histogram(MetricApplyBatch).Max >= 2 {
+					atomic.StoreInt32(&batched, 1)
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	ck := cfg.makeClient(cfg.All())
+	for c := 0; c < nclients; c++ {
+		if puts[c] > 0 {
+			check(cfg, t, ck, strconv.Itoa(c), strconv.Itoa(puts[c]-1))
+		}
+	}
+	// entries committed together are applied together
+	h := registry.Histogram(MetricApplyBatch)
+	if h.Max < 2 || h.Count >= int64(h.Sum) {
+		t.Fatalf("apply batches %+v for %v entries", h, h.Sum)
+	}
+
+	cfg.end()
+}
+
+func TestShutdown3A(t *testing.T) {
+	const nservers = 3
+	const nclients = 5
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: graceful shutdown of the leader (3A)")
+
+	// a leader with something applied, the clients may be backing off from
+	// the first election for a while
+	ck := cfg.makeClient(cfg.All())
+	ck.Put("start", "")
+
+	var stop int32
+	counts := make([]int, nclients)
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			ck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(ck)
+			for atomic.LoadInt32(&stop) == 0 {
+				ck.Append(strconv.Itoa(c), "x "+strconv.Itoa(c)+" "+strconv.Itoa(counts[c])+" y")
+				counts[c]++
+			}
+		}(c)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	_, leader := cfg.Leader()
+	kv := cfg.kvservers[leader]
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := kv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	reply := CommandReply{}
+	kv.Command(&CommandArgs{Op: Gett, Key: "0"}, &reply)
+	if reply.Err != ErrWrongLeader {
+		t.Fatalf("command after Shutdown got %v", reply.Err)
+	}
+	applied := kv.lastApplied
+	if cfg.saved[leader].SnapshotSize() == 0 {
+		t.Fatalf("no snapshot taken on Shutdown")
+	}
+
+	// the others carry on, and nothing acknowledged is lost
+	time.Sleep(500 * time.Millisecond)
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	for c := 0; c < nclients; c++ {
+		checkClntAppends(t, c, ck.Get(strconv.Itoa(c)), counts[c])
+	}
+
+	// and the server restarts from its final snapshot
+	cfg.ShutdownServer(leader)
+	cfg.StartServer(leader)
+	cfg.kvservers[leader].mu.RLock()
+	restored := cfg.kvservers[leader].lastApplied
+	cfg.kvservers[leader].mu.RUnlock()
+	if restored != applied {
+		t.Fatalf("restarted at %v, want %v", restored, applied)
+	}
+
+	cfg.end()
+}
+
+func TestGateway3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	server := httptest.NewServer(NewGateway(cfg.makeClient(cfg.All())))
+	defer server.Close()
+
+	cfg.begin("Test: HTTP gateway (3A)")
+
+	do := func(method string, path string, body string) (int, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("%v %v: %v", method, path, err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v %v: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	// watch a prefix before writing to it
+	resp, err := http.Get(server.URL + "/watch/a?prefix=1")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("watch content type %q", ct)
+	}
+
+	if code, body := do("PUT", "/kv/a1", "one"); code != http.StatusNoContent {
+		t.Fatalf("PUT: %v %v", code, body)
+	}
+	do("PUT", "/kv/a2", "two")
+	do("PUT", "/kv/b", "three")
+	if code, body := do("GET", "/kv/a1", ""); code != http.StatusOK || body != "one" {
+		t.Fatalf("GET a1: %v %q", code, body)
+	}
+	if code, _ := do("GET", "/kv/missing", ""); code != http.StatusNotFound {
+		t.Fatalf("GET of a missing key: %v", code)
+	}
+	if code, _ := do("DELETE", "/kv/a2", ""); code != http.StatusNoContent {
+		t.Fatalf("DELETE: %v", code)
+	}
+	if code, _ := do("DELETE", "/kv/a2", ""); code != http.StatusNotFound {
+		t.Fatalf("DELETE of a missing key: %v", code)
+	}
+	if code, _ := do("POST", "/kv/a1", ""); code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST: %v", code)
+	}
+
+	code, body := do("GET", "/range?start=a&end=c&limit=1", "")
+	var page rangeResponse
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &page) != nil {
+		t.Fatalf("range: %v %q", code, body)
+	}
+	if len(page.Pairs) != 1 || page.Pairs[0].Key != "a1" || page.Next == "" {
+		t.Fatalf("first page %+v", page)
+	}
+	code, body = do("GET", "/range?start=a&end=c&token="+page.Next, "")
+	page = rangeResponse{}
+	json.Unmarshal([]byte(body), &page)
+	if len(page.Pairs) != 1 || page.Pairs[0].Key != "b" || string(page.Pairs[0].Value) != "three" || page.Next != "" {
+		t.Fatalf("second page %v %+v", code, page)
+	}
+
+	// the writes under a, in order, as events
+	want := []string{"Put a1 one", "Put a2 two", "Delete a2 "}
+	reader := bufio.NewReader(resp.Body)
+	for _, w := range want {
+		var event WatchEvent
+		id, kind := "", ""
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("watch stream: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				break
+			}
+			field := strings.SplitN(line, ": ", 2)
+			switch field[0] {
+			case "id":
+				id = field[1]
+			case "event":
+				kind = field[1]
+			case "data":
+				if err := json.Unmarshal([]byte(field[1]), &event); err != nil {
+					t.Fatalf("event data %q: %v", field[1], err)
+				}
+			}
+		}
+		if got := kind + " " + event.Key + " " + string(event.Value); got != w || id != strconv.Itoa(event.Revision) {
+			t.Fatalf("event %v %q, want %q", id, got, w)
+		}
+	}
+
+	cfg.end()
+}
+
+// one RESP reply, rendered flat: errors keep their "-", nil is "(nil)" and
+// arrays are their elements in brackets
+func readRedisReply(t *testing.T, r *bufio.Reader) string {
+	line, err := readRedisLine(r)
+	if err != nil || line == "" {
+		t.Fatalf("reading reply: %q %v", line, err)
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:]
+	case '-':
+		return line
+	case '$':
+		if line == "$-1" {
+			return "(nil)"
+		}
+		n, _ := strconv.Atoi(line[1:])
+		value := make([]byte, n+2)
+		if _, err := io.ReadFull(r, value); err != nil {
+			t.Fatalf("reading bulk: %v", err)
+		}
+		return string(value[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		elements := make([]string, n)
+		for i := range elements {
+			elements[i] = readRedisReply(t, r)
+		}
+		return "[" + strings.Join(elements, " ") + "]"
+	}
+	t.Fatalf("bad reply %q", line)
+	return ""
+}
+
+func TestRedis3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go NewRedisFrontend(cfg.makeClient(cfg.All())).Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	send := func(args ...string) {
+		command := fmt.Sprintf("*%d\r\n", len(args))
+		for _, arg := range args {
+			command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+		}
+		if _, err := io.WriteString(conn, command); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	expect := func(want string, args ...string) {
+		send(args...)
+		if got := readRedisReply(t, r); got != want {
+			t.Fatalf("%v: got %q, want %q", args, got, want)
+		}
+	}
+
+	cfg.begin("Test: Redis protocol frontend (3A)")
+
+	expect("PONG", "PING")
+	expect("OK", "SET", "a", "1")
+	expect("1", "GET", "a")
+	expect("(nil)", "GET", "missing")
+	expect("3", "APPEND", "a", "23")
+	expect("124", "INCR", "a")
+	expect("OK", "set", "s", "x")
+	expect("-ERR value is not an integer or out of range", "INCR", "s")
+	expect("2", "DEL", "a", "s", "missing")
+	expect("-ERR wrong number of arguments for 'get' command", "GET")
+	expect("-ERR unknown command 'FLUSHALL'", "FLUSHALL")
+
+	expect("OK", "SET", "e", "v")
+	expect("1", "EXPIRE", "e", "1")
+	expect("0", "EXPIRE", "missing", "1")
+	expect("OK", "SET", "px", "v", "PX", "100")
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		send("GET", "e")
+		e := readRedisReply(t, r)
+		send("GET", "px")
+		px := readRedisReply(t, r)
+		if e == "(nil)" && px == "(nil)" {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("keys with a TTL never expired: %q %q", e, px)
+		}
+	}
+
+	// pipelined and inline
+	io.WriteString(conn, "PING\r\n*2\r\n$3\r\nGET\r\n$1\r\ne\r\n")
+	if got := readRedisReply(t, r) + " " + readRedisReply(t, r); got != "PONG (nil)" {
+		t.Fatalf("pipelined replies %q", got)
+	}
+
+	for i := 1; i <= 5; i++ {
+		expect("OK", "SET", "k"+strconv.Itoa(i), "v")
+	}
+	expect("OK", "SET", "other", "v")
+	var keys []string
+	cursor, pages := "0", 0
+	for {
+		send("SCAN", cursor, "MATCH", "k*", "COUNT", "2")
+		if line, _ := readRedisLine(r); line != "*2" {
+			t.Fatalf("SCAN reply %q", line)
+		}
+		cursor = readRedisReply(t, r)
+		page := strings.Trim(readRedisReply(t, r), "[]")
+		keys = append(keys, strings.Fields(page)...)
+		if pages++; cursor == "0" {
+			break
+		}
+	}
+	if strings.Join(keys, " ") != "k1 k2 k3 k4 k5" || pages < 3 {
+		t.Fatalf("SCAN found %v in %v pages", keys, pages)
+	}
+
+	expect("OK", "QUIT")
+
+	cfg.end()
+}
+
+func TestMemcached3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go NewMemcachedFrontend(cfg.makeClient(cfg.All())).Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	// send request and read as many lines as want has
+	expect := func(request string, want ...string) {
+		if _, err := io.WriteString(conn, request); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		for _, w := range want {
+			if got, err := readRedisLine(r); err != nil || got != w {
+				t.Fatalf("%q: got %q %v, want %q", request, got, err, w)
+			}
+		}
+	}
+
+	cfg.begin("Test: memcached protocol frontend (3A)")
+
+	expect("set a 0 0 5\r\nhello\r\n", "STORED")
+	expect("get a missing\r\n", "VALUE a 0 5", "hello", "END")
+	expect("set n 0 0 2\r\n10\r\n", "STORED")
+	expect("incr n 5\r\n", "15")
+	expect("incr missing 1\r\n", "NOT_FOUND")
+	expect("incr a 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	expect("delete a\r\n", "DELETED")
+	expect("delete a\r\n", "NOT_FOUND")
+	expect("bogus\r\n", "ERROR")
+	// no answer to noreply, so the next one is get's
+	expect("set q 0 0 1 noreply\r\nx\r\nget q\r\n", "VALUE q 0 1", "x", "END")
+
+	expect("set e 0 1 1\r\nx\r\n", "STORED")
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		io.WriteString(conn, "get e\r\n")
+		line, _ := readRedisLine(r)
+		if line == "END" {
+			break
+		}
+		readRedisLine(r)
+		readRedisLine(r)
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("key with an exptime never expired")
+		}
+	}
+	expect("set gone 0 -1 1\r\nx\r\nget gone\r\n", "STORED", "END")
+
+	cfg.end()
+}
+
+func TestCacheEviction3A(t *testing.T) {
+	const nservers = 3
+	const budget = 2000
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	registry := metrics.NewRegistry()
+	cfg.kvservers[0].SetMetrics(registry)
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].SetCacheBudget(budget)
+	}
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: LRU eviction in cache mode (3A)")
+
+	value := strings.Repeat("v", 95)
+	ck.Put("hot", value)
+	for i := 0; i < 100; i++ {
+		ck.Put(fmt.Sprintf("k%02d", i), value)
+		check(cfg, t, ck, "hot", value)
+	}
+
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		settled := true
+		for i := 0; i < nservers; i++ {
+			kv := cfg.kvservers[i]
+			kv.mu.RLock()
+			if kv.storage.Size() > budget {
+				settled = false
+			}
+			kv.mu.RUnlock()
+		}
+		if settled {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("store never got under the budget")
+		}
+	}
+	// the recently used stay, the cold go
+	check(cfg, t, ck, "hot", value)
+	check(cfg, t, ck, "k99", value)
+	check(cfg, t, ck, "k00", "")
+	if n := registry.Counter(MetricEvictions); n < 80 {
+		t.Fatalf("%v keys evicted", n)
+	}
+
+	cfg.end()
+}
+
+func TestMultiGet3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: MultiGet reads its keys at one point (3A)")
+
+	// x is written first, so at any point x is y or one ahead
+	var stop int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writer := cfg.makeClient(cfg.All())
+		defer cfg.deleteClient(writer)
+		for i := 0; atomic.LoadInt32(&stop) == 0; i++ {
+			writer.Put("x", strconv.Itoa(i))
+			writer.Put("y", strconv.Itoa(i))
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		values, revision := ck.MultiGet("x", "y", "missing")
+		if _, ok := values["missing"]; ok {
+			t.Fatalf("MultiGet returned a missing key")
+		}
+		if len(values) == 0 {
+			continue
+		}
+		x, _ := strconv.Atoi(string(values["x"]))
+		y, _ := strconv.Atoi(string(values["y"]))
+		if x != y && x != y+1 {
+			t.Fatalf("MultiGet read x=%v and y=%v", x, y)
+		}
+		// the same again as of that revision
+		again, _, err := ck.MultiGetAt(revision, "x", "y")
+		if err != OK || !reflect.DeepEqual(again, values) {
+			t.Fatalf("MultiGetAt(%v) = %v %v, want %v", revision, again, err, values)
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	<-done
+
+	cfg.end()
+}
+
+func TestWaitApplied3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: waiting for a replica to apply up to an index (3A)")
+
+	_, leader := cfg.Leader()
+	behind := (leader + 1) % nservers
+	cfg.disconnect(behind, cfg.All())
+	ck.Put("k", "v")
+	index := ck.seenIndex
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if err := cfg.kvservers[behind].WaitApplied(ctx, index); err != context.DeadlineExceeded {
+		t.Fatalf("disconnected server waited with %v", err)
+	}
+	cancel()
+
+	cfg.ConnectAll()
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := cfg.kvservers[behind].WaitApplied(ctx, index); err != nil {
+		t.Fatalf("reconnected server: %v", err)
+	}
+	// fenced: the write is there
+	kv := cfg.kvservers[behind]
+	kv.mu.RLock()
+	value, err := kv.storage.Get("k")
+	kv.mu.RUnlock()
+	if err != OK || string(value) != "v" {
+		t.Fatalf("after WaitApplied the replica has %q %v", value, err)
+	}
+
+	// a killed server stops waiting
+	waited := make(chan error)
+	go func() {
+		waited <- kv.WaitApplied(context.Background(), index+1000)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	kv.Kill()
+	select {
+	case err := <-waited:
+		if err != raft.ErrKilled {
+			t.Fatalf("killed server waited with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("WaitApplied still blocked after Kill")
+	}
+
+	cfg.end()
+}
+
+func TestLeaderHint3A(t *testing.T) {
+	const nservers = 5
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: clerks follow the leader hints of other servers (3A)")
+
+	ck.Put("k", "v")
+	_, leader := cfg.Leader()
+	for i := 0; i < nservers; i++ {
+		reply := CommandReply{}
+		cfg.kvservers[i].Command(&CommandArgs{Op: Gett, Key: "k"}, &reply)
+		if reply.Server != i || (i != leader && (reply.Err != ErrWrongLeader || reply.Leader != leader)) {
+			t.Fatalf("server %v answered %+v, leader is %v", i, reply, leader)
+		}
+	}
+
+	// hear from every server once, so their ids are known
+	for p := range ck.servers {
+		ck.leaderId = int64(p)
+		check(cfg, t, ck, "k", "v")
+	}
+	if len(ck.positions) != nservers {
+		t.Fatalf("clerk knows %v of %v servers", ck.positions, nservers)
+	}
+	leaderAt := ck.positions[leader]
+	// a follower not right before the leader, so rotating wouldn't find it next
+	from := (leaderAt + 2) % nservers
+	registries := make([]*metrics.Registry, nservers)
+	for i := range registries {
+		registries[i] = metrics.NewRegistry()
+		cfg.kvservers[i].SetMetrics(registries[i])
+	}
+	ck.leaderId = from
+	check(cfg, t, ck, "k", "v")
+	for i, registry := range registries {
+		asked := ck.positions[i] == from || i == leader
+		if n := registry.Counter(labelled(MetricCommands, "op", Gett)); (n > 0) != asked {
+			t.Fatalf("server %v got %v commands", i, n)
+		}
+	}
+
+	cfg.end()
+}
+
+func TestRetryBackoff(t *testing.T) {
+	last := time.Duration(0)
+	for round := 1; round < 100; round++ {
+		wait := retryBackoff(round)
+		if wait > retryBackoffCap || wait < last/2 {
+			t.Fatalf("round %v waits %v after %v", round, wait, last)
+		}
+		last = wait
+	}
+	if wait := retryBackoff(1); wait < retryBackoffBase/2 || wait > retryBackoffBase {
+		t.Fatalf("first round waits %v", wait)
+	}
+}
+
+func TestRetryBackoffNoLeader3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: clerks back off while there is no leader (3A)")
+
+	ck.Put("k", "v")
+	_, leader := cfg.Leader()
+	cfg.ShutdownServer(leader)
+	registries := make([]*metrics.Registry, nservers)
+	for i := range registries {
+		if i != leader {
+			// no majority anywhere, and no leader to hint at once the
+			// followers start elections
+			cfg.disconnect(i, cfg.All())
+			registries[i] = metrics.NewRegistry()
+			cfg.kvservers[i].SetMetrics(registries[i])
+		}
+	}
+	time.Sleep(electionTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if reply := ck.CommandContext(ctx, &CommandArgs{Op: Gett, Key: "k"}); reply.Err != ErrTimeout {
+		t.Fatalf("got %v without a leader", reply.Err)
+	}
+	attempts := int64(0)
+	for _, registry := range registries {
+		if registry != nil {
+			attempts += registry.Counter(labelled(MetricCommands, "op", Gett))
+		}
+	}
+	// retrying in a loop, the followers would be asked as fast as they answer
+	if attempts > 50 {
+		t.Fatalf("clerk made %v attempts in two seconds", attempts)
+	}
+
+	cfg.StartServer(leader)
+	cfg.ConnectAll()
+	check(cfg, t, ck, "k", "v")
+
+	cfg.end()
+}
+
+type auditRecorder struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func (r *auditRecorder) Audit(record AuditRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, record)
+}
+
+func TestClientContext3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: clerk ops with a context (3A)")
+
+	recorder := &auditRecorder{}
+	cfg.kvservers[0].SetAuditSink(recorder)
+	ctx := WithTrace(context.Background(), "request-1")
+	if err := ck.PutContext(ctx, "k", "a"); err != OK {
+		t.Fatalf("PutContext: %v", err)
+	}
+	if err := ck.AppendContext(ctx, "k", "b"); err != OK {
+		t.Fatalf("AppendContext: %v", err)
+	}
+	if value, err := ck.GetContext(ctx, "k"); err != OK || value != "ab" {
+		t.Fatalf("GetContext got %q, %v", value, err)
+	}
+	if err := ck.DeleteContext(ctx, "k"); err != OK {
+		t.Fatalf("DeleteContext: %v", err)
+	}
+	if value, err := ck.GetContext(ctx, "k"); err != ErrNoKey || value != "" {
+		t.Fatalf("GetContext of a deleted key got %q, %v", value, err)
+	}
+	start := time.Now()
+	for {
+		recorder.mu.Lock()
+		traced := 0
+		for _, record := range recorder.records {
+			if record.Trace == "request-1" {
+				traced++
+			} else if record.ClientId == ck.clientId {
+				t.Fatalf("untraced record %+v", record)
+			}
+		}
+		recorder.mu.Unlock()
+		if traced == 3 {
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("%v records with the trace, not 3", traced)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// no majority, the deadline ends the wait
+	for i := 0; i < nservers; i++ {
+		cfg.disconnect(i, cfg.All())
+	}
+	deadline, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	// may still be applied, once there's a leader again
+	if err := ck.PutContext(deadline, "x", "c"); err != ErrTimeout {
+		t.Fatalf("PutContext without a leader: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("PutContext returned %v after its deadline", elapsed-500*time.Millisecond)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ck.GetContext(canceled, "k"); err != ErrTimeout {
+		t.Fatalf("GetContext with a canceled context: %v", err)
+	}
+
+	cfg.ConnectAll()
+	check(cfg, t, ck, "k", "")
+
+	cfg.end()
+}
+
+func TestAsync3A(t *testing.T) {
+	const nservers = 3
+	const nkeys = 10
+	const nappends = 20
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+	defer ck.CloseAsync()
+
+	cfg.begin("Test: asynchronous clerk ops (3A)")
+
+	results := make([]<-chan Result, 0, nkeys*nappends)
+	for i := 0; i < nappends; i++ {
+		for k := 0; k < nkeys; k++ {
+			results = append(results, ck.AppendAsync(strconv.Itoa(k), "x "+strconv.Itoa(k)+" "+strconv.Itoa(i)+" y"))
+		}
+	}
+	for _, result := range results {
+		if r := <-result; r.Err != OK {
+			t.Fatalf("AppendAsync: %v", r.Err)
+		}
+	}
+	// the appends to a key applied in the order they were issued
+	for k := 0; k < nkeys; k++ {
+		r := <-ck.GetAsync(strconv.Itoa(k))
+		if r.Err != OK {
+			t.Fatalf("GetAsync: %v", r.Err)
+		}
+		checkClntAppends(t, k, r.Value, nappends)
+		if r.Value != ck.Get(strconv.Itoa(k)) {
+			t.Fatalf("GetAsync and Get disagree on %v", k)
+		}
+	}
+
+	put, del := ck.PutAsync("k", "v"), ck.DeleteAsync("k")
+	if r := <-put; r.Err != OK {
+		t.Fatalf("PutAsync: %v", r.Err)
+	}
+	if r := <-del; r.Err != OK {
+		t.Fatalf("DeleteAsync after PutAsync: %v", r.Err)
+	}
+	done := make(chan Err)
+	ck.CommandAsync(&CommandArgs{Op: Gett, Key: "k"}, func(reply *CommandReply) {
+		done <- reply.Err
+	})
+	if err := <-done; err != ErrNoKey {
+		t.Fatalf("Get of a deleted key: %v", err)
+	}
+
+	cfg.end()
+}
+
+func TestWriteBatching3A(t *testing.T) {
+	const nservers = 3
+	const nwrites = 500
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+	ck.SetAsyncWorkers(2)
+	ck.SetWriteBatching(20*time.Millisecond, 50)
+	defer ck.CloseAsync()
+
+	cfg.begin("Test: clerk write batching (3A)")
+
+	ck.Put("warmup", "")
+	registries := make([]*metrics.Registry, nservers)
+	for i := range registries {
+		registries[i] = metrics.NewRegistry()
+		cfg.kvservers[i].SetMetrics(registries[i])
+	}
+	results := make([]<-chan Result, 0, 2*nwrites)
+	for i := 0; i < nwrites; i++ {
+		key := "k" + strconv.Itoa(i%100)
+		if i < 100 {
+			results = append(results, ck.PutAsync(key, "x"))
+		} else {
+			results = append(results, ck.AppendAsync(key, "y"))
+		}
+	}
+	// a read ends the batch before it, and sees it
+	if r := <-ck.GetAsync("k0"); r.Err != OK || r.Value != "xyyyy" {
+		t.Fatalf("GetAsync after the writes got %q, %v", r.Value, r.Err)
+	}
+	for _, result := range results {
+		if r := <-result; r.Err != OK {
+			t.Fatalf("batched write: %v", r.Err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		check(cfg, t, ck, "k"+strconv.Itoa(i), "xyyyy")
+	}
+	sent := int64(0)
+	for _, registry := range registries {
+		for _, op := range []string{Putt, Appendd, Txn} {
+			sent += registry.Counter(labelled(MetricCommands, "op", op))
+		}
+	}
+	if sent > nwrites/10 {
+		t.Fatalf("%v writes took %v commands", nwrites, sent)
+	}
+
+	cfg.end()
+}
+
+func TestFollowerReads3A(t *testing.T) {
+	const nservers = 3
+	const ngets = 30
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+	ck.SetFollowerReads(true)
+
+	cfg.begin("Test: clerk reads spread over the replicas (3A)")
+
+	ck.Put("k", "1")
+	time.Sleep(200 * time.Millisecond)
+	registries := make([]*metrics.Registry, nservers)
+	for i := range registries {
+		registries[i] = metrics.NewRegistry()
+		cfg.kvservers[i].SetMetrics(registries[i])
+	}
+	for i := 0; i < ngets; i++ {
+		check(cfg, t, ck, "k", "1")
+	}
+	for i, registry := range registries {
+		if n := registry.Counter(labelled(MetricCommands, "op", Gett)); n < ngets/nservers {
+			t.Fatalf("server %v served %v of %v reads", i, n, ngets)
+		}
+	}
+
+	// a follower cut off is behind what the clerk has seen after a Put, its
+	// turns go to the leader
+	_, leader := cfg.Leader()
+	isolated := (leader + 1) % nservers
+	cfg.partition([]int{leader, (leader + 2) % nservers}, []int{isolated})
+	cfg.ConnectClient(ck, cfg.All())
+	ck.Put("k", "2")
+	for i := 0; i < ngets; i++ {
+		check(cfg, t, ck, "k", "2")
+	}
+
+	cfg.end()
+}
+
+func TestRetryBudget3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: clerk commands give up once out of retry budget (3A)")
+
+	ck.Put("k", "v")
+	registries := make([]*metrics.Registry, nservers)
+	for i := range registries {
+		cfg.disconnect(i, cfg.All())
+		registries[i] = metrics.NewRegistry()
+		cfg.kvservers[i].SetMetrics(registries[i])
+	}
+
+	// no majority, only so many attempts
+	ck.SetRetryBudget(4, 0)
+	if reply := ck.CommandContext(context.Background(), &CommandArgs{Op: Putt, Key: "x", Value: []byte("a")}); reply.Err != ErrTimeout {
+		t.Fatalf("got %v without a leader", reply.Err)
+	}
+	attempts := int64(0)
+	for _, registry := range registries {
+		attempts += registry.Counter(labelled(MetricCommands, "op", Putt))
+	}
+	if attempts > 4 {
+		t.Fatalf("%v attempts with a budget of 4", attempts)
+	}
+
+	// only so long, each server told to give up within it
+	ck.SetRetryBudget(0, 300*time.Millisecond)
+	ck.SetTimeout(5 * time.Second)
+	start := time.Now()
+	if reply := ck.CommandContext(context.Background(), &CommandArgs{Op: Putt, Key: "x", Value: []byte("b")}); reply.Err != ErrTimeout {
+		t.Fatalf("got %v without a leader", reply.Err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("command returned %v after its budget", elapsed-300*time.Millisecond)
+	}
+
+	ck.SetRetryBudget(0, 0)
+	ck.SetTimeout(defaultAttemptTimeout)
+	cfg.ConnectAll()
+	check(cfg, t, ck, "k", "v")
+
+	cfg.end()
+}
+
+func TestHealthChecks3A(t *testing.T) {
+	const nservers = 3
+	const ngets = 60
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+	ck.SetFollowerReads(true)
+
+	cfg.begin("Test: clerks pass over servers that don't answer pings (3A)")
+
+	ck.Put("k", "1")
+	_, leader := cfg.Leader()
+	down := (leader + 1) % nservers
+	cfg.DisconnectClient(ck, []int{down})
+	ck.StartHealthChecks(20 * time.Millisecond)
+	defer ck.StopHealthChecks()
+	time.Sleep(300 * time.Millisecond)
+	// the clerk's servers are shuffled, those it finds healthy mustn't be down
+	unhealthy := ck.Unhealthy()
+	if len(unhealthy) != 1 {
+		t.Fatalf("unhealthy %v, expected one", unhealthy)
+	}
+	for i := range ck.servers {
+		reply := &PingReply{}
+		if i != unhealthy[0] && (!ck.servers[i].Call("KVServer.Ping", &PingArgs{}, reply) || reply.Server == down) {
+			t.Fatalf("server %v is unhealthy, not %v", down, unhealthy[0])
+		}
+	}
+	// a third of the reads would wait on the server that's down
+	start := time.Now()
+	for i := 0; i < ngets; i++ {
+		check(cfg, t, ck, "k", "1")
+	}
+	if elapsed := time.Since(start); elapsed > ngets*defaultAttemptTimeout/nservers/2 {
+		t.Fatalf("%v reads took %v", ngets, elapsed)
+	}
+
+	cfg.ConnectClient(ck, []int{down})
+	time.Sleep(300 * time.Millisecond)
+	if unhealthy := ck.Unhealthy(); len(unhealthy) != 0 {
+		t.Fatalf("unhealthy %v after reconnecting", unhealthy)
+	}
+	check(cfg, t, ck, "k", "1")
+
+	cfg.end()
+}
+
+func TestLiveness3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: clerks track the latency of the servers they ping (3A)")
+
+	if ck.Liveness() != nil || ck.Nearest() != -1 {
+		t.Fatalf("liveness without health checks")
+	}
+	ck.Put("k", "1")
+	cfg.DisconnectClient(ck, []int{0})
+	ck.StartHealthChecks(20 * time.Millisecond)
+	defer ck.StopHealthChecks()
+	time.Sleep(300 * time.Millisecond)
+	unhealthy := ck.Unhealthy()
+	if len(unhealthy) != 1 {
+		t.Fatalf("unhealthy %v, expected one", unhealthy)
+	}
+	for i, l := range ck.Liveness() {
+		if down := i == unhealthy[0]; l.Alive == down || down != l.LastSuccess.IsZero() || down != (l.Failures > 0) {
+			t.Fatalf("server %v: %+v, unhealthy %v", i, l, unhealthy)
+		}
+	}
+	if nearest := ck.Nearest(); nearest == -1 || nearest == unhealthy[0] {
+		t.Fatalf("nearest %v, unhealthy %v", nearest, unhealthy)
+	}
+
+	cfg.end()
+}
+
+func TestReadHedging3A(t *testing.T) {
+	const nservers = 3
+	const ngets = 60
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+	ck.SetReadHedging(95)
+
+	cfg.begin("Test: stale reads hedged to a second replica (3A)")
+
+	ck.Put("k", "1")
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < hedgeMinSamples; i++ {
+		if v := ck.GetStale("k"); string(v) != "1" {
+			t.Fatalf("stale read got %q, expected 1", v)
+		}
+	}
+
+	// requests to a replica cut off take seconds to fail, a third of the
+	// reads would wait out the clerk's timeout on it
+	cfg.net.LongDelays(true)
+	cfg.DisconnectClient(ck, []int{0})
+	start := time.Now()
+	for i := 0; i < ngets; i++ {
+		if v := ck.GetStale("k"); string(v) != "1" {
+			t.Fatalf("stale read got %q, expected 1", v)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > ngets*defaultAttemptTimeout/nservers/2 {
+		t.Fatalf("%v reads took %v", ngets, elapsed)
+	}
+	cfg.net.LongDelays(false)
+
+	cfg.end()
+}
+
+func TestClerkIdentity3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ends := cfg.makeClient(cfg.All()).servers
+	dir, err := ioutil.TempDir("", "kvraft-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "clerk")
+
+	cfg.begin("Test: clerk identity survives a restart (3A)")
+
+	ck, err := OpenClerk(ends, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ck.Append("k", "a")
+	ck.Append("k", "b")
+	clientId, commandId := ck.Identity()
+
+	// a restart picks up the id, and its commands aren't taken for repeats
+	// of those before
+	restarted, err := OpenClerk(ends, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, next := restarted.Identity(); id != clientId || next < commandId {
+		t.Fatalf("restarted as %v at %v, was %v at %v", id, next, clientId, commandId)
+	}
+	restarted.Append("k", "c")
+	if v := restarted.Get("k"); v != "abc" {
+		t.Fatalf("got %q after a restart, expected abc", v)
+	}
+
+	// as does a clerk handed the identity
+	clientId, commandId = restarted.Identity()
+	continued := MakeClerkWithIdentity(ends, clientId, commandId)
+	continued.Append("k", "d")
+	if v := continued.Get("k"); v != "abcd" {
+		t.Fatalf("got %q from a continued clerk, expected abcd", v)
+	}
+
+	cfg.end()
+}
+
+func TestClientMetrics3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+	registry := metrics.NewRegistry()
+	ck.SetMetrics(registry)
+
+	cfg.begin("Test: clerk metrics and error classes (3A)")
+
+	ck.Put("k", "v")
+	check(cfg, t, ck, "k", "v")
+	if n := registry.Counter(labelled(MetricClientCommands, "op", Putt)); n != 1 {
+		t.Fatalf("%v Puts counted, expected 1", n)
+	}
+	if h := registry.Histogram(labelled(MetricClientLatency, "op", Gett)); h.Count != 1 {
+		t.Fatalf("%v Get latencies observed, expected 1", h.Count)
+	}
+
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].SetQuota(1)
+	}
+	// the alarm is raised once the checker notices
+	var err Err
+	for i := 0; i < 100 && err != ErrNoSpace; i++ {
+		err = ck.command(&CommandArgs{Op: Putt, Key: "big", Value: []byte("value")}).Err
+		time.Sleep(10 * time.Millisecond)
+	}
+	if Classify(context.Background(), err) != ClassQuota {
+		t.Fatalf("%v over the quota isn't a Quota error", err)
+	}
+	if n := registry.Counter(labelled(MetricClientErrors, "class", string(ClassQuota))); n != 1 {
+		t.Fatalf("%v Quota errors counted, expected 1", n)
+	}
+
+	// no majority: retries, then a timeout or cancellation
+	for i := 0; i < nservers; i++ {
+		cfg.disconnect(i, cfg.All())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := ck.CommandContext(ctx, &CommandArgs{Op: Gett, Key: "k"}).Err; Classify(ctx, err) != ClassTimeout {
+		t.Fatalf("%v past the deadline isn't a Timeout", err)
+	}
+	if n := registry.Counter(labelled(MetricClientRetries, "op", Gett)); n == 0 {
+		t.Fatalf("no retries counted without a leader")
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ck.CommandContext(canceled, &CommandArgs{Op: Gett, Key: "k"}).Err; Classify(canceled, err) != ClassCanceled {
+		t.Fatalf("%v with a canceled context isn't Canceled", err)
+	}
+	for _, class := range []ErrorClass{ClassTimeout, ClassCanceled} {
+		if n := registry.Counter(labelled(MetricClientErrors, "class", string(class))); n != 1 {
+			t.Fatalf("%v %v errors counted, expected 1", n, class)
+		}
+	}
+	if Classify(context.Background(), ErrValueTooLarge) != ClassInvalid || Classify(context.Background(), ErrNoKey) != ClassNone {
+		t.Fatalf("misclassified errors of the caller's own")
+	}
+
+	cfg.ConnectAll()
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].SetQuota(0)
+	}
+	check(cfg, t, ck, "k", "v")
+
+	cfg.end()
+}
+
+func TestPool3A(t *testing.T) {
+	const nservers = 3
+	const nclients = 20
+	const poolSize = 4
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ends := cfg.makeClient(cfg.All()).servers
+	pool := MakePool(ends, poolSize)
+
+	cfg.begin("Test: goroutines sharing a pool of clerks (3A)")
+
+	var wg sync.WaitGroup
+	for i := 0; i < nclients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				pool.Append("k"+strconv.Itoa(i), strconv.Itoa(j))
+			}
+			pool.Append("shared", "x")
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < nclients; i++ {
+		if v := pool.Get("k" + strconv.Itoa(i)); v != "01234" {
+			t.Fatalf("client %v's appends got %q", i, v)
+		}
+	}
+	if v := pool.Get("shared"); v != strings.Repeat("x", nclients) {
+		t.Fatalf("shared key got %q", v)
+	}
+	// the servers only ever heard from the pool's clerks
+	ck := cfg.makeClient(cfg.All())
+	if status := ck.Status(); status.Clients > poolSize {
+		t.Fatalf("%v clients in the duplicate table, pool of %v", status.Clients, poolSize)
+	}
+
+	cfg.end()
+}
+
+func TestWatchResume3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: watches resume across failures without gaps or repeats (3A)")
+
+	expect := func(w *Watcher, value string) WatchEvent {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				t.Fatalf("watch ended: %v", w.Err())
+			}
+			if event.Key != "/quiet" || string(event.Value) != value {
+				t.Fatalf("got event %+v, expected /quiet=%v", event, value)
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no watch event for /quiet=%v", value)
+		}
+		return WatchEvent{}
+	}
+
+	w := ck.Watch("/quiet", false, 0)
+	time.Sleep(100 * time.Millisecond)
+	ck.Put("/quiet", "a")
+	first := expect(w, "a")
+
+	// push the write out of every replica's history, the watch follows
+	// their applied index meanwhile
+	for i := 0; i < 2; i++ {
+		writes := make([]TxnWrite, watchHistorySize*3/4)
+		for j := range writes {
+			writes[j] = TxnWrite{Putt, "/busy/" + strconv.Itoa(j), []byte("x")}
+		}
+		ck.Txn(TxnRequest{Writes: writes})
+	}
+	time.Sleep(2 * watchPollTimeout)
+	if revision := w.Revision(); revision <= first.Revision {
+		t.Fatalf("watch at revision %v, not past %v", revision, first.Revision)
+	}
+
+	// losing any replica, the one serving the watch included, neither
+	// drops nor repeats events
+	for i := 0; i < nservers; i++ {
+		cfg.ShutdownServer(i)
+		ck.Put("/quiet", strconv.Itoa(i))
+		expect(w, strconv.Itoa(i))
+		cfg.StartServer(i)
+		cfg.ConnectAll()
+		time.Sleep(electionTimeout)
+	}
+	select {
+	case event := <-w.Events:
+		t.Fatalf("unexpected event %+v", event)
+	case <-time.After(2 * watchPollTimeout):
+	}
+
+	// a new watch from after the old one's revision carries on from there
+	revision := w.Revision()
+	w.Close()
+	ck.Put("/quiet", "b")
+	resumed := ck.Watch("/quiet", false, revision+1)
+	defer resumed.Close()
+	expect(resumed, "b")
+
+	cfg.end()
+}
+
+func TestClerkConfig3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	root := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: clerks made from a config on a secured cluster (3A)")
+
+	root.SetRole("writer", Permission{Prefix: "app/", Read: true, Write: true})
+	root.SetUser("alice", "apw", "writer")
+	root.SetUser(RootUser, "rootpw", RootRole)
+	if err := root.EnableAuth(); err != OK {
+		t.Fatalf("EnableAuth returned %v", err)
+	}
+	if err := root.Authenticate(RootUser, "rootpw"); err != OK {
+		t.Fatalf("Authenticate returned %v", err)
+	}
+	recorder := &auditRecorder{}
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].SetAuditSink(recorder)
+	}
+
+	if _, err := MakeClerkWithConfig(root.servers, ClerkConfig{Name: "alice", Password: "wrong"}); err != ErrAuthFailed {
+		t.Fatalf("config with a wrong password got %v", err)
+	}
+	alice, err := MakeClerkWithConfig(root.servers, ClerkConfig{
+		Name:     "alice",
+		Password: "apw",
+		Metadata: func(ctx context.Context, args *CommandArgs) { args.Trace = "tenant-1" },
+	})
+	if err != OK {
+		t.Fatalf("config with alice's credentials got %v", err)
+	}
+	if err := alice.command(&CommandArgs{Key: "app/k", Value: []byte("a"), Op: Putt}).Err; err != OK {
+		t.Fatalf("Put with alice's credentials returned %v", err)
+	}
+
+	// setting the user again turns down its tokens, the clerk gets a new one
+	root.SetUser("alice", "apw", "writer")
+	if err := alice.command(&CommandArgs{Key: "app/k", Value: []byte("b"), Op: Appendd}).Err; err != OK {
+		t.Fatalf("Append after alice was set again returned %v", err)
+	}
+
+	// a token on its own works as well, without a way to renew it
+	token, err := MakeClerkWithConfig(root.servers, ClerkConfig{Token: root.authToken})
+	if err != OK {
+		t.Fatalf("config with a token got %v", err)
+	}
+	if v, err := token.GetContext(context.Background(), "app/k"); err != OK || v != "ab" {
+		t.Fatalf("Get with a token got %q, %v", v, err)
+	}
+
+	recorder.mu.Lock()
+	traced := 0
+	for _, record := range recorder.records {
+		if record.Trace == "tenant-1" {
+			traced++
+		}
+	}
+	recorder.mu.Unlock()
+	if traced == 0 {
+		t.Fatalf("no audit records with the metadata's trace")
+	}
+
+	cfg.end()
+}
+
+func TestErrValues(t *testing.T) {
+	var err error = ErrTimeout
+	if !errors.Is(err, ErrTimeout) || errors.Is(err, ErrNoKey) || err.Error() != "ErrTimeout" {
+		t.Fatalf("ErrTimeout as an error: %q", err)
+	}
+	wrapped := fmt.Errorf("get k: %w", ErrNoKey)
+	var e Err
+	if !errors.Is(wrapped, ErrNoKey) || !errors.As(wrapped, &e) || e != ErrNoKey {
+		t.Fatalf("wrapped ErrNoKey: %v, took out %q", wrapped, e)
+	}
+	if OK.AsError() != nil || ErrNoSpace.AsError() != ErrNoSpace {
+		t.Fatalf("AsError of OK or ErrNoSpace")
+	}
+
+	// the strings on the wire are the ones they always were
+	w := new(bytes.Buffer)
+	labgob.NewEncoder(w).Encode(CommandReply{Err: ErrTimeout})
+	var reply CommandReply
+	labgob.NewDecoder(w).Decode(&reply)
+	if string(reply.Err) != " ErrTimeout" {
+		t.Fatalf("ErrTimeout went over the wire as %q", string(reply.Err))
+	}
+}
+
+func TestRecipes3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck1 := cfg.makeClient(cfg.All())
+	ck2 := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: session, mutex, barrier and sequential key recipes (3A)")
+
+	// the session outlives its TTL many times over
+	s1 := ck1.NewSession(300 * time.Millisecond)
+	s2 := ck2.NewSession(300 * time.Millisecond)
+	defer s2.Close()
+	m1, m2 := ck1.NewMutex(s1, "lock"), ck2.NewMutex(s2, "lock")
+	if !m1.Lock() {
+		t.Fatalf("Lock on a fresh session failed")
+	}
+	time.Sleep(time.Second)
+	if err := m2.TryLock(); err != ErrLocked {
+		t.Fatalf("TryLock of a held lock returned %v", err)
+	}
+
+	// closing the session hands the lock over
+	locked := make(chan bool)
+	go func() { locked <- m2.Lock() }()
+	s1.Close()
+	select {
+	case ok := <-locked:
+		if !ok || m2.Token <= m1.Token {
+			t.Fatalf("second holder got %v with token %v after %v", ok, m2.Token, m1.Token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lock not handed over after the holder's session closed")
+	}
+	select {
+	case <-s1.Done():
+	default:
+		t.Fatalf("closed session isn't done")
+	}
+	if m1.Unlock() || !m2.Unlock() {
+		t.Fatalf("Unlock by a stale holder succeeded or by the holder failed")
+	}
+
+	b := ck1.NewBarrier("barrier")
+	b.Hold(nil)
+	released := make(chan struct{})
+	go func() {
+		ck2.NewBarrier("barrier").Wait()
+		close(released)
+	}()
+	select {
+	case <-released:
+		t.Fatalf("Wait returned while the barrier is held")
+	case <-time.After(200 * time.Millisecond):
+	}
+	b.Release()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Wait didn't return after the barrier was released")
+	}
+
+	first := ck1.PutSequential("queue", []byte("a"), nil)
+	second := ck2.PutSequential("queue", []byte("b"), s2)
+	if first == "" || second <= first {
+		t.Fatalf("sequential keys %q then %q", first, second)
+	}
+	if pairs, _ := ck1.GetByPrefix("queue/", 0); len(pairs) != 2 || pairs[0].Key != first || pairs[1].Key != second {
+		t.Fatalf("queue holds %v", pairs)
+	}
+
+	cfg.end()
+}
+
+func TestTCPTransport3A(t *testing.T) {
+	const nservers = 3
+	transports := make([]*transport.TCPTransport, nservers)
+	addrs := make([]string, nservers)
+	for i := range transports {
+		tr, err := transport.ListenTCP("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		transports[i], addrs[i] = tr, tr.Addr()
+	}
+	dial := func(tr transport.Transport) []transport.Endpoint {
+		ends := make([]transport.Endpoint, nservers)
+		for i, addr := range addrs {
+			ends[i] = tr.Dial(addr)
+		}
+		return ends
+	}
+	servers := make([]*KVServer, nservers)
+	for i := range servers {
+		servers[i] = StartKVServer(dial(transports[i]), i, raft.MakePersister(), -1)
+		servers[i].Register(transports[i])
+	}
+	defer func() {
+		for i := range servers {
+			servers[i].Kill()
+			transports[i].Close()
+		}
+	}()
+	client, err := transport.ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ck := MakeClerk(dial(client))
+
+	fmt.Printf("Test: a cluster over TCP (3A) ...\n")
+
+	ck.Put("k", "a")
+	ck.Append("k", "b")
+	if v := ck.Get("k"); v != "ab" {
+		t.Fatalf("got %q, expected ab", v)
+	}
+
+	// the others carry on without the leader
+	leader := -1
+	for ; leader == -1; time.Sleep(10 * time.Millisecond) {
+		for i, kv := range servers {
+			if _, isLeader := kv.rf.GetState(); isLeader {
+				leader = i
+			}
+		}
+	}
+	servers[leader].Kill()
+	transports[leader].Close()
+	ck.Append("k", "c")
+	if v := ck.Get("k"); v != "abc" {
+		t.Fatalf("got %q after losing the leader, expected abc", v)
+	}
+	// the new leader reports it can't reach the old one
+	for i, kv := range servers {
+		if status := kv.rf.Status(); i != leader && status.State == "Leader" {
+			if peer := status.Peers[leader]; peer.Connected || peer.Failures == 0 {
+				t.Fatalf("status of the killed leader's connection %+v", peer)
+			}
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestBootstrap3A(t *testing.T) {
+	const nservers = 3
+	transports := make([]*transport.TCPTransport, nservers)
+	members := make([]Member, nservers)
+	persisters := make([]*raft.Persister, nservers)
+	for i := range transports {
+		tr, err := transport.ListenTCP("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		transports[i] = tr
+		members[i] = Member{Id: "n" + strconv.Itoa(i), Addr: tr.Addr()}
+		persisters[i] = raft.MakePersister()
+	}
+	if _, err := StartKVServerFromConfig(transports[0], "n0", persisters[0], 1000); err != ErrNotBootstrapped {
+		t.Fatalf("start without a configuration returned %v", err)
+	}
+	for i, persister := range persisters {
+		if err := Bootstrap(persister, members); err != nil {
+			t.Fatal(err)
+		}
+		if err := Bootstrap(persister, members); err != raft.ErrPersisterNotEmpty {
+			t.Fatalf("bootstrapping server %v twice returned %v", i, err)
+		}
+	}
+	if _, err := StartKVServerFromConfig(transports[0], "n9", persisters[0], 1000); err != ErrNotMember {
+		t.Fatalf("start of a non-member returned %v", err)
+	}
+	servers := make([]*KVServer, nservers)
+	for i := range servers {
+		kv, err := StartKVServerFromConfig(transports[i], members[i].Id, persisters[i], 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = kv
+	}
+	defer func() {
+		for i := range servers {
+			servers[i].Kill()
+			transports[i].Close()
+		}
+	}()
+	client, err := transport.ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ends := make([]transport.Endpoint, nservers)
+	for i, m := range members {
+		ends[i] = client.Dial(m.Addr)
+	}
+	ck := MakeClerk(ends)
+
+	fmt.Printf("Test: a cluster bootstrapped from its configuration (3A) ...\n")
+
+	// the configuration is applied as the first entry
+	ck.Put("k", "v")
+	for i, kv := range servers {
+		for start := time.Now(); !reflect.DeepEqual(kv.Members(), members); time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 2*time.Second {
+				t.Fatalf("server %v has members %v", i, kv.Members())
+			}
+		}
+	}
+
+	// a member restarted once its log is compacted reads the configuration
+	// from its snapshot
+	for i := 0; i < 50; i++ {
+		ck.Put("k"+strconv.Itoa(i), strings.Repeat("x", 50))
+	}
+	servers[0].Kill()
+	transports[0].Close()
+	persister := persisters[0].Copy()
+	if _, ok := raft.BootstrapCommand(persister); ok {
+		t.Fatalf("configuration entry still in the log after compaction")
+	}
+	if config, err := Configuration(persister); err != nil || !reflect.DeepEqual(config, members) {
+		t.Fatalf("configuration from the snapshot %v, %v", config, err)
+	}
+	if transports[0], err = transport.ListenTCP(members[0].Addr); err != nil {
+		t.Fatal(err)
+	}
+	if servers[0], err = StartKVServerFromConfig(transports[0], "n0", persister, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if v := ck.Get("k"); v != "v" {
+		t.Fatalf("got %q after a restart, expected v", v)
+	}
+	if !reflect.DeepEqual(servers[0].Members(), members) {
+		t.Fatalf("restarted server has members %v", servers[0].Members())
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTCPGroups3A(t *testing.T) {
+	const nservers = 3
+	const ngroups = 2
+	transports := make([]*transport.TCPTransport, nservers)
+	addrs := make([]string, nservers)
+	for i := range transports {
+		tr, err := transport.ListenTCP("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		transports[i], addrs[i] = tr, tr.Addr()
+	}
+	dial := func(tr *transport.TCPTransport, group int) []transport.Endpoint {
+		ends := make([]transport.Endpoint, nservers)
+		for i, addr := range addrs {
+			ends[i] = tr.DialGroup(addr, group)
+		}
+		return ends
+	}
+	var servers []*KVServer
+	for g := 0; g < ngroups; g++ {
+		for i := range transports {
+			kv := StartKVServer(dial(transports[i], g), i, raft.MakePersister(), -1)
+			kv.RegisterGroup(transports[i], g)
+			servers = append(servers, kv)
+		}
+	}
+	defer func() {
+		for _, kv := range servers {
+			kv.Kill()
+		}
+		for _, tr := range transports {
+			tr.Close()
+		}
+	}()
+	client, err := transport.ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	fmt.Printf("Test: raft groups sharing connections over TCP (3A) ...\n")
+
+	// each group keeps its own values
+	clerks := make([]*Clerk, ngroups)
+	for g := range clerks {
+		clerks[g] = MakeClerk(dial(client, g))
+		clerks[g].Put("k", strconv.Itoa(g))
+	}
+	for g, ck := range clerks {
+		if v := ck.Get("k"); v != strconv.Itoa(g) {
+			t.Fatalf("group %v got %q", g, v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a server that never answers, counting the calls it gets
+type downEndpoint struct {
+	calls int32
+}
+
+func (e *downEndpoint) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	atomic.AddInt32(&e.calls, 1)
+	return false
+}
+
+func TestStaleReadRetries(t *testing.T) {
+	down := &downEndpoint{}
+	ck := MakeClerk([]transport.Endpoint{down, down, down})
+
+	// only so many attempts
+	ck.SetRetryBudget(7, 0)
+	if v := ck.GetStale("k"); v != nil {
+		t.Fatalf("stale read without replicas got %q", v)
+	}
+	if calls := atomic.LoadInt32(&down.calls); calls != 7 {
+		t.Fatalf("%v calls with a budget of 7", calls)
+	}
+
+	// only so long, backing off between rounds rather than spinning
+	atomic.StoreInt32(&down.calls, 0)
+	ck.SetRetryBudget(0, 500*time.Millisecond)
+	start := time.Now()
+	if v := ck.GetStale("k"); v != nil {
+		t.Fatalf("stale read without replicas got %q", v)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("stale read returned after %v with a budget of 500ms", elapsed)
+	}
+	if calls := atomic.LoadInt32(&down.calls); calls > 60 {
+		t.Fatalf("%v calls in 500ms", calls)
+	}
+}
+
+func TestLeaseKeepAliveNewLeader3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: lease keep-alive right after a leader change (3A)")
+
+	for iters := 0; iters < 3; iters++ {
+		// the leader is cut off as soon as the grant applies, so the next
+		// one may not have applied it yet when the keep-alive reaches it
+		lease := ck.GrantLease(2 * time.Second)
+		_, leader := cfg.Leader()
+		others := []int{}
+		for i := 0; i < nservers; i++ {
+			if i != leader {
+				others = append(others, i)
+			}
+		}
+		cfg.partition(others, []int{leader})
+		if !ck.KeepAlive(lease) {
+			t.Fatalf("KeepAlive of a live lease failed")
+		}
+		time.Sleep(500 * time.Millisecond)
+		if !ck.KeepAlive(lease) {
+			t.Fatalf("lease expired within its TTL of a keep-alive")
+		}
+		cfg.ConnectAll()
+	}
+
+	cfg.end()
+}
+
+func TestCompactAfterSnapshot3B(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, 1000)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: replicas answer a compaction alike after loading a snapshot (3B)")
+
+	revision := ck.command(&CommandArgs{Key: "k", Value: []byte("1"), Op: Putt}).Revision
+
+	// a replica that installs a snapshot starts its history over from it
+	_, leader := cfg.Leader()
+	lagging := (leader + 1) % nservers
+	others := []int{}
+	for i := 0; i < nservers; i++ {
+		if i != lagging {
+			others = append(others, i)
+		}
+	}
+	cfg.partition(others, []int{lagging})
+	for i := 0; i < 50; i++ {
+		ck.Put("k", randstring(20))
+	}
+	cfg.ConnectAll()
+	latest := ck.command(&CommandArgs{Key: "k", Op: Gett}).Revision
+	kv := cfg.kvservers[lagging]
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		kv.mu.RLock()
+		applied, oldest := kv.lastApplied, kv.storage.Oldest()
+		kv.mu.RUnlock()
+		if applied >= latest {
+			if oldest <= revision {
+				t.Fatalf("server %v didn't install a snapshot", lagging)
+			}
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("server %v didn't catch up", lagging)
+		}
+	}
+
+	// no compaction happened yet, on any replica
+	if err := ck.Compact(revision); err != OK {
+		t.Fatalf("Compact: %v", err)
+	}
+	after := ck.command(&CommandArgs{Key: "k", Value: []byte("2"), Op: Putt}).Revision
+	for i := 0; i < nservers; i++ {
+		kv := cfg.kvservers[i]
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			kv.mu.RLock()
+			applied, compacted := kv.lastApplied, kv.compacted
+			kv.mu.RUnlock()
+			if applied >= after {
+				if compacted != revision {
+					t.Fatalf("server %v compacted to %v, expected %v", i, compacted, revision)
+				}
+				break
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("server %v didn't apply the compaction", i)
+			}
+		}
+	}
+	if report := VerifyReplicas(ck.servers, 8); report.DivergentIndex != -1 || report.StateDiverged {
+		t.Fatalf("replicas disagree: %+v", report)
+	}
+
+	cfg.end()
+}
+
+func TestProtoMessages(t *testing.T) {
+	args := CommandArgs{Key: "k", Op: Txn, ClientId: 7, CommandId: 3,
+		Txn: &TxnRequest{
+			Conditions: []TxnCondition{CompareValue("a", CmpEqual, []byte("1")), CompareVersion("b", CmpGreater, 2)},
+			Reads:      []string{"a", ""},
+			Writes:     []TxnWrite{{Op: Putt, Key: "a", Value: []byte("2")}},
+			ElseReads:  []string{"b"},
+			ElseWrites: []TxnWrite{{Op: Deletee, Key: "b"}},
+		},
+		Auth: &AuthRequest{Roles: []string{"r"}, Permissions: []Permission{{Prefix: "p/", Read: true}, {Write: true}},
+			Salt: []byte("s")},
+		Script: &ScriptRequest{Source: `(get "a")`, Keys: []string{"a"}, Args: [][]byte{[]byte("x"), {}}},
+	}
+	reply := CommandReply{Err: OK, Index: 9, Server: 1,
+		Txn: &TxnResult{Failed: -1, Reads: []KeyValue{{"a", []byte("1")}, {"b", nil}}}}
+	// the same messages as marshaled by the Go protobuf module, from
+	// kvraft.proto compiled with github.com/bufbuild/protocompile, filled in
+	// through dynamicpb
+	golden := []struct {
+		m    transport.Message
+		want transport.Message
+		hex  string
+	}{
+		{&args, new(CommandArgs), "0a016b1a0354786e20072803ca01350a060a01611201310a090a016218012003280212016112001a0b0a03507574" +
+			"1201611a01322201622a0b0a0644656c657465120162d201120a017212060a02702f1001120218011a0173da01130a0928676574" +
+			"20226122291201611a01781a00"},
+		{&reply, new(CommandReply), "0a024f4b180968017a1810ffffffffffffffffff011a060a01611201311a030a0162"},
+	}
+	for _, g := range golden {
+		data, err := g.m.Marshal()
+		if err != nil || hex.EncodeToString(data) != g.hex {
+			t.Fatalf("%T marshaled to %x %v, want %v", g.m, data, err, g.hex)
+		}
+		data, _ = hex.DecodeString(g.hex)
+		if err := g.want.Unmarshal(data); err != nil || !reflect.DeepEqual(g.want, g.m) {
+			t.Fatalf("unmarshaled %+v %v, want %+v", g.want, err, g.m)
+		}
+	}
+
+	// an empty request isn't a missing one
+	data, _ := (&CommandArgs{Op: Txn, Txn: &TxnRequest{}}).Marshal()
+	var decoded CommandArgs
+	if err := decoded.Unmarshal(data); err != nil || decoded.Txn == nil {
+		t.Fatalf("empty Txn unmarshaled to %+v %v", decoded, err)
+	}
+}
@@ -0,0 +1,102 @@
+package kvraft
+
+import "time"
+
+// keys with a TTL are removed through the log, so that every replica deletes
+// them at the same position: the leader's sweeper proposes an Expire entry
+// for each key past its deadline, and applying it deletes the key only if
+// its deadline hasn't been moved by a Put in the meantime.
+// until then the key is still readable. expired leases and client sessions
+// are swept the same way.
+const Expire = "Expire"
+
+// give an existing key a TTL, or with none remove its TTL, without writing
+// its value. ErrNoKey if there's no such key.
+const SetTTL = "SetTTL"
+
+const (
+	ttlSweepInterval = 100 * time.Millisecond
+	ttlSweepBatch    = 100         // Expire entries proposed per sweep at most
+	ttlRepropose     = time.Second // an Expire not applied by then is proposed again
+)
+
+func (kv *KVServer) ttlSweeper() {
+	proposed := make(map[string]time.Time) // when an Expire was last proposed for a key
+	proposedLeases := make(map[int64]time.Time)
+	proposedSessions := make(map[int64]time.Time)
+	for !kv.killed() {
+		time.Sleep(ttlSweepInterval)
+		if _, isLeader := kv.rf.GetState(); !isLeader {
+			continue
+		}
+		now := time.Now().UnixNano()
+		ops := make([]Op, 0)
+		kv.mu.RLock()
+		for key, at := range kv.storage.Expiry {
+			if at <= now && time.Since(proposed[key]) > ttlRepropose && len(ops) < ttlSweepBatch {
+				ops = append(ops, Op{OpTask: Expire, Key: key, ExpireAt: at})
+			}
+		}
+		for key := range proposed {
+			if _, ok := kv.storage.Expiry[key]; !ok {
+				delete(proposed, key)
+			}
+		}
+		for id, lease := range kv.leases {
+			if lease.Deadline <= now && time.Since(proposedLeases[id]) > ttlRepropose && len(ops) < ttlSweepBatch {
+				ops = append(ops, Op{OpTask: LeaseExpire, Lease: id, ExpireAt: lease.Deadline})
+			}
+		}
+		for id := range proposedLeases {
+			if _, ok := kv.leases[id]; !ok {
+				delete(proposedLeases, id)
+			}
+		}
+		for client, at := range kv.sessions {
+			if at <= now && time.Since(proposedSessions[client]) > ttlRepropose && len(ops) < ttlSweepBatch {
+				ops = append(ops, Op{OpTask: SessionExpire, ClientId: client, ExpireAt: at})
+			}
+		}
+		for client := range proposedSessions {
+			if _, ok := kv.sessions[client]; !ok {
+				delete(proposedSessions, client)
+			}
+		}
+		kv.mu.RUnlock()
+		for _, op := range ops {
+			if _, _, isLeader := kv.rf.Start(op); !isLeader {
+				break
+			} else if op.OpTask == LeaseExpire {
+				proposedLeases[op.Lease] = time.Now()
+			} else if op.OpTask == SessionExpire {
+				proposedSessions[op.ClientId] = time.Now()
+			} else {
+				proposed[op.Key] = time.Now()
+			}
+		}
+	}
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applySetTTL(op Op, index int) opResult {
+	result := opResult{Err: OK, Index: index}
+	if !kv.storage.Found(op.Key) {
+		result.Err = ErrNoKey
+		return result
+	}
+	kv.storage.SetExpiry(op.Key, op.ExpireAt)
+	return result
+}
+
+// key expires ttl from now, or never with a ttl of 0. false if there's no
+// such key.
+func (ck *Clerk) SetTTL(key string, ttl time.Duration) bool {
+	return ck.command(&CommandArgs{Key: key, TTL: ttl, Op: SetTTL}).Err == OK
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applyExpire(op Op) {
+	if at, ok := kv.storage.Expiry[op.Key]; ok && at == op.ExpireAt {
+		kv.storage.Delete(op.Key)
+	}
+}
@@ -0,0 +1,198 @@
+package kvraft
+
+import "bytes"
+
+// a transaction is one log entry, evaluated and applied in one go by the
+// apply loop: if every condition holds, the reads see the state before the
+// writes and all writes are applied, otherwise the same happens with
+// ElseReads and ElseWrites, which are empty for a plain conditional write.
+//
+// Clerk.If builds the etcd style If(...).Then(...).Else(...) form on top of it,
+// e.g. for leader election:
+//
+//	ck.If(CompareVersion("leader", CmpEqual, 0)).
+//		Then(OpPut("leader", me)).
+//		Else(OpGet("leader")).
+//		Commit()
+const Txn = "Txn"
+
+// what a condition looks at
+const (
+	TargetValue   = iota // the value, a missing key holds an empty one
+	TargetVersion        // the number of writes since the key was created, 0 if missing
+)
+
+const (
+	CmpEqual = iota
+	CmpNotEqual
+	CmpLess
+	CmpGreater
+)
+
+// holds when the Target of Key compares to Value or Version as Cmp says.
+// the zero Target and Cmp check that the value equals Value.
+type TxnCondition struct {
+	Key     string
+	Value   []byte
+	Target  int
+	Cmp     int
+	Version int64
+}
+
+type TxnWrite struct {
+	Op    string // Putt, Appendd or Deletee
+	Key   string
+	Value []byte
+}
+
+type TxnRequest struct {
+	Conditions []TxnCondition
+	Reads      []string
+	Writes     []TxnWrite
+	ElseReads  []string
+	ElseWrites []TxnWrite
+}
+
+type TxnResult struct {
+	Succeeded bool
+	// when !Succeeded, index of the first condition that didn't hold,
+	// or -1 if a write has an unknown Op
+	Failed int
+	Reads  []KeyValue // in the order of the reads of the branch taken, Value nil for a missing key
+}
+
+func CompareValue(key string, cmp int, value []byte) TxnCondition {
+	return TxnCondition{Key: key, Target: TargetValue, Cmp: cmp, Value: value}
+}
+
+func CompareVersion(key string, cmp int, version int64) TxnCondition {
+	return TxnCondition{Key: key, Target: TargetVersion, Cmp: cmp, Version: version}
+}
+
+// c is -1, 0 or 1 as for bytes.Compare
+func compare(cmp int, c int) bool {
+	switch cmp {
+	case CmpEqual:
+		return c == 0
+	case CmpNotEqual:
+		return c != 0
+	case CmpLess:
+		return c < 0
+	case CmpGreater:
+		return c > 0
+	}
+	return false
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) holds(cond TxnCondition) bool {
+	if cond.Target == TargetVersion {
+		version := kv.storage.Version(cond.Key)
+		c := 0
+		if version < cond.Version {
+			c = -1
+		} else if version > cond.Version {
+			c = 1
+		}
+		return compare(cond.Cmp, c)
+	}
+	value, _ := kv.storage.Get(cond.Key)
+	return compare(cond.Cmp, bytes.Compare(value, cond.Value))
+}
+
+func validWrites(writes []TxnWrite) bool {
+	for _, w := range writes {
+		if w.Op != Putt && w.Op != Appendd && w.Op != Deletee {
+			return false
+		}
+	}
+	return true
+}
+
+// caller must hold kv.mu
+func (kv *KVServer) applyTxn(txn *TxnRequest) *TxnResult {
+	if txn == nil {
+		txn = &TxnRequest{}
+	}
+	result := &TxnResult{Succeeded: true}
+	if !validWrites(txn.Writes) || !validWrites(txn.ElseWrites) {
+		result.Succeeded, result.Failed = false, -1
+		return result
+	}
+	reads, writes := txn.Reads, txn.Writes
+	for i, cond := range txn.Conditions {
+		if !kv.holds(cond) {
+			result.Succeeded, result.Failed = false, i
+			reads, writes = txn.ElseReads, txn.ElseWrites
+			break
+		}
+	}
+	result.Reads = make([]KeyValue, 0, len(reads))
+	for _, key := range reads {
+		value, _ := kv.storage.Get(key)
+		result.Reads = append(result.Reads, KeyValue{key, value})
+	}
+	for _, w := range writes {
+		switch w.Op {
+		case Putt:
+			kv.storage.Put(w.Key, w.Value)
+		case Appendd:
+			kv.storage.Append(w.Key, w.Value)
+		case Deletee:
+			kv.storage.Delete(w.Key)
+		}
+	}
+	return result
+}
+
+// apply txn atomically through the log, see TxnRequest
+func (ck *Clerk) Txn(txn TxnRequest) TxnResult {
+	reply := ck.command(&CommandArgs{Op: Txn, Txn: &txn})
+	if reply.Txn == nil {
+		return TxnResult{}
+	}
+	return *reply.Txn
+}
+
+// an operation in a Then or Else branch, Op is Gett, Putt, Appendd or Deletee
+type TxnOp TxnWrite
+
+func OpGet(key string) TxnOp                  { return TxnOp{Op: Gett, Key: key} }
+func OpPut(key string, value []byte) TxnOp    { return TxnOp{Op: Putt, Key: key, Value: value} }
+func OpAppend(key string, value []byte) TxnOp { return TxnOp{Op: Appendd, Key: key, Value: value} }
+func OpDelete(key string) TxnOp               { return TxnOp{Op: Deletee, Key: key} }
+
+type TxnBuilder struct {
+	ck  *Clerk
+	txn TxnRequest
+}
+
+func (ck *Clerk) If(conditions ...TxnCondition) *TxnBuilder {
+	return &TxnBuilder{ck: ck, txn: TxnRequest{Conditions: conditions}}
+}
+
+// gets in a branch see the state before any of its writes
+func split(ops []TxnOp) (reads []string, writes []TxnWrite) {
+	for _, op := range ops {
+		if op.Op == Gett {
+			reads = append(reads, op.Key)
+		} else {
+			writes = append(writes, TxnWrite(op))
+		}
+	}
+	return reads, writes
+}
+
+func (b *TxnBuilder) Then(ops ...TxnOp) *TxnBuilder {
+	b.txn.Reads, b.txn.Writes = split(ops)
+	return b
+}
+
+func (b *TxnBuilder) Else(ops ...TxnOp) *TxnBuilder {
+	b.txn.ElseReads, b.txn.ElseWrites = split(ops)
+	return b
+}
+
+func (b *TxnBuilder) Commit() TxnResult {
+	return b.ck.Txn(b.txn)
+}
@@ -0,0 +1,67 @@
+package kvraft
+
+import (
+	"math"
+
+	"raft/raft"
+	"raft/transport"
+)
+
+type VerifyReport struct {
+	DivergentIndex int   // first log index at which two replicas disagree, -1 if none
+	StateDiverged  bool  // two replicas at the same applied index hold different state
+	Unreachable    []int // servers that didn't answer
+}
+
+// compare the committed logs and applied state of all servers. logs are first
+// compared by ranges of rangeSize entries, then the first differing range is
+// narrowed down to a single index with per entry hashes. applied state can only
+// be compared between replicas that happen to be at the same applied index.
+func VerifyReplicas(servers []transport.Endpoint, rangeSize int) VerifyReport {
+	report := VerifyReport{DivergentIndex: -1}
+	replies := make([]*VerifyReply, len(servers))
+	for i := range servers {
+		replies[i] = callVerify(servers[i], 0, math.MaxInt32, rangeSize)
+		if replies[i] == nil {
+			report.Unreachable = append(report.Unreachable, i)
+		}
+	}
+
+	start, first, second := -1, -1, -1
+	for i := range replies {
+		for j := i + 1; j < len(replies); j++ {
+			if replies[i] == nil || replies[j] == nil {
+				continue
+			}
+			if replies[i].AppliedIndex == replies[j].AppliedIndex && replies[i].StateHash != replies[j].StateHash {
+				report.StateDiverged = true
+			}
+			r := raft.FirstDivergentRange(replies[i].Digest, replies[j].Digest)
+			if r != -1 && (start == -1 || r < start) {
+				start, first, second = r, i, j
+			}
+		}
+	}
+	if start == -1 {
+		return report
+	}
+
+	report.DivergentIndex = start
+	a := callVerify(servers[first], start, start+rangeSize-1, 1)
+	b := callVerify(servers[second], start, start+rangeSize-1, 1)
+	if a != nil && b != nil {
+		if index := raft.FirstDivergentRange(a.Digest, b.Digest); index != -1 {
+			report.DivergentIndex = index
+		}
+	}
+	return report
+}
+
+func callVerify(server transport.Endpoint, from int, to int, rangeSize int) *VerifyReply {
+	args := &VerifyArgs{From: from, To: to, RangeSize: rangeSize}
+	reply := new(VerifyReply)
+	if !server.Call("KVServer.Verify", args, reply) {
+		return nil
+	}
+	return reply
+}
@@ -0,0 +1,333 @@
+package kvraft
+
+import (
+	"sync"
+	"time"
+
+	"raft/transport"
+)
+
+//
+// watches deliver the changes to a key, or to every key under a prefix, as
+// the log is applied. labrpc has no streams, so a watch is a series of long
+// polls: each Watch RPC returns the events buffered for it since the previous
+// one, waiting a little when there are none.
+//
+// every replica applies the same writes at the same log index, so events are
+// identified by that index (their revision) and any replica can serve them.
+// a replica remembers the last watchHistorySize events, so a watcher can start
+// from a recent revision or move to another replica and resume.
+//
+
+const (
+	EventPut    = "Put"
+	EventDelete = "Delete"
+)
+
+const (
+	watchHistorySize = 1000
+	watchBufferSize  = 1000 // events a watcher may fall behind before it's canceled
+	watchPollTimeout = 500 * time.Millisecond
+	watchIdleTimeout = time.Minute // watchers not polled for this long are dropped
+)
+
+type WatchEvent struct {
+	Type     string // EventPut or EventDelete
+	Key      string
+	Value    []byte // EventPut only
+	Revision int    // log index of the write
+}
+
+type WatchArgs struct {
+	Id           int64 // 0 to start watching
+	Key          string
+	Prefix       bool // watch every key starting with Key
+	FromRevision int  // first revision to deliver, 0 for changes from now on
+}
+
+type WatchReply struct {
+	Err    Err // ErrCompacted if the history doesn't reach back far enough
+	Id     int64
+	From   int // first revision the watch covers
+	Events []WatchEvent
+	// the replica's applied index as the poll began, every event up to it
+	// is in this reply or an earlier one
+	Applied int
+}
+
+type watcher struct {
+	key      string
+	prefix   bool
+	from     int
+	buffer   []WatchEvent
+	lastPoll time.Time
+	overrun  bool // fell more than watchBufferSize behind, or the state was replaced
+}
+
+func (w *watcher) matches(key string) bool {
+	if w.prefix {
+		return len(key) >= len(w.key) && key[:len(w.key)] == w.key
+	}
+	return key == w.key
+}
+
+type watchHub struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	history     []WatchEvent
+	historyFrom int // history holds every event with Revision >= historyFrom
+	watchers    map[int64]*watcher
+}
+
+func (hub *watchHub) init(applied int) {
+	hub.cond = sync.NewCond(&hub.mu)
+	hub.historyFrom = applied + 1
+	hub.watchers = make(map[int64]*watcher)
+}
+
+// called by the storage for every change, with kv.mu held
+func (kv *KVServer) recordEvent(key string, value []byte, deleted bool) {
+	event := WatchEvent{Type: EventPut, Key: key, Value: value, Revision: kv.lastApplied}
+	if deleted {
+		event.Type, event.Value = EventDelete, nil
+	}
+	hub := &kv.watches
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.history = append(hub.history, event)
+	if len(hub.history) > watchHistorySize {
+		hub.historyFrom = hub.history[0].Revision + 1
+		hub.history = hub.history[1:]
+	}
+	for _, w := range hub.watchers {
+		// a replica still catching up applies writes from before the watch started
+		if w.overrun || !w.matches(key) || event.Revision < w.from {
+			continue
+		}
+		if len(w.buffer) == watchBufferSize {
+			// slow consumer, don't let it hold memory forever
+			w.overrun, w.buffer = true, nil
+			continue
+		}
+		w.buffer = append(w.buffer, event)
+	}
+	hub.cond.Broadcast()
+}
+
+// the state jumped to a snapshot, events in between are unknown.
+// caller must hold kv.mu.
+func (kv *KVServer) resetWatches() {
+	hub := &kv.watches
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.history = nil
+	hub.historyFrom = kv.lastApplied + 1
+	for _, w := range hub.watchers {
+		w.overrun, w.buffer = true, nil
+	}
+	hub.cond.Broadcast()
+}
+
+// events before revision were compacted away, caller must hold kv.mu.
+// watches already running have their events and carry on.
+func (kv *KVServer) compactWatches(revision int) {
+	hub := &kv.watches
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if revision <= hub.historyFrom {
+		return
+	}
+	i := 0
+	for i < len(hub.history) && hub.history[i].Revision < revision {
+		i++
+	}
+	hub.history = hub.history[i:]
+	hub.historyFrom = revision
+}
+
+func (kv *KVServer) Watch(args *WatchArgs, reply *WatchReply) {
+	kv.mu.RLock()
+	applied := kv.lastApplied
+	kv.mu.RUnlock()
+
+	hub := &kv.watches
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	w, ok := hub.watchers[args.Id]
+	if !ok {
+		if args.Id != 0 {
+			// dropped or never seen here; the client resumes with a new watch
+			reply.Err = ErrNoWatch
+			return
+		}
+		from := args.FromRevision
+		if from == 0 {
+			from = applied + 1
+		}
+		if from < hub.historyFrom {
+			reply.Err = ErrCompacted
+			return
+		}
+		w = &watcher{key: args.Key, prefix: args.Prefix, from: from}
+		for _, event := range hub.history {
+			if event.Revision >= from && w.matches(event.Key) {
+				w.buffer = append(w.buffer, event)
+			}
+		}
+		args.Id = nrand()
+		hub.watchers[args.Id] = w
+		for id, other := range hub.watchers {
+			if time.Since(other.lastPoll) > watchIdleTimeout && other != w {
+				delete(hub.watchers, id)
+			}
+		}
+	}
+	reply.Id, reply.From = args.Id, w.from
+	w.lastPoll = time.Now()
+
+	if len(w.buffer) == 0 && !w.overrun {
+		timer := time.AfterFunc(watchPollTimeout, func() {
+			hub.mu.Lock()
+			hub.cond.Broadcast()
+			hub.mu.Unlock()
+		})
+		deadline := time.Now().Add(watchPollTimeout)
+		for len(w.buffer) == 0 && !w.overrun && time.Now().Before(deadline) && !kv.killed() {
+			hub.cond.Wait()
+		}
+		timer.Stop()
+	}
+	if w.overrun {
+		// the client resumes from its last revision, which works
+		// as long as some replica's history still reaches back to it
+		delete(hub.watchers, args.Id)
+		reply.Err = ErrNoWatch
+		return
+	}
+	reply.Err, reply.Applied = OK, applied
+	reply.Events, w.buffer = w.buffer, nil
+}
+
+type Watcher struct {
+	Events   <-chan WatchEvent // closed when the watch ends, see Err
+	events   chan WatchEvent
+	done     chan struct{}
+	mu       sync.Mutex
+	err      Err
+	revision int // see Revision
+}
+
+// stream the changes to key (or under it, with prefix) starting at
+// fromRevision, 0 meaning from now on. events arrive in revision order.
+// the watcher moves between replicas as needed, resuming after the last
+// event delivered, and ends with ErrCompacted if it falls too far behind
+// for any replica to fill the gap. a quiet watch keeps up with the
+// replicas' applied index, so it doesn't fall behind for lack of events.
+func (ck *Clerk) Watch(key string, prefix bool, fromRevision int) *Watcher {
+	w := &Watcher{events: make(chan WatchEvent), done: make(chan struct{})}
+	w.Events = w.events
+	go w.run(ck.servers, int(ck.leaderId), &WatchArgs{Key: key, Prefix: prefix, FromRevision: fromRevision})
+	return w
+}
+
+func (w *Watcher) run(servers []transport.Endpoint, server int, args *WatchArgs) {
+	defer close(w.events)
+	// a transaction writes several keys at one revision, so resuming restarts
+	// at the revision of the last event and skips what was already delivered
+	delivered, skip := 0, 0
+	compacted := 0
+	failures := 0 // calls in a row no replica answered
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		resumed := args.Id == 0
+		reply := new(WatchReply)
+		if !servers[server].Call("KVServer.Watch", args, reply) || reply.Err == ErrNoWatch {
+			// resume elsewhere from where we got to
+			server, args.Id = (server+1)%len(servers), 0
+			if reply.Err == "" {
+				if failures++; failures%len(servers) == 0 {
+					select {
+					case <-time.After(retryBackoff(failures / len(servers))):
+					case <-w.done:
+						return
+					}
+				}
+			}
+			continue
+		}
+		failures = 0
+		if reply.Err == ErrCompacted {
+			// another replica may remember more
+			if compacted++; compacted < len(servers) {
+				server = (server + 1) % len(servers)
+				continue
+			}
+		}
+		if reply.Err != OK {
+			w.mu.Lock()
+			w.err = reply.Err
+			w.mu.Unlock()
+			return
+		}
+		compacted = 0
+		if resumed && args.FromRevision == 0 {
+			// pin "from now" to a revision, in case we have to resume elsewhere
+			args.FromRevision = reply.From
+		}
+		args.Id = reply.Id
+		if resumed {
+			// the replica may not have applied them yet, so this can span replies
+			skip = delivered
+		}
+		for _, event := range reply.Events {
+			if event.Revision == args.FromRevision && skip > 0 {
+				skip--
+				continue
+			}
+			skip = 0
+			select {
+			case w.events <- event:
+				if event.Revision != args.FromRevision {
+					args.FromRevision, delivered = event.Revision, 0
+				}
+				delivered++
+			case <-w.done:
+				return
+			}
+		}
+		if reply.Applied >= args.FromRevision {
+			// all delivered up to there, a resumed watch needn't go back further
+			args.FromRevision, delivered, skip = reply.Applied+1, 0, 0
+		}
+		w.mu.Lock()
+		w.revision = args.FromRevision - 1
+		w.mu.Unlock()
+	}
+}
+
+// the revision up to which every event has been delivered. a new watch from
+// the revision after picks up where this one left off, e.g. in a process
+// that restarts.
+func (w *Watcher) Revision() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.revision
+}
+
+// why the watch ended, OK if it was closed
+func (w *Watcher) Err() Err {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == "" {
+		return OK
+	}
+	return w.err
+}
+
+func (w *Watcher) Close() {
+	close(w.done)
+}
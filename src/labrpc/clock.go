@@ -0,0 +1,143 @@
+package labrpc
+
+//
+// the network's delays and timeouts are kept on a Clock: the real one by
+// default, or a VirtualClock that only moves when the test advances it.
+// with a virtual clock, a message delayed for 30ms is delivered when the
+// test advances the clock past those 30ms, however long that takes, and
+// messages due at the same time go in the order they were sent, so with
+// the same seed the network treats the same sequence of messages the same
+// way on every run. the servers' own timers, raft's among them, still run
+// in real time.
+//
+// clock := MakeVirtualClock()
+// net.SetClock(clock)
+// clock.Advance(100 * time.Millisecond)
+//
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) {
+	time.AfterFunc(d, f)
+}
+
+type VirtualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers timerHeap
+	nextId uint64
+}
+
+type timer struct {
+	at time.Time
+	id uint64 // the order timers were set in, for those due together
+	f  func()
+}
+
+// a clock at the Unix epoch, until advanced
+func MakeVirtualClock() *VirtualClock {
+	return &VirtualClock{now: time.Unix(0, 0)}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *VirtualClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.AfterFunc(d, func() { ch <- c.Now() })
+	return ch
+}
+
+// call f once the clock is advanced by d, at once if d <= 0
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) {
+	if d <= 0 {
+		f()
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	heap.Push(&c.timers, &timer{at: c.now.Add(d), id: c.nextId, f: f})
+	c.nextId++
+}
+
+// move the clock forward by d, firing the timers due on the way in order
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].at.After(end) {
+		t := heap.Pop(&c.timers).(*timer)
+		c.now = t.at
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// the number of timers not yet due
+func (c *VirtualClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+type timerHeap []*timer
+
+func (h timerHeap) Len() int {
+	return len(h)
+}
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].id < h[j].id
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	*h = append(*h, x.(*timer))
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
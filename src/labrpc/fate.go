@@ -0,0 +1,110 @@
+package labrpc
+
+//
+// all the network's randomness comes from one source, seeded with Seed,
+// and every random choice about a request -- its delays, whether it or its
+// reply is lost, whether it's duplicated -- is made as it's sent, in the
+// order requests are sent. so a run that sends the same requests in the
+// same order with the same seed sees the same delays and losses, and a
+// failure can be replayed by seeding the network as in the failed run:
+//
+// net.Seed(seed) -- before the test sends anything.
+// net.GetSeed() -- the seed, to log when the test fails.
+//
+// a new network is seeded from $LABRPC_SEED if set, so a whole test can be
+// replayed without changing it: LABRPC_SEED=<seed> go test -run <test>.
+//
+
+import (
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// the random choices about a request
+type fate struct {
+	delay     time.Duration // before delivery, if unreliable
+	dropReq   bool          // the request is lost, if unreliable
+	dropReply bool          // the reply is lost, if unreliable
+	reorder   time.Duration // of the reply with long reordering, 0 for none
+	timeout   int           // random, for how long until a lost request fails
+	// latency of the request and of its reply, on the link and path
+	latency      time.Duration
+	replyLatency time.Duration
+	duplicate    bool
+}
+
+// $LABRPC_SEED, or a seed of its own
+func initialSeed() int64 {
+	if seed, err := strconv.ParseInt(os.Getenv("LABRPC_SEED"), 10, 64); err == nil {
+		return seed
+	}
+	return time.Now().UnixNano()
+}
+
+func (rn *Network) Seed(seed int64) {
+	rn.randMu.Lock()
+	defer rn.randMu.Unlock()
+	rn.seed = seed
+	rn.rand = rand.New(rand.NewSource(seed))
+}
+
+func (rn *Network) GetSeed() int64 {
+	rn.randMu.Lock()
+	defer rn.randMu.Unlock()
+	return rn.seed
+}
+
+// use clock for the network's delays and timeouts, see clock.go
+func (rn *Network) SetClock(clock Clock) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.clock = clock
+}
+
+func (rn *Network) getClock() Clock {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	return rn.clock
+}
+
+// settle what happens to a request as it's sent
+func (rn *Network) decide(req *reqMsg) {
+	rn.mu.Lock()
+	req.link = rn.links[req.endname]
+	source, ok := rn.sources[req.endname]
+	servername := rn.connections[req.endname]
+	if ok && servername != nil {
+		req.out = rn.paths[route{source, servername}]
+		req.back = rn.paths[route{servername, source}]
+	}
+	req.clock = rn.clock
+	rn.mu.Unlock()
+	req.seq = req.link.turn()
+
+	rn.randMu.Lock()
+	defer rn.randMu.Unlock()
+	r := rn.rand
+	f := &req.fate
+	f.delay = time.Duration(r.Int()%27) * time.Millisecond
+	f.dropReq = r.Int()%1000 < 100
+	f.dropReply = r.Int()%1000 < 100
+	if r.Intn(900) < 600 {
+		f.reorder = time.Duration(200+r.Intn(1+r.Intn(2000))) * time.Millisecond
+	}
+	f.timeout = r.Int()
+	if l := req.link; l != nil {
+		if l.opts.Latency != nil {
+			f.latency += l.opts.Latency(r)
+			f.replyLatency += l.opts.Latency(r)
+		}
+		f.duplicate = l.opts.Duplicate > 0 && r.Float64() < l.opts.Duplicate
+	}
+	if req.out != nil && req.out.opts.Latency != nil {
+		f.latency += req.out.opts.Latency(r)
+	}
+	if req.back != nil && req.back.opts.Latency != nil {
+		f.replyLatency += req.back.opts.Latency(r)
+	}
+}
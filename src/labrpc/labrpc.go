@@ -22,6 +22,14 @@ package labrpc
 // net.Connect(endname, servername) -- connect a client to a server.
 // net.Enable(endname, enabled) -- enable/disable a client.
 // net.Reliable(bool) -- false means drop/delay messages
+// net.SetLink(endname, opts) -- latency, duplication, FIFO delivery and
+//   bandwidth on one client's link, see link.go
+// net.SetPath(from, to, opts) -- one-way reachability, latency and bandwidth
+//   between servers, see path.go
+// end.Use(interceptor), srv.Use(interceptor) -- wrap calls made and served,
+//   see transport.ClientInterceptor
+// net.Seed(seed), net.SetClock(clock) -- replay a run's delays and losses,
+//   see fate.go and clock.go
 //
 // end.Call("Raft.AppendEntries", &args, &reply) -- send an RPC, wait for reply.
 // the "Raft" is the name of the server struct to be called.
@@ -40,6 +48,14 @@ package labrpc
 // as pointers, so that their types exactly match the types of the arguments
 // to Call().
 //
+// end.CallContext(ctx, "Raft.AppendEntries", &args, &reply) -- as Call, but
+// returns false as soon as ctx is done.
+// end.Stream("Raft.InstallSnapshotStream", &args, payload, &reply) -- as Call,
+// with a payload read from an io.Reader that the handler, declared as
+// func (r *T) Method(args *A, payload io.Reader, reply *R), reads from in
+// turn. the payload is carried whole in the request here; a real
+// transport sends it in chunks.
+//
 // srv := MakeServer()
 // srv.AddService(svc) -- a server can have multiple services, e.g. Raft and k/v
 //   pass srv to net.AddServer()
@@ -51,6 +67,9 @@ package labrpc
 
 import (
 	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"reflect"
@@ -60,6 +79,7 @@ import (
 	"time"
 
 	"raft/labgob"
+	"raft/transport"
 )
 
 type reqMsg struct {
@@ -67,7 +87,15 @@ type reqMsg struct {
 	svcMeth  string      // e.g. "Raft.AppendEntries"
 	argsType reflect.Type
 	args     []byte
+	payload  []byte // Stream only
 	replyCh  chan replyMsg
+	link     *link  // the conditions set with SetLink, if any
+	seq      uint64 // the request's turn on a FIFO link
+	out      *path  // the paths of the request and its reply, see SetPath
+	back     *path
+	fate     fate // see decide()
+	clock    Clock
+	metadata map[string]string // see transport.WithMetadata
 }
 
 type replyMsg struct {
@@ -76,20 +104,59 @@ type replyMsg struct {
 }
 
 type ClientEnd struct {
-	endname interface{}   // this end-point's name
-	ch      chan reqMsg   // copy of Network.endCh
-	done    chan struct{} // closed when Network is cleaned up
+	endname      interface{}   // this end-point's name
+	ch           chan reqMsg   // copy of Network.endCh
+	done         chan struct{} // closed when Network is cleaned up
+	mu           sync.Mutex
+	interceptors []transport.ClientInterceptor
+}
+
+// add interceptors around the calls made through the end, as
+// transport.TCPTransport.UseClient.
+func (e *ClientEnd) Use(interceptors ...transport.ClientInterceptor) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.interceptors = append(e.interceptors[:len(e.interceptors):len(e.interceptors)], interceptors...)
 }
 
 // send an RPC, wait for the reply.
 // the return value indicates success; false means that
 // no reply was received from the server.
 func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return e.call(context.Background(), svcMeth, args, nil, reply)
+}
+
+// as Call, but give up and return false once ctx is done.
+func (e *ClientEnd) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) bool {
+	return e.call(ctx, svcMeth, args, nil, reply)
+}
+
+// send an RPC with a payload for the handler to read, wait for the reply.
+func (e *ClientEnd) Stream(svcMeth string, args interface{}, payload io.Reader, reply interface{}) bool {
+	data, err := ioutil.ReadAll(payload)
+	if err != nil {
+		return false
+	}
+	return e.call(context.Background(), svcMeth, args, data, reply)
+}
+
+func (e *ClientEnd) call(ctx context.Context, svcMeth string, args interface{}, payload []byte, reply interface{}) bool {
+	e.mu.Lock()
+	interceptors := e.interceptors
+	e.mu.Unlock()
+	return transport.ChainClient(interceptors, func(ctx context.Context, svcMeth string, args interface{}, reply interface{}) bool {
+		return e.send(ctx, svcMeth, args, payload, reply)
+	})(ctx, svcMeth, args, reply)
+}
+
+func (e *ClientEnd) send(ctx context.Context, svcMeth string, args interface{}, payload []byte, reply interface{}) bool {
 	req := reqMsg{}
 	req.endname = e.endname
 	req.svcMeth = svcMeth
+	req.payload = payload
+	req.metadata = transport.Metadata(ctx)
 	req.argsType = reflect.TypeOf(args)
-	req.replyCh = make(chan replyMsg)
+	req.replyCh = make(chan replyMsg, 1) // not waited on once ctx is done
 
 	qb := new(bytes.Buffer)
 	qe := labgob.NewEncoder(qb)
@@ -107,12 +174,19 @@ func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bo
 	case <-e.done:
 		// entire Network has been destroyed.
 		return false
+	case <-ctx.Done():
+		return false
 	}
 
 	//
 	// wait for the reply.
 	//
-	rep := <-req.replyCh
+	var rep replyMsg
+	select {
+	case rep = <-req.replyCh:
+	case <-ctx.Done():
+		return false
+	}
 	if rep.ok {
 		rb := bytes.NewBuffer(rep.reply)
 		rd := labgob.NewDecoder(rb)
@@ -134,10 +208,17 @@ type Network struct {
 	enabled        map[interface{}]bool        // by end name
 	servers        map[interface{}]*Server     // servers, by name
 	connections    map[interface{}]interface{} // endname -> servername
+	links          map[interface{}]*link       // by end name, see SetLink
+	sources        map[interface{}]interface{} // endname -> servername it sends for
+	paths          map[route]*path             // see SetPath
 	endCh          chan reqMsg
 	done           chan struct{} // closed when Network is cleaned up
 	count          int32         // total RPC count, for statistics
 	bytes          int64         // total bytes send, for statistics
+	clock          Clock         // for delays and timeouts, see SetClock
+	randMu         sync.Mutex
+	rand           *rand.Rand // all of the network's randomness, see Seed
+	seed           int64
 }
 
 func MakeNetwork() *Network {
@@ -147,6 +228,11 @@ func MakeNetwork() *Network {
 	rn.enabled = map[interface{}]bool{}
 	rn.servers = map[interface{}]*Server{}
 	rn.connections = map[interface{}](interface{}){}
+	rn.links = map[interface{}]*link{}
+	rn.sources = map[interface{}]interface{}{}
+	rn.paths = map[route]*path{}
+	rn.clock = realClock{}
+	rn.Seed(initialSeed())
 	rn.endCh = make(chan reqMsg)
 	rn.done = make(chan struct{})
 
@@ -156,7 +242,8 @@ func MakeNetwork() *Network {
 			select {
 			case xreq := <-rn.endCh:
 				atomic.AddInt32(&rn.count, 1)
-				atomic.AddInt64(&rn.bytes, int64(len(xreq.args)))
+				atomic.AddInt64(&rn.bytes, int64(len(xreq.args)+len(xreq.payload)))
+				rn.decide(&xreq)
 				go rn.processReq(xreq)
 			case <-rn.done:
 				return
@@ -220,20 +307,31 @@ func (rn *Network) isServerDead(endname interface{}, servername interface{}, ser
 
 func (rn *Network) processReq(req reqMsg) {
 	enabled, servername, server, reliable, longreordering := rn.readEndnameInfo(req.endname)
+	clock := req.clock
+
+	if enabled && servername != nil && server != nil && req.out.up() {
+		clock.Sleep(req.sendDelay(len(req.args) + len(req.payload)))
 
-	if enabled && servername != nil && server != nil {
 		if reliable == false {
 			// short delay
-			ms := (rand.Int() % 27)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+			clock.Sleep(req.fate.delay)
 		}
 
-		if reliable == false && (rand.Int()%1000) < 100 {
+		if reliable == false && req.fate.dropReq {
 			// drop the request, return as if timeout
+			req.release()
 			req.replyCh <- replyMsg{false, nil}
 			return
 		}
 
+		req.waitTurn()
+		if req.fate.duplicate {
+			// delivered twice, the second reply is lost
+			dup := req
+			dup.link = nil
+			go server.dispatch(dup)
+		}
+
 		// execute the request (call the RPC handler).
 		// in a separate thread so that we can periodically check
 		// if the server has been killed and the RPC should get a
@@ -241,6 +339,7 @@ func (rn *Network) processReq(req reqMsg) {
 		ech := make(chan replyMsg)
 		go func() {
 			r := server.dispatch(req)
+			req.release()
 			ech <- r
 		}()
 
@@ -254,7 +353,7 @@ func (rn *Network) processReq(req reqMsg) {
 			select {
 			case reply = <-ech:
 				replyOK = true
-			case <-time.After(100 * time.Millisecond):
+			case <-clock.After(100 * time.Millisecond):
 				serverDead = rn.isServerDead(req.endname, servername, server)
 				if serverDead {
 					go func() {
@@ -275,36 +374,41 @@ func (rn *Network) processReq(req reqMsg) {
 		if replyOK == false || serverDead == true {
 			// server was killed while we were waiting; return error.
 			req.replyCh <- replyMsg{false, nil}
-		} else if reliable == false && (rand.Int()%1000) < 100 {
+		} else if reliable == false && req.fate.dropReply {
 			// drop the reply, return as if timeout
 			req.replyCh <- replyMsg{false, nil}
-		} else if longreordering == true && rand.Intn(900) < 600 {
+		} else if !req.back.up() {
+			// the server can't reach the client
+			req.replyCh <- replyMsg{false, nil}
+		} else if longreordering == true && req.fate.reorder > 0 {
 			// delay the response for a while
-			ms := 200 + rand.Intn(1+rand.Intn(2000))
 			// Russ points out that this timer arrangement will decrease
 			// the number of goroutines, so that the race
 			// detector is less likely to get upset.
-			time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+			clock.AfterFunc(req.fate.reorder, func() {
 				atomic.AddInt64(&rn.bytes, int64(len(reply.reply)))
 				req.replyCh <- reply
 			})
 		} else {
+			clock.Sleep(req.replyDelay(len(reply.reply)))
 			atomic.AddInt64(&rn.bytes, int64(len(reply.reply)))
 			req.replyCh <- reply
 		}
 	} else {
+		req.release()
+
 		// simulate no reply and eventual timeout.
 		ms := 0
 		if rn.longDelays {
 			// let Raft tests check that leader doesn't send
 			// RPCs synchronously.
-			ms = (rand.Int() % 7000)
+			ms = req.fate.timeout % 7000
 		} else {
 			// many kv tests require the client to try each
 			// server in fairly rapid succession.
-			ms = (rand.Int() % 100)
+			ms = req.fate.timeout % 100
 		}
-		time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+		clock.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
 			req.replyCh <- replyMsg{false, nil}
 		})
 	}
@@ -388,9 +492,10 @@ func (rn *Network) GetTotalBytes() int64 {
 // and a k/v server can listen to the same rpc endpoint.
 //
 type Server struct {
-	mu       sync.Mutex
-	services map[string]*Service
-	count    int // incoming RPCs
+	mu           sync.Mutex
+	services     map[string]*Service
+	count        int // incoming RPCs
+	interceptors []transport.ServerInterceptor
 }
 
 func MakeServer() *Server {
@@ -405,6 +510,14 @@ func (rs *Server) AddService(svc *Service) {
 	rs.services[svc.name] = svc
 }
 
+// add interceptors around the handlers of the server's services, as
+// transport.TCPTransport.UseServer.
+func (rs *Server) Use(interceptors ...transport.ServerInterceptor) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.interceptors = append(rs.interceptors[:len(rs.interceptors):len(rs.interceptors)], interceptors...)
+}
+
 func (rs *Server) dispatch(req reqMsg) replyMsg {
 	rs.mu.Lock()
 
@@ -416,11 +529,12 @@ func (rs *Server) dispatch(req reqMsg) replyMsg {
 	methodName := req.svcMeth[dot+1:]
 
 	service, ok := rs.services[serviceName]
+	interceptors := rs.interceptors
 
 	rs.mu.Unlock()
 
 	if ok {
-		return service.dispatch(methodName, req)
+		return service.dispatch(methodName, req, interceptors)
 	} else {
 		choices := []string{}
 		for k, _ := range rs.services {
@@ -438,6 +552,8 @@ func (rs *Server) GetCount() int {
 	return rs.count
 }
 
+var readerType = reflect.TypeOf((*io.Reader)(nil)).Elem()
+
 // an object with methods that can be called via RPC.
 // a single server may have more than one Service.
 type Service struct {
@@ -462,10 +578,11 @@ func MakeService(rcvr interface{}) *Service {
 		//fmt.Printf("%v pp %v ni %v 1k %v 2k %v no %v\n",
 		//	mname, method.PkgPath, mtype.NumIn(), mtype.In(1).Kind(), mtype.In(2).Kind(), mtype.NumOut())
 
+		stream := mtype.NumIn() == 4 && mtype.In(2) == readerType
 		if method.PkgPath != "" || // capitalized?
-			mtype.NumIn() != 3 ||
+			(mtype.NumIn() != 3 && !stream) ||
 			//mtype.In(1).Kind() != reflect.Ptr ||
-			mtype.In(2).Kind() != reflect.Ptr ||
+			mtype.In(mtype.NumIn()-1).Kind() != reflect.Ptr ||
 			mtype.NumOut() != 0 {
 			// the method is not suitable for a handler
 			//fmt.Printf("bad method: %v\n", mname)
@@ -478,7 +595,7 @@ func MakeService(rcvr interface{}) *Service {
 	return svc
 }
 
-func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
+func (svc *Service) dispatch(methname string, req reqMsg, interceptors []transport.ServerInterceptor) replyMsg {
 	if method, ok := svc.methods[methname]; ok {
 		// prepare space into which to read the argument.
 		// the Value's type will be a pointer to req.argsType.
@@ -490,13 +607,26 @@ func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
 		ad.Decode(args.Interface())
 
 		// allocate space for the reply.
-		replyType := method.Type.In(2)
+		replyType := method.Type.In(method.Type.NumIn() - 1)
 		replyType = replyType.Elem()
 		replyv := reflect.New(replyType)
 
-		// call the method.
+		// call the method, a stream handler with the payload,
+		// through the server's interceptors.
 		function := method.Func
-		function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv})
+		handler := func(context.Context, string, interface{}, interface{}) bool {
+			if method.Type.NumIn() == 4 {
+				payload := reflect.ValueOf(bytes.NewReader(req.payload))
+				function.Call([]reflect.Value{svc.rcvr, args.Elem(), payload, replyv})
+			} else {
+				function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv})
+			}
+			return true
+		}
+		ctx := transport.MetadataContext(req.metadata)
+		if !transport.ChainServer(interceptors, handler)(ctx, req.svcMeth, args.Elem().Interface(), replyv.Interface()) {
+			return replyMsg{false, nil}
+		}
 
 		// encode the reply.
 		rb := new(bytes.Buffer)
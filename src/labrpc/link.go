@@ -0,0 +1,168 @@
+package labrpc
+
+//
+// conditions on a single link, for tests that need more than Reliable and
+// LongReordering: the link from a ClientEnd to its server can be given a
+// latency distribution, for each request and again for each reply, a
+// chance that a request is delivered twice, FIFO delivery and a bandwidth
+// cap.
+//
+// net.SetLink(endname, LinkOptions{Latency: UniformLatency(0, 20*time.Millisecond), Duplicate: 0.1})
+//
+// requests are delivered as soon as their latency is up, so with a latency
+// that varies a later request overtakes an earlier one unless the link is
+// FIFO. on a FIFO link a request is handled once those sent before it have
+// been, as by a server reading a connection in one goroutine. a duplicate is delivered alongside the request and its reply is
+// dropped, as if the sender had retransmitted. a link with a bandwidth
+// cap carries one message at a time each way, so a large one holds up
+// those sent after it, for its size over the bandwidth. the reliable, disconnect
+// and server-killed behavior of the network applies on top.
+//
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// draws a message's delay from the network's source of randomness
+type Latency func(r *rand.Rand) time.Duration
+
+func FixedLatency(d time.Duration) Latency {
+	return func(*rand.Rand) time.Duration { return d }
+}
+
+// anywhere from min to max, evenly
+func UniformLatency(min, max time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		return min + time.Duration(r.Int63n(int64(max-min)+1))
+	}
+}
+
+// min, plus an exponentially distributed delay averaging mean: mostly fast
+// with a long tail
+func ExponentialLatency(min, mean time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		return min + time.Duration(r.ExpFloat64()*float64(mean))
+	}
+}
+
+type LinkOptions struct {
+	Latency   Latency // of each request and each reply, none if nil
+	Duplicate float64 // the chance that a request is delivered twice
+	FIFO      bool    // deliver requests in the order they were sent
+	Bandwidth int     // bytes per second each way, unlimited if 0
+}
+
+type link struct {
+	opts     LinkOptions
+	mu       sync.Mutex
+	cond     *sync.Cond
+	sent     uint64          // requests numbered, FIFO only
+	next     uint64          // the first request not delivered yet
+	released map[uint64]bool // delivered out of turn, dropped or lost
+	requests pipe
+	replies  pipe
+}
+
+// a connection of limited bandwidth, carrying a message at a time
+type pipe struct {
+	mu   sync.Mutex
+	free time.Time // when the messages sent so far are through
+}
+
+// how long until a message of size bytes sent now is through, at rate
+// bytes per second
+func (p *pipe) transmit(now time.Time, size int, rate int) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.free.Before(now) {
+		p.free = now
+	}
+	p.free = p.free.Add(time.Duration(size) * time.Second / time.Duration(rate))
+	return p.free.Sub(now)
+}
+
+// set the conditions on endname's link, LinkOptions{} for none
+func (rn *Network) SetLink(endname interface{}, opts LinkOptions) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	l := &link{opts: opts, released: map[uint64]bool{}}
+	l.cond = sync.NewCond(&l.mu)
+	rn.links[endname] = l
+}
+
+// the turn of a request sent on the link, if FIFO
+func (l *link) turn() uint64 {
+	if l == nil || !l.opts.FIFO {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seq := l.sent
+	l.sent++
+	return seq
+}
+
+// the time a request of size bytes takes to reach the server
+func (req *reqMsg) sendDelay(size int) time.Duration {
+	d := req.fate.latency
+	now := req.clock.Now()
+	if req.link != nil {
+		d += req.link.requests.transmit(now, size, req.link.opts.Bandwidth)
+	}
+	if req.out != nil {
+		d += req.out.pipe.transmit(now, size, req.out.opts.Bandwidth)
+	}
+	return d
+}
+
+// the time its reply of size bytes takes back
+func (req *reqMsg) replyDelay(size int) time.Duration {
+	d := req.fate.replyLatency
+	now := req.clock.Now()
+	if req.link != nil {
+		d += req.link.replies.transmit(now, size, req.link.opts.Bandwidth)
+	}
+	if req.back != nil {
+		d += req.back.pipe.transmit(now, size, req.back.opts.Bandwidth)
+	}
+	return d
+}
+
+// on a FIFO link, wait until the requests sent before are delivered
+func (req *reqMsg) waitTurn() {
+	l := req.link
+	if l == nil || !l.opts.FIFO {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.next != req.seq {
+		l.cond.Wait()
+	}
+}
+
+// on a FIFO link, let the next request be delivered. called once the
+// request is handled or won't be, more than once is fine.
+func (req *reqMsg) release() {
+	l := req.link
+	if l == nil || !l.opts.FIFO {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if req.seq < l.next {
+		return
+	}
+	l.released[req.seq] = true
+	for l.released[l.next] {
+		delete(l.released, l.next)
+		l.next++
+	}
+	l.cond.Broadcast()
+}
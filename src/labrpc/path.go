@@ -0,0 +1,54 @@
+package labrpc
+
+//
+// conditions between servers rather than on one client's link: each
+// ordered pair of servers has a path, and a message from one to the other
+// takes it. a request an end of A's sends to B goes over the path from A
+// to B, and B's reply over the path from B to A, so with only one of them
+// down, A can reach B but not the other way round: B handles A's requests
+// but A never hears back, and B's own requests to A are lost. a path's
+// bandwidth is shared by all its messages, requests and replies alike.
+//
+// net.SetSource(endname, "A") -- endname sends on behalf of server A.
+// net.SetPath("B", "A", Path{Down: true}) -- B can't reach A.
+//
+// ends with no source, such as clients', take no paths. the conditions of
+// a path add to those of an end's link.
+//
+
+type Path struct {
+	Down      bool    // messages are lost
+	Latency   Latency // of each message, none if nil
+	Bandwidth int     // bytes per second, unlimited if 0
+}
+
+type route struct {
+	from interface{}
+	to   interface{}
+}
+
+type path struct {
+	opts Path
+	pipe pipe
+}
+
+// endname sends on behalf of servername, see SetPath
+func (rn *Network) SetSource(endname interface{}, servername interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.sources[endname] = servername
+}
+
+// set the conditions on the path from server from to server to, Path{}
+// for none
+func (rn *Network) SetPath(from interface{}, to interface{}, opts Path) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.paths[route{from, to}] = &path{opts: opts}
+}
+
+func (p *path) up() bool {
+	return p == nil || !p.opts.Down
+}
@@ -6,6 +6,12 @@ import "sync"
 import "runtime"
 import "time"
 import "fmt"
+import "io"
+import "io/ioutil"
+import "strings"
+import "context"
+import "raft/transport"
+import "reflect"
 
 type JunkArgs struct {
 	X int
@@ -66,6 +72,11 @@ func (js *JunkServer) Handler7(args int, reply *string) {
 	}
 }
 
+func (js *JunkServer) Handler8(args string, payload io.Reader, reply *int) {
+	data, _ := ioutil.ReadAll(payload)
+	*reply = len(args) + len(data)
+}
+
 func TestBasic(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
@@ -101,6 +112,71 @@ func TestBasic(t *testing.T) {
 	}
 }
 
+func TestStream(t *testing.T) {
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	reply := 0
+	if !e.Stream("JunkServer.Handler8", "ab", strings.NewReader(strings.Repeat("x", 1<<20)), &reply) || reply != 2+1<<20 {
+		t.Fatalf("wrong reply %v from Handler8", reply)
+	}
+	if rn.GetTotalBytes() < 1<<20 {
+		t.Fatalf("payload not counted, %v bytes sent", rn.GetTotalBytes())
+	}
+	// called without a payload, the handler reads an empty one
+	if !e.Call("JunkServer.Handler8", "ab", &reply) || reply != 2 {
+		t.Fatalf("wrong reply %v from Handler8", reply)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	rs.Use(func(ctx context.Context, svcMeth string, args, reply interface{}, next transport.Handler) bool {
+		if transport.Metadata(ctx)["token"] != "secret" {
+			return false
+		}
+		if !next(ctx, svcMeth, args, reply) {
+			return false
+		}
+		// replies can be changed on the way out
+		if r, ok := reply.(*string); ok {
+			*r += " via " + svcMeth
+		}
+		return true
+	})
+	reply := ""
+	if e.Call("JunkServer.Handler2", 1, &reply) {
+		t.Fatalf("call without a token succeeded")
+	}
+
+	e.Use(func(ctx context.Context, svcMeth string, args, reply interface{}, next transport.Invoker) bool {
+		return next(transport.WithMetadata(ctx, "token", "secret"), svcMeth, args, reply)
+	})
+	if !e.Call("JunkServer.Handler2", 2, &reply) || reply != "handler2-2 via JunkServer.Handler2" {
+		t.Fatalf("wrong reply %v", reply)
+	}
+	n := 0
+	if !e.Stream("JunkServer.Handler8", "ab", strings.NewReader("xyz"), &n) || n != 5 {
+		t.Fatalf("wrong reply %v from Handler8", n)
+	}
+}
+
 func TestTypes(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
@@ -215,6 +291,289 @@ func TestCounts(t *testing.T) {
 	}
 }
 
+//
+// test latency, duplication and FIFO delivery set with SetLink
+//
+func TestLinks(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer(99, rs)
+
+	e := rn.MakeEnd("latency")
+	rn.Connect("latency", 99)
+	rn.Enable("latency", true)
+	rn.SetLink("latency", LinkOptions{Latency: FixedLatency(20 * time.Millisecond)})
+	t0 := time.Now()
+	reply := ""
+	if !e.Call("JunkServer.Handler2", 1, &reply) {
+		t.Fatalf("call failed")
+	}
+	if d := time.Since(t0); d < 40*time.Millisecond {
+		t.Fatalf("call took %v, expected a latency of 20ms each way", d)
+	}
+
+	e = rn.MakeEnd("duplicate")
+	rn.Connect("duplicate", 99)
+	rn.Enable("duplicate", true)
+	rn.SetLink("duplicate", LinkOptions{Duplicate: 1})
+	before := rn.GetCount(99)
+	for i := 0; i < 10; i++ {
+		reply := ""
+		if !e.Call("JunkServer.Handler2", i, &reply) || reply != "handler2-"+strconv.Itoa(i) {
+			t.Fatalf("wrong reply %v", reply)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := rn.GetCount(99) - before; n != 20 {
+		t.Fatalf("10 calls delivered %v times, expected 20", n)
+	}
+
+	// requests sent in order, and how many arrive after a later one
+	overtaken := func(endname string, fifo bool) int {
+		e := rn.MakeEnd(endname)
+		rn.Connect(endname, 99)
+		rn.Enable(endname, true)
+		rn.SetLink(endname, LinkOptions{Latency: UniformLatency(0, 30*time.Millisecond), FIFO: fifo})
+		js.mu.Lock()
+		js.log2 = nil
+		js.mu.Unlock()
+		var wg sync.WaitGroup
+		for i := 0; i < 30; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				reply := ""
+				e.Call("JunkServer.Handler2", i, &reply)
+			}(i)
+			time.Sleep(time.Millisecond)
+		}
+		wg.Wait()
+		js.mu.Lock()
+		defer js.mu.Unlock()
+		n := 0
+		for i := 1; i < len(js.log2); i++ {
+			if js.log2[i] < js.log2[i-1] {
+				n++
+			}
+		}
+		return n
+	}
+	if n := overtaken("unordered", false); n == 0 {
+		t.Fatalf("no request overtaken without FIFO")
+	}
+	if n := overtaken("fifo", true); n != 0 {
+		t.Fatalf("%v requests overtaken with FIFO", n)
+	}
+}
+
+//
+// test bandwidth caps on a link
+//
+func TestBandwidth(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer(99, rs)
+
+	e := rn.MakeEnd("slow")
+	rn.Connect("slow", 99)
+	rn.Enable("slow", true)
+	rn.SetLink("slow", LinkOptions{Bandwidth: 100000})
+
+	// concurrent requests queue up behind each other
+	t0 := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply := 0
+			if !e.Call("JunkServer.Handler6", strings.Repeat("x", 10000), &reply) || reply != 10000 {
+				t.Errorf("wrong reply %v", reply)
+			}
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(t0); d < 500*time.Millisecond {
+		t.Fatalf("50KB sent at 100KB/s in %v", d)
+	}
+
+	// replies are capped too
+	t0 = time.Now()
+	reply := ""
+	if !e.Call("JunkServer.Handler7", 20000, &reply) || len(reply) != 20000 {
+		t.Fatalf("wrong reply of %v bytes", len(reply))
+	}
+	if d := time.Since(t0); d < 200*time.Millisecond {
+		t.Fatalf("a 20KB reply received at 100KB/s in %v", d)
+	}
+}
+
+//
+// test paths between servers, reachable one way only
+//
+func TestPaths(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	jsa := &JunkServer{}
+	rsa := MakeServer()
+	rsa.AddService(MakeService(jsa))
+	rn.AddServer("a", rsa)
+	jsb := &JunkServer{}
+	rsb := MakeServer()
+	rsb.AddService(MakeService(jsb))
+	rn.AddServer("b", rsb)
+
+	ab := rn.MakeEnd("a-b")
+	rn.Connect("a-b", "b")
+	rn.Enable("a-b", true)
+	rn.SetSource("a-b", "a")
+	ba := rn.MakeEnd("b-a")
+	rn.Connect("b-a", "a")
+	rn.Enable("b-a", true)
+	rn.SetSource("b-a", "b")
+
+	// b can't reach a: a's requests are handled by b, but the replies
+	// are lost, and b's requests don't get through
+	rn.SetPath("b", "a", Path{Down: true})
+	reply := ""
+	if ab.Call("JunkServer.Handler2", 1, &reply) {
+		t.Fatalf("a heard back from b")
+	}
+	if rn.GetCount("b") != 1 {
+		t.Fatalf("b didn't handle a's request")
+	}
+	if ba.Call("JunkServer.Handler2", 2, &reply) {
+		t.Fatalf("b reached a")
+	}
+	if rn.GetCount("a") != 0 {
+		t.Fatalf("a handled b's request")
+	}
+
+	// a path's latency applies to the messages taking it
+	rn.SetPath("b", "a", Path{Latency: FixedLatency(50 * time.Millisecond)})
+	t0 := time.Now()
+	if !ab.Call("JunkServer.Handler2", 3, &reply) || reply != "handler2-3" {
+		t.Fatalf("wrong reply %v", reply)
+	}
+	if d := time.Since(t0); d < 50*time.Millisecond {
+		t.Fatalf("reply over a path of 50ms latency in %v", d)
+	}
+
+	// ends without a source take no paths
+	c := rn.MakeEnd("c-a")
+	rn.Connect("c-a", "a")
+	rn.Enable("c-a", true)
+	rn.SetPath("b", "a", Path{Down: true})
+	rn.SetPath("a", "b", Path{Down: true})
+	reply = ""
+	if !c.Call("JunkServer.Handler2", 4, &reply) || reply != "handler2-4" {
+		t.Fatalf("wrong reply %v", reply)
+	}
+}
+
+//
+// test that a seed decides the fate of each request
+//
+func TestSeed(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	run := func(seed int64) []bool {
+		rn := MakeNetwork()
+		defer rn.Cleanup()
+		rn.Seed(seed)
+		rn.Reliable(false)
+
+		rs := MakeServer()
+		rs.AddService(MakeService(&JunkServer{}))
+		rn.AddServer(99, rs)
+		e := rn.MakeEnd("end")
+		rn.Connect("end", 99)
+		rn.Enable("end", true)
+
+		var oks []bool
+		for i := 0; i < 40; i++ {
+			reply := ""
+			oks = append(oks, e.Call("JunkServer.Handler2", i, &reply))
+		}
+		return oks
+	}
+
+	a, b, c := run(7), run(7), run(8)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("runs with the same seed differ:\n%v\n%v", a, b)
+	}
+	if reflect.DeepEqual(a, c) {
+		t.Fatalf("runs with different seeds lost the same requests")
+	}
+}
+
+//
+// test delays on a virtual clock
+//
+func TestVirtualClock(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+	clock := MakeVirtualClock()
+	rn.SetClock(clock)
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer(99, rs)
+	e := rn.MakeEnd("end")
+	rn.Connect("end", 99)
+	rn.Enable("end", true)
+	rn.SetLink("end", LinkOptions{Latency: FixedLatency(30 * time.Millisecond)})
+
+	done := make(chan bool)
+	go func() {
+		reply := ""
+		done <- e.Call("JunkServer.Handler2", 1, &reply) && reply == "handler2-1"
+	}()
+	// wait for the network to hold the request, and then the reply
+	pending := func(n int) {
+		for clock.Pending() < n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	pending(1)
+	clock.Advance(29 * time.Millisecond)
+	if rn.GetCount(99) != 0 {
+		t.Fatalf("request delivered before its latency was up")
+	}
+	clock.Advance(time.Millisecond)
+	pending(2) // and a timer checking on the server
+	select {
+	case <-done:
+		t.Fatalf("reply received before its latency was up")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(30 * time.Millisecond)
+	if ok := <-done; !ok {
+		t.Fatalf("call failed")
+	}
+	if d := clock.Now().Sub(time.Unix(0, 0)); d != 60*time.Millisecond {
+		t.Fatalf("clock at %v", d)
+	}
+}
+
 //
 // test net.GetTotalBytes()
 //
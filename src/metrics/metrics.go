@@ -0,0 +1,159 @@
+package metrics
+
+//
+// minimal metrics plumbing shared by raft, kvraft and clients.
+//
+// components report to a Sink. Registry is an in-memory Sink that keeps
+// counters and histograms for tests and status RPCs; forwarding to a real
+// monitoring system is a matter of implementing Sink.
+//
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+type Sink interface {
+	IncCounter(name string, delta int64)
+	Observe(name string, value float64) // seconds for latencies, bytes for sizes
+}
+
+// a Sink that drops everything, used when nothing is configured
+type discard struct{}
+
+func (discard) IncCounter(name string, delta int64) {}
+func (discard) Observe(name string, value float64)  {}
+
+var Discard Sink = discard{}
+
+// histogram buckets are powers of two, bucket i counts values in (2^(i-1), 2^i]
+const (
+	minExp = -30 // ~1ns in seconds
+	maxExp = 40  // ~1TB in bytes
+)
+
+type HistogramSnapshot struct {
+	Count   int64
+	Sum     float64
+	Max     float64
+	Buckets map[int]int64 // exponent -> count
+}
+
+func (h HistogramSnapshot) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / float64(h.Count)
+}
+
+// upper bound of the bucket holding the q-th quantile, 0 <= q <= 1
+func (h HistogramSnapshot) Quantile(q float64) float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	exps := make([]int, 0, len(h.Buckets))
+	for exp := range h.Buckets {
+		exps = append(exps, exp)
+	}
+	sort.Ints(exps)
+	rank := int64(math.Ceil(q * float64(h.Count)))
+	seen := int64(0)
+	for _, exp := range exps {
+		seen += h.Buckets[exp]
+		if seen >= rank {
+			return math.Min(math.Ldexp(1, exp), h.Max)
+		}
+	}
+	return h.Max
+}
+
+type Registry struct {
+	mu         sync.Mutex
+	counters   map[string]int64
+	histograms map[string]*HistogramSnapshot
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   make(map[string]int64),
+		histograms: make(map[string]*HistogramSnapshot),
+	}
+}
+
+func (r *Registry) IncCounter(name string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += delta
+}
+
+func (r *Registry) Observe(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.histograms[name]
+	if !ok {
+		h = &HistogramSnapshot{Buckets: make(map[int]int64)}
+		r.histograms[name] = h
+	}
+	h.Count++
+	h.Sum += value
+	h.Max = math.Max(h.Max, value)
+	h.Buckets[bucketOf(value)]++
+}
+
+func bucketOf(value float64) int {
+	if value <= 0 {
+		return minExp
+	}
+	exp := int(math.Ceil(math.Log2(value)))
+	if exp < minExp {
+		return minExp
+	}
+	if exp > maxExp {
+		return maxExp
+	}
+	return exp
+}
+
+func (r *Registry) Counter(name string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counters[name]
+}
+
+func (r *Registry) Histogram(name string) HistogramSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.histograms[name]
+	if !ok {
+		return HistogramSnapshot{}
+	}
+	snapshot := *h
+	snapshot.Buckets = make(map[int]int64, len(h.Buckets))
+	for exp, n := range h.Buckets {
+		snapshot.Buckets[exp] = n
+	}
+	return snapshot
+}
+
+// copies of every counter and histogram
+func (r *Registry) Counters() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counters := make(map[string]int64, len(r.counters))
+	for name, v := range r.counters {
+		counters[name] = v
+	}
+	return counters
+}
+
+func (r *Registry) HistogramNames() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.histograms))
+	for name := range r.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
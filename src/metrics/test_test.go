@@ -0,0 +1,27 @@
+package metrics
+
+import "testing"
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	r.IncCounter("ops", 2)
+	r.IncCounter("ops", 3)
+	if r.Counter("ops") != 5 {
+		t.Fatalf("counter is %v, expected 5", r.Counter("ops"))
+	}
+
+	for i := 1; i <= 100; i++ {
+		r.Observe("latency", float64(i))
+	}
+	h := r.Histogram("latency")
+	if h.Count != 100 || h.Max != 100 || h.Mean() != 50.5 {
+		t.Fatalf("unexpected histogram %+v", h)
+	}
+	// the median falls into the (32, 64] bucket
+	if q := h.Quantile(0.5); q != 64 {
+		t.Fatalf("median estimated as %v, expected 64", q)
+	}
+	if q := h.Quantile(1); q != 100 {
+		t.Fatalf("max estimated as %v, expected 100", q)
+	}
+}
@@ -0,0 +1,199 @@
+package protowire
+
+//
+// the protocol buffers (proto3) wire format, enough of it to marshal the
+// messages in the .proto files of this repo by hand: varints, zig-zag-free
+// signed integers as int64, bools, and length-delimited bytes, strings and
+// nested messages. fields with zero values are left out, as proto3 does,
+// and a Reader skips fields it doesn't know, so messages can grow.
+//
+// var b protowire.Buffer
+// b.Int64(1, args.Term)
+// b.Bytes(2, args.Snapshot)
+// data := b.Data()
+//
+// r := protowire.NewReader(data)
+// for r.Next() {
+//   switch r.Field() {
+//   case 1: args.Term = r.Int64()
+//   case 2: args.Snapshot = r.Bytes()
+//   }
+// }
+// err := r.Err()
+//
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+const (
+	typeVarint  = 0
+	typeFixed64 = 1
+	typeBytes   = 2
+	typeFixed32 = 5
+)
+
+var ErrMalformed = errors.New("protowire: malformed message")
+
+type Buffer struct {
+	b []byte
+}
+
+func (b *Buffer) tag(field int, typ int) {
+	b.b = appendUvarint(b.b, uint64(field)<<3|uint64(typ))
+}
+
+func (b *Buffer) Uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.tag(field, typeVarint)
+	b.b = appendUvarint(b.b, v)
+}
+
+// an int64 or int32 field, negative values take ten bytes as in proto
+func (b *Buffer) Int64(field int, v int64) {
+	b.Uint64(field, uint64(v))
+}
+
+func (b *Buffer) Int(field int, v int) {
+	b.Int64(field, int64(v))
+}
+
+func (b *Buffer) Bool(field int, v bool) {
+	if v {
+		b.Uint64(field, 1)
+	}
+}
+
+func (b *Buffer) Bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	b.tag(field, typeBytes)
+	b.b = appendUvarint(b.b, uint64(len(v)))
+	b.b = append(b.b, v...)
+}
+
+func (b *Buffer) String(field int, v string) {
+	if v == "" {
+		return
+	}
+	b.tag(field, typeBytes)
+	b.b = appendUvarint(b.b, uint64(len(v)))
+	b.b = append(b.b, v...)
+}
+
+// one element of a repeated bytes, string or message field, written even
+// if empty so that the element count is kept
+func (b *Buffer) Element(field int, v []byte) {
+	b.tag(field, typeBytes)
+	b.b = appendUvarint(b.b, uint64(len(v)))
+	b.b = append(b.b, v...)
+}
+
+func (b *Buffer) Data() []byte {
+	return b.b
+}
+
+type Reader struct {
+	b     []byte
+	field int
+	v     uint64 // varint and fixed fields
+	data  []byte // length-delimited fields
+	err   error
+}
+
+func NewReader(data []byte) *Reader {
+	return &Reader{b: data}
+}
+
+// advance to the next field, false at the end of the message or on an
+// error, see Err
+func (r *Reader) Next() bool {
+	if r.err != nil || len(r.b) == 0 {
+		return false
+	}
+	tag, n := binary.Uvarint(r.b)
+	if n <= 0 || tag>>3 == 0 || tag>>3 > math.MaxInt32 {
+		r.err = ErrMalformed
+		return false
+	}
+	r.b = r.b[n:]
+	r.field, r.v, r.data = int(tag>>3), 0, nil
+	switch tag & 7 {
+	case typeVarint:
+		r.v, n = binary.Uvarint(r.b)
+	case typeFixed64:
+		if n = 8; len(r.b) >= n {
+			r.v = binary.LittleEndian.Uint64(r.b)
+		}
+	case typeFixed32:
+		if n = 4; len(r.b) >= n {
+			r.v = uint64(binary.LittleEndian.Uint32(r.b))
+		}
+	case typeBytes:
+		var size uint64
+		size, n = binary.Uvarint(r.b)
+		if n > 0 && size <= uint64(len(r.b)-n) {
+			r.data = r.b[n : n+int(size)]
+			n += int(size)
+		} else {
+			n = 0
+		}
+	default:
+		n = 0
+	}
+	if n <= 0 || n > len(r.b) {
+		r.err = ErrMalformed
+		return false
+	}
+	r.b = r.b[n:]
+	return true
+}
+
+func (r *Reader) Field() int {
+	return r.field
+}
+
+func (r *Reader) Uint64() uint64 {
+	return r.v
+}
+
+func (r *Reader) Int64() int64 {
+	return int64(r.v)
+}
+
+func (r *Reader) Int() int {
+	return int(int64(r.v))
+}
+
+func (r *Reader) Bool() bool {
+	return r.v != 0
+}
+
+// a copy of the field's bytes, the message's buffer may be reused
+func (r *Reader) Bytes() []byte {
+	if r.data == nil {
+		return nil
+	}
+	return append([]byte{}, r.data...)
+}
+
+func (r *Reader) String() string {
+	return string(r.data)
+}
+
+func (r *Reader) Err() error {
+	return r.err
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
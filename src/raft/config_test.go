@@ -19,6 +19,7 @@ import (
 
 	"raft/labgob"
 	"raft/labrpc"
+	"raft/transport"
 
 	crand "crypto/rand"
 	"encoding/base64"
@@ -54,7 +55,8 @@ type config struct {
 	endnames    [][]string            // the port file names each sends to
 	logs        []map[int]interface{} // copy of each server's committed entries
 	lastApplied []int
-	start       time.Time // time at which make_config() was called
+	links       labrpc.LinkOptions // on every link, see setlinks()
+	start       time.Time          // time at which make_config() was called
 	// begin()/end() statistics
 	t0        time.Time // time at which test_test.go called cfg.begin()
 	rpcs0     int       // rpcTotal() at start of test
@@ -291,10 +293,12 @@ func (cfg *config) start1(i int, applier func(int, chan ApplyMsg)) {
 	}
 
 	// a fresh set of ClientEnds.
-	ends := make([]*labrpc.ClientEnd, cfg.n)
+	ends := make([]transport.Endpoint, cfg.n)
 	for j := 0; j < cfg.n; j++ {
 		ends[j] = cfg.net.MakeEnd(cfg.endnames[i][j])
 		cfg.net.Connect(cfg.endnames[i][j], j)
+		cfg.net.SetLink(cfg.endnames[i][j], cfg.links)
+		cfg.net.SetSource(cfg.endnames[i][j], i)
 	}
 
 	cfg.mu.Lock()
@@ -360,6 +364,9 @@ func (cfg *config) cleanup() {
 	}
 	cfg.net.Cleanup()
 	cfg.checkTimeout()
+	if cfg.t.Failed() {
+		cfg.t.Logf("replay the network with LABRPC_SEED=%v", cfg.net.GetSeed())
+	}
 }
 
 // attach server i to the net.
@@ -428,6 +435,23 @@ func (cfg *config) setlongreordering(longrel bool) {
 	cfg.net.LongReordering(longrel)
 }
 
+// latency, duplication and FIFO delivery on every link, including those
+// of servers started later
+func (cfg *config) setlinks(opts labrpc.LinkOptions) {
+	cfg.links = opts
+	for i := 0; i < cfg.n; i++ {
+		for j := 0; cfg.endnames[i] != nil && j < cfg.n; j++ {
+			cfg.net.SetLink(cfg.endnames[i][j], opts)
+		}
+	}
+}
+
+// reachability, latency and bandwidth of messages from server from to
+// server to, e.g. Path{Down: true} for from can't reach to
+func (cfg *config) setpath(from int, to int, opts labrpc.Path) {
+	cfg.net.SetPath(from, to, opts)
+}
+
 //
 // check that one of the connected servers thinks
 // it is the leader, and that no other connected
@@ -4,24 +4,26 @@ import (
 	//	"bytes"
 
 	"bytes"
+	"context"
+	"errors"
 	"log"
 	"math/rand"
 	"sync"
 	"time"
 
 	"raft/labgob"
-	"raft/labrpc"
 )
 
 type Raft struct {
-	mu        sync.RWMutex        // Lock to protect shared access to this peer's state
-	peers     []*labrpc.ClientEnd // RPC end points of all peers
-	persister *Persister          // Object to hold this peer's persisted state
-	me        int                 // this peer's index into peers[]
-	dead      int32               // set by Kill()
+	mu        sync.RWMutex // Lock to protect shared access to this peer's state
+	peers     Peers        // how to reach the other peers
+	persister *Persister   // Object to hold this peer's persisted state
+	me        int          // this peer's id
+	dead      int32        // set by Kill()
 
 	applyCh       chan ApplyMsg
 	applyCond     *sync.Cond   // used to wakeup applier goroutine after committing new entries
+	appliedCond   *sync.Cond   // broadcast as lastApplied moves, see WaitApplied
 	tryAppendCond []*sync.Cond // used to signal replicator goroutine to batch replicating entries
 	state         int
 
@@ -31,12 +33,25 @@ type Raft struct {
 
 	commitIndex int
 	lastApplied int
+	// the leader as last heard of, as of leaderTerm. unknown in any later term
+	leaderId    int
+	leaderTerm  int
 	nextIndex   []int
 	matchIndex  []int
 	hasSnapshot bool
 
 	electionTimer  *time.Timer
 	heartbeatTimer *time.Timer
+
+	archive *archiveQueue // nil unless SetArchiver was called
+
+	// the context of RPCs sent in the current role, cancelled on stepping
+	// down, and their timeout, see SetRPCTimeout
+	rpcCtx     context.Context
+	rpcCancel  context.CancelFunc
+	rpcTimeout int64
+
+	liveness *LivenessTracker // of the other peers, see raft_liveness.go
 }
 
 func StableHeartbeatTimeout() time.Duration {
@@ -48,28 +63,33 @@ func RandomizedElectionTimeout() time.Duration {
 	diff := 600 - 300
 	return time.Duration(300+r.Intn(diff)) * time.Millisecond
 }
-func Make(peers []*labrpc.ClientEnd, me int,
+func MakeWithPeers(peers Peers, me int,
 	persister *Persister, applyCh chan ApplyMsg) *Raft {
+	n := peers.Count()
 	rf := &Raft{
 		peers:          peers,
 		persister:      persister,
 		me:             me,
 		dead:           0,
 		applyCh:        applyCh,
-		tryAppendCond:  make([]*sync.Cond, len(peers)),
+		tryAppendCond:  make([]*sync.Cond, n),
 		state:          StateFollower,
 		currentTerm:    0,
 		votedFor:       -1,
+		leaderId:       -1,
 		raftLog:        newLogs(),
-		nextIndex:      make([]int, len(peers)),
-		matchIndex:     make([]int, len(peers)),
+		nextIndex:      make([]int, n),
+		matchIndex:     make([]int, n),
 		heartbeatTimer: time.NewTimer(StableHeartbeatTimeout()),
 		electionTimer:  time.NewTimer(RandomizedElectionTimeout()),
+		liveness:       MakeLivenessTracker(n, livenessWindow),
 	}
+	rf.rpcCtx, rf.rpcCancel = context.WithCancel(context.Background())
 	rf.readPersist(persister.ReadRaftState())
 	rf.applyCond = sync.NewCond(&rf.mu)
+	rf.appliedCond = sync.NewCond(&rf.mu)
 
-	for i := 0; i < len(peers); i++ {
+	for i := 0; i < n; i++ {
 		if i != rf.me {
 			rf.tryAppendCond[i] = sync.NewCond(&sync.Mutex{})
 			// start a peer's replicator goroutine to replicate entries in the background
@@ -86,12 +106,27 @@ func Make(peers []*labrpc.ClientEnd, me int,
 	return rf
 }
 
+var (
+	ErrNotLeader = errors.New("raft: not the leader")
+	// the persister is backlogged, retry after a while
+	ErrBusy = errors.New("raft: persistence is falling behind")
+)
+
 //receive appending command from upper KV layer
 func (rf *Raft) Start(command interface{}) (int, int, bool) {
+	index, term, err := rf.Propose(command)
+	return index, term, err == nil
+}
+
+// like Start, but tells why the command wasn't accepted
+func (rf *Raft) Propose(command interface{}) (int, int, error) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
 	if rf.state != StateLeader {
-		return -1, -1, false
+		return -1, -1, ErrNotLeader
+	}
+	if rf.persister.Backlogged() {
+		return -1, -1, ErrBusy
 	}
 	newLog := Entry{}
 	newLog.Command = command
@@ -100,7 +135,7 @@ func (rf *Raft) Start(command interface{}) (int, int, bool) {
 	rf.raftLog.append(newLog)
 	rf.persist()
 	rf.BroadcastAppend(Append)
-	return newLog.Index, newLog.Term, true
+	return newLog.Index, newLog.Term, nil
 }
 
 func (rf *Raft) ticker() {
@@ -198,6 +233,7 @@ func (rf *Raft) applier() {
 		// use commitIndex rather than rf.commitIndex because rf.commitIndex may change during the Unlock() and Lock()
 		// use Max(rf.lastApplied, commitIndex) rather than commitIndex directly to avoid concurrently InstallSnapshot rpc causing lastApplied to rollback
 		rf.lastApplied = Max(rf.lastApplied, commitIndex)
+		rf.appliedCond.Broadcast()
 		rf.mu.Unlock()
 	}
 }
@@ -206,18 +242,28 @@ func (rf *Raft) persist() {
 	data := rf.SaveState()
 	rf.persister.SaveRaftState(data)
 }
+
+// version 0 (unversioned) and 1 share the layout: currentTerm, votedFor, logs.
+// 2: currentTerm, votedFor, then the entries in a gob stream of their own,
+// one message each, see raftLog.encode
+const raftStateVersion = 2
+
 func (rf *Raft) SaveState() []byte {
 	w := new(bytes.Buffer)
 	e := labgob.NewEncoder(w)
 	e.Encode(rf.currentTerm)
 	e.Encode(rf.votedFor)
-	e.Encode(rf.raftLog.getLogs())
-	return w.Bytes()
+	w.Write(rf.raftLog.encode())
+	return AddFormatVersion(raftStateVersion, w.Bytes())
 }
 func (rf *Raft) readPersist(data []byte) {
 	if data == nil || len(data) < 1 { // bootstrap without any state?
 		return
 	}
+	version, data := SplitFormatVersion(data)
+	if version > raftStateVersion {
+		log.Fatalf("raft state has format version %v, this build reads up to %v", version, raftStateVersion)
+	}
 	r := bytes.NewBuffer(data)
 	d := labgob.NewDecoder(r)
 	var CurrentTerm int
@@ -225,13 +271,23 @@ func (rf *Raft) readPersist(data []byte) {
 	var logs []Entry
 	if d.Decode(&CurrentTerm) != nil ||
 		d.Decode(&VotedFor) != nil ||
-		d.Decode(&logs) != nil {
+		version < 2 && d.Decode(&logs) != nil {
 		log.Fatal("error")
-	} else {
-		rf.currentTerm = CurrentTerm
-		rf.votedFor = VotedFor
-		rf.raftLog.setLogs(logs)
 	}
+	if version >= 2 {
+		// d reads no further than it decoded
+		entries := labgob.NewDecoder(r)
+		for r.Len() > 0 {
+			var entry Entry
+			if entries.Decode(&entry) != nil {
+				log.Fatal("error")
+			}
+			logs = append(logs, entry)
+		}
+	}
+	rf.currentTerm = CurrentTerm
+	rf.votedFor = VotedFor
+	rf.raftLog.setLogs(logs)
 }
 
 func (rf *Raft) GetState() (int, bool) {
@@ -1,8 +1,15 @@
 package raft
 
+import "context"
+
+// upper bound of entries carried by one AppendEntries, so that catching up a
+// follower which is far behind doesn't copy the whole log tail at once. the
+// replicator keeps sending rounds until the follower reaches lastIndex.
+const maxEntriesPerAppend = 100
+
 //HeartBeat
 func (rf *Raft) BroadcastAppend(job int) {
-	for peer := range rf.peers {
+	for peer := 0; peer < rf.peers.Count(); peer++ {
 		if peer == rf.me {
 			continue
 		}
@@ -23,6 +30,7 @@ func (rf *Raft) appendOneRound(peer int) {
 		rf.mu.RUnlock()
 		return
 	}
+	ctx := rf.rpcCtx
 	prevLogIndex := rf.nextIndex[peer] - 1
 	if prevLogIndex < rf.raftLog.dummyIndex() {
 		args := &InstallSnapshotArgs{
@@ -34,7 +42,7 @@ func (rf *Raft) appendOneRound(peer int) {
 		}
 		rf.mu.RUnlock()
 		reply := new(InstallSnapshotReply)
-		if rf.sendInstallSnapshot(peer, args, reply) {
+		if rf.sendInstallSnapshot(ctx, peer, args, reply) {
 			rf.processInstallSnapshotReply(peer, args, reply)
 		}
 	} else {
@@ -42,19 +50,20 @@ func (rf *Raft) appendOneRound(peer int) {
 			panic("revLogIndex > rf.raftLog.lastIndex()")
 		}
 		// just entries can catch up
+		n := Min(rf.raftLog.lastIndex()-prevLogIndex, maxEntriesPerAppend)
 		args := &AppendEntriesArgs{
 			LeaderId:     rf.me,
 			Term:         rf.currentTerm,
 			PrevLogIndex: prevLogIndex,
 			PrevLogTerm:  rf.raftLog.getEntry(prevLogIndex).Term,
-			Entries:      make([]Entry, rf.raftLog.lastIndex()-prevLogIndex),
+			Entries:      make([]Entry, n),
 			LeaderCommit: rf.commitIndex,
 		}
 
-		copy(args.Entries, rf.raftLog.sliceFrom(prevLogIndex+1))
+		copy(args.Entries, rf.raftLog.slice(prevLogIndex+1, prevLogIndex+1+n))
 		rf.mu.RUnlock()
 		reply := new(AppendEntriesReply)
-		if rf.sendAppendEntries(peer, args, reply) {
+		if rf.sendAppendEntries(ctx, peer, args, reply) {
 			// Here, we might activate more replicateOneRound depend on
 			// whether we can fix this peer's log in this round
 			rf.mu.Lock()
@@ -67,7 +76,7 @@ func (rf *Raft) processAppendEntriesReply(peer int, args *AppendEntriesArgs, rep
 	if reply.Term > rf.currentTerm {
 		rf.currentTerm = reply.Term
 		rf.votedFor = -1
-		rf.state = StateFollower
+		rf.stepDown()
 		rf.electionTimer.Reset(RandomizedElectionTimeout())
 		rf.persist()
 	} else if reply.Term == rf.currentTerm && rf.state == StateLeader &&
@@ -89,13 +98,13 @@ func (rf *Raft) processAppendEntriesReply(peer int, args *AppendEntriesArgs, rep
 func (rf *Raft) advanceCommitIndexForLeader() {
 	for i := rf.raftLog.lastIndex(); i > rf.commitIndex; i-- {
 		num := 0
-		for j := range rf.peers {
+		for j := 0; j < rf.peers.Count(); j++ {
 			if j != rf.me && rf.matchIndex[j] >= i {
 				num++
 			}
 		}
 		//from raft paper (Rules for Servers, leader, last bullet point)
-		if num+1 > (len(rf.peers)/2) && rf.raftLog.getEntry(i).Term == rf.currentTerm {
+		if num+1 > (rf.peers.Count()/2) && rf.raftLog.getEntry(i).Term == rf.currentTerm {
 			rf.commitIndex = i
 			rf.applyCond.Signal()
 			return
@@ -106,9 +115,23 @@ func (rf *Raft) advanceCommitIndexForLeader() {
 
 //Handle the received RPC
 func (rf *Raft) HandleAppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) {
+	rf.handleAppendEntries(args, reply)
+	// a follower whose disk doesn't keep up acks late, which slows
+	// the leader down instead of piling up unsynced state here
+	rf.persister.WaitBacklog()
+}
+
+func (rf *Raft) handleAppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
-	defer rf.persist()
+	term, votedFor, appended := rf.currentTerm, rf.votedFor, false
+	defer func() {
+		// heartbeats and commit updates leave nothing new to persist, and
+		// persisting writes out the whole log
+		if appended || rf.currentTerm != term || rf.votedFor != votedFor {
+			rf.persist()
+		}
+	}()
 	if args.Term < rf.currentTerm {
 		reply.Term, reply.Success = rf.currentTerm, false
 		return
@@ -117,7 +140,8 @@ func (rf *Raft) HandleAppendEntries(args *AppendEntriesArgs, reply *AppendEntrie
 		rf.currentTerm, rf.votedFor = args.Term, -1
 	}
 
-	rf.state = StateFollower
+	rf.stepDown()
+	rf.leaderId, rf.leaderTerm = args.LeaderId, args.Term
 	rf.electionTimer.Reset(RandomizedElectionTimeout())
 
 	if args.PrevLogIndex < rf.raftLog.dummyIndex() {
@@ -150,18 +174,20 @@ func (rf *Raft) HandleAppendEntries(args *AppendEntriesArgs, reply *AppendEntrie
 		if rf.raftLog.convertIndex(entry.Index) >= rf.raftLog.len() || rf.raftLog.getEntry(entry.Index).Term != entry.Term {
 			rf.raftLog.trunc(entry.Index)
 			rf.raftLog.append(args.Entries[index:]...)
+			appended = true
 			break
 		}
 	}
-	// raft paper (AppendEntries RPC, 5)
-	if args.LeaderCommit > rf.commitIndex {
-		rf.commitIndex = Min(args.LeaderCommit, rf.raftLog.lastIndex())
+	// raft paper (AppendEntries RPC, 5), entries after the last new one are
+	// not known to match the leader, since the leader may send only part of its log
+	if newCommit := Min(args.LeaderCommit, args.PrevLogIndex+len(args.Entries)); newCommit > rf.commitIndex {
+		rf.commitIndex = newCommit
 		rf.applyCond.Signal()
 	}
 	reply.Term, reply.Success = rf.currentTerm, true
 }
 
-func (rf *Raft) sendAppendEntries(server int, args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
-	ok := rf.peers[server].Call("Raft.HandleAppendEntries", args, reply)
+func (rf *Raft) sendAppendEntries(ctx context.Context, server int, args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
+	ok := rf.send(ctx, server, "Raft.HandleAppendEntries", args, reply)
 	return ok
 }
@@ -0,0 +1,215 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"raft/labgob"
+)
+
+//
+// when a snapshot compacts the log, the discarded entries form a sealed
+// segment. with an archiver set, raft uploads every such segment together
+// with the snapshot that replaced it, so that the state at any index since
+// archiving began can be rebuilt from a snapshot plus the segments after it,
+// while the local persister only keeps the recent window.
+//
+// a follower that installs the leader's snapshot archives it along with the
+// entries up to it, if its log holds the snapshot's last entry. if it fell
+// behind, it only archives the entries it had committed, never having had
+// the ones between those and the snapshot: its archive can't rebuild the
+// state at their indexes, only before them and from the snapshot on. the
+// leader's archive has no such gaps, nor has the archive all peers share,
+// since whichever peer first compacts an entry has it in its log.
+//
+
+// object storage holding archived snapshots and log segments. DirArchiver
+// keeps them in a directory, an S3-compatible client implements the same calls.
+type Archiver interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	List() ([]string, error)
+}
+
+type DirArchiver struct {
+	Dir string
+}
+
+func (a *DirArchiver) Put(name string, data []byte) error {
+	if err := os.MkdirAll(a.Dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(a.Dir, name)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (a *DirArchiver) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(a.Dir, name))
+}
+
+func (a *DirArchiver) List() ([]string, error) {
+	files, err := ioutil.ReadDir(a.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".tmp" {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+// zero padded, so that names sort by index
+func snapshotObjectName(index int, term int) string {
+	return fmt.Sprintf("snapshot-%020d-%020d", index, term)
+}
+
+func segmentObjectName(first int, last int) string {
+	return fmt.Sprintf("log-%020d-%020d", first, last)
+}
+
+type archiveObject struct {
+	name string
+	data []byte
+}
+
+// uploads run in their own goroutine, in order, so raft never waits on object storage
+type archiveQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	archiver Archiver
+	pending  []archiveObject
+}
+
+func (rf *Raft) SetArchiver(archiver Archiver) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.archive == nil {
+		rf.archive = &archiveQueue{}
+		rf.archive.cond = sync.NewCond(&rf.archive.mu)
+		go rf.archiveUploader(rf.archive)
+	}
+	rf.archive.mu.Lock()
+	rf.archive.archiver = archiver
+	rf.archive.mu.Unlock()
+}
+
+// caller must hold rf.mu, entries are the ones about to be discarded
+func (rf *Raft) archiveCompaction(entries []Entry, index int, term int, snapshot []byte) {
+	if rf.archive == nil {
+		return
+	}
+	objects := make([]archiveObject, 0, 2)
+	if len(entries) > 0 {
+		w := new(bytes.Buffer)
+		if err := labgob.NewEncoder(w).Encode(entries); err != nil {
+			log.Fatalf("raft %v: encode archived segment: %v", rf.me, err)
+		}
+		objects = append(objects, archiveObject{segmentObjectName(entries[0].Index, entries[len(entries)-1].Index), w.Bytes()})
+	}
+	objects = append(objects, archiveObject{snapshotObjectName(index, term), clone(snapshot)})
+
+	rf.archive.mu.Lock()
+	rf.archive.pending = append(rf.archive.pending, objects...)
+	rf.archive.cond.Signal()
+	rf.archive.mu.Unlock()
+}
+
+func (rf *Raft) archiveUploader(q *archiveQueue) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !rf.killed() {
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+			if rf.killed() {
+				return
+			}
+		}
+		object, archiver := q.pending[0], q.archiver
+		q.mu.Unlock()
+		err := archiver.Put(object.name, object.data)
+		q.mu.Lock()
+		if err != nil {
+			// keep it queued and retry a bit later
+			log.Printf("raft %v: archiving %v: %v", rf.me, object.name, err)
+			q.mu.Unlock()
+			time.Sleep(time.Second)
+			q.mu.Lock()
+			continue
+		}
+		q.pending = q.pending[1:]
+	}
+}
+
+// latest archived snapshot at or before index, for point-in-time recovery
+func ArchivedSnapshot(archiver Archiver, index int) (snapshotIndex int, snapshotTerm int, data []byte, err error) {
+	names, err := archiver.List()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	sort.Strings(names)
+	found := ""
+	for _, name := range names {
+		var i, t int
+		if n, _ := fmt.Sscanf(name, "snapshot-%d-%d", &i, &t); n == 2 && i <= index {
+			found, snapshotIndex, snapshotTerm = name, i, t
+		}
+	}
+	if found == "" {
+		return 0, 0, nil, fmt.Errorf("raft: no archived snapshot at or before %v", index)
+	}
+	data, err = archiver.Get(found)
+	return snapshotIndex, snapshotTerm, data, err
+}
+
+// archived entries with from <= index <= to, failing if any of them is missing
+func ArchivedEntries(archiver Archiver, from int, to int) ([]Entry, error) {
+	names, err := archiver.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	entries := make([]Entry, 0)
+	next := from
+	for _, name := range names {
+		var first, last int
+		if n, _ := fmt.Sscanf(name, "log-%d-%d", &first, &last); n != 2 || last < next || first > to {
+			continue
+		}
+		if first > next {
+			break
+		}
+		data, err := archiver.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		var segment []Entry
+		if err := labgob.NewDecoder(bytes.NewBuffer(data)).Decode(&segment); err != nil {
+			return nil, err
+		}
+		for _, entry := range segment {
+			if entry.Index >= next && entry.Index <= to {
+				entries = append(entries, entry)
+				next = entry.Index + 1
+			}
+		}
+	}
+	if next <= to {
+		return nil, fmt.Errorf("raft: archive is missing entry %v", next)
+	}
+	return entries, nil
+}
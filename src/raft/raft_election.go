@@ -1,5 +1,7 @@
 package raft
 
+import "context"
+
 //Sending election RPC
 func (rf *Raft) StartElection() {
 	//Yusong
@@ -13,15 +15,16 @@ func (rf *Raft) StartElection() {
 	args.LastLogTerm = lastLog.Term
 	rf.votedFor = rf.me
 	rf.persist()
+	ctx := rf.rpcCtx
 	// use Closure
 	grantedVotes := 1
-	for peer := range rf.peers {
+	for peer := 0; peer < rf.peers.Count(); peer++ {
 		if peer == rf.me {
 			continue
 		}
 		go func(peer int) {
 			reply := new(RequestVoteReply)
-			if rf.sendRequestVote(peer, args, reply) {
+			if rf.sendRequestVote(ctx, peer, args, reply) {
 				rf.mu.Lock()
 				defer rf.mu.Unlock()
 				// check if the term is equal to make sure that we are still in current round
@@ -29,9 +32,10 @@ func (rf *Raft) StartElection() {
 				if rf.currentTerm == args.Term && rf.state == StateCandidate {
 					if reply.VoteGranted {
 						grantedVotes += 1
-						if grantedVotes > len(rf.peers)/2 {
+						if grantedVotes > rf.peers.Count()/2 {
 							rf.state = StateLeader
-							for i := 0; i < len(rf.peers); i++ {
+							rf.leaderId, rf.leaderTerm = rf.me, rf.currentTerm
+							for i := 0; i < rf.peers.Count(); i++ {
 								// if we don't set rf.matchIndex[i] == 0, there will be error in unreliable test
 								rf.matchIndex[i] = 0
 								rf.nextIndex[i] = rf.raftLog.lastIndex() + 1
@@ -40,7 +44,7 @@ func (rf *Raft) StartElection() {
 							rf.BroadcastAppend(HeartBeat)
 						}
 					} else if reply.Term > rf.currentTerm {
-						rf.state = StateFollower
+						rf.stepDown()
 						rf.currentTerm, rf.votedFor = reply.Term, -1
 						rf.persist()
 					}
@@ -61,7 +65,7 @@ func (rf *Raft) HandleRequestVote(args *RequestVoteArgs, reply *RequestVoteReply
 		return
 	}
 	if args.Term > rf.currentTerm {
-		rf.state = StateFollower
+		rf.stepDown()
 		rf.currentTerm, rf.votedFor = args.Term, -1
 	}
 	reply.Term = rf.currentTerm
@@ -76,7 +80,7 @@ func (rf *Raft) HandleRequestVote(args *RequestVoteArgs, reply *RequestVoteReply
 	reply.VoteGranted = false
 }
 
-func (rf *Raft) sendRequestVote(server int, args *RequestVoteArgs, reply *RequestVoteReply) bool {
-	ok := rf.peers[server].Call("Raft.HandleRequestVote", args, reply)
+func (rf *Raft) sendRequestVote(ctx context.Context, server int, args *RequestVoteArgs, reply *RequestVoteReply) bool {
+	ok := rf.send(ctx, server, "Raft.HandleRequestVote", args, reply)
 	return ok
 }
@@ -0,0 +1,128 @@
+package raft
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//
+// every RPC a peer sends tells it something of the other's health: when it
+// last answered and how fast. the leader hears from its followers with
+// every heartbeat, others can ask with Ping. Status reports it, and a
+// leader handing over can pick its successor with TransferTarget. clients
+// keep their own LivenessTracker of the servers they call.
+//
+
+// a peer is taken by raft to be alive if it answered within this long, the
+// longest election timeout
+const livenessWindow = 600 * time.Millisecond
+
+// how much of each new round trip goes into Latency
+const latencyWeight = 0.2
+
+// what RPCs have shown of a peer's health
+type Liveness struct {
+	Alive       bool          // answered within the tracker's window
+	LastSuccess time.Time     // zero if never answered
+	Latency     time.Duration // round trip, smoothed over the answered RPCs
+	Failures    int           // RPCs unanswered in a row
+}
+
+type LivenessTracker struct {
+	mu     sync.Mutex
+	peers  []Liveness
+	window time.Duration
+}
+
+// track n peers, taking those that answered within window to be alive
+func MakeLivenessTracker(n int, window time.Duration) *LivenessTracker {
+	return &LivenessTracker{peers: make([]Liveness, n), window: window}
+}
+
+// an RPC to peer that took rtt, answered if ok
+func (lt *LivenessTracker) Record(peer int, rtt time.Duration, ok bool) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	l := &lt.peers[peer]
+	if !ok {
+		l.Failures++
+		return
+	}
+	if l.LastSuccess.IsZero() {
+		l.Latency = rtt
+	} else {
+		l.Latency += time.Duration(latencyWeight * float64(rtt-l.Latency))
+	}
+	l.LastSuccess, l.Failures = time.Now(), 0
+}
+
+func (lt *LivenessTracker) Get(peer int) Liveness {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	l := lt.peers[peer]
+	l.Alive = !l.LastSuccess.IsZero() && time.Since(l.LastSuccess) < lt.window
+	return l
+}
+
+func (lt *LivenessTracker) All() []Liveness {
+	all := make([]Liveness, len(lt.peers))
+	for peer := range all {
+		all[peer] = lt.Get(peer)
+	}
+	return all
+}
+
+type PingArgs struct {
+	From int
+}
+
+type PingReply struct {
+	Term   int
+	Leader int // as far as the peer knows, -1 if it doesn't
+}
+
+// pings go ahead of entries and snapshots too
+func (args *PingArgs) Urgent() bool {
+	return true
+}
+
+func (rf *Raft) HandlePing(args *PingArgs, reply *PingReply) {
+	rf.mu.RLock()
+	defer rf.mu.RUnlock()
+	reply.Term, reply.Leader = rf.currentTerm, rf.leaderL()
+}
+
+// ping peer, recording its liveness, and return what it said
+func (rf *Raft) Ping(peer int) (PingReply, bool) {
+	var reply PingReply
+	ok := rf.send(context.Background(), peer, "Raft.HandlePing", &PingArgs{From: rf.me}, &reply)
+	return reply, ok
+}
+
+// the peer a leader should hand leadership to: one alive, as far along
+// the log as any, and the fastest to answer of those. -1 if this peer
+// isn't leader or no other is alive.
+func (rf *Raft) TransferTarget() int {
+	rf.mu.RLock()
+	defer rf.mu.RUnlock()
+	if rf.state != StateLeader {
+		return -1
+	}
+	target := -1
+	var best Liveness
+	for peer := range rf.matchIndex {
+		if peer == rf.me {
+			continue
+		}
+		l := rf.liveness.Get(peer)
+		if !l.Alive {
+			continue
+		}
+		if target == -1 || rf.matchIndex[peer] > rf.matchIndex[target] ||
+			rf.matchIndex[peer] == rf.matchIndex[target] && l.Latency < best.Latency {
+			target, best = peer, l
+		}
+	}
+	return target
+}
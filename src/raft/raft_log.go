@@ -1,7 +1,20 @@
 package raft
 
+import (
+	"bytes"
+
+	"raft/labgob"
+)
+
 type raftLog struct {
 	logs []Entry
+
+	// logs[:encodedLen] as persisted, a gob message per entry, so that
+	// persisting encodes only the entries appended since the last time
+	// rather than the whole log. any other change starts it over.
+	encoded    bytes.Buffer
+	encoder    *labgob.LabEncoder
+	encodedLen int
 }
 
 func newLogs() *raftLog {
@@ -18,17 +31,37 @@ func (l *raftLog) getLogs() []Entry {
 func (l *raftLog) setLogs(newlogs []Entry) {
 	l.logs = make([]Entry, len(newlogs))
 	copy(l.logs, newlogs)
+	l.forgetEncoding()
 }
 
 func (l *raftLog) clearDummyEntryCommand() {
 	l.logs[0].Command = nil
+	l.forgetEncoding()
 }
 
 func (l *raftLog) setDummyIndex(index int) {
 	l.logs[0].Index = index
+	l.forgetEncoding()
 }
 func (l *raftLog) setDummyTerm(term int) {
 	l.logs[0].Term = term
+	l.forgetEncoding()
+}
+
+func (l *raftLog) forgetEncoding() {
+	l.encoded.Reset()
+	l.encoder, l.encodedLen = nil, 0
+}
+
+// the entries as persisted, see raftStateVersion
+func (l *raftLog) encode() []byte {
+	if l.encoder == nil {
+		l.encoder = labgob.NewEncoder(&l.encoded)
+	}
+	for ; l.encodedLen < len(l.logs); l.encodedLen++ {
+		l.encoder.Encode(l.logs[l.encodedLen])
+	}
+	return l.encoded.Bytes()
 }
 func (l *raftLog) dummyIndex() int {
 	return l.logs[0].Index
@@ -69,6 +102,11 @@ func (l *raftLog) append(ents ...Entry) int {
 
 func (l *raftLog) trunc(high int) int {
 	l.logs = l.sliceTo(high)
+	if len(l.logs) < l.encodedLen {
+		// a gob stream can't be cut anywhere: the types an entry uses are
+		// described along with the first one to use them
+		l.forgetEncoding()
+	}
 	return l.lastIndex()
 }
 
@@ -0,0 +1,140 @@
+package raft
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"raft/transport"
+)
+
+//
+// raft knows its peers by id, 0 to Count()-1 with this one among them, and
+// sends them its RPCs through Peers, so it runs over any transport. Send
+// has the semantics of labrpc's Call: true only if the peer handled the
+// request and reply holds its answer. the handlers on the receiving side
+// are Raft.HandleAppendEntries, Raft.HandleRequestVote and
+// Raft.HandleInstallSnapshot.
+//
+
+type Peers interface {
+	Count() int
+	Send(peer int, svcMeth string, args interface{}, reply interface{}) bool
+}
+
+// Peers that can send a snapshot as a stream, in chunks, rather than in a
+// single InstallSnapshot message. the receiving side's handler is
+// Raft.HandleInstallSnapshotStream.
+type StreamPeers interface {
+	Peers
+	Stream(peer int, svcMeth string, args interface{}, payload io.Reader, reply interface{}) bool
+}
+
+// Peers whose sends can be cut short, see SetRPCTimeout. SendContext
+// returns false once ctx is done.
+type ContextPeers interface {
+	Peers
+	SendContext(ctx context.Context, peer int, svcMeth string, args interface{}, reply interface{}) bool
+}
+
+// Peers that can report on their connections, see Status
+type StatusPeers interface {
+	Peers
+	PeerStatus(peer int) (transport.EndpointStatus, bool)
+}
+
+// Peers reached through a transport's endpoints, that of peer i at i
+type Endpoints []transport.Endpoint
+
+func (ends Endpoints) Count() int {
+	return len(ends)
+}
+
+func (ends Endpoints) Send(peer int, svcMeth string, args interface{}, reply interface{}) bool {
+	return ends[peer].Call(svcMeth, args, reply)
+}
+
+// through endpoints that are transport.ContextEndpoints, others ignore ctx
+func (ends Endpoints) SendContext(ctx context.Context, peer int, svcMeth string, args interface{}, reply interface{}) bool {
+	if end, ok := ends[peer].(transport.ContextEndpoint); ok {
+		return end.CallContext(ctx, svcMeth, args, reply)
+	}
+	return ends[peer].Call(svcMeth, args, reply)
+}
+
+// the status of a transport.StatusEndpoint, false for other endpoints
+func (ends Endpoints) PeerStatus(peer int) (transport.EndpointStatus, bool) {
+	if end, ok := ends[peer].(transport.StatusEndpoint); ok {
+		return end.Status(), true
+	}
+	return transport.EndpointStatus{}, false
+}
+
+// streams through endpoints that are transport.StreamEndpoints, false for
+// others
+func (ends Endpoints) Stream(peer int, svcMeth string, args interface{}, payload io.Reader, reply interface{}) bool {
+	if end, ok := ends[peer].(transport.StreamEndpoint); ok {
+		return end.Stream(svcMeth, args, payload, reply)
+	}
+	return false
+}
+
+// a raft peer reaching the others through the endpoints, peers[i] being
+// that of peer i
+func Make(peers []transport.Endpoint, me int,
+	persister *Persister, applyCh chan ApplyMsg) *Raft {
+	return MakeWithPeers(Endpoints(peers), me, persister, applyCh)
+}
+
+// give up on an AppendEntries, RequestVote or InstallSnapshot that hasn't
+// been answered within timeout, 0 to wait as long as Peers does. RPCs sent
+// as leader or candidate are abandoned anyway once the peer steps down.
+// needs ContextPeers, a snapshot sent as a stream isn't bounded.
+func (rf *Raft) SetRPCTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&rf.rpcTimeout, int64(timeout))
+}
+
+// send with ctx, taken as the args were made, and the RPC timeout,
+// recording peer's liveness unless the RPC was abandoned
+func (rf *Raft) send(ctx context.Context, peer int, svcMeth string, args interface{}, reply interface{}) bool {
+	start := time.Now()
+	ok := rf.call(ctx, peer, svcMeth, args, reply)
+	if ok || ctx.Err() == nil {
+		rf.liveness.Record(peer, time.Since(start), ok)
+	}
+	return ok
+}
+
+func (rf *Raft) call(ctx context.Context, peer int, svcMeth string, args interface{}, reply interface{}) bool {
+	peers, ok := rf.peers.(ContextPeers)
+	if !ok {
+		return rf.peers.Send(peer, svcMeth, args, reply)
+	}
+	if timeout := time.Duration(atomic.LoadInt64(&rf.rpcTimeout)); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return peers.SendContext(ctx, peer, svcMeth, args, reply)
+}
+
+// become a follower, abandoning the RPCs sent as leader or candidate.
+// caller must hold rf.mu.
+func (rf *Raft) stepDown() {
+	if rf.state != StateFollower {
+		rf.rpcCancel()
+		rf.rpcCtx, rf.rpcCancel = context.WithCancel(context.Background())
+	}
+	rf.state = StateFollower
+}
+
+// heartbeats and votes go on a transport's priority lane, if it has one,
+// ahead of entries and snapshots, see transport.Prioritized
+func (args *AppendEntriesArgs) Urgent() bool {
+	return len(args.Entries) == 0
+}
+
+func (args *RequestVoteArgs) Urgent() bool {
+	return true
+}
@@ -0,0 +1,260 @@
+package raft
+
+import (
+	"bytes"
+
+	"raft/labgob"
+	"raft/protowire"
+)
+
+//
+// the RPC messages in the protobuf format of raft.proto, used in place of
+// labgob by transport.TCPTransport. an entry's command is opaque to raft
+// and stays labgob encoded inside it.
+//
+
+func (e *Entry) Marshal() ([]byte, error) {
+	var b protowire.Buffer
+	b.Int(1, e.Index)
+	if e.Command != nil {
+		cb := new(bytes.Buffer)
+		if err := labgob.NewEncoder(cb).Encode(&e.Command); err != nil {
+			return nil, err
+		}
+		b.Bytes(2, cb.Bytes())
+	}
+	b.Int(3, e.Term)
+	b.Int(4, e.Id)
+	return b.Data(), nil
+}
+
+func (e *Entry) Unmarshal(data []byte) error {
+	*e = Entry{}
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			e.Index = r.Int()
+		case 2:
+			if err := labgob.NewDecoder(bytes.NewReader(r.Bytes())).Decode(&e.Command); err != nil {
+				return err
+			}
+		case 3:
+			e.Term = r.Int()
+		case 4:
+			e.Id = r.Int()
+		}
+	}
+	return r.Err()
+}
+
+func (args *AppendEntriesArgs) Marshal() ([]byte, error) {
+	var b protowire.Buffer
+	b.Int(1, args.Term)
+	b.Int(2, args.LeaderId)
+	for i := range args.Entries {
+		eb, err := args.Entries[i].Marshal()
+		if err != nil {
+			return nil, err
+		}
+		b.Element(3, eb)
+	}
+	b.Int(4, args.PrevLogIndex)
+	b.Int(5, args.PrevLogTerm)
+	b.Int(6, args.LeaderCommit)
+	return b.Data(), nil
+}
+
+func (args *AppendEntriesArgs) Unmarshal(data []byte) error {
+	*args = AppendEntriesArgs{}
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			args.Term = r.Int()
+		case 2:
+			args.LeaderId = r.Int()
+		case 3:
+			var e Entry
+			if err := e.Unmarshal(r.Bytes()); err != nil {
+				return err
+			}
+			args.Entries = append(args.Entries, e)
+		case 4:
+			args.PrevLogIndex = r.Int()
+		case 5:
+			args.PrevLogTerm = r.Int()
+		case 6:
+			args.LeaderCommit = r.Int()
+		}
+	}
+	return r.Err()
+}
+
+func (reply *AppendEntriesReply) Marshal() ([]byte, error) {
+	var b protowire.Buffer
+	b.Bool(1, reply.Conflict)
+	b.Int(2, reply.ConflictIndex)
+	b.Int(3, reply.Term)
+	b.Bool(4, reply.Success)
+	return b.Data(), nil
+}
+
+func (reply *AppendEntriesReply) Unmarshal(data []byte) error {
+	*reply = AppendEntriesReply{}
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			reply.Conflict = r.Bool()
+		case 2:
+			reply.ConflictIndex = r.Int()
+		case 3:
+			reply.Term = r.Int()
+		case 4:
+			reply.Success = r.Bool()
+		}
+	}
+	return r.Err()
+}
+
+func (args *RequestVoteArgs) Marshal() ([]byte, error) {
+	var b protowire.Buffer
+	b.Int(1, args.CandidateId)
+	b.Int(2, args.Term)
+	b.Int(3, args.LastLogIndex)
+	b.Int(4, args.LastLogTerm)
+	return b.Data(), nil
+}
+
+func (args *RequestVoteArgs) Unmarshal(data []byte) error {
+	*args = RequestVoteArgs{}
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			args.CandidateId = r.Int()
+		case 2:
+			args.Term = r.Int()
+		case 3:
+			args.LastLogIndex = r.Int()
+		case 4:
+			args.LastLogTerm = r.Int()
+		}
+	}
+	return r.Err()
+}
+
+func (reply *RequestVoteReply) Marshal() ([]byte, error) {
+	var b protowire.Buffer
+	b.Int(1, reply.Term)
+	b.Bool(2, reply.VoteGranted)
+	b.Int(3, reply.State)
+	return b.Data(), nil
+}
+
+func (reply *RequestVoteReply) Unmarshal(data []byte) error {
+	*reply = RequestVoteReply{}
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			reply.Term = r.Int()
+		case 2:
+			reply.VoteGranted = r.Bool()
+		case 3:
+			reply.State = r.Int()
+		}
+	}
+	return r.Err()
+}
+
+func (args *InstallSnapshotArgs) Marshal() ([]byte, error) {
+	var b protowire.Buffer
+	b.Int(1, args.Term)
+	b.Int(2, args.LeaderId)
+	b.Int(3, args.LastIncludedIndex)
+	b.Int(4, args.LastIncludedTerm)
+	b.Bytes(5, args.Snapshot)
+	return b.Data(), nil
+}
+
+func (args *InstallSnapshotArgs) Unmarshal(data []byte) error {
+	*args = InstallSnapshotArgs{}
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			args.Term = r.Int()
+		case 2:
+			args.LeaderId = r.Int()
+		case 3:
+			args.LastIncludedIndex = r.Int()
+		case 4:
+			args.LastIncludedTerm = r.Int()
+		case 5:
+			args.Snapshot = r.Bytes()
+		}
+	}
+	return r.Err()
+}
+
+func (reply *InstallSnapshotReply) Marshal() ([]byte, error) {
+	var b protowire.Buffer
+	b.Int(1, reply.Term)
+	b.Bool(2, reply.Success)
+	return b.Data(), nil
+}
+
+func (reply *InstallSnapshotReply) Unmarshal(data []byte) error {
+	*reply = InstallSnapshotReply{}
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			reply.Term = r.Int()
+		case 2:
+			reply.Success = r.Bool()
+		}
+	}
+	return r.Err()
+}
+
+func (args *PingArgs) Marshal() ([]byte, error) {
+	var b protowire.Buffer
+	b.Int(1, args.From)
+	return b.Data(), nil
+}
+
+func (args *PingArgs) Unmarshal(data []byte) error {
+	*args = PingArgs{}
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			args.From = r.Int()
+		}
+	}
+	return r.Err()
+}
+
+func (reply *PingReply) Marshal() ([]byte, error) {
+	var b protowire.Buffer
+	b.Int(1, reply.Term)
+	b.Int(2, reply.Leader)
+	return b.Data(), nil
+}
+
+func (reply *PingReply) Unmarshal(data []byte) error {
+	*reply = PingReply{}
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			reply.Term = r.Int()
+		case 2:
+			reply.Leader = r.Int()
+		}
+	}
+	return r.Err()
+}
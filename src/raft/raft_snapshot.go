@@ -1,5 +1,64 @@
 package raft
 
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var ErrPersisterNotEmpty = errors.New("raft: persister already holds state")
+
+// seed an empty persister so that a peer started on it begins with a log
+// compacted up to index, as if it had taken snapshot at that point itself.
+// every peer of a new cluster must be seeded with the same index and term.
+func BootstrapFromSnapshot(persister *Persister, index int, term int, snapshot []byte) error {
+	if persister.RaftStateSize() > 0 || persister.SnapshotSize() > 0 {
+		return ErrPersisterNotEmpty
+	}
+	rf := &Raft{
+		currentTerm: term,
+		votedFor:    -1,
+		raftLog:     newLogs(),
+	}
+	rf.raftLog.setDummyIndex(index)
+	rf.raftLog.setDummyTerm(term)
+	persister.SaveStateAndSnapshot(rf.SaveState(), snapshot)
+	return nil
+}
+
+// seed an empty persister so that a peer started on it begins with command
+// as the first entry of its log, in term 1: the cluster's initial
+// configuration, say, written once rather than handed to every peer at
+// Make. every peer of a new cluster must be seeded with the same command.
+// the entry commits along with the first of the first leader's term, as any
+// entry an earlier term left.
+func BootstrapLog(persister *Persister, command interface{}) error {
+	if persister.RaftStateSize() > 0 || persister.SnapshotSize() > 0 {
+		return ErrPersisterNotEmpty
+	}
+	rf := &Raft{
+		currentTerm: 1,
+		votedFor:    -1,
+		raftLog:     newLogs(),
+	}
+	rf.raftLog.append(Entry{Index: 1, Term: 1, Command: command})
+	persister.SaveRaftState(rf.SaveState())
+	return nil
+}
+
+// the command of the first entry of persister's log if it's still there and
+// of term 1, as BootstrapLog writes it
+func BootstrapCommand(persister *Persister) (interface{}, bool) {
+	rf := &Raft{raftLog: newLogs()}
+	rf.readPersist(persister.ReadRaftState())
+	if rf.raftLog.dummyIndex() != 0 || rf.raftLog.lastIndex() < 1 || rf.raftLog.getEntry(1).Term != 1 {
+		return nil, false
+	}
+	return rf.raftLog.getEntry(1).Command, true
+}
+
 func (rf *Raft) Snapshot(index int, snapshot []byte) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
@@ -7,6 +66,7 @@ func (rf *Raft) Snapshot(index int, snapshot []byte) {
 		//println("Raft already trim the log at index:", index)
 		return
 	}
+	rf.archiveCompaction(rf.raftLog.slice(rf.raftLog.dummyIndex()+1, index+1), index, rf.raftLog.getEntry(index).Term, snapshot)
 	rf.raftLog.setLogs(rf.raftLog.sliceFrom(index))
 	rf.raftLog.clearDummyEntryCommand()
 	rf.persister.SaveStateAndSnapshot(rf.SaveState(), snapshot)
@@ -26,13 +86,22 @@ func (rf *Raft) HandleInstallSnapshot(args *InstallSnapshotArgs, reply *InstallS
 		rf.persist()
 	}
 
-	rf.state = StateFollower
+	rf.stepDown()
+	rf.leaderId, rf.leaderTerm = args.LeaderId, args.Term
 	rf.electionTimer.Reset(RandomizedElectionTimeout())
 	// outdated snapshot
 	if args.LastIncludedIndex <= rf.commitIndex {
 		return
 	}
 
+	// the entries known to match the leader's are archived with its snapshot:
+	// all up to it if the log holds its last entry, else the committed ones,
+	// the rest being covered by the snapshot alone. see raft_archive.go.
+	archived := rf.commitIndex
+	if rf.raftLog.matchLog(args.LastIncludedTerm, args.LastIncludedIndex) {
+		archived = args.LastIncludedIndex
+	}
+	rf.archiveCompaction(rf.raftLog.slice(rf.raftLog.dummyIndex()+1, archived+1), args.LastIncludedIndex, args.LastIncludedTerm, args.Snapshot)
 	if args.LastIncludedIndex > rf.raftLog.lastIndex() {
 		newlog := make([]Entry, 1)
 		rf.raftLog.setLogs(newlog)
@@ -59,7 +128,7 @@ func (rf *Raft) processInstallSnapshotReply(peer int, args *InstallSnapshotArgs,
 	if reply.Term > rf.currentTerm {
 		rf.currentTerm = reply.Term
 		rf.votedFor = -1
-		rf.state = StateFollower
+		rf.stepDown()
 		rf.electionTimer.Reset(RandomizedElectionTimeout())
 		rf.persist()
 	} else if rf.state == StateLeader && args.Term == rf.currentTerm {
@@ -68,11 +137,27 @@ func (rf *Raft) processInstallSnapshotReply(peer int, args *InstallSnapshotArgs,
 	}
 }
 
-func (rf *Raft) sendInstallSnapshot(server int, args *InstallSnapshotArgs, reply *InstallSnapshotReply) bool {
-	ok := rf.peers[server].Call("Raft.HandleInstallSnapshot", args, reply)
+func (rf *Raft) sendInstallSnapshot(ctx context.Context, server int, args *InstallSnapshotArgs, reply *InstallSnapshotReply) bool {
+	if peers, ok := rf.peers.(StreamPeers); ok {
+		// the snapshot goes as the payload, not in args
+		streamArgs := *args
+		streamArgs.Snapshot = nil
+		return peers.Stream(server, "Raft.HandleInstallSnapshotStream", &streamArgs, bytes.NewReader(args.Snapshot), reply)
+	}
+	ok := rf.send(ctx, server, "Raft.HandleInstallSnapshot", args, reply)
 	return ok
 }
 
+// InstallSnapshot with the snapshot streamed as the payload
+func (rf *Raft) HandleInstallSnapshotStream(args *InstallSnapshotArgs, snapshot io.Reader, reply *InstallSnapshotReply) {
+	data, err := ioutil.ReadAll(snapshot)
+	if err != nil {
+		return
+	}
+	args.Snapshot = data
+	rf.HandleInstallSnapshot(args, reply)
+}
+
 func (rf *Raft) CondInstallSnapshot(lastIncludedTerm int, lastIncludedIndex int, snapshot []byte) bool {
 	return true
 }
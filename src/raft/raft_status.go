@@ -0,0 +1,81 @@
+package raft
+
+import "raft/transport"
+
+// a point in time view of this peer, for operators and tests
+type Status struct {
+	Me            int
+	Term          int
+	State         string
+	Leader        int // as far as this peer knows, -1 if it doesn't
+	CommitIndex   int
+	LastApplied   int
+	LastLogIndex  int
+	SnapshotIndex int
+	Durability    string // what the persister guarantees across crashes
+	// the connections to the other peers by id, nil if Peers can't tell
+	Peers []transport.EndpointStatus
+	// what RPCs have shown of the other peers by id, see raft_liveness.go
+	Liveness []Liveness
+}
+
+func (rf *Raft) Status() Status {
+	peers := rf.peerStatus()
+	rf.mu.RLock()
+	defer rf.mu.RUnlock()
+	return Status{
+		Me:            rf.me,
+		Term:          rf.currentTerm,
+		State:         stateName(rf.state),
+		Leader:        rf.leaderL(),
+		CommitIndex:   rf.commitIndex,
+		LastApplied:   rf.lastApplied,
+		LastLogIndex:  rf.raftLog.lastIndex(),
+		SnapshotIndex: rf.raftLog.dummyIndex(),
+		Durability:    rf.persister.Config().Guarantee(),
+		Peers:         peers,
+		Liveness:      rf.liveness.All(),
+	}
+}
+
+func (rf *Raft) peerStatus() []transport.EndpointStatus {
+	peers, ok := rf.peers.(StatusPeers)
+	if !ok {
+		return nil
+	}
+	status := make([]transport.EndpointStatus, peers.Count())
+	for peer := range status {
+		if peer == rf.me {
+			continue
+		}
+		if status[peer], ok = peers.PeerStatus(peer); !ok {
+			return nil
+		}
+	}
+	return status
+}
+
+// the peer leading the current term, -1 if none is known yet
+func (rf *Raft) Leader() int {
+	rf.mu.RLock()
+	defer rf.mu.RUnlock()
+	return rf.leaderL()
+}
+
+func (rf *Raft) leaderL() int {
+	if rf.leaderTerm != rf.currentTerm {
+		return -1
+	}
+	return rf.leaderId
+}
+
+func stateName(state int) string {
+	switch state {
+	case StateLeader:
+		return "Leader"
+	case StateCandidate:
+		return "Candidate"
+	default:
+		return "Follower"
+	}
+}
@@ -0,0 +1,65 @@
+package raft
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// hashes of committed log entries, one per range of RangeSize entries.
+// ranges start at 1+k*RangeSize, so digests of two replicas can
+// be compared range by range even if they snapshotted at different indexes.
+// only complete ranges are included.
+type LogDigest struct {
+	From      int // first index covered by Hashes[0]
+	RangeSize int
+	Hashes    []uint64 // Hashes[i] covers [From+i*RangeSize, From+(i+1)*RangeSize)
+}
+
+// hash committed entries in [from, to], entries already in the snapshot are skipped
+func (rf *Raft) LogDigest(from int, to int, rangeSize int) LogDigest {
+	rf.mu.RLock()
+	defer rf.mu.RUnlock()
+	if rangeSize < 1 {
+		rangeSize = 1
+	}
+	low := Max(from, rf.raftLog.dummyIndex()+1)
+	high := Min(to, rf.commitIndex)
+	// round low up to the next range boundary
+	low = 1 + (low-1+rangeSize-1)/rangeSize*rangeSize
+	digest := LogDigest{From: low, RangeSize: rangeSize}
+	for start := low; start+rangeSize-1 <= high; start += rangeSize {
+		h := fnv.New64a()
+		for _, entry := range rf.raftLog.slice(start, start+rangeSize) {
+			fmt.Fprintf(h, "%d %d %v;", entry.Index, entry.Term, entry.Command)
+		}
+		digest.Hashes = append(digest.Hashes, h.Sum64())
+	}
+	return digest
+}
+
+// hash covering [start, start+RangeSize), false if it isn't part of the digest
+func (d *LogDigest) RangeHash(start int) (uint64, bool) {
+	if d.RangeSize < 1 || start < d.From || (start-d.From)%d.RangeSize != 0 {
+		return 0, false
+	}
+	i := (start - d.From) / d.RangeSize
+	if i >= len(d.Hashes) {
+		return 0, false
+	}
+	return d.Hashes[i], true
+}
+
+// first range start at which the two digests disagree, -1 if all ranges
+// present in both digests match. digests must use the same RangeSize.
+func FirstDivergentRange(a LogDigest, b LogDigest) int {
+	if a.RangeSize != b.RangeSize {
+		panic("comparing digests with different range size")
+	}
+	for i, h := range a.Hashes {
+		start := a.From + i*a.RangeSize
+		if other, ok := b.RangeHash(start); ok && other != h {
+			return start
+		}
+	}
+	return -1
+}
@@ -0,0 +1,40 @@
+package raft
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrKilled = errors.New("raft: killed")
+
+// block until every entry through index has been handed to the service on
+// applyCh, e.g. for a coordinator to fence on this peer having seen the log
+// up to a point. the service may still be applying the last of them, see
+// kvraft's WaitApplied for the applied state itself. ctx.Err() if ctx is
+// done first.
+func (rf *Raft) WaitApplied(ctx context.Context, index int) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rf.mu.Lock()
+			rf.appliedCond.Broadcast()
+			rf.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	// an installed snapshot moves lastApplied before it's handed over
+	for rf.lastApplied < index || rf.hasSnapshot {
+		if rf.killed() {
+			return ErrKilled
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rf.appliedCond.Wait()
+	}
+	return nil
+}
@@ -9,8 +9,16 @@ package raft
 //
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"raft/labgob"
+	"raft/labrpc"
+	"raft/metrics"
+	"reflect"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -1236,3 +1244,652 @@ func TestSnapshotAllCrash2D(t *testing.T) {
 	}
 	cfg.end()
 }
+
+func TestFilePersister(t *testing.T) {
+	modes := []Durability{DurabilityStrict, DurabilityBatched, DurabilityAsync}
+	for _, mode := range modes {
+		dir, err := ioutil.TempDir("", "persister")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer os.RemoveAll(dir)
+		config := PersisterConfig{Dir: dir, Durability: mode, SyncInterval: 10 * time.Millisecond}
+
+		ps, err := MakeFilePersister(config)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		registry := metrics.NewRegistry()
+		ps.SetMetrics(registry)
+		ps.SaveRaftState([]byte("state1"))
+		ps.SaveStateAndSnapshot([]byte("state2"), []byte("snapshot"))
+		ps.Close()
+
+		if registry.Histogram(MetricPersistLatency).Count != 2 ||
+			registry.Counter(MetricPersistBytes) != int64(len("state1state2snapshot")) ||
+			registry.Histogram(MetricSnapshotSize).Max != float64(len("snapshot")) {
+			t.Fatalf("mode %v: unexpected persister metrics %v", mode, registry.Counters())
+		}
+		if fsyncs := registry.Counter(MetricFsyncs); (mode == DurabilityAsync) != (fsyncs == 0) {
+			t.Fatalf("mode %v: %v fsyncs", mode, fsyncs)
+		}
+
+		ps, err = MakeFilePersister(config)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if string(ps.ReadRaftState()) != "state2" || string(ps.ReadSnapshot()) != "snapshot" {
+			t.Fatalf("mode %v: reopened persister has %q %q", mode, ps.ReadRaftState(), ps.ReadSnapshot())
+		}
+		ps.Close()
+	}
+}
+
+func TestProtoMessages(t *testing.T) {
+	args := AppendEntriesArgs{Term: 3, LeaderId: 2, PrevLogIndex: 5, PrevLogTerm: -1, LeaderCommit: 4,
+		Entries: []Entry{{Index: 6, Term: 3, Command: 100}, {Index: 7, Term: 3, Id: 9}}}
+	data, err := args.Marshal()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var decoded AppendEntriesArgs
+	if err := decoded.Unmarshal(data); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(args, decoded) {
+		t.Fatalf("decoded %+v, want %+v", decoded, args)
+	}
+
+	// a reply from a newer peer, with a field this one doesn't know
+	reply := RequestVoteReply{Term: 3, VoteGranted: true, State: StateFollower}
+	data, _ = reply.Marshal()
+	data = append(data, 0xf8, 0x01, 0x07) // field 31, varint 7
+	var decodedReply RequestVoteReply
+	if err := decodedReply.Unmarshal(data); err != nil || decodedReply != reply {
+		t.Fatalf("decoded %+v %v, want %+v", decodedReply, err, reply)
+	}
+	if err := decodedReply.Unmarshal(data[:len(data)-1]); err == nil {
+		t.Fatalf("truncated message decoded")
+	}
+}
+
+func TestRPCTimeout2A(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2A): RPC timeouts and abandoning RPCs on stepping down")
+
+	leader := cfg.checkOneLeader()
+	other := (leader + 1) % servers
+	cfg.disconnect(other)
+	cfg.net.LongDelays(true)
+	rf := cfg.rafts[leader]
+
+	// an unanswered RPC gives up after the timeout rather than the
+	// network's seconds
+	rf.SetRPCTimeout(50 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if rf.send(context.Background(), other, "Raft.HandleRequestVote", &RequestVoteArgs{}, &RequestVoteReply{}) {
+			t.Fatalf("RPC to a disconnected peer succeeded")
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("5 RPCs with a 50ms timeout took %v", elapsed)
+	}
+
+	// without one, stepping down cuts the leader's RPCs short
+	rf.SetRPCTimeout(0)
+	done := make(chan time.Time)
+	for i := 0; i < 5; i++ {
+		rf.mu.RLock()
+		ctx := rf.rpcCtx
+		rf.mu.RUnlock()
+		go func() {
+			rf.send(ctx, other, "Raft.HandleRequestVote", &RequestVoteArgs{}, &RequestVoteReply{})
+			done <- time.Now()
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	rf.mu.Lock()
+	stepped := time.Now()
+	rf.stepDown()
+	rf.mu.Unlock()
+	for i := 0; i < 5; i++ {
+		if returned := <-done; returned.Sub(stepped) > 100*time.Millisecond {
+			t.Fatalf("RPC returned %v after stepping down", returned.Sub(stepped))
+		}
+	}
+
+	cfg.end()
+}
+
+// peers in one process calling each other's handlers, each message going
+// through its protobuf encoding as it would over a network
+type localPeers struct {
+	mu    sync.Mutex
+	rafts []*Raft
+}
+
+type protoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+func (lp *localPeers) Count() int {
+	return len(lp.rafts)
+}
+
+func (lp *localPeers) Send(peer int, svcMeth string, args interface{}, reply interface{}) bool {
+	lp.mu.Lock()
+	rf := lp.rafts[peer]
+	lp.mu.Unlock()
+	if rf == nil || rf.killed() {
+		return false
+	}
+	data, _ := args.(protoMessage).Marshal()
+	switch svcMeth {
+	case "Raft.HandleAppendEntries":
+		a, r := &AppendEntriesArgs{}, &AppendEntriesReply{}
+		a.Unmarshal(data)
+		rf.HandleAppendEntries(a, r)
+		data, _ = r.Marshal()
+	case "Raft.HandleRequestVote":
+		a, r := &RequestVoteArgs{}, &RequestVoteReply{}
+		a.Unmarshal(data)
+		rf.HandleRequestVote(a, r)
+		data, _ = r.Marshal()
+	case "Raft.HandleInstallSnapshot":
+		a, r := &InstallSnapshotArgs{}, &InstallSnapshotReply{}
+		a.Unmarshal(data)
+		rf.HandleInstallSnapshot(a, r)
+		data, _ = r.Marshal()
+	default:
+		return false
+	}
+	return reply.(protoMessage).Unmarshal(data) == nil
+}
+
+func TestCustomPeers2B(t *testing.T) {
+	const n = 3
+	lp := &localPeers{rafts: make([]*Raft, n)}
+	applyChs := make([]chan ApplyMsg, n)
+	lp.mu.Lock()
+	for i := 0; i < n; i++ {
+		applyChs[i] = make(chan ApplyMsg, 100)
+		lp.rafts[i] = MakeWithPeers(lp, i, MakePersister(), applyChs[i])
+	}
+	lp.mu.Unlock()
+	defer func() {
+		for _, rf := range lp.rafts {
+			rf.Kill()
+		}
+	}()
+
+	fmt.Printf("Test (2B): agreement over a custom Peers ...\n")
+
+	index := -1
+	for deadline := time.Now().Add(5 * time.Second); index == -1; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no leader took the command")
+		}
+		for _, rf := range lp.rafts {
+			if i, _, isLeader := rf.Start(100); isLeader {
+				index = i
+				break
+			}
+		}
+	}
+	for i, ch := range applyChs {
+		for applied := false; !applied; {
+			select {
+			case msg := <-ch:
+				if msg.CommandValid && msg.CommandIndex == index {
+					if msg.Command != 100 {
+						t.Fatalf("peer %v applied %v at %v, expected 100", i, msg.Command, index)
+					}
+					applied = true
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("peer %v didn't apply index %v", i, index)
+			}
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestArchive2D(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, true)
+	defer cfg.cleanup()
+
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	archiver := &DirArchiver{Dir: dir}
+
+	cfg.begin("Test (2D): archive compacted log segments")
+
+	// a follower that falls behind would skip entries by installing the
+	// leader's snapshot
+	cfg.rafts[cfg.checkOneLeader()].SetArchiver(archiver)
+
+	cmds := make(map[int]int)
+	for i := 0; i < 3*SnapShotInterval; i++ {
+		cmd := rand.Int()
+		cmds[cfg.one(cmd, servers, true)] = cmd
+	}
+	time.Sleep(RaftElectionTimeout / 2)
+
+	index, _, data, err := ArchivedSnapshot(archiver, 1<<30)
+	if err != nil || len(data) == 0 || index < SnapShotInterval {
+		t.Fatalf("no archived snapshot: index %v, %v", index, err)
+	}
+	entries, err := ArchivedEntries(archiver, 1, index)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, entry := range entries {
+		if cmd, ok := cmds[entry.Index]; ok && entry.Command != cmd {
+			t.Fatalf("archived entry %v holds %v, expected %v", entry.Index, entry.Command, cmd)
+		}
+	}
+	if len(entries) != index {
+		t.Fatalf("expected %v archived entries, got %v", index, len(entries))
+	}
+
+	cfg.end()
+}
+
+func TestArchiveFollower2D(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, true)
+	defer cfg.cleanup()
+
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	archiver := &DirArchiver{Dir: dir}
+
+	cfg.begin("Test (2D): archive of a follower that installs a snapshot")
+
+	cmds := make(map[int]int)
+	for i := 0; i < SnapShotInterval/2; i++ {
+		cmd := rand.Int()
+		cmds[cfg.one(cmd, servers, true)] = cmd
+	}
+	before := len(cmds)
+
+	// the follower misses entries the leader compacts meanwhile
+	follower := (cfg.checkOneLeader() + 1) % servers
+	cfg.rafts[follower].SetArchiver(archiver)
+	cfg.disconnect(follower)
+	for i := 0; i < 3*SnapShotInterval; i++ {
+		cfg.one(rand.Int(), servers-1, true)
+	}
+	cfg.connect(follower)
+	for i := 0; i < 2*SnapShotInterval; i++ {
+		cfg.one(rand.Int(), servers, true)
+	}
+	time.Sleep(RaftElectionTimeout / 2)
+
+	names, err := archiver.List()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	installed := -1
+	for _, name := range names {
+		var i, term int
+		if n, _ := fmt.Sscanf(name, "snapshot-%d-%d", &i, &term); n == 2 && i > before && (installed == -1 || i < installed) {
+			installed = i
+		}
+	}
+	if installed <= before+SnapShotInterval {
+		t.Fatalf("no installed snapshot archived: %v", names)
+	}
+
+	// what it had committed is there, then a gap up to the snapshot
+	entries, err := ArchivedEntries(archiver, 1, before)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, entry := range entries {
+		if entry.Command != cmds[entry.Index] {
+			t.Fatalf("archived entry %v holds %v, expected %v", entry.Index, entry.Command, cmds[entry.Index])
+		}
+	}
+	if _, err := ArchivedEntries(archiver, before+1, installed); err == nil {
+		t.Fatalf("follower archived entries %v-%v it never had", before+1, installed)
+	}
+
+	// caught up, it archives entries after the snapshot again
+	if _, err := ArchivedEntries(archiver, installed+1, installed+1); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cfg.end()
+}
+
+func TestPersisterBacklog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persister")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	ps, err := MakeFilePersister(PersisterConfig{
+		Dir:             dir,
+		Durability:      DurabilityBatched,
+		SyncInterval:    100 * time.Millisecond,
+		MaxPendingSyncs: 2,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer ps.Close()
+
+	for i := 0; i < 3; i++ {
+		ps.SaveRaftState([]byte("state"))
+	}
+	if !ps.Backlogged() {
+		t.Fatalf("3 unsynced writes don't exceed a limit of 2")
+	}
+	start := time.Now()
+	ps.WaitBacklog()
+	if ps.Backlogged() || time.Since(start) > time.Second {
+		t.Fatalf("backlog not drained by the syncer")
+	}
+}
+
+func TestWaitApplied2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): waiting for entries to be applied")
+
+	index := cfg.one(101, servers, false)
+	for i := 0; i < servers; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), RaftElectionTimeout)
+		if err := cfg.rafts[i].WaitApplied(ctx, index); err != nil {
+			t.Fatalf("peer %v: %v", i, err)
+		}
+		cancel()
+	}
+
+	leader := cfg.checkOneLeader()
+	behind := (leader + 1) % servers
+	cfg.disconnect(behind)
+	index = cfg.one(102, servers-1, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if err := cfg.rafts[behind].WaitApplied(ctx, index); err != context.DeadlineExceeded {
+		t.Fatalf("disconnected peer waited with %v", err)
+	}
+	cancel()
+
+	cfg.connect(behind)
+	ctx, cancel = context.WithTimeout(context.Background(), 2*RaftElectionTimeout)
+	defer cancel()
+	if err := cfg.rafts[behind].WaitApplied(ctx, index); err != nil {
+		t.Fatalf("reconnected peer: %v", err)
+	}
+
+	cfg.end()
+}
+
+func TestReorderedDuplicated2C(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2C): agreement despite reordered and duplicated RPCs")
+
+	// requests overtake each other and are delivered twice, so stale
+	// AppendEntries arrive after newer ones
+	cfg.setlinks(labrpc.LinkOptions{
+		Latency:   labrpc.UniformLatency(0, 25*time.Millisecond),
+		Duplicate: 0.2,
+	})
+
+	crashed := 0
+	for iters := 0; iters < 10; iters++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				cfg.one(100*iters+i, servers-1, true)
+			}(i)
+		}
+		wg.Wait()
+		if iters == 3 {
+			crashed = (cfg.checkOneLeader() + 1) % servers
+			cfg.crash1(crashed)
+		}
+		if iters == 6 {
+			cfg.start1(crashed, cfg.applier)
+			cfg.connect(crashed)
+		}
+	}
+	cfg.one(1000, servers, true)
+
+	cfg.end()
+}
+
+func TestAsymmetricPartition2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): agreement with a follower that can't be heard")
+
+	cfg.one(101, servers, false)
+
+	// a follower that hears the others but can't reach them, on a slow
+	// link: the leader and the other follower go on without it
+	leader := cfg.checkOneLeader()
+	mute := (leader + 1) % servers
+	for i := 0; i < servers; i++ {
+		if i != mute {
+			cfg.setpath(mute, i, labrpc.Path{Down: true})
+			cfg.setpath(i, mute, labrpc.Path{Bandwidth: 20000})
+		}
+	}
+	for i := 0; i < 5; i++ {
+		cfg.one(102+i, servers-1, true)
+	}
+	time.Sleep(RaftElectionTimeout)
+	if leader1 := cfg.checkOneLeader(); leader1 == mute {
+		t.Fatalf("a peer that can't be heard became leader")
+	}
+
+	// once it's heard again, it catches up
+	for i := 0; i < servers; i++ {
+		cfg.setpath(mute, i, labrpc.Path{})
+		cfg.setpath(i, mute, labrpc.Path{})
+	}
+	cfg.one(110, servers, true)
+
+	cfg.end()
+}
+
+func TestLiveness2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): peers track each other's liveness")
+
+	cfg.one(101, servers, false)
+
+	// the leader hears from its followers with every heartbeat
+	leader := cfg.checkOneLeader()
+	for peer, l := range cfg.rafts[leader].Status().Liveness {
+		if peer != leader && (!l.Alive || l.Latency <= 0 || l.Failures != 0) {
+			t.Fatalf("follower %v looks down to leader: %+v", peer, l)
+		}
+	}
+	if target := cfg.rafts[leader].TransferTarget(); target == leader || target == -1 {
+		t.Fatalf("transfer target %v", target)
+	}
+
+	// a follower can ask the leader
+	follower := (leader + 1) % servers
+	reply, ok := cfg.rafts[follower].Ping(leader)
+	if !ok || reply.Leader != leader {
+		t.Fatalf("ping of leader %v: %+v, %v", leader, reply, ok)
+	}
+	if !cfg.rafts[follower].Status().Liveness[leader].Alive {
+		t.Fatalf("leader looks down to follower after answering its ping")
+	}
+	if target := cfg.rafts[follower].TransferTarget(); target != -1 {
+		t.Fatalf("follower has transfer target %v", target)
+	}
+
+	// a follower that's gone isn't handed leadership
+	cfg.disconnect(follower)
+	time.Sleep(RaftElectionTimeout)
+	if cfg.rafts[leader].Status().Liveness[follower].Alive {
+		t.Fatalf("disconnected follower looks alive")
+	}
+	other := (leader + 2) % servers
+	if target := cfg.rafts[leader].TransferTarget(); target != other {
+		t.Fatalf("transfer target %v, expected %v", target, other)
+	}
+
+	cfg.connect(follower)
+	cfg.one(102, servers, true)
+
+	cfg.end()
+}
+
+func TestCommitRule2B(t *testing.T) {
+	lp := &localPeers{rafts: make([]*Raft, 3)}
+	applyCh := make(chan ApplyMsg, 100)
+	rf := MakeWithPeers(lp, 1, MakePersister(), applyCh)
+	defer rf.Kill()
+
+	fmt.Printf("Test (2B): followers commit only entries known to match the leader ...\n")
+
+	// entries 1-5 from a leader of term 10, none of them committed yet
+	entries := make([]Entry, 5)
+	for i := range entries {
+		entries[i] = Entry{Index: i + 1, Term: 10, Command: 100 + i}
+	}
+	reply := &AppendEntriesReply{}
+	rf.HandleAppendEntries(&AppendEntriesArgs{Term: 10, LeaderId: 0, Entries: entries}, reply)
+	if !reply.Success {
+		t.Fatalf("append of entries 1-5 failed")
+	}
+
+	// the next leader shares only 1-3 and commits past them, sending just
+	// entry 3: 4 and 5 here aren't checked against its log, so they must
+	// not commit
+	reply = &AppendEntriesReply{}
+	rf.HandleAppendEntries(&AppendEntriesArgs{Term: 11, LeaderId: 2, PrevLogIndex: 2, PrevLogTerm: 10,
+		Entries: entries[2:3], LeaderCommit: 5}, reply)
+	if !reply.Success {
+		t.Fatalf("append of entry 3 failed")
+	}
+	rf.mu.RLock()
+	commitIndex := rf.commitIndex
+	rf.mu.RUnlock()
+	if commitIndex != 3 {
+		t.Fatalf("commitIndex %v, expected 3", commitIndex)
+	}
+	for i := 1; i <= 3; i++ {
+		select {
+		case msg := <-applyCh:
+			if !msg.CommandValid || msg.CommandIndex != i || msg.Command != 99+i {
+				t.Fatalf("applied %+v, expected %v at %v", msg, 99+i, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("index %v wasn't applied", i)
+		}
+	}
+	select {
+	case msg := <-applyCh:
+		t.Fatalf("applied %+v past the last entry known to match", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestCatchUpManyEntries2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): catch up a follower more entries behind than one AppendEntries carries")
+
+	cfg.one(101, servers, true)
+
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % servers
+	cfg.disconnect(follower)
+
+	term, _ := cfg.rafts[leader].GetState()
+	last := -1
+	for i := 0; i < 3*maxEntriesPerAppend+10; i++ {
+		index, _, ok := cfg.rafts[leader].Start(1000 + i)
+		if !ok {
+			t.Fatalf("leader %v lost leadership", leader)
+		}
+		last = index
+	}
+	cfg.wait(last, servers-1, term)
+
+	// the follower takes the entries it missed in several rounds
+	cfg.connect(follower)
+	cfg.one(102, servers, true)
+	if nd, _ := cfg.nCommitted(last); nd != servers {
+		t.Fatalf("only %v servers committed index %v", nd, last)
+	}
+
+	cfg.end()
+}
+
+func TestPersistedLog2C(t *testing.T) {
+	fmt.Printf("Test (2C): the log persisted an entry at a time reads back whole ...\n")
+
+	rf := &Raft{currentTerm: 4, votedFor: 1, raftLog: newLogs()}
+	check := func(what string) {
+		restored := &Raft{raftLog: newLogs()}
+		restored.readPersist(rf.SaveState())
+		if restored.currentTerm != 4 || restored.votedFor != 1 ||
+			!reflect.DeepEqual(restored.raftLog.getLogs(), rf.raftLog.getLogs()) {
+			t.Fatalf("%v: read back %v, want %v", what, restored.raftLog.getLogs(), rf.raftLog.getLogs())
+		}
+	}
+	for i := 1; i <= 5; i++ {
+		rf.raftLog.append(Entry{Index: i, Term: 1, Command: 100 + i})
+		check("append")
+	}
+	// cut into what's encoded already, and replaced
+	rf.raftLog.trunc(3)
+	rf.raftLog.append(Entry{Index: 3, Term: 2, Command: "x"}, Entry{Index: 4, Term: 2})
+	check("truncation")
+	// compacted, as by a snapshot
+	rf.raftLog.setLogs(rf.raftLog.sliceFrom(2))
+	rf.raftLog.clearDummyEntryCommand()
+	check("compaction")
+	rf.raftLog.append(Entry{Index: 5, Term: 3, Command: 105})
+	check("append after compaction")
+
+	// as saved before version 2, the log in one message
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(4)
+	e.Encode(1)
+	e.Encode(rf.raftLog.getLogs())
+	restored := &Raft{raftLog: newLogs()}
+	restored.readPersist(AddFormatVersion(1, w.Bytes()))
+	if !reflect.DeepEqual(restored.raftLog.getLogs(), rf.raftLog.getLogs()) {
+		t.Fatalf("version 1: read back %v, want %v", restored.raftLog.getLogs(), rf.raftLog.getLogs())
+	}
+	fmt.Printf("  ... Passed\n")
+}
@@ -8,7 +8,7 @@ import (
 // for testing, crash a server
 func (rf *Raft) Kill() {
 	atomic.StoreInt32(&rf.dead, 1)
-	for peer := range rf.peers {
+	for peer := 0; peer < rf.peers.Count(); peer++ {
 		if peer == rf.me {
 			continue
 		}
@@ -16,6 +16,17 @@ func (rf *Raft) Kill() {
 		rf.tryAppendCond[peer].Signal()
 	}
 	rf.applyCond.Signal()
+	rf.mu.RLock()
+	if rf.archive != nil {
+		rf.archive.mu.Lock()
+		rf.archive.cond.Signal()
+		rf.archive.mu.Unlock()
+	}
+	rf.mu.RUnlock()
+	rf.mu.Lock()
+	rf.appliedCond.Broadcast()
+	rf.rpcCancel()
+	rf.mu.Unlock()
 }
 
 func (rf *Raft) killed() bool {
@@ -26,14 +37,7 @@ func (rf *Raft) killed() bool {
 func (rf *Raft) GetState2() (int, string) {
 	rf.mu.Lock()
 	Term := rf.currentTerm
-	var State string
-	if rf.state == StateFollower {
-		State = "Follower"
-	} else if rf.state == StateCandidate {
-		State = "Candidate"
-	} else {
-		State = "Leader"
-	}
+	State := stateName(rf.state)
 	rf.mu.Unlock()
 	return Term, State
 }
@@ -9,14 +9,15 @@ import (
 	"math/big"
 	"time"
 
-	"raft/labrpc"
+	"raft/transport"
 )
 
 type Clerk struct {
-	servers []*labrpc.ClientEnd
+	servers []transport.Endpoint
 	// Your data here.
 	id        int64
 	CommandId uint64
+	leaderId  int // the server that last answered, tried first
 }
 
 func nrand() int64 {
@@ -26,7 +27,7 @@ func nrand() int64 {
 	return x
 }
 
-func MakeClerk(servers []*labrpc.ClientEnd) *Clerk {
+func MakeClerk(servers []transport.Endpoint) *Clerk {
 	ck := new(Clerk)
 	ck.servers = servers
 	// Your code here.
@@ -50,11 +51,13 @@ func (ck *Clerk) Command(num int, servers map[int][]string, gids []int, shard in
 	args.GID = gid
 	args.Type = commandType
 	for {
-		// try each known server.
-		for _, srv := range ck.servers {
+		// try each known server, the last leader first.
+		for i := range ck.servers {
+			server := (ck.leaderId + i) % len(ck.servers)
 			var reply CommandReply
-			ok := srv.Call("ShardCtrler.Command", args, &reply)
+			ok := ck.servers[server].Call("ShardCtrler.Command", args, &reply)
 			if ok && !reply.WrongLeader {
+				ck.leaderId = server
 				return reply.Config
 			}
 		}
@@ -5,8 +5,8 @@ import (
 	"time"
 
 	"raft/labgob"
-	"raft/labrpc"
 	"raft/raft"
+	"raft/transport"
 )
 
 type OpType string
@@ -161,7 +161,7 @@ func (sc *ShardCtrler) listenApplyCh() {
 	}
 }
 
-func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister) *ShardCtrler {
+func StartServer(servers []transport.Endpoint, me int, persister *raft.Persister) *ShardCtrler {
 	sc := new(ShardCtrler)
 	sc.me = me
 
@@ -8,11 +8,10 @@ package shardkv
 // talks to the group that holds the key's shard.
 //
 
-import "raft/labrpc"
+import "raft/transport"
 import "crypto/rand"
 import "math/big"
 import "raft/shardctrler"
-import "time"
 
 //
 // which shard is a key in?
@@ -38,8 +37,10 @@ func nrand() int64 {
 type Clerk struct {
 	sm       *shardctrler.Clerk
 	config   shardctrler.Config
-	make_end func(string) *labrpc.ClientEnd
+	make_end func(string) transport.Endpoint
 	// You will have to modify this struct.
+	leaders map[int]int                  // of each group, the server that last answered, tried first
+	ends    map[string]transport.Endpoint // by server name, see router.go
 }
 
 //
@@ -48,14 +49,16 @@ type Clerk struct {
 // ctrlers[] is needed to call shardctrler.MakeClerk().
 //
 // make_end(servername) turns a server name from a
-// Config.Groups[gid][i] into a labrpc.ClientEnd on which you can
+// Config.Groups[gid][i] into a transport.Endpoint on which you can
 // send RPCs.
 //
-func MakeClerk(ctrlers []*labrpc.ClientEnd, make_end func(string) *labrpc.ClientEnd) *Clerk {
+func MakeClerk(ctrlers []transport.Endpoint, make_end func(string) transport.Endpoint) *Clerk {
 	ck := new(Clerk)
 	ck.sm = shardctrler.MakeClerk(ctrlers)
 	ck.make_end = make_end
 	// You'll have to add code here.
+	ck.leaders = make(map[int]int)
+	ck.ends = make(map[string]transport.Endpoint)
 	return ck
 }
 
@@ -63,41 +66,25 @@ func MakeClerk(ctrlers []*labrpc.ClientEnd, make_end func(string) *labrpc.Client
 // fetch the current value for a key.
 // returns "" if the key does not exist.
 // keeps trying forever in the face of all other errors.
-// You will have to modify this function.
 //
 func (ck *Clerk) Get(key string) string {
 	args := GetArgs{}
 	args.Key = key
 
-	for {
-		shard := key2shard(key)
-		gid := ck.config.Shards[shard]
-		if servers, ok := ck.config.Groups[gid]; ok {
-			// try each server for the shard.
-			for si := 0; si < len(servers); si++ {
-				srv := ck.make_end(servers[si])
-				var reply GetReply
-				ok := srv.Call("ShardKV.Get", &args, &reply)
-				if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
-					return reply.Value
-				}
-				if ok && (reply.Err == ErrWrongGroup) {
-					break
-				}
-				// ... not ok, or ErrWrongLeader
-			}
+	var value string
+	ck.route(key, func(srv transport.Endpoint) Err {
+		var reply GetReply
+		if !srv.Call("ShardKV.Get", &args, &reply) {
+			return ""
 		}
-		time.Sleep(100 * time.Millisecond)
-		// ask controler for the latest configuration.
-		ck.config = ck.sm.Query(-1)
-	}
-
-	return ""
+		value = reply.Value
+		return reply.Err
+	})
+	return value
 }
 
 //
 // shared by Put and Append.
-// You will have to modify this function.
 //
 func (ck *Clerk) PutAppend(key string, value string, op string) {
 	args := PutAppendArgs{}
@@ -105,27 +92,13 @@ func (ck *Clerk) PutAppend(key string, value string, op string) {
 	args.Value = value
 	args.Op = op
 
-	for {
-		shard := key2shard(key)
-		gid := ck.config.Shards[shard]
-		if servers, ok := ck.config.Groups[gid]; ok {
-			for si := 0; si < len(servers); si++ {
-				srv := ck.make_end(servers[si])
-				var reply PutAppendReply
-				ok := srv.Call("ShardKV.PutAppend", &args, &reply)
-				if ok && reply.Err == OK {
-					return
-				}
-				if ok && reply.Err == ErrWrongGroup {
-					break
-				}
-				// ... not ok, or ErrWrongLeader
-			}
+	ck.route(key, func(srv transport.Endpoint) Err {
+		var reply PutAppendReply
+		if !srv.Call("ShardKV.PutAppend", &args, &reply) {
+			return ""
 		}
-		time.Sleep(100 * time.Millisecond)
-		// ask controler for the latest configuration.
-		ck.config = ck.sm.Query(-1)
-	}
+		return reply.Err
+	})
 }
 
 func (ck *Clerk) Put(key string, value string) {
@@ -2,6 +2,7 @@ package shardkv
 
 import "raft/shardctrler"
 import "raft/labrpc"
+import "raft/transport"
 import "testing"
 import "os"
 
@@ -32,8 +33,8 @@ func makeSeed() int64 {
 }
 
 // Randomize server handles
-func random_handles(kvh []*labrpc.ClientEnd) []*labrpc.ClientEnd {
-	sa := make([]*labrpc.ClientEnd, len(kvh))
+func random_handles(kvh []transport.Endpoint) []transport.Endpoint {
+	sa := make([]transport.Endpoint, len(kvh))
 	copy(sa, kvh)
 	for i := range sa {
 		j := rand.Intn(i + 1)
@@ -120,7 +121,7 @@ func (cfg *config) makeClient() *Clerk {
 	defer cfg.mu.Unlock()
 
 	// ClientEnds to talk to controler service.
-	ends := make([]*labrpc.ClientEnd, cfg.nctrlers)
+	ends := make([]transport.Endpoint, cfg.nctrlers)
 	endnames := make([]string, cfg.n)
 	for j := 0; j < cfg.nctrlers; j++ {
 		endnames[j] = randstring(20)
@@ -129,7 +130,7 @@ func (cfg *config) makeClient() *Clerk {
 		cfg.net.Enable(endnames[j], true)
 	}
 
-	ck := MakeClerk(ends, func(servername string) *labrpc.ClientEnd {
+	ck := MakeClerk(ends, func(servername string) transport.Endpoint {
 		name := randstring(20)
 		end := cfg.net.MakeEnd(name)
 		cfg.net.Connect(name, servername)
@@ -214,7 +215,7 @@ func (cfg *config) StartServer(gi int, i int) {
 	}
 
 	// and the connections to other servers in this group.
-	ends := make([]*labrpc.ClientEnd, cfg.n)
+	ends := make([]transport.Endpoint, cfg.n)
 	for j := 0; j < cfg.n; j++ {
 		ends[j] = cfg.net.MakeEnd(gg.endnames[i][j])
 		cfg.net.Connect(gg.endnames[i][j], cfg.servername(gg.gid, j))
@@ -222,7 +223,7 @@ func (cfg *config) StartServer(gi int, i int) {
 	}
 
 	// ends to talk to shardctrler service
-	mends := make([]*labrpc.ClientEnd, cfg.nctrlers)
+	mends := make([]transport.Endpoint, cfg.nctrlers)
 	gg.mendnames[i] = make([]string, cfg.nctrlers)
 	for j := 0; j < cfg.nctrlers; j++ {
 		gg.mendnames[i][j] = randstring(20)
@@ -245,7 +246,7 @@ func (cfg *config) StartServer(gi int, i int) {
 
 	gg.servers[i] = StartServer(ends, i, gg.saved[i], cfg.maxraftstate,
 		gg.gid, mends,
-		func(servername string) *labrpc.ClientEnd {
+		func(servername string) transport.Endpoint {
 			name := randstring(20)
 			end := cfg.net.MakeEnd(name)
 			cfg.net.Connect(name, servername)
@@ -269,7 +270,7 @@ func (cfg *config) StartGroup(gi int) {
 
 func (cfg *config) StartCtrlerserver(i int) {
 	// ClientEnds to talk to other controler replicas.
-	ends := make([]*labrpc.ClientEnd, cfg.nctrlers)
+	ends := make([]transport.Endpoint, cfg.nctrlers)
 	for j := 0; j < cfg.nctrlers; j++ {
 		endname := randstring(20)
 		ends[j] = cfg.net.MakeEnd(endname)
@@ -291,7 +292,7 @@ func (cfg *config) StartCtrlerserver(i int) {
 
 func (cfg *config) shardclerk() *shardctrler.Clerk {
 	// ClientEnds to talk to ctrler service.
-	ends := make([]*labrpc.ClientEnd, cfg.nctrlers)
+	ends := make([]transport.Endpoint, cfg.nctrlers)
 	for j := 0; j < cfg.nctrlers; j++ {
 		name := randstring(20)
 		ends[j] = cfg.net.MakeEnd(name)
@@ -0,0 +1,67 @@
+package shardkv
+
+import (
+	"time"
+
+	"raft/transport"
+)
+
+//
+// the clerk routes each command to the group serving its key's shard in
+// the configuration it last fetched, so callers see a single key/value
+// store however the shards are spread. the configuration is only fetched
+// again when a group answers ErrWrongGroup or none of its servers do, and
+// the ends made for server names are kept across commands and
+// configurations.
+//
+
+// how long to wait before asking the shardctrler again, when the latest
+// configuration is the one that just failed
+const refreshBackoff = 100 * time.Millisecond
+
+// the end for a server name, made on first use
+func (ck *Clerk) end(server string) transport.Endpoint {
+	if end, ok := ck.ends[server]; ok {
+		return end
+	}
+	end := ck.make_end(server)
+	ck.ends[server] = end
+	return end
+}
+
+// fetch the latest configuration, reporting whether it's newer than the
+// one the clerk had
+func (ck *Clerk) refresh() bool {
+	config := ck.sm.Query(-1)
+	newer := config.Num > ck.config.Num
+	ck.config = config
+	return newer
+}
+
+// call send on the servers of the group serving key, the last leader first,
+// until one answers OK or ErrNoKey. send returns the reply's Err, "" if
+// there was none.
+func (ck *Clerk) route(key string, send func(srv transport.Endpoint) Err) {
+	for {
+		gid := ck.config.Shards[key2shard(key)]
+		if servers, ok := ck.config.Groups[gid]; ok {
+			for i := 0; i < len(servers); i++ {
+				si := (ck.leaders[gid] + i) % len(servers)
+				err := send(ck.end(servers[si]))
+				if err == OK || err == ErrNoKey {
+					ck.leaders[gid] = si
+					return
+				}
+				if err == ErrWrongGroup {
+					break
+				}
+				// ... not ok, or ErrWrongLeader
+			}
+		}
+		if !ck.refresh() {
+			// the shards may be moving, give the shardctrler and the
+			// groups time to catch up
+			time.Sleep(refreshBackoff)
+		}
+	}
+}
@@ -2,7 +2,7 @@ package shardkv
 
 import (
 	"raft/labgob"
-	"raft/labrpc"
+	"raft/transport"
 	"raft/raft"
 	"raft/shardctrler"
 	"sync"
@@ -19,9 +19,9 @@ type ShardKV struct {
 	me           int
 	rf           *raft.Raft
 	applyCh      chan raft.ApplyMsg
-	make_end     func(string) *labrpc.ClientEnd
+	make_end     func(string) transport.Endpoint
 	gid          int
-	ctrlers      []*labrpc.ClientEnd
+	ctrlers      []transport.Endpoint
 	maxraftstate int // snapshot if log grows this big
 	// Your definitions here.
 	ctrlerClient *shardctrler.Clerk
@@ -65,7 +65,7 @@ func (kv *ShardKV) Kill() {
 // RPCs to the shardctrler.
 //
 // make_end(servername) turns a server name from a
-// Config.Groups[gid][i] into a labrpc.ClientEnd on which you can
+// Config.Groups[gid][i] into a transport.Endpoint on which you can
 // send RPCs. You'll need this to send RPCs to other groups.
 //
 // look at client.go for examples of how to use ctrlers[]
@@ -74,7 +74,7 @@ func (kv *ShardKV) Kill() {
 // StartServer() must return quickly, so it should start goroutines
 // for any long-running work.
 //
-func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister, maxraftstate int, gid int, ctrlers []*labrpc.ClientEnd, make_end func(string) *labrpc.ClientEnd) *ShardKV {
+func StartServer(servers []transport.Endpoint, me int, persister *raft.Persister, maxraftstate int, gid int, ctrlers []transport.Endpoint, make_end func(string) transport.Endpoint) *ShardKV {
 	// call labgob.Register on structures you want
 	// Go's RPC library to marshall/unmarshall.
 	labgob.Register(Op{})
@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// with batching on, the frames a connection sends are held for up to the
+// batching interval and go out together in one write: a node's heartbeats
+// and acks for many groups to the same peer then cost one syscall and a
+// few packets rather than one each. it delays every call by up to the
+// interval, so it pays off with many groups and little else.
+//
+
+// hold frames for up to interval before writing them out, 0 to write each
+// at once. applies to connections made from now on.
+func (t *TCPTransport) SetBatching(interval time.Duration) {
+	atomic.StoreInt64(&t.batching, int64(interval))
+}
+
+// writes frames to a connection, batched every interval
+type frameWriter struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	w        *bufio.Writer
+	interval time.Duration
+	pending  bool // a flush is scheduled
+	t        *TCPTransport
+}
+
+// the buffer frames are held in, written out early if it fills
+const batchBuffer = 64 << 10
+
+func (t *TCPTransport) newFrameWriter(conn net.Conn) *frameWriter {
+	fw := &frameWriter{conn: conn, interval: time.Duration(atomic.LoadInt64(&t.batching)), t: t}
+	if fw.interval == 0 {
+		fw.w = bufio.NewWriter(conn)
+	} else {
+		fw.w = bufio.NewWriterSize(conn, batchBuffer)
+	}
+	return fw
+}
+
+func (fw *frameWriter) write(frame []byte) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	atomic.AddInt64(&fw.t.sent, int64(len(frame)))
+	if fw.interval == 0 {
+		atomic.AddInt64(&fw.t.writes, 1)
+		return writeFrame(fw.w, frame)
+	}
+	if err := appendFrame(fw.w, frame); err != nil {
+		return err
+	}
+	if !fw.pending {
+		fw.pending = true
+		time.AfterFunc(fw.interval, fw.flush)
+	}
+	return nil
+}
+
+// write out the frames held, closing the connection if that fails so that
+// its reader fails the calls waiting on it
+func (fw *frameWriter) flush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.pending = false
+	atomic.AddInt64(&fw.t.writes, 1)
+	if fw.w.Flush() != nil {
+		fw.conn.Close()
+	}
+}
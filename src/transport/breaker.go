@@ -0,0 +1,76 @@
+package transport
+
+import "time"
+
+//
+// a TCP endpoint that can't connect to its node waits before dialing again,
+// twice as long after each failed dial up to breakerMaxBackoff, and fails
+// calls at once in the meantime rather than have each wait on a dial of a
+// node known to be down. the first dial that gets through closes the
+// circuit again. a call whose request can't be written to a broken
+// connection is retried once on a new one.
+//
+
+const (
+	breakerBackoff    = 20 * time.Millisecond
+	breakerMaxBackoff = time.Second
+)
+
+// what an endpoint knows of its connection, for operators
+type EndpointStatus struct {
+	Id        string // if dialed with DialNode
+	Addr      string // as last resolved, if dialed with DialNode
+	Connected bool
+	Open      bool          // calls fail at once, the node couldn't be reached
+	Failures  int           // dials failed in a row
+	RetryIn   time.Duration // until the next dial, if Open
+	// the node's protocol version and features as of the last handshake,
+	// see version.go
+	Version  int
+	Features []string
+}
+
+// an Endpoint that reports on its connection
+type StatusEndpoint interface {
+	Endpoint
+	Status() EndpointStatus
+}
+
+type breaker struct {
+	failures int
+	retryAt  time.Time
+}
+
+func (b *breaker) allow() bool {
+	return !time.Now().Before(b.retryAt)
+}
+
+func (b *breaker) failed() {
+	backoff := breakerMaxBackoff
+	if b.failures < 16 && breakerBackoff<<b.failures < breakerMaxBackoff {
+		backoff = breakerBackoff << b.failures
+	}
+	b.failures++
+	b.retryAt = time.Now().Add(backoff)
+}
+
+func (b *breaker) succeeded() {
+	*b = breaker{}
+}
+
+func (g *groupEndpoint) Status() EndpointStatus {
+	return g.peer.status()
+}
+
+func (e *tcpEndpoint) status() EndpointStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	status := EndpointStatus{Id: e.id, Addr: e.addr, Connected: e.conn != nil, Failures: e.breaker.failures}
+	if e.hello != nil {
+		status.Version, status.Features = e.hello.Version, e.hello.Features
+	}
+	if wait := time.Until(e.breaker.retryAt); wait > 0 {
+		status.Open, status.RetryIn = true, wait
+	}
+	return status
+}
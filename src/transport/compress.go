@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+//
+// with compression on, arguments, replies and stream chunks of at least
+// the threshold's size are gzipped, for replication over links where
+// bandwidth is short: AppendEntries with many entries and snapshots shrink
+// several times over. each request says whether its sender takes
+// compressed replies, so a node compresses replies only for peers that
+// turned compression on themselves. what doesn't shrink is sent as it is.
+//
+
+// gzip payloads of threshold bytes or more, 0 to send all as they are.
+// receiving compressed payloads works either way.
+func (t *TCPTransport) SetCompression(threshold int) {
+	atomic.StoreInt64(&t.compression, int64(threshold))
+}
+
+func (t *TCPTransport) compressing() bool {
+	return atomic.LoadInt64(&t.compression) > 0
+}
+
+// data gzipped, if compression is on, data is big enough and it shrinks
+func (t *TCPTransport) compress(data []byte) ([]byte, bool) {
+	threshold := atomic.LoadInt64(&t.compression)
+	if threshold <= 0 || int64(len(data)) < threshold {
+		return data, false
+	}
+	b := new(bytes.Buffer)
+	zw := gzip.NewWriter(b)
+	zw.Write(data)
+	zw.Close()
+	if b.Len() >= len(data) {
+		return data, false
+	}
+	return b.Bytes(), true
+}
+
+func decompress(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(zr)
+}
@@ -0,0 +1,347 @@
+package transport
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"raft/protowire"
+)
+
+//
+// with gossip, nodes find each other's addresses and learn who is up
+// without a static list of peers. each round a node bumps its own
+// heartbeat and swaps the members it knows with a few others picked at
+// random, or with the seed addresses it was started with while it knows
+// no one: both keep the newer heartbeat of every member. a member whose
+// heartbeat stops going up is suspect after SuspectAfter and dead after
+// DeadAfter, each node judging for itself, and alive again once a newer
+// heartbeat reaches it.
+//
+// Gossip is a Resolver, so a transport set to resolve through it dials
+// nodes by id wherever they last said they were. Notify tells of members
+// joining, becoming suspect and dying, e.g. for a policy that removes dead
+// members from their groups.
+//
+// g := StartGossip(t, "n1", t.Addr(), []string{"10.0.0.7:7000"}, GossipConfig{})
+// t.SetResolver(g)
+//
+
+type MemberState int
+
+const (
+	MemberAlive MemberState = iota
+	MemberSuspect
+	MemberDead
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "Alive"
+	case MemberSuspect:
+		return "Suspect"
+	default:
+		return "Dead"
+	}
+}
+
+type Member struct {
+	Id   string
+	Addr string
+	// bumped by the member every round. it starts at the time the member
+	// started, so a node that restarts isn't taken for its old self.
+	Heartbeat uint64
+	State     MemberState // as this node judges it, not gossiped
+}
+
+type GossipConfig struct {
+	Interval     time.Duration // between rounds, 200ms if 0
+	Fanout       int           // members swapped with each round, 3 if 0
+	SuspectAfter time.Duration // without a newer heartbeat, 5 intervals if 0
+	DeadAfter    time.Duration // without a newer heartbeat, 15 intervals if 0
+}
+
+type Gossip struct {
+	mu      sync.Mutex
+	t       Transport
+	me      string
+	seeds   []string
+	config  GossipConfig
+	members map[string]*member
+	ends    map[string]Endpoint // by address
+	notify  []func(Member)
+	stop    chan struct{}
+	tellMu  sync.Mutex // held calling notify, never with mu
+}
+
+type member struct {
+	Member
+	updated time.Time // when the heartbeat last went up
+}
+
+// join the cluster as id at addr through t, gossiping in the background
+// until Stop. seeds are addresses of members to swap with until others are
+// known, none for the first node.
+func StartGossip(t Transport, id string, addr string, seeds []string, config GossipConfig) *Gossip {
+	if config.Interval == 0 {
+		config.Interval = 200 * time.Millisecond
+	}
+	if config.Fanout == 0 {
+		config.Fanout = 3
+	}
+	if config.SuspectAfter == 0 {
+		config.SuspectAfter = 5 * config.Interval
+	}
+	if config.DeadAfter == 0 {
+		config.DeadAfter = 15 * config.Interval
+	}
+	g := &Gossip{
+		t:       t,
+		me:      id,
+		seeds:   seeds,
+		config:  config,
+		members: make(map[string]*member),
+		ends:    make(map[string]Endpoint),
+		stop:    make(chan struct{}),
+	}
+	g.members[id] = &member{Member: Member{Id: id, Addr: addr, Heartbeat: uint64(time.Now().UnixNano())}, updated: time.Now()}
+	t.Register(g)
+	go g.run(g.stop)
+	return g
+}
+
+// stop gossiping: the others will find this node dead
+func (g *Gossip) Stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stop != nil {
+		close(g.stop)
+		g.stop = nil
+	}
+}
+
+// call fn with a member each time it joins or changes state, one call at a
+// time
+func (g *Gossip) Notify(fn func(Member)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.notify = append(g.notify, fn)
+}
+
+// the members known, this node among them
+func (g *Gossip) Members() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	members := make([]Member, 0, len(g.members))
+	for _, m := range g.members {
+		members = append(members, m.Member)
+	}
+	return members
+}
+
+// the address of a member that isn't dead
+func (g *Gossip) Resolve(id string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m, ok := g.members[id]
+	if !ok || m.State == MemberDead {
+		return "", ErrUnknownNode
+	}
+	return m.Addr, nil
+}
+
+type GossipArgs struct {
+	Members []Member
+}
+
+type GossipReply struct {
+	Members []Member
+}
+
+// swap members with another node
+func (g *Gossip) Exchange(args *GossipArgs, reply *GossipReply) {
+	g.merge(args.Members)
+	reply.Members = g.Members()
+}
+
+func (g *Gossip) run(stop chan struct{}) {
+	for {
+		select {
+		case <-time.After(g.config.Interval):
+		case <-stop:
+			return
+		}
+		g.round()
+	}
+}
+
+// bump the heartbeat, judge the others and swap with a few
+func (g *Gossip) round() {
+	g.mu.Lock()
+	g.members[g.me].Heartbeat++
+	var changed []Member
+	var addrs []string
+	for _, m := range g.members {
+		if m.Id == g.me {
+			continue
+		}
+		state := MemberAlive
+		if since := time.Since(m.updated); since >= g.config.DeadAfter {
+			state = MemberDead
+		} else if since >= g.config.SuspectAfter {
+			state = MemberSuspect
+		}
+		if state != m.State {
+			m.State = state
+			changed = append(changed, m.Member)
+		}
+		if state != MemberDead {
+			addrs = append(addrs, m.Addr)
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, g.seeds...)
+	}
+	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if len(addrs) > g.config.Fanout {
+		addrs = addrs[:g.config.Fanout]
+	}
+	ends := make([]Endpoint, len(addrs))
+	for i, addr := range addrs {
+		if g.ends[addr] == nil {
+			g.ends[addr] = g.t.Dial(addr)
+		}
+		ends[i] = g.ends[addr]
+	}
+	notify := g.notify
+	g.mu.Unlock()
+	g.tell(notify, changed)
+
+	args := GossipArgs{Members: g.Members()}
+	for _, end := range ends {
+		go func(end Endpoint) {
+			reply := GossipReply{}
+			if g.call(end, &args, &reply) {
+				g.merge(reply.Members)
+			}
+		}(end)
+	}
+}
+
+// an exchange that gives up after a round, if end can be cut short
+func (g *Gossip) call(end Endpoint, args *GossipArgs, reply *GossipReply) bool {
+	if end, ok := end.(ContextEndpoint); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), g.config.Interval)
+		defer cancel()
+		return end.CallContext(ctx, "Gossip.Exchange", args, reply)
+	}
+	return end.Call("Gossip.Exchange", args, reply)
+}
+
+// take the newer heartbeat of each member
+func (g *Gossip) merge(members []Member) {
+	g.mu.Lock()
+	var changed []Member
+	for _, in := range members {
+		if in.Id == g.me {
+			continue
+		}
+		m, ok := g.members[in.Id]
+		if ok && in.Heartbeat <= m.Heartbeat {
+			continue
+		}
+		if !ok {
+			m = &member{Member: Member{Id: in.Id}}
+			g.members[in.Id] = m
+		}
+		m.Addr, m.Heartbeat, m.updated = in.Addr, in.Heartbeat, time.Now()
+		if !ok || m.State != MemberAlive {
+			m.State = MemberAlive
+			changed = append(changed, m.Member)
+		}
+	}
+	notify := g.notify
+	g.mu.Unlock()
+	g.tell(notify, changed)
+}
+
+func (g *Gossip) tell(notify []func(Member), changed []Member) {
+	g.tellMu.Lock()
+	defer g.tellMu.Unlock()
+	for _, m := range changed {
+		for _, fn := range notify {
+			fn(m)
+		}
+	}
+}
+
+func (m *Member) Marshal() ([]byte, error) {
+	var b protowire.Buffer
+	b.String(1, m.Id)
+	b.String(2, m.Addr)
+	b.Uint64(3, m.Heartbeat)
+	return b.Data(), nil
+}
+
+func (m *Member) Unmarshal(data []byte) error {
+	*m = Member{}
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			m.Id = r.String()
+		case 2:
+			m.Addr = r.String()
+		case 3:
+			m.Heartbeat = r.Uint64()
+		}
+	}
+	return r.Err()
+}
+
+func marshalMembers(members []Member) []byte {
+	var b protowire.Buffer
+	for i := range members {
+		mb, _ := members[i].Marshal()
+		b.Element(1, mb)
+	}
+	return b.Data()
+}
+
+func unmarshalMembers(data []byte) ([]Member, error) {
+	var members []Member
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			var m Member
+			if err := m.Unmarshal(r.Bytes()); err != nil {
+				return nil, err
+			}
+			members = append(members, m)
+		}
+	}
+	return members, r.Err()
+}
+
+func (args *GossipArgs) Marshal() ([]byte, error) {
+	return marshalMembers(args.Members), nil
+}
+
+func (args *GossipArgs) Unmarshal(data []byte) error {
+	var err error
+	args.Members, err = unmarshalMembers(data)
+	return err
+}
+
+func (reply *GossipReply) Marshal() ([]byte, error) {
+	return marshalMembers(reply.Members), nil
+}
+
+func (reply *GossipReply) Unmarshal(data []byte) error {
+	var err error
+	reply.Members, err = unmarshalMembers(data)
+	return err
+}
@@ -0,0 +1,100 @@
+package transport
+
+import "context"
+
+//
+// interceptors wrap every call a node makes or serves, for what concerns
+// all RPCs alike: logging, metrics, auth tokens, fault injection. a
+// client interceptor sees the call before it's sent and the reply after,
+// and may fail it, change it or send it several times by calling next as
+// it sees fit. a server interceptor does the same around the handler,
+// with the arguments decoded; returning false fails the call as if the
+// method didn't exist. with several, the first one added is the
+// outermost. streams pass through them too, but not their payloads.
+//
+// interceptors pass values along with a call as metadata: a client
+// interceptor adds them to the ctx it calls next with, and the server's
+// interceptors find them in theirs.
+//
+// t.UseClient(func(ctx context.Context, svcMeth string, args, reply interface{}, next transport.Invoker) bool {
+//     return next(transport.WithMetadata(ctx, "token", token), svcMeth, args, reply)
+// })
+// t.UseServer(func(ctx context.Context, svcMeth string, args, reply interface{}, next transport.Handler) bool {
+//     return transport.Metadata(ctx)["token"] == token && next(ctx, svcMeth, args, reply)
+// })
+//
+
+// sends a call, true if reply holds the answer
+type Invoker func(ctx context.Context, svcMeth string, args interface{}, reply interface{}) bool
+
+// runs a call's handler, true if reply holds the answer
+type Handler func(ctx context.Context, svcMeth string, args interface{}, reply interface{}) bool
+
+type ClientInterceptor func(ctx context.Context, svcMeth string, args interface{}, reply interface{}, next Invoker) bool
+
+type ServerInterceptor func(ctx context.Context, svcMeth string, args interface{}, reply interface{}, next Handler) bool
+
+// invoker wrapped in interceptors, the first outermost
+func ChainClient(interceptors []ClientInterceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, svcMeth string, args interface{}, reply interface{}) bool {
+			return interceptor(ctx, svcMeth, args, reply, next)
+		}
+	}
+	return invoker
+}
+
+// handler wrapped in interceptors, the first outermost
+func ChainServer(interceptors []ServerInterceptor, handler Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, svcMeth string, args interface{}, reply interface{}) bool {
+			return interceptor(ctx, svcMeth, args, reply, next)
+		}
+	}
+	return handler
+}
+
+type metadataKey struct{}
+
+// ctx with key set to value in the metadata sent with a call
+func WithMetadata(ctx context.Context, key string, value string) context.Context {
+	md := make(map[string]string)
+	for k, v := range Metadata(ctx) {
+		md[k] = v
+	}
+	md[key] = value
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// the metadata in ctx, not to be modified
+func Metadata(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(metadataKey{}).(map[string]string)
+	return md
+}
+
+// a context holding md, as a server's interceptors get it
+func MetadataContext(md map[string]string) context.Context {
+	return context.WithValue(context.Background(), metadataKey{}, md)
+}
+
+// add interceptors around the calls made through the transport's endpoints
+func (t *TCPTransport) UseClient(interceptors ...ClientInterceptor) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clientInterceptors = append(t.clientInterceptors[:len(t.clientInterceptors):len(t.clientInterceptors)], interceptors...)
+}
+
+// add interceptors around the handlers of the transport's services
+func (t *TCPTransport) UseServer(interceptors ...ServerInterceptor) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.serverInterceptors = append(t.serverInterceptors[:len(t.serverInterceptors):len(t.serverInterceptors)], interceptors...)
+}
+
+func (t *TCPTransport) interceptors() ([]ClientInterceptor, []ServerInterceptor) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.clientInterceptors, t.serverInterceptors
+}
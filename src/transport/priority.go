@@ -0,0 +1,48 @@
+package transport
+
+//
+// a TCP endpoint keeps a second connection to its node, a priority lane,
+// for calls whose arguments say they're Urgent: raft's heartbeats and
+// votes. a call's frame goes out whole before the next one on its
+// connection, so an AppendEntries with many entries or a snapshot sent in
+// one message would hold up the heartbeats queued behind it, for long
+// enough on a slow link that followers time out and start elections. on a
+// lane of their own they go out at once. the lane is dialed on the first
+// urgent call, and has a circuit breaker of its own.
+//
+
+// arguments that are sent on the priority lane if Urgent says so
+type Prioritized interface {
+	Urgent() bool
+}
+
+func urgent(args interface{}) bool {
+	p, ok := args.(Prioritized)
+	return ok && p.Urgent()
+}
+
+// the endpoints for both lanes to the node at key, made if there are none
+// yet. caller must hold t.mu.
+func (t *TCPTransport) lanes(key peerKey) (*tcpEndpoint, *tcpEndpoint) {
+	key.urgent = false
+	peer := t.endpoint(key)
+	key.urgent = true
+	return peer, t.endpoint(key)
+}
+
+func (t *TCPTransport) endpoint(key peerKey) *tcpEndpoint {
+	e, ok := t.peers[key]
+	if !ok {
+		e = &tcpEndpoint{addr: key.addr, id: key.id, t: t, pending: make(map[uint64]chan *response)}
+		t.peers[key] = e
+	}
+	return e
+}
+
+// the endpoint to send args on
+func (g *groupEndpoint) lane(args interface{}) *tcpEndpoint {
+	if urgent(args) {
+		return g.urgent
+	}
+	return g.peer
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+//
+// a node dialed by id with DialNode is looked up in the transport's
+// Resolver at every dial, so when a node restarts on a new address its
+// peers reconnect as soon as the resolver knows it, without a restart of
+// their own. addresses given as host:port need no resolver: the host is
+// looked up in DNS at every dial anyway.
+//
+// StaticResolver holds the addresses in memory. they're set from code, read
+// from a file again with Load, e.g. on SIGHUP, or set by an operator over
+// RPC once the resolver is registered with a transport:
+//
+// t.Register(resolver)
+// end.Call("StaticResolver.SetAddress", &SetAddressArgs{Id: "n1", Addr: "10.0.0.7:7000"}, &reply)
+//
+
+// maps node ids to addresses
+type Resolver interface {
+	Resolve(id string) (string, error)
+}
+
+var ErrUnknownNode = errors.New("transport: unknown node")
+
+// a transport resolving ids of nodes dialed with DialNode through r
+func (t *TCPTransport) SetResolver(r Resolver) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resolver = r
+}
+
+// an endpoint for group at the node with id, wherever the resolver says it
+// is at the time
+func (t *TCPTransport) DialNode(id string, group int) Endpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peer, lane := t.lanes(peerKey{id: id})
+	return &groupEndpoint{peer: peer, urgent: lane, group: group}
+}
+
+func (t *TCPTransport) resolve(id string) (string, error) {
+	t.mu.Lock()
+	r := t.resolver
+	t.mu.Unlock()
+	if r == nil {
+		return "", ErrUnknownNode
+	}
+	return r.Resolve(id)
+}
+
+type StaticResolver struct {
+	mu    sync.Mutex
+	addrs map[string]string
+}
+
+func MakeStaticResolver(addrs map[string]string) *StaticResolver {
+	r := &StaticResolver{addrs: make(map[string]string)}
+	for id, addr := range addrs {
+		r.addrs[id] = addr
+	}
+	return r
+}
+
+func (r *StaticResolver) Resolve(id string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addr, ok := r.addrs[id]
+	if !ok {
+		return "", ErrUnknownNode
+	}
+	return addr, nil
+}
+
+// set the address of id, "" to forget it
+func (r *StaticResolver) Set(id string, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if addr == "" {
+		delete(r.addrs, id)
+	} else {
+		r.addrs[id] = addr
+	}
+}
+
+// replace the addresses with those in the file at path, a line "id addr"
+// for each node. blank lines and lines starting with # are skipped.
+func (r *StaticResolver) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	addrs := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("transport: %v:%v: expected id and address", path, line)
+		}
+		addrs[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs = addrs
+	return nil
+}
+
+type SetAddressArgs struct {
+	Id   string
+	Addr string // "" to forget the node
+}
+
+type SetAddressReply struct{}
+
+// Set, over RPC
+func (r *StaticResolver) SetAddress(args *SetAddressArgs, reply *SetAddressReply) {
+	r.Set(args.Id, args.Addr)
+}
@@ -0,0 +1,747 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+
+	"raft/labgob"
+	"raft/protowire"
+)
+
+//
+// a Transport over TCP. every endpoint keeps one connection to its node,
+// dialed on the first call and again after it breaks, and calls in flight
+// on it are matched to replies by sequence number, so a slow call doesn't
+// hold up the others. requests and responses are protobuf frames, see
+// transport.proto, and arguments and replies are Messages or else labgob
+// encoded as with labrpc, so the same handlers serve both.
+//
+// a transport keeps one connection to each address, whatever the number of
+// raft groups it reaches there: a node hosting many groups registers each
+// group's services with RegisterGroup, peers reach them with DialGroup,
+// and every request names its group.
+//
+// calls marked Urgent go on a second connection, see Prioritized.
+//
+// interceptors wrap the calls made and served, see UseClient and
+// UseServer. a connection opens with a handshake of protocol versions, see
+// version.go.
+//
+// a Stream gets a connection of its own: the request is followed by the
+// payload in chunks and an empty frame, then the handler's response, and
+// the connection is closed. the handler reads the chunks off the
+// connection as it goes, so neither side holds the whole payload.
+//
+
+type request struct {
+	Seq     uint64
+	SvcMeth string // e.g. "Raft.AppendEntries"
+	Args    []byte
+	Stream  bool // the payload follows
+	Group   int  // the raft group whose service is called
+	Gzip    bool // Args are compressed
+	// the sender takes compressed replies
+	AcceptGzip bool
+	Metadata   map[string]string // see WithMetadata
+}
+
+type response struct {
+	Seq   uint64
+	OK    bool // false if there's no such service or method
+	Reply []byte
+	Gzip  bool // Reply is compressed
+}
+
+// the largest frame accepted, a guard against a corrupt length
+const maxFrame = 1 << 30
+
+// the size of the chunks a stream's payload is sent in
+const streamChunk = 64 << 10
+
+func (req *request) marshal() []byte {
+	var b protowire.Buffer
+	b.Uint64(1, req.Seq)
+	b.String(2, req.SvcMeth)
+	b.Bytes(3, req.Args)
+	b.Bool(4, req.Stream)
+	b.Int(5, req.Group)
+	b.Bool(6, req.Gzip)
+	b.Bool(7, req.AcceptGzip)
+	for k, v := range req.Metadata {
+		var entry protowire.Buffer
+		entry.String(1, k)
+		entry.String(2, v)
+		b.Element(8, entry.Data())
+	}
+	return b.Data()
+}
+
+func (req *request) unmarshal(data []byte) error {
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			req.Seq = r.Uint64()
+		case 2:
+			req.SvcMeth = r.String()
+		case 3:
+			req.Args = r.Bytes()
+		case 4:
+			req.Stream = r.Bool()
+		case 5:
+			req.Group = r.Int()
+		case 6:
+			req.Gzip = r.Bool()
+		case 7:
+			req.AcceptGzip = r.Bool()
+		case 8:
+			var k, v string
+			entry := protowire.NewReader(r.Bytes())
+			for entry.Next() {
+				switch entry.Field() {
+				case 1:
+					k = entry.String()
+				case 2:
+					v = entry.String()
+				}
+			}
+			if entry.Err() != nil {
+				return entry.Err()
+			}
+			if req.Metadata == nil {
+				req.Metadata = make(map[string]string)
+			}
+			req.Metadata[k] = v
+		}
+	}
+	return r.Err()
+}
+
+func (resp *response) marshal() []byte {
+	var b protowire.Buffer
+	b.Uint64(1, resp.Seq)
+	b.Bool(2, resp.OK)
+	b.Bytes(3, resp.Reply)
+	b.Bool(4, resp.Gzip)
+	return b.Data()
+}
+
+func (resp *response) unmarshal(data []byte) error {
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			resp.Seq = r.Uint64()
+		case 2:
+			resp.OK = r.Bool()
+		case 3:
+			resp.Reply = r.Bytes()
+		case 4:
+			resp.Gzip = r.Bool()
+		}
+	}
+	return r.Err()
+}
+
+func writeFrame(w *bufio.Writer, frame []byte) error {
+	if err := appendFrame(w, frame); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// buffer frame in w without flushing it
+func appendFrame(w *bufio.Writer, frame []byte) error {
+	var size [binary.MaxVarintLen64]byte
+	if _, err := w.Write(size[:binary.PutUvarint(size[:], uint64(len(frame)))]); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxFrame {
+		return nil, protowire.ErrMalformed
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func encode(v interface{}) ([]byte, error) {
+	if m, ok := v.(Message); ok {
+		return m.Marshal()
+	}
+	b := new(bytes.Buffer)
+	err := labgob.NewEncoder(b).Encode(v)
+	return b.Bytes(), err
+}
+
+func decode(data []byte, v interface{}) error {
+	if m, ok := v.(Message); ok {
+		return m.Unmarshal(data)
+	}
+	return labgob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+var ErrClosed = errors.New("transport: closed")
+
+type TCPTransport struct {
+	listener    net.Listener
+	tls         *tlsState // nil for plain TCP
+	mu          sync.Mutex
+	services    map[serviceKey]*service
+	peers       map[peerKey]*tcpEndpoint // shared by all groups
+	resolver    Resolver
+	conns       map[net.Conn]bool
+	closed      bool
+	batching    int64 // time.Duration, see SetBatching
+	compression int64 // threshold, see SetCompression
+	writes      int64 // network writes of frames, for statistics
+	sent        int64 // bytes of frames written, for statistics
+	// see UseClient and UseServer
+	clientInterceptors []ClientInterceptor
+	serverInterceptors []ServerInterceptor
+	hello              hello // this node's, see version.go
+}
+
+// a transport serving calls on addr, e.g. ":7000", or "127.0.0.1:0" for
+// any free port
+func ListenTCP(addr string) (*TCPTransport, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newTCPTransport(listener, nil), nil
+}
+
+func newTCPTransport(listener net.Listener, tls *tlsState) *TCPTransport {
+	t := &TCPTransport{listener: listener, tls: tls, services: make(map[serviceKey]*service),
+		peers: make(map[peerKey]*tcpEndpoint), conns: make(map[net.Conn]bool), hello: defaultHello()}
+	go t.accept()
+	return t
+}
+
+// the address the transport listens on, with the port it got
+func (t *TCPTransport) Addr() string {
+	return t.listener.Addr().String()
+}
+
+type serviceKey struct {
+	group int
+	name  string
+}
+
+// register rcvr for group 0
+func (t *TCPTransport) Register(rcvr interface{}) {
+	t.RegisterGroup(0, rcvr)
+}
+
+func (t *TCPTransport) RegisterGroup(group int, rcvr interface{}) {
+	svc := makeService(rcvr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.services[serviceKey{group, svc.name}] = svc
+}
+
+// an endpoint for group 0 at addr
+func (t *TCPTransport) Dial(addr string) Endpoint {
+	return t.DialGroup(addr, 0)
+}
+
+// an endpoint for the services of group at addr, sharing the connection
+// with the transport's other endpoints for addr
+func (t *TCPTransport) DialGroup(addr string, group int) Endpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peer, lane := t.lanes(peerKey{addr: addr})
+	return &groupEndpoint{peer: peer, urgent: lane, group: group}
+}
+
+// stop serving: the listener and every accepted connection are closed
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	t.closed = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+	return t.listener.Close()
+}
+
+func (t *TCPTransport) accept() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			conn.Close()
+			return
+		}
+		t.conns[conn] = true
+		t.mu.Unlock()
+		go t.serve(conn)
+	}
+}
+
+func (t *TCPTransport) serve(conn net.Conn) {
+	defer func() {
+		t.mu.Lock()
+		delete(t.conns, conn)
+		t.mu.Unlock()
+		conn.Close()
+	}()
+	fw := t.newFrameWriter(conn)
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		var req request
+		if req.unmarshal(frame) != nil {
+			return
+		}
+		// at version 0, as a node from before the handshake, there's no
+		// Transport service to answer it
+		if req.SvcMeth == helloMethod && t.hello.Version > 0 {
+			resp, ok := t.answerHello(&req)
+			fw.write(resp.marshal())
+			if !ok {
+				fw.flush()
+				return
+			}
+			continue
+		}
+		if req.Stream {
+			payload := &streamReader{r: r}
+			resp := t.dispatch(&req, payload)
+			if io.Copy(ioutil.Discard, payload); payload.err == io.EOF {
+				writeFrame(bufio.NewWriter(conn), resp.marshal())
+			}
+			return
+		}
+		go func() {
+			resp := t.dispatch(&req, nil)
+			fw.write(resp.marshal())
+		}()
+	}
+}
+
+func (t *TCPTransport) dispatch(req *request, payload io.Reader) *response {
+	resp := &response{Seq: req.Seq}
+	dot := strings.LastIndex(req.SvcMeth, ".")
+	if dot == -1 {
+		return resp
+	}
+	t.mu.Lock()
+	svc, ok := t.services[serviceKey{req.Group, req.SvcMeth[:dot]}]
+	t.mu.Unlock()
+	if !ok {
+		return resp
+	}
+	args := req.Args
+	if req.Gzip {
+		var err error
+		if args, err = decompress(args); err != nil {
+			log.Printf("transport: decompress args of %v: %v", req.SvcMeth, err)
+			return resp
+		}
+	}
+	_, interceptors := t.interceptors()
+	resp.Reply, resp.OK = svc.dispatch(MetadataContext(req.Metadata), interceptors, req.SvcMeth[dot+1:], args, payload)
+	if resp.OK && req.AcceptGzip {
+		resp.Reply, resp.Gzip = t.compress(resp.Reply)
+	}
+	return resp
+}
+
+// an object whose methods answer calls, as labrpc.Service
+type service struct {
+	name    string
+	rcvr    reflect.Value
+	methods map[string]reflect.Method
+}
+
+func makeService(rcvr interface{}) *service {
+	svc := &service{rcvr: reflect.ValueOf(rcvr), methods: make(map[string]reflect.Method)}
+	svc.name = reflect.Indirect(svc.rcvr).Type().Name()
+	typ := reflect.TypeOf(rcvr)
+	for m := 0; m < typ.NumMethod(); m++ {
+		method := typ.Method(m)
+		mtype := method.Type
+		stream := mtype.NumIn() == 4 && mtype.In(2) == readerType
+		if method.PkgPath == "" && (mtype.NumIn() == 3 || stream) &&
+			mtype.In(mtype.NumIn()-1).Kind() == reflect.Ptr && mtype.NumOut() == 0 {
+			svc.methods[method.Name] = method
+		}
+	}
+	return svc
+}
+
+var readerType = reflect.TypeOf((*io.Reader)(nil)).Elem()
+
+// call a method through the interceptors, a stream handler with payload or
+// an empty one
+func (svc *service) dispatch(ctx context.Context, interceptors []ServerInterceptor, methname string, data []byte, payload io.Reader) ([]byte, bool) {
+	method, ok := svc.methods[methname]
+	if !ok {
+		log.Printf("transport: unknown method %v of %v", methname, svc.name)
+		return nil, false
+	}
+	args := reflect.New(method.Type.In(1))
+	target := args.Interface()
+	if at := method.Type.In(1); at.Kind() == reflect.Ptr {
+		// a Message is decoded through the pointer the handler takes
+		args.Elem().Set(reflect.New(at.Elem()))
+		target = args.Elem().Interface()
+	}
+	if err := decode(data, target); err != nil {
+		log.Printf("transport: decode args of %v.%v: %v", svc.name, methname, err)
+		return nil, false
+	}
+	reply := reflect.New(method.Type.In(method.Type.NumIn() - 1).Elem())
+	handler := func(context.Context, string, interface{}, interface{}) bool {
+		if method.Type.NumIn() == 4 {
+			if payload == nil {
+				payload = bytes.NewReader(nil)
+			}
+			method.Func.Call([]reflect.Value{svc.rcvr, args.Elem(), reflect.ValueOf(payload), reply})
+		} else {
+			method.Func.Call([]reflect.Value{svc.rcvr, args.Elem(), reply})
+		}
+		return true
+	}
+	svcMeth := svc.name + "." + methname
+	if !ChainServer(interceptors, handler)(ctx, svcMeth, args.Elem().Interface(), reply.Interface()) {
+		return nil, false
+	}
+	rb, err := encode(reply.Interface())
+	if err != nil {
+		log.Printf("transport: encode reply of %v.%v: %v", svc.name, methname, err)
+		return nil, false
+	}
+	return rb, true
+}
+
+// a node dialed by address or, with DialNode, by id
+type peerKey struct {
+	addr   string
+	id     string
+	urgent bool // the priority lane
+}
+
+type tcpEndpoint struct {
+	addr    string // as dialed, or as last resolved from id
+	id      string
+	t       *TCPTransport
+	mu      sync.Mutex
+	conn    net.Conn
+	fw      *frameWriter
+	nextSeq uint64
+	pending map[uint64]chan *response
+	breaker breaker
+	hello   *hello // the node's, as of the last handshake
+}
+
+type groupEndpoint struct {
+	peer   *tcpEndpoint
+	urgent *tcpEndpoint // the priority lane to the same node
+	group  int
+}
+
+func (g *groupEndpoint) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return g.CallContext(context.Background(), svcMeth, args, reply)
+}
+
+func (g *groupEndpoint) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) bool {
+	interceptors, _ := g.peer.t.interceptors()
+	return ChainClient(interceptors, func(ctx context.Context, svcMeth string, args interface{}, reply interface{}) bool {
+		return g.lane(args).call(ctx, g.group, svcMeth, args, reply)
+	})(ctx, svcMeth, args, reply)
+}
+
+func (g *groupEndpoint) Stream(svcMeth string, args interface{}, payload io.Reader, reply interface{}) bool {
+	interceptors, _ := g.peer.t.interceptors()
+	return ChainClient(interceptors, func(ctx context.Context, svcMeth string, args interface{}, reply interface{}) bool {
+		return g.peer.stream(ctx, g.group, svcMeth, args, payload, reply)
+	})(context.Background(), svcMeth, args, reply)
+}
+
+func (e *tcpEndpoint) call(ctx context.Context, group int, svcMeth string, args interface{}, reply interface{}) bool {
+	ab, err := encode(args)
+	if err != nil {
+		panic(err)
+	}
+	ch := make(chan *response, 1)
+	req := request{SvcMeth: svcMeth, Group: group, AcceptGzip: e.t.compressing(), Metadata: Metadata(ctx)}
+	req.Args = ab
+	if e.negotiate(ctx, FeatureGzip) {
+		req.Args, req.Gzip = e.t.compress(ab)
+	}
+	e.mu.Lock()
+	for attempt := 0; ; attempt++ {
+		if e.conn == nil && !e.dial(ctx) {
+			e.mu.Unlock()
+			return false
+		}
+		e.nextSeq++
+		req.Seq = e.nextSeq
+		// the reply can't be looked up before e.mu is released
+		if e.fw.write(req.marshal()) == nil {
+			e.pending[req.Seq] = ch
+			break
+		}
+		e.broken(e.conn)
+		if attempt == 1 {
+			e.mu.Unlock()
+			return false
+		}
+	}
+	e.mu.Unlock()
+
+	var resp *response
+	select {
+	case resp = <-ch:
+	case <-ctx.Done():
+		e.mu.Lock()
+		delete(e.pending, req.Seq)
+		e.mu.Unlock()
+		return false
+	}
+	if resp == nil || !resp.OK {
+		return false
+	}
+	return resp.decode(svcMeth, reply)
+}
+
+func (resp *response) decode(svcMeth string, reply interface{}) bool {
+	data := resp.Reply
+	if resp.Gzip {
+		var err error
+		if data, err = decompress(data); err != nil {
+			log.Printf("transport: decompress reply of %v: %v", svcMeth, err)
+			return false
+		}
+	}
+	if err := decode(data, reply); err != nil {
+		log.Fatalf("transport: decode reply of %v: %v", svcMeth, err)
+	}
+	return true
+}
+
+// connect to addr, or to where the resolver says the node with id is
+func (e *tcpEndpoint) connect(ctx context.Context, addr string) (net.Conn, string, error) {
+	if e.id != "" {
+		var err error
+		if addr, err = e.t.resolve(e.id); err != nil {
+			return nil, "", err
+		}
+	}
+	var conn net.Conn
+	var err error
+	if e.t.tls != nil {
+		dialer := &tls.Dialer{Config: e.t.tls.clientConfig(addr)}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	return conn, addr, err
+}
+
+// connect unless the circuit is open, caller must hold e.mu
+func (e *tcpEndpoint) dial(ctx context.Context) bool {
+	if !e.breaker.allow() {
+		return false
+	}
+	conn, addr, err := e.connect(ctx, e.addr)
+	if addr != "" {
+		e.addr = addr
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			e.breaker.failed()
+		}
+		return false
+	}
+	r := bufio.NewReader(conn)
+	peer, err := e.t.handshake(ctx, conn, r)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() == nil {
+			e.breaker.failed()
+		}
+		return false
+	}
+	e.breaker.succeeded()
+	e.conn, e.fw, e.hello = conn, e.t.newFrameWriter(conn), peer
+	go e.receive(conn, r)
+	return true
+}
+
+func (e *tcpEndpoint) receive(conn net.Conn, r *bufio.Reader) {
+	for {
+		var resp response
+		frame, err := readFrame(r)
+		if err == nil {
+			err = resp.unmarshal(frame)
+		}
+		if err != nil {
+			e.mu.Lock()
+			e.broken(conn)
+			e.mu.Unlock()
+			return
+		}
+		e.mu.Lock()
+		ch, ok := e.pending[resp.Seq]
+		delete(e.pending, resp.Seq)
+		e.mu.Unlock()
+		if ok {
+			ch <- &resp
+		}
+	}
+}
+
+// fail the calls waiting on conn and drop it, so the next call dials
+// again. caller must hold e.mu.
+func (e *tcpEndpoint) broken(conn net.Conn) {
+	if e.conn != conn {
+		return
+	}
+	conn.Close()
+	for seq, ch := range e.pending {
+		ch <- nil
+		delete(e.pending, seq)
+	}
+	e.conn = nil
+}
+
+// a stream to group, on a connection of its own, with the metadata in ctx
+func (e *tcpEndpoint) stream(ctx context.Context, group int, svcMeth string, args interface{}, payload io.Reader, reply interface{}) bool {
+	ab, err := encode(args)
+	if err != nil {
+		panic(err)
+	}
+	e.mu.Lock()
+	allow, addr := e.breaker.allow(), e.addr
+	e.mu.Unlock()
+	if !allow {
+		return false
+	}
+	conn, _, err := e.connect(context.Background(), addr)
+	if err != nil {
+		e.mu.Lock()
+		e.breaker.failed()
+		e.mu.Unlock()
+		return false
+	}
+	defer conn.Close()
+	w := bufio.NewWriter(conn)
+	req := request{SvcMeth: svcMeth, Stream: true, Group: group, AcceptGzip: e.t.compressing(), Metadata: Metadata(ctx)}
+	gzip := e.supports(FeatureGzip)
+	req.Args = ab
+	if gzip {
+		req.Args, req.Gzip = e.t.compress(ab)
+	}
+	if writeFrame(w, req.marshal()) != nil {
+		return false
+	}
+	buf := make([]byte, streamChunk)
+	for {
+		n, err := payload.Read(buf)
+		if n > 0 {
+			var chunk protowire.Buffer
+			data, gz := buf[:n], false
+			if gzip {
+				data, gz = e.t.compress(data)
+			}
+			chunk.Bytes(1, data)
+			chunk.Bool(2, gz)
+			if writeFrame(w, chunk.Data()) != nil {
+				return false
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return false
+		}
+	}
+	if writeFrame(w, nil) != nil {
+		return false
+	}
+	frame, err := readFrame(bufio.NewReader(conn))
+	var resp response
+	if err != nil || resp.unmarshal(frame) != nil || !resp.OK {
+		return false
+	}
+	return resp.decode(svcMeth, reply)
+}
+
+// a stream's payload as the handler reads it, chunk by chunk off the
+// connection until the empty frame
+type streamReader struct {
+	r     *bufio.Reader
+	chunk []byte
+	err   error // io.EOF once the empty frame is read
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	for len(sr.chunk) == 0 {
+		if sr.err != nil {
+			return 0, sr.err
+		}
+		frame, err := readFrame(sr.r)
+		if err != nil {
+			sr.err = io.ErrUnexpectedEOF
+		} else if len(frame) == 0 {
+			sr.err = io.EOF
+		} else {
+			gz := false
+			r := protowire.NewReader(frame)
+			for r.Next() {
+				switch r.Field() {
+				case 1:
+					sr.chunk = r.Bytes()
+				case 2:
+					gz = r.Bool()
+				}
+			}
+			if r.Err() != nil {
+				sr.err = r.Err()
+			} else if gz {
+				if sr.chunk, err = decompress(sr.chunk); err != nil {
+					sr.err = err
+				}
+			}
+		}
+	}
+	n := copy(p, sr.chunk)
+	sr.chunk = sr.chunk[n:]
+	return n, nil
+}
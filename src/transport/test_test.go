@@ -0,0 +1,807 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"raft/protowire"
+)
+
+type EchoArgs struct {
+	Text string
+}
+
+type EchoReply struct {
+	Text string
+}
+
+type Echo struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (e *Echo) Echo(args *EchoArgs, reply *EchoReply) {
+	e.mu.Lock()
+	e.calls++
+	e.mu.Unlock()
+	reply.Text = args.Text
+}
+
+// the payload's size and the largest single read of it
+func (e *Echo) Count(args *EchoArgs, payload io.Reader, reply *CountReply) {
+	buf := make([]byte, 1<<20)
+	for {
+		n, err := payload.Read(buf)
+		reply.Bytes += n
+		if n > reply.MaxRead {
+			reply.MaxRead = n
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+type CountReply struct {
+	Bytes   int
+	MaxRead int
+}
+
+func TestTCP(t *testing.T) {
+	server, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := &Echo{}
+	server.Register(echo)
+	client, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	end := client.Dial(server.Addr())
+
+	// calls in flight at once share the connection
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reply := EchoReply{}
+			if !end.Call("Echo.Echo", &EchoArgs{Text: strconv.Itoa(i)}, &reply) || reply.Text != strconv.Itoa(i) {
+				t.Errorf("call %v got %q", i, reply.Text)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if echo.calls != 50 {
+		t.Fatalf("%v calls served, expected 50", echo.calls)
+	}
+	if end.Call("Echo.Nosuch", &EchoArgs{}, &EchoReply{}) || end.Call("Nosuch.Echo", &EchoArgs{}, &EchoReply{}) {
+		t.Fatalf("call to an unknown method succeeded")
+	}
+
+	// a closed server fails calls, a new one on its address is dialed again
+	addr := server.Addr()
+	server.Close()
+	if end.Call("Echo.Echo", &EchoArgs{Text: "x"}, &EchoReply{}) {
+		t.Fatalf("call to a closed server succeeded")
+	}
+	server, err = ListenTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Register(echo)
+	time.Sleep(breakerBackoff) // in case the failed call found the circuit open
+	reply := EchoReply{}
+	if !end.Call("Echo.Echo", &EchoArgs{Text: "y"}, &reply) || reply.Text != "y" {
+		t.Fatalf("call after the server came back got %q", reply.Text)
+	}
+}
+
+func TestStream(t *testing.T) {
+	server, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Register(&Echo{})
+	client, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	end := client.Dial(server.Addr()).(StreamEndpoint)
+
+	// the handler gets the payload in chunks, not in one piece
+	const size = 8 << 20
+	reply := CountReply{}
+	if !end.Stream("Echo.Count", &EchoArgs{}, strings.NewReader(strings.Repeat("x", size)), &reply) {
+		t.Fatalf("stream failed")
+	}
+	if reply.Bytes != size || reply.MaxRead > streamChunk {
+		t.Fatalf("handler read %v bytes, %v at most at once", reply.Bytes, reply.MaxRead)
+	}
+	// calls on the endpoint are unaffected, an ordinary handler ignores a payload
+	echo := EchoReply{}
+	if !end.Call("Echo.Echo", &EchoArgs{Text: "x"}, &echo) || echo.Text != "x" {
+		t.Fatalf("call after a stream got %q", echo.Text)
+	}
+	if !end.Stream("Echo.Echo", &EchoArgs{Text: "y"}, strings.NewReader("payload"), &echo) || echo.Text != "y" {
+		t.Fatalf("stream to an ordinary handler got %q", echo.Text)
+	}
+	if end.Stream("Echo.Nosuch", &EchoArgs{}, strings.NewReader("payload"), &reply) {
+		t.Fatalf("stream to an unknown method succeeded")
+	}
+}
+
+type Group struct {
+	id int
+}
+
+func (g *Group) Echo(args *EchoArgs, reply *EchoReply) {
+	reply.Text = args.Text + strconv.Itoa(g.id)
+}
+
+func TestGroups(t *testing.T) {
+	server, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	const ngroups = 10
+	for g := 0; g < ngroups; g++ {
+		server.RegisterGroup(g, &Group{id: g})
+	}
+
+	// every group's calls reach its own service, over the one connection
+	for g := 0; g < ngroups; g++ {
+		reply := EchoReply{}
+		if !client.DialGroup(server.Addr(), g).Call("Group.Echo", &EchoArgs{Text: "g"}, &reply) || reply.Text != "g"+strconv.Itoa(g) {
+			t.Fatalf("group %v got %q", g, reply.Text)
+		}
+	}
+	server.mu.Lock()
+	conns := len(server.conns)
+	server.mu.Unlock()
+	if conns != 1 {
+		t.Fatalf("%v connections for %v groups", conns, ngroups)
+	}
+	if client.DialGroup(server.Addr(), ngroups).Call("Group.Echo", &EchoArgs{}, &EchoReply{}) {
+		t.Fatalf("call to an unregistered group succeeded")
+	}
+}
+
+func TestBatching(t *testing.T) {
+	server, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Register(&Echo{})
+	client, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server.SetBatching(5 * time.Millisecond)
+	client.SetBatching(5 * time.Millisecond)
+	end := client.Dial(server.Addr())
+
+	// calls made together go out in a few writes, and their replies too
+	const ncalls = 100
+	var wg sync.WaitGroup
+	for i := 0; i < ncalls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reply := EchoReply{}
+			if !end.Call("Echo.Echo", &EchoArgs{Text: strconv.Itoa(i)}, &reply) || reply.Text != strconv.Itoa(i) {
+				t.Errorf("call %v got %q", i, reply.Text)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if writes := atomic.LoadInt64(&client.writes); writes > ncalls/4 {
+		t.Fatalf("%v calls sent in %v writes", ncalls, writes)
+	}
+	if writes := atomic.LoadInt64(&server.writes); writes > ncalls/4 {
+		t.Fatalf("%v replies sent in %v writes", ncalls, writes)
+	}
+}
+
+type PingArgs struct {
+	Text string
+}
+
+func (args *PingArgs) Urgent() bool {
+	return true
+}
+
+func (e *Echo) Ping(args *PingArgs, reply *EchoReply) {
+	reply.Text = args.Text
+}
+
+func TestPriorityLanes(t *testing.T) {
+	server, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Register(&Echo{})
+	client, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// a proxy to the server that never reads from the first connection, so
+	// a large call on it is stuck half written
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	accepted := make(chan bool, 1)
+	defer func() {
+		proxy.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			stalled := len(conns) == 1
+			mu.Unlock()
+			if stalled {
+				accepted <- true
+				continue
+			}
+			upstream, err := net.Dial("tcp", server.Addr())
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go io.Copy(upstream, conn)
+			go io.Copy(conn, upstream)
+		}
+	}()
+	end := client.Dial(proxy.Addr().String())
+
+	go end.Call("Echo.Echo", &EchoArgs{Text: strings.Repeat("x", 32<<20)}, &EchoReply{})
+	<-accepted
+	time.Sleep(100 * time.Millisecond)
+
+	// an urgent call isn't held up behind it
+	done := make(chan bool)
+	go func() {
+		reply := EchoReply{}
+		done <- end.Call("Echo.Ping", &PingArgs{Text: "ping"}, &reply) && reply.Text == "ping"
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatalf("urgent call failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("urgent call held up by a large one")
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	server, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Register(&Echo{})
+	client, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	end := client.Dial(server.Addr()).(StreamEndpoint)
+
+	// the server wants a token, and sees the arguments
+	var served []string
+	var mu sync.Mutex
+	server.UseServer(func(ctx context.Context, svcMeth string, args, reply interface{}, next Handler) bool {
+		if Metadata(ctx)["token"] != "secret" {
+			return false
+		}
+		mu.Lock()
+		if echo, ok := args.(*EchoArgs); ok {
+			served = append(served, svcMeth+" "+echo.Text)
+		}
+		mu.Unlock()
+		return next(ctx, svcMeth, args, reply)
+	})
+	if end.Call("Echo.Echo", &EchoArgs{Text: "x"}, &EchoReply{}) {
+		t.Fatalf("call without a token succeeded")
+	}
+
+	// the client's interceptors run in the order added, around the call
+	var order []string
+	client.UseClient(func(ctx context.Context, svcMeth string, args, reply interface{}, next Invoker) bool {
+		order = append(order, "token")
+		return next(WithMetadata(ctx, "token", "secret"), svcMeth, args, reply)
+	}, func(ctx context.Context, svcMeth string, args, reply interface{}, next Invoker) bool {
+		order = append(order, "log "+svcMeth)
+		ok := next(ctx, svcMeth, args, reply)
+		if echo, isEcho := reply.(*EchoReply); isEcho && ok {
+			order = append(order, "reply "+echo.Text)
+		}
+		return ok
+	})
+	reply := EchoReply{}
+	if !end.Call("Echo.Echo", &EchoArgs{Text: "y"}, &reply) || reply.Text != "y" {
+		t.Fatalf("call with a token got %q", reply.Text)
+	}
+	if strings.Join(order, ",") != "token,log Echo.Echo,reply y" {
+		t.Fatalf("interceptors ran as %v", order)
+	}
+	if len(served) != 1 || served[0] != "Echo.Echo y" {
+		t.Fatalf("server interceptor saw %v", served)
+	}
+
+	// streams carry the metadata too
+	count := CountReply{}
+	if !end.Stream("Echo.Count", &EchoArgs{}, strings.NewReader("payload"), &count) || count.Bytes != 7 {
+		t.Fatalf("stream with a token read %v bytes", count.Bytes)
+	}
+
+	// an interceptor can fail calls without sending them
+	client.UseClient(func(ctx context.Context, svcMeth string, args, reply interface{}, next Invoker) bool {
+		return false
+	})
+	before := len(served)
+	if end.Call("Echo.Echo", &EchoArgs{Text: "z"}, &EchoReply{}) || len(served) != before {
+		t.Fatalf("call failed by an interceptor was served")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	server, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Register(&Echo{})
+	server.SetCompression(1024)
+	client, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetCompression(1024)
+
+	end := client.Dial(server.Addr()).(StatusEndpoint)
+	reply := EchoReply{}
+	if !end.Call("Echo.Echo", &EchoArgs{Text: "x"}, &reply) || reply.Text != "x" {
+		t.Fatalf("call failed")
+	}
+	if status := end.Status(); status.Version != ProtocolVersion || len(status.Features) != 1 || status.Features[0] != FeatureGzip {
+		t.Fatalf("handshake got version %v, features %v", status.Version, status.Features)
+	}
+
+	// a node of a release before the handshake is called all the same,
+	// without compression
+	old, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	old.Register(&Echo{})
+	old.hello = hello{} // knows no Transport.Hello
+	end = client.Dial(old.Addr()).(StatusEndpoint)
+	text := strings.Repeat("x", 100<<10)
+	sent := atomic.LoadInt64(&client.sent)
+	reply = EchoReply{}
+	if !end.Call("Echo.Echo", &EchoArgs{Text: text}, &reply) || reply.Text != text {
+		t.Fatalf("call to an old node failed")
+	}
+	if sent = atomic.LoadInt64(&client.sent) - sent; sent < int64(len(text)) {
+		t.Fatalf("%v bytes sent to an old node, compressed", sent)
+	}
+	if status := end.Status(); status.Version != 0 || len(status.Features) != 0 {
+		t.Fatalf("old node has version %v, features %v", status.Version, status.Features)
+	}
+
+	// a node too new to talk to
+	future, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer future.Close()
+	future.Register(&Echo{})
+	future.hello = hello{Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1}
+	end = client.Dial(future.Addr()).(StatusEndpoint)
+	if end.Call("Echo.Echo", &EchoArgs{Text: "x"}, &EchoReply{}) {
+		t.Fatalf("call to an incompatible node succeeded")
+	}
+	if status := end.Status(); status.Connected || !status.Open {
+		t.Fatalf("incompatible node connected %v, open %v", status.Connected, status.Open)
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	req := request{Seq: 7, SvcMeth: "Echo.Echo", Args: []byte("args"), Group: 3}
+	var b protowire.Buffer
+	b.Int(50, 1)
+	b.String(51, "from a newer release")
+	data := append(req.marshal(), b.Data()...)
+	var got request
+	if err := got.unmarshal(data); err != nil || got.Seq != 7 || got.SvcMeth != "Echo.Echo" || string(got.Args) != "args" || got.Group != 3 {
+		t.Fatalf("request with unknown fields decoded as %+v, %v", got, err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	server, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Register(&Echo{})
+	server.SetCompression(1024)
+	client, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	plain, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	client.SetCompression(1024)
+
+	// a big echo goes both ways compressed
+	text := strings.Repeat("x", 100<<10)
+	reply := EchoReply{}
+	if !client.Dial(server.Addr()).Call("Echo.Echo", &EchoArgs{Text: text}, &reply) || reply.Text != text {
+		t.Fatalf("compressed echo failed")
+	}
+	if sent := atomic.LoadInt64(&client.sent); sent > 10<<10 {
+		t.Fatalf("client sent %v bytes", sent)
+	}
+	if sent := atomic.LoadInt64(&server.sent); sent > 10<<10 {
+		t.Fatalf("server sent %v bytes", sent)
+	}
+
+	// to a peer that didn't turn compression on, replies go as they are
+	if !plain.Dial(server.Addr()).Call("Echo.Echo", &EchoArgs{Text: text}, &reply) || reply.Text != text {
+		t.Fatalf("uncompressed echo failed")
+	}
+	if sent := atomic.LoadInt64(&server.sent); sent < 100<<10 {
+		t.Fatalf("server sent only %v bytes to a peer without compression", sent)
+	}
+
+	// as do stream chunks
+	count := CountReply{}
+	if !client.Dial(server.Addr()).(StreamEndpoint).Stream("Echo.Count", &EchoArgs{}, strings.NewReader(text), &count) || count.Bytes != len(text) {
+		t.Fatalf("compressed stream got %v bytes", count.Bytes)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	// an address nothing listens on, yet
+	server, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := server.Addr()
+	server.Close()
+	client, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	end := client.Dial(addr).(StatusEndpoint)
+
+	if end.Call("Echo.Echo", &EchoArgs{}, &EchoReply{}) {
+		t.Fatalf("call to a node that's down succeeded")
+	}
+	status := end.Status()
+	if status.Connected || !status.Open || status.Failures != 1 || status.RetryIn > breakerBackoff {
+		t.Fatalf("status after a failed dial %+v", status)
+	}
+	// while the circuit is open calls fail without dialing
+	end.Call("Echo.Echo", &EchoArgs{}, &EchoReply{})
+	if status := end.Status(); status.Failures != 1 {
+		t.Fatalf("dialed with the circuit open, %+v", status)
+	}
+	// then each failed dial backs off for longer
+	time.Sleep(breakerBackoff)
+	end.Call("Echo.Echo", &EchoArgs{}, &EchoReply{})
+	if status := end.Status(); status.Failures != 2 || status.RetryIn <= breakerBackoff {
+		t.Fatalf("status after a second failed dial %+v", status)
+	}
+
+	// the node coming back closes the circuit at the next dial
+	server, err = ListenTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Register(&Echo{})
+	time.Sleep(2 * breakerBackoff)
+	reply := EchoReply{}
+	if !end.Call("Echo.Echo", &EchoArgs{Text: "x"}, &reply) || reply.Text != "x" {
+		t.Fatalf("call after the node came back failed")
+	}
+	if status := end.Status(); !status.Connected || status.Open || status.Failures != 0 {
+		t.Fatalf("status after reconnecting %+v", status)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Register(&Group{id: 1})
+	resolver := MakeStaticResolver(nil)
+	path := filepath.Join(dir, "nodes")
+	if err := ioutil.WriteFile(path, []byte("# test nodes\nn1 "+server.Addr()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolver.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	client, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetResolver(resolver)
+	client.Register(resolver)
+	end := client.DialNode("n1", 0)
+	reply := EchoReply{}
+	if !end.Call("Group.Echo", &EchoArgs{}, &reply) || reply.Text != "1" {
+		t.Fatalf("call to n1 got %q", reply.Text)
+	}
+	if client.DialNode("n2", 0).Call("Group.Echo", &EchoArgs{}, &reply) {
+		t.Fatalf("call to an unknown node succeeded")
+	}
+
+	// n1 restarts on a new address, which an operator tells the resolver
+	server.Close()
+	moved, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer moved.Close()
+	moved.Register(&Group{id: 2})
+	admin, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if !admin.Dial(client.Addr()).Call("StaticResolver.SetAddress", &SetAddressArgs{Id: "n1", Addr: moved.Addr()}, &SetAddressReply{}) {
+		t.Fatalf("SetAddress failed")
+	}
+	ok := false
+	for i := 0; i < 10 && !ok; i++ {
+		ok = end.Call("Group.Echo", &EchoArgs{}, &reply) && reply.Text == "2"
+		time.Sleep(breakerBackoff)
+	}
+	if !ok {
+		t.Fatalf("n1 not reached at its new address")
+	}
+	if status := end.(StatusEndpoint).Status(); status.Id != "n1" || status.Addr != moved.Addr() {
+		t.Fatalf("status after the move %+v", status)
+	}
+}
+
+// a new CA in dir/ca.pem, and a certificate it signs for 127.0.0.1 in
+// dir/cert.pem and dir/key.pem
+func writeCerts(t *testing.T, dir string) TLSConfig {
+	write := func(name string, block *pem.Block) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "ca"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "node"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	write("ca.pem", &pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	write("cert.pem", &pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	write("key.pem", &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return TLSConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem"),
+		PeerCertFile: filepath.Join(dir, "cert.pem"), PeerKeyFile: filepath.Join(dir, "key.pem"),
+		CAFile: filepath.Join(dir, "ca.pem")}
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := writeCerts(t, dir)
+	config.RequireClientCert = true
+	server, err := ListenTLS("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Register(&Echo{})
+	peer, err := ListenTLS("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	reply := EchoReply{}
+	end := peer.Dial(server.Addr())
+	if !end.Call("Echo.Echo", &EchoArgs{Text: "x"}, &reply) || reply.Text != "x" {
+		t.Fatalf("call over TLS got %q", reply.Text)
+	}
+
+	// without a certificate of its own a client is turned away
+	anonymous := config
+	anonymous.PeerCertFile, anonymous.PeerKeyFile = "", ""
+	client, err := ListenTLS("127.0.0.1:0", anonymous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if client.Dial(server.Addr()).Call("Echo.Echo", &EchoArgs{}, &EchoReply{}) {
+		t.Fatalf("call without a client certificate succeeded")
+	}
+
+	// rotate to a new CA: the open connection carries on, nodes that
+	// reloaded connect anew, one still trusting the old CA can't
+	stale, err := ListenTLS("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stale.Close()
+	other, err := ListenTLS("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Register(&Echo{})
+	writeCerts(t, dir)
+	for _, tr := range []*TCPTransport{server, peer, other} {
+		if err := tr.ReloadTLS(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !end.Call("Echo.Echo", &EchoArgs{Text: "y"}, &reply) || reply.Text != "y" {
+		t.Fatalf("call on the open connection got %q", reply.Text)
+	}
+	if !peer.Dial(other.Addr()).Call("Echo.Echo", &EchoArgs{Text: "z"}, &reply) || reply.Text != "z" {
+		t.Fatalf("call with rotated certificates got %q", reply.Text)
+	}
+	if stale.Dial(server.Addr()).Call("Echo.Echo", &EchoArgs{}, &EchoReply{}) {
+		t.Fatalf("call trusting the old CA succeeded")
+	}
+}
+
+func TestGossip(t *testing.T) {
+	config := GossipConfig{Interval: 20 * time.Millisecond, SuspectAfter: 100 * time.Millisecond, DeadAfter: 200 * time.Millisecond}
+	start := func(id int, seeds []string) (*TCPTransport, *Gossip) {
+		node, err := ListenTCP("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.Register(&Group{id: id})
+		g := StartGossip(node, "n"+strconv.Itoa(id), node.Addr(), seeds, config)
+		node.SetResolver(g)
+		return node, g
+	}
+	// every node knows of the first one only
+	first, g0 := start(0, nil)
+	defer first.Close()
+	defer g0.Stop()
+	var mu sync.Mutex
+	var changes []Member
+	g0.Notify(func(m Member) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, m)
+	})
+	second, g1 := start(1, []string{first.Addr()})
+	defer second.Close()
+	defer g1.Stop()
+	third, g2 := start(2, []string{first.Addr()})
+	for _, g := range []*Gossip{g0, g1, g2} {
+		for i := 0; len(g.Members()) != 3; i++ {
+			if i == 100 {
+				t.Fatalf("%v knows %v", g.me, g.Members())
+			}
+			time.Sleep(config.Interval)
+		}
+	}
+	reply := EchoReply{}
+	if !second.DialNode("n2", 0).Call("Group.Echo", &EchoArgs{}, &reply) || reply.Text != "2" {
+		t.Fatalf("call to n2 through gossip got %q", reply.Text)
+	}
+
+	// the others find a node that stops dead, and alive again once it's
+	// back, wherever it is
+	g2.Stop()
+	third.Close()
+	time.Sleep(config.DeadAfter + 5*config.Interval)
+	if _, err := g0.Resolve("n2"); err != ErrUnknownNode {
+		t.Fatalf("resolved a dead node, %v", err)
+	}
+	third, g2 = start(2, []string{second.Addr()})
+	defer third.Close()
+	defer g2.Stop()
+	ok := false
+	for i := 0; i < 100 && !ok; i++ {
+		time.Sleep(config.Interval)
+		addr, err := g0.Resolve("n2")
+		ok = err == nil && addr == third.Addr()
+	}
+	if !ok {
+		t.Fatalf("n2 not found at its new address")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var states []MemberState
+	for _, m := range changes {
+		if m.Id == "n2" {
+			states = append(states, m.State)
+		}
+	}
+	if want := []MemberState{MemberAlive, MemberSuspect, MemberDead, MemberAlive}; fmt.Sprint(states) != fmt.Sprint(want) {
+		t.Fatalf("n2 went %v, expected %v", states, want)
+	}
+}
@@ -0,0 +1,125 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+//
+// TCPTransport over mutual TLS. a node presents its server certificate to
+// those that connect to it and its peer certificate to those it dials, and
+// checks theirs against the CA bundle, so only holders of certificates from
+// the cluster's CA can join in. clients dial with a transport that has no
+// peer certificate unless RequireClientCert is set on the servers.
+//
+// ReloadTLS reads the files again, to rotate certificates or the CA
+// without a restart. connections already open keep their handshake, new
+// ones use the new files.
+//
+
+type TLSConfig struct {
+	CertFile string // server certificate and key, PEM
+	KeyFile  string
+	// certificate and key presented when dialing, none if empty
+	PeerCertFile string
+	PeerKeyFile  string
+	CAFile       string // the CAs that sign certificates of other nodes
+	// refuse connections that present no certificate. a certificate that's
+	// presented is always verified.
+	RequireClientCert bool
+}
+
+var ErrNoCA = errors.New("transport: no CA certificates found")
+
+type tlsState struct {
+	config TLSConfig
+	mu     sync.Mutex
+	server *tls.Certificate
+	peer   *tls.Certificate
+	roots  *x509.CertPool
+}
+
+// a transport serving calls on addr over TLS, see ListenTCP
+func ListenTLS(addr string, config TLSConfig) (*TCPTransport, error) {
+	state := &tlsState{config: config}
+	if err := state.load(); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listener = tls.NewListener(listener, &tls.Config{GetConfigForClient: state.serverConfig})
+	return newTCPTransport(listener, state), nil
+}
+
+// read the certificates and CAs again, keeping the old ones if any can't
+// be read
+func (t *TCPTransport) ReloadTLS() error {
+	if t.tls == nil {
+		return nil
+	}
+	return t.tls.load()
+}
+
+func (s *tlsState) load() error {
+	server, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	var peer *tls.Certificate
+	if s.config.PeerCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.config.PeerCertFile, s.config.PeerKeyFile)
+		if err != nil {
+			return err
+		}
+		peer = &cert
+	}
+	pem, err := ioutil.ReadFile(s.config.CAFile)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return ErrNoCA
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.server, s.peer, s.roots = &server, peer, roots
+	return nil
+}
+
+func (s *tlsState) serverConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*s.server},
+		ClientCAs:    s.roots,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if s.config.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// the config to dial addr with, its host must be named in the server's
+// certificate
+func (s *tlsState) clientConfig(addr string) *tls.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	config := &tls.Config{ServerName: host, RootCAs: s.roots, MinVersion: tls.VersionTLS12}
+	if s.peer != nil {
+		config.Certificates = []tls.Certificate{*s.peer}
+	}
+	return config
+}
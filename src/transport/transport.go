@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"context"
+	"io"
+)
+
+//
+// what raft and kvraft need from the network. labrpc's simulated network
+// is one implementation, used by the tests; TCPTransport runs a cluster
+// across machines.
+//
+// end.Call("Raft.AppendEntries", &args, &reply) -- send an RPC, wait for reply.
+// as with labrpc, Call returns true only if the server executed the request
+// and the reply is valid, and false if the request or reply was lost or the
+// server is down. a Call may be in progress on an Endpoint alongside others.
+//
+// t.Register(rcvr) -- rcvr's exported methods shaped like labrpc handlers,
+//   func (r *T) Method(args *A, reply *R), answer calls to "T.Method".
+// t.Dial(addr) -- an Endpoint for the node at addr.
+//
+
+// a connection to one peer or server
+type Endpoint interface {
+	Call(svcMeth string, args interface{}, reply interface{}) bool
+}
+
+// an Endpoint whose calls can be cut short: CallContext returns false once
+// ctx is done, whether or not the request reached the server
+type ContextEndpoint interface {
+	Endpoint
+	CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) bool
+}
+
+// an Endpoint that can also send a payload too large for one message, such
+// as a snapshot, from an io.Reader. the handler is declared
+// func (r *T) Method(args *A, payload io.Reader, reply *R) and reads the
+// payload as it arrives.
+type StreamEndpoint interface {
+	Endpoint
+	Stream(svcMeth string, args interface{}, payload io.Reader, reply interface{}) bool
+}
+
+// serves this node's services and reaches other nodes by address
+type Transport interface {
+	Register(rcvr interface{})
+	Dial(addr string) Endpoint
+	Close() error
+}
+
+// arguments and replies that marshal themselves, in the protobuf format of
+// a .proto file, are sent that way by TCPTransport; others are labgob
+// encoded
+type Message interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+// a Transport hosting many raft groups on a node, each with its own
+// services, that reaches all of a node's groups over one connection.
+// Register and Dial are for group 0.
+type GroupTransport interface {
+	Transport
+	RegisterGroup(group int, rcvr interface{})
+	DialGroup(addr string, group int) Endpoint
+}
@@ -0,0 +1,155 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"raft/protowire"
+)
+
+//
+// a TCP endpoint opens every connection with a handshake: a request to
+// Transport.Hello carrying its protocol version, the oldest version it can
+// still speak and the features it has, answered by the node's own. a node
+// a release or two behind can then be dialed and serve calls while the
+// cluster is upgraded node by node, each side sending the other only what
+// it understands. a peer from before the handshake knows no Transport
+// service and fails the request: it's taken to be at version 0, with no
+// features. nodes whose versions don't overlap refuse each other's
+// connections.
+//
+// messages are decoded leniently to go with it: protobuf fields a node
+// doesn't know are skipped, and so are labgob's.
+//
+
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 0 // the oldest version this release still speaks
+)
+
+// features that may be missing from peers of other releases
+const (
+	FeatureGzip = "gzip" // takes compressed arguments and stream chunks
+)
+
+var ErrIncompatible = errors.New("transport: incompatible protocol versions")
+
+const helloMethod = "Transport.Hello"
+
+// how long a peer has to answer the handshake
+const helloTimeout = time.Second
+
+type hello struct {
+	Version    int
+	MinVersion int
+	Features   []string
+}
+
+func (h *hello) marshal() []byte {
+	var b protowire.Buffer
+	b.Int(1, h.Version)
+	b.Int(2, h.MinVersion)
+	for _, f := range h.Features {
+		b.Element(3, []byte(f))
+	}
+	return b.Data()
+}
+
+func (h *hello) unmarshal(data []byte) error {
+	r := protowire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			h.Version = r.Int()
+		case 2:
+			h.MinVersion = r.Int()
+		case 3:
+			h.Features = append(h.Features, r.String())
+		}
+	}
+	return r.Err()
+}
+
+func (h *hello) compatible(peer *hello) bool {
+	return peer.Version >= h.MinVersion && h.Version >= peer.MinVersion
+}
+
+func (h *hello) has(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// what this release speaks
+func defaultHello() hello {
+	return hello{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Features: []string{FeatureGzip}}
+}
+
+// exchange hellos on a new connection, the peer's unless they don't get
+// on. replies are read on from r.
+func (t *TCPTransport) handshake(ctx context.Context, conn net.Conn, r *bufio.Reader) (*hello, error) {
+	deadline := time.Now().Add(helloTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+	req := request{SvcMeth: helloMethod, Args: t.hello.marshal()}
+	if err := writeFrame(bufio.NewWriter(conn), req.marshal()); err != nil {
+		return nil, err
+	}
+	frame, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	var resp response
+	if err := resp.unmarshal(frame); err != nil {
+		return nil, err
+	}
+	peer := &hello{}
+	if resp.OK {
+		if err := peer.unmarshal(resp.Reply); err != nil {
+			return nil, err
+		}
+	}
+	if !t.hello.compatible(peer) {
+		log.Printf("transport: %v speaks protocol versions %v to %v, this node %v to %v",
+			conn.RemoteAddr(), peer.MinVersion, peer.Version, t.hello.MinVersion, t.hello.Version)
+		return nil, ErrIncompatible
+	}
+	return peer, nil
+}
+
+// answer a handshake, and whether to go on with the connection
+func (t *TCPTransport) answerHello(req *request) (*response, bool) {
+	var peer hello
+	if peer.unmarshal(req.Args) != nil {
+		return &response{Seq: req.Seq}, false
+	}
+	return &response{Seq: req.Seq, OK: true, Reply: t.hello.marshal()}, t.hello.compatible(&peer)
+}
+
+// whether the node has feature, as of the last handshake. false until the
+// first, it may be a node of an older release.
+func (e *tcpEndpoint) supports(feature string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.hello != nil && e.hello.has(feature)
+}
+
+// whether the node has feature, connecting first to find out if need be
+func (e *tcpEndpoint) negotiate(ctx context.Context, feature string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == nil {
+		e.dial(ctx)
+	}
+	return e.hello != nil && e.hello.has(feature)
+}